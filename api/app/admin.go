@@ -0,0 +1,245 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// Admin routes are only mounted when ADMIN_TOKEN is set, requests need it as
+// a bearer token
+func adminRouter(h *Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(adminAuthMiddleware)
+
+	r.Get("/leads", adminListLeadsHandler)
+	r.Get("/channel", adminChannelHandler)
+	r.Get("/leads/search", adminSearchLeadsHandler)
+	r.Post("/leads/import", adminImportLeadsHandler)
+	r.Get("/leads/{id}", adminGetLeadHandler)
+	r.Delete("/leads/{id}", adminDeleteLeadHandler)
+	r.Post("/leads/{id}/restore", adminRestoreLeadHandler)
+	r.Post("/leads/{id}/release", adminReleaseLeadHandler)
+	r.Post("/leads/{id}/status", adminLeadStatusHandler)
+	r.Post("/leads/{id}/tags", adminLeadTagsHandler)
+	r.Post("/leads/{id}/merge", adminMergeLeadHandler)
+	r.Post("/leads/{id}/notes", adminAddLeadNoteHandler)
+	r.Get("/leads/{id}/timeline", adminLeadTimelineHandler)
+	r.Post("/leads/{id}/consultation", h.adminBookConsultationHandler)
+	r.Get("/subjects/{email}/export", h.adminSubjectExportHandler)
+	r.Get("/push/devices", adminListPushDevicesHandler)
+	r.Post("/push/devices", adminRegisterPushDeviceHandler)
+	r.Delete("/push/devices", adminRemovePushDeviceHandler)
+	r.Get("/email/preview", h.adminEmailPreviewHandler)
+	r.Get("/stats", adminStatsHandler)
+	r.Get("/attribution", adminAttributionHandler)
+	r.Get("/storage/reconcile", adminGetReconcileHandler)
+	r.Post("/storage/reconcile", h.adminReconcileHandler)
+	r.Post("/retention", h.adminRetentionHandler)
+	r.Get("/self-test", adminGetSelfTestHandler)
+	r.Post("/self-test", h.adminSelfTestHandler)
+	r.Get("/api-keys", adminListApiKeysHandler)
+	r.Post("/api-keys", adminCreateApiKeyHandler)
+	r.Get("/api-keys/{id}", adminGetApiKeyHandler)
+	r.Patch("/api-keys/{id}", adminUpdateApiKeyHandler)
+	r.Delete("/api-keys/{id}", adminRevokeApiKeyHandler)
+	r.Post("/api-keys/{id}/rotate", adminRotateApiKeyHandler)
+	r.Get("/api-keys/{id}/usage", adminApiKeyUsageHandler)
+	r.Post("/config/reload", adminReloadConfigHandler)
+	r.Post("/exports", adminExportHandler)
+	r.Post("/crm/sync", h.adminStartCrmSyncHandler)
+	r.Get("/crm/sync/{id}", adminGetCrmSyncHandler)
+	r.Post("/crm/sync/{id}/resume", h.adminResumeCrmSyncHandler)
+
+	return r
+}
+
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	token, _ := ADMIN_TOKEN.Value()
+
+	return bearerAuthMiddleware(token, "admin")(next)
+}
+
+func bearerAuthMiddleware(token string, realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok {
+				bearer, ok = websocketBearer(r)
+			}
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+				writeProblem(w, r, http.StatusUnauthorized, "Unauthorized")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func leadStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errLeadNotFound) {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	slog.ErrorContext(r.Context(), "error", "lead store", err.Error())
+	writeProblem(w, r, http.StatusInternalServerError, err.Error())
+}
+
+// Paginated with the cursor returned as nextCursor, see pagination.go
+func adminListLeadsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := requestLeadFilter(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	sort, err := parseLeadSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	var after *lead
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		after, err = decodeLeadCursor(sort, value)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+			return
+		}
+	}
+
+	limit := LIST_DEFAULT_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > LIST_MAX_LIMIT {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid limit, it must be between 1 and "+strconv.Itoa(LIST_MAX_LIMIT))
+
+			return
+		}
+
+		limit = parsed
+	}
+
+	all, err := leads.list(r.Context(), filter)
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	page, next := paginateLeads(all, sort, after, limit)
+
+	res := map[string]any{"leads": page}
+	if next != "" {
+		res["nextCursor"] = next
+	}
+
+	writeResponse(w, r, http.StatusOK, res)
+}
+
+func adminGetLeadHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := leads.get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, l)
+}
+
+// Moves a quarantined lead back to new and queues the team notification it
+// skipped in the same update, the outbox retries it if it fails
+func adminReleaseLeadHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	released := false
+	l, err := leads.update(r.Context(), id, func(l *lead) error {
+		if l.Status != LEAD_STATUS_QUARANTINED {
+			return nil
+		}
+
+		l.Status = LEAD_STATUS_NEW
+		queueProcessor(l, notifyProcessor{}.name())
+		released = true
+
+		return nil
+	})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	if !released {
+		writeProblem(w, r, http.StatusConflict, "Lead is not quarantined")
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "released", "lead", id)
+
+	events.publish(r.Context(), EVENT_LEAD_STATUS_CHANGED, id, map[string]any{
+		"from": LEAD_STATUS_QUARANTINED,
+		"to":   LEAD_STATUS_NEW,
+	})
+
+	deliverOutbox(r.Context(), l)
+
+	writeResponse(w, r, http.StatusOK, l)
+}
+
+// Quarantined and unverified are only set when a lead is received
+func isAdminLeadStatus(status string) bool {
+	return isLeadStatus(status) && status != LEAD_STATUS_QUARANTINED && status != LEAD_STATUS_UNVERIFIED
+}
+
+func adminLeadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status string `json:"status"`
+		// Status the lead is expected to be in, unchecked when empty
+		From string `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if !isAdminLeadStatus(req.Status) {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid status %s", req.Status))
+
+		return
+	}
+
+	l, previous, err := changeLeadStatus(r.Context(), chi.URLParam(r, "id"), req.From, req.Status)
+	if errors.Is(err, errLeadStatusConflict) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "status", "lead", l.ID, "from", previous, "to", l.Status)
+
+	writeResponse(w, r, http.StatusOK, l)
+}
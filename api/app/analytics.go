@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// Every lead event is streamed as a row to BIGQUERY_TABLE for funnel
+// analysis, rows only identify the person with BIGQUERY_INCLUDE_PII
+var analytics *analyticsSink
+
+// The table is created partitioned by day on at when it doesn't exist
+var BIGQUERY_SCHEMA = []*bigquery.TableFieldSchema{
+	{Name: "event_id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "event", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "lead_id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "at", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "received_at", Type: "TIMESTAMP"},
+	{Name: "form", Type: "STRING"},
+	{Name: "enquiry_type", Type: "STRING"},
+	{Name: "status", Type: "STRING"},
+	{Name: "score", Type: "INTEGER"},
+	{Name: "bot_score", Type: "INTEGER"},
+	{Name: "country", Type: "STRING"},
+	{Name: "source", Type: "STRING"},
+	{Name: "medium", Type: "STRING"},
+	{Name: "campaign", Type: "STRING"},
+	{Name: "landing_page", Type: "STRING"},
+	{Name: "experiment", Type: "STRING"},
+	{Name: "variant", Type: "STRING"},
+	{Name: "attachments", Type: "INTEGER"},
+	{Name: "email", Type: "STRING"},
+	{Name: "first_name", Type: "STRING"},
+	{Name: "last_name", Type: "STRING"},
+	{Name: "mobile", Type: "STRING"},
+}
+
+type analyticsSink struct {
+	service *bigquery.Service
+	project string
+	dataset string
+	table   string
+	pii     bool
+}
+
+func createAnalyticsSink(ctx context.Context) *analyticsSink {
+	table, ok := BIGQUERY_TABLE.Value()
+	if !ok {
+		return nil
+	}
+
+	project, dataset, name, err := parseBigQueryTable(table)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "bigquery", err.Error())
+		panic(err)
+	}
+
+	// Authenticates with client default credentials
+	client, err := googleClientOption(ctx, []string{bigquery.BigqueryInsertdataScope, bigquery.BigqueryScope})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "bigquery", err.Error())
+		panic(err)
+	}
+
+	service, err := bigquery.NewService(ctx, client)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "bigquery", err.Error())
+		panic(err)
+	}
+
+	sink := &analyticsSink{
+		service: service,
+		project: project,
+		dataset: dataset,
+		table:   name,
+		pii:     BIGQUERY_INCLUDE_PII.Value(),
+	}
+
+	if err := sink.ensureTable(ctx); err != nil {
+		slog.ErrorContext(ctx, "error", "bigquery table", err.Error(), "table", table)
+	}
+
+	slog.DebugContext(ctx, "created analytics sink", "table", table, "pii", sink.pii)
+
+	return sink
+}
+
+// Accepts project.dataset.table or the legacy project:dataset.table
+func parseBigQueryTable(table string) (string, string, string, error) {
+	parts := strings.Split(strings.Replace(table, ":", ".", 1), ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid BIGQUERY_TABLE %s, expected project.dataset.table", table)
+	}
+
+	return parts[0], parts[1], parts[2], nil
+}
+
+func (s *analyticsSink) ensureTable(ctx context.Context) error {
+	_, err := s.service.Tables.Get(s.project, s.dataset, s.table).Context(ctx).Do()
+
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		return err
+	}
+
+	_, err = s.service.Tables.Insert(s.project, s.dataset, &bigquery.Table{
+		TableReference: &bigquery.TableReference{
+			ProjectId: s.project,
+			DatasetId: s.dataset,
+			TableId:   s.table,
+		},
+		Schema:           &bigquery.TableSchema{Fields: BIGQUERY_SCHEMA},
+		TimePartitioning: &bigquery.TimePartitioning{Type: "DAY", Field: "at"},
+	}).Context(ctx).Do()
+
+	return err
+}
+
+func (s *analyticsSink) row(ctx context.Context, e event) map[string]bigquery.JsonValue {
+	row := map[string]bigquery.JsonValue{
+		"event_id": e.ID,
+		"event":    e.Name,
+		"lead_id":  e.Lead,
+		"at":       e.At.UTC().Format(time.RFC3339Nano),
+	}
+
+	// Events are published as the lead changes, the stored lead has the
+	// state after it
+	l, err := leads.get(ctx, e.Lead)
+	if err != nil {
+		return row
+	}
+
+	row["received_at"] = l.CreatedAt.UTC().Format(time.RFC3339Nano)
+	row["form"] = l.Form
+	row["enquiry_type"] = l.EnquiryType
+	row["status"] = l.Status
+	row["score"] = l.Score
+	row["bot_score"] = l.BotScore
+	row["attachments"] = len(l.Attachments)
+
+	if l.Geo != nil {
+		row["country"] = l.Geo.Country
+	}
+	if a := l.Attribution; a != nil {
+		row["source"] = a.Source
+		row["medium"] = a.Medium
+		row["campaign"] = a.Campaign
+		row["landing_page"] = a.LandingPage
+	}
+	if x := l.Experiment; x != nil {
+		row["experiment"] = x.Name
+		row["variant"] = x.Variant
+	}
+
+	if s.pii && l.AnonymizedAt == nil {
+		row["email"] = l.Email
+		row["first_name"] = l.FirstName
+		row["last_name"] = l.LastName
+		row["mobile"] = l.Mobile
+	}
+
+	return row
+}
+
+// The event ID is the insert ID, so a retried insert isn't counted twice
+func (s *analyticsSink) record(ctx context.Context, e event) {
+	if e.Lead == "" || isSelfTest(ctx) {
+		return
+	}
+
+	res, err := s.service.Tabledata.InsertAll(s.project, s.dataset, s.table, &bigquery.TableDataInsertAllRequest{
+		Rows: []*bigquery.TableDataInsertAllRequestRows{{InsertId: e.ID, Json: s.row(ctx, e)}},
+	}).Context(ctx).Do()
+	if err == nil && len(res.InsertErrors) > 0 {
+		for _, insertErr := range res.InsertErrors {
+			for _, reason := range insertErr.Errors {
+				err = errors.Join(err, errors.New(reason.Message))
+			}
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "bigquery", err.Error(), "event", e.Name, "lead", e.Lead)
+	}
+}
@@ -0,0 +1,692 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// Programmatic submitters send a key in API_KEY_HEADER, keys are identified
+// by the SHA-256 of the key so neither API_KEYS nor the store holds the key
+// itself
+const API_KEY_DAY_FORMAT = "2006-01-02"
+const API_KEY_MONTH_FORMAT = "2006-01"
+
+// Days of usage kept for reporting, enough for the previous month
+const API_KEY_USAGE_DAYS = 62
+
+const API_KEY_PREFIX = "lk_"
+
+const API_KEY_SCOPE_LEADS = "leads"
+const API_KEY_SCOPE_DRAFTS = "drafts"
+const API_KEY_SCOPE_MOBILE = "mobile"
+
+var API_KEY_SCOPES = []string{API_KEY_SCOPE_LEADS, API_KEY_SCOPE_DRAFTS, API_KEY_SCOPE_MOBILE}
+
+const EVENT_API_KEY_CREATED = "api_key.created"
+const EVENT_API_KEY_ROTATED = "api_key.rotated"
+const EVENT_API_KEY_REVOKED = "api_key.revoked"
+
+var errApiKeyNotFound = errors.New("API key not found")
+var errApiKeyRevoked = errors.New("API key is revoked")
+
+type apiKeyContextKey struct{}
+
+type apiKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Hex encoded SHA-256 of the key, never included in responses
+	Hash string `json:"hash,omitempty"`
+	// Routes the key can be used for and the forms it can submit, any when
+	// empty
+	Scopes []string `json:"scopes,omitempty"`
+	Forms  []string `json:"forms,omitempty"`
+	// Submissions allowed per UTC day and month, unlimited when 0
+	DailyQuota   uint64     `json:"dailyQuota,omitempty"`
+	MonthlyQuota uint64     `json:"monthlyQuota,omitempty"`
+	CreatedAt    *time.Time `json:"createdAt,omitempty"`
+	RotatedAt    *time.Time `json:"rotatedAt,omitempty"`
+	RevokedAt    *time.Time `json:"revokedAt,omitempty"`
+}
+
+type apiKeyUsage struct {
+	ID           string            `json:"id"`
+	Today        uint64            `json:"today"`
+	Month        uint64            `json:"month"`
+	DailyQuota   uint64            `json:"dailyQuota,omitempty"`
+	MonthlyQuota uint64            `json:"monthlyQuota,omitempty"`
+	Days         map[string]uint64 `json:"days"`
+}
+
+var apiKeys *apiKeyRegistry
+
+// Keys in API_KEYS are seeded first and the store is loaded over them, so a
+// configured key rotated or revoked from the admin API stays that way.
+// Counts are kept by key ID and day, with a path they are also written to a
+// JSON file so a restart doesn't reset quotas
+type apiKeyRegistry struct {
+	mu sync.Mutex
+	// By ID, with the hashes of keys that aren't revoked pointing at them
+	keys     map[string]*apiKey
+	hashes   map[string]string
+	keysPath string
+	path     string
+	counts   map[string]map[string]uint64
+}
+
+func createApiKeyRegistry(ctx context.Context) *apiKeyRegistry {
+	registry := &apiKeyRegistry{
+		keys:   map[string]*apiKey{},
+		hashes: map[string]string{},
+		counts: map[string]map[string]uint64{},
+	}
+
+	if file, ok := API_KEYS.Value(); ok {
+		content, err := file.ReadBytes()
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "api keys", err.Error())
+			panic(err)
+		}
+
+		if err := registry.add(content); err != nil {
+			slog.ErrorContext(ctx, "error", "api keys", err.Error())
+			panic(err)
+		}
+	}
+
+	if LEAD_STORE.Value() == "file" {
+		registry.keysPath = API_KEY_STORE_FILE.Value()
+
+		content, err := os.ReadFile(registry.keysPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "api keys", err.Error())
+			panic(err)
+		}
+		if err == nil {
+			if err := registry.add(content); err != nil {
+				slog.ErrorContext(ctx, "error", "api keys", err.Error())
+				panic(err)
+			}
+		}
+	}
+
+	if path, ok := API_KEY_USAGE_FILE.Value(); ok {
+		registry.path = path
+
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "api key usage", err.Error())
+			panic(err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(content, &registry.counts); err != nil {
+				slog.ErrorContext(ctx, "error", "api key usage", err.Error())
+				panic(err)
+			}
+		}
+	}
+
+	slog.DebugContext(ctx, "created api key registry", "keys", len(registry.keys))
+
+	return registry
+}
+
+func (a *apiKeyRegistry) add(content []byte) error {
+	keys := []*apiKey{}
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := key.check(); err != nil {
+			return err
+		}
+
+		key.Hash = strings.ToLower(key.Hash)
+		if previous, ok := a.keys[key.ID]; ok {
+			delete(a.hashes, previous.Hash)
+		}
+
+		a.keys[key.ID] = key
+		if key.RevokedAt == nil {
+			a.hashes[key.Hash] = key.ID
+		}
+	}
+
+	return nil
+}
+
+func (key *apiKey) check() error {
+	if key.ID == "" || key.Hash == "" {
+		return errors.New("API keys need an id and hash")
+	}
+
+	for _, scope := range key.Scopes {
+		if !slices.Contains(API_KEY_SCOPES, scope) {
+			return fmt.Errorf("API key %s has unknown scope %s", key.ID, scope)
+		}
+	}
+
+	for _, form := range key.Forms {
+		if _, ok := currentConfig().forms[form]; !ok {
+			return fmt.Errorf("API key %s has unknown form %s", key.ID, form)
+		}
+	}
+
+	return nil
+}
+
+func (key *apiKey) allows(scope string) bool {
+	return len(key.Scopes) == 0 || slices.Contains(key.Scopes, scope)
+}
+
+func (key *apiKey) allowsForm(form string) bool {
+	return len(key.Forms) == 0 || slices.Contains(key.Forms, form)
+}
+
+// Copies taken under the lock are what leave the registry, without the hash
+func (key apiKey) public() *apiKey {
+	key.Hash = ""
+	key.Scopes = slices.Clone(key.Scopes)
+	key.Forms = slices.Clone(key.Forms)
+
+	return &key
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func newApiKeySecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func (a *apiKeyRegistry) lookup(key string) (*apiKey, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id, ok := a.hashes[hashApiKey(key)]
+	if !ok {
+		return nil, false
+	}
+
+	return a.keys[id].public(), true
+}
+
+func (a *apiKeyRegistry) get(id string) (*apiKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, errApiKeyNotFound
+	}
+
+	return key.public(), nil
+}
+
+// Oldest first, keys without a creation time come from API_KEYS
+func (a *apiKeyRegistry) list() []*apiKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	keys := make([]*apiKey, 0, len(a.keys))
+	for _, key := range a.keys {
+		keys = append(keys, key.public())
+	}
+
+	slices.SortFunc(keys, func(x, y *apiKey) int {
+		created := func(key *apiKey) time.Time {
+			if key.CreatedAt == nil {
+				return time.Time{}
+			}
+
+			return *key.CreatedAt
+		}
+
+		if order := created(x).Compare(created(y)); order != 0 {
+			return order
+		}
+
+		return strings.Compare(x.ID, y.ID)
+	})
+
+	return keys
+}
+
+// Returns the key once, only its hash is kept
+func (a *apiKeyRegistry) create(key *apiKey) (string, *apiKey, error) {
+	secret, err := newApiKeySecret()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	key.ID = uuid.NewString()
+	key.Hash = hashApiKey(secret)
+	key.CreatedAt = &now
+	key.RotatedAt = nil
+	key.RevokedAt = nil
+
+	if err := key.check(); err != nil {
+		return "", nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.keys[key.ID] = key
+	a.hashes[key.Hash] = key.ID
+
+	return secret, key.public(), a.persistKeys()
+}
+
+// Applies the change to the stored key and saves it
+func (a *apiKeyRegistry) update(id string, change func(key *apiKey) error) (*apiKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, ok := a.keys[id]
+	if !ok {
+		return nil, errApiKeyNotFound
+	}
+
+	changed := stored.public()
+	changed.Hash = stored.Hash
+	if err := change(changed); err != nil {
+		return nil, err
+	}
+	if err := changed.check(); err != nil {
+		return nil, err
+	}
+
+	delete(a.hashes, stored.Hash)
+	a.keys[id] = changed
+	if changed.RevokedAt == nil {
+		a.hashes[changed.Hash] = id
+	}
+
+	return changed.public(), a.persistKeys()
+}
+
+// Counts the submission unless it would go over a quota, in which case the
+// time the quota resets is returned
+func (a *apiKeyRegistry) use(key *apiKey, now time.Time) (bool, time.Time, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now = now.UTC()
+	days := a.counts[key.ID]
+	if days == nil {
+		days = map[string]uint64{}
+		a.counts[key.ID] = days
+	}
+
+	today := days[now.Format(API_KEY_DAY_FORMAT)]
+	if key.DailyQuota > 0 && today >= key.DailyQuota {
+		return false, time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	if key.MonthlyQuota > 0 && monthUsage(days, now) >= key.MonthlyQuota {
+		return false, time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+
+	days[now.Format(API_KEY_DAY_FORMAT)] = today + 1
+
+	cutoff := now.AddDate(0, 0, -API_KEY_USAGE_DAYS).Format(API_KEY_DAY_FORMAT)
+	for day := range days {
+		if day < cutoff {
+			delete(days, day)
+		}
+	}
+
+	return true, time.Time{}, a.persist()
+}
+
+func monthUsage(days map[string]uint64, now time.Time) uint64 {
+	month := now.Format(API_KEY_MONTH_FORMAT)
+
+	total := uint64(0)
+	for day, count := range days {
+		if strings.HasPrefix(day, month) {
+			total += count
+		}
+	}
+
+	return total
+}
+
+func (a *apiKeyRegistry) usage(id string, now time.Time) (*apiKeyUsage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, errApiKeyNotFound
+	}
+
+	now = now.UTC()
+	days := map[string]uint64{}
+	for day, count := range a.counts[id] {
+		days[day] = count
+	}
+
+	return &apiKeyUsage{
+		ID:           id,
+		Today:        days[now.Format(API_KEY_DAY_FORMAT)],
+		Month:        monthUsage(days, now),
+		DailyQuota:   key.DailyQuota,
+		MonthlyQuota: key.MonthlyQuota,
+		Days:         days,
+	}, nil
+}
+
+func (a *apiKeyRegistry) persist() error {
+	if a.path == "" {
+		return nil
+	}
+
+	return writeJsonFile(a.path, a.counts)
+}
+
+// Every key is written, configured keys included, so the store alone is
+// enough to authenticate once API_KEYS is dropped
+func (a *apiKeyRegistry) persistKeys() error {
+	if a.keysPath == "" {
+		return nil
+	}
+
+	keys := make([]*apiKey, 0, len(a.keys))
+	for _, key := range a.keys {
+		keys = append(keys, key)
+	}
+
+	return writeJsonFile(a.keysPath, keys)
+}
+
+// Written to a temporary file first so a crash never leaves a partial file
+func writeJsonFile(path string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// Requests without a key pass through to the other limiters, a key that
+// isn't known or isn't scoped for the route is rejected rather than treated
+// as a browser
+func apiKeyMiddleware(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get(API_KEY_HEADER)
+			if value == "" {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			key, ok := apiKeys.lookup(value)
+			if !ok {
+				slog.WarnContext(r.Context(), "denied", "api key", "unknown", "ip", r.RemoteAddr)
+				writeProblem(w, r, http.StatusUnauthorized, "Invalid API key")
+
+				return
+			}
+
+			if !key.allows(scope) {
+				slog.WarnContext(r.Context(), "denied", "api key", key.ID, "scope", scope)
+				writeProblem(w, r, http.StatusForbidden, "API key is not allowed to do this")
+
+				return
+			}
+
+			allowed, reset, err := apiKeys.use(key, time.Now())
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error", "api key usage", err.Error(), "key", key.ID)
+			}
+
+			if !allowed {
+				slog.WarnContext(r.Context(), "quota exceeded", "key", key.ID)
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				w.Header().Set("X-RateLimit-Reset", reset.UTC().Format(time.RFC1123))
+				writeProblem(w, r, http.StatusTooManyRequests, "API key quota exceeded")
+
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+		})
+	}
+}
+
+// Runs once the form is parsed, keys bound to forms can only submit those
+func apiKeyFormMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := r.Context().Value(apiKeyContextKey{}).(*apiKey)
+		if !ok {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		if form, _, _ := requestForm(r); !key.allowsForm(form) {
+			slog.WarnContext(r.Context(), "denied", "api key", key.ID, "form", form)
+			writeProblem(w, r, http.StatusForbidden, "API key is not allowed to submit this form")
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiKeyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errApiKeyNotFound) {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	slog.ErrorContext(r.Context(), "error", "api keys", err.Error())
+	writeProblem(w, r, http.StatusInternalServerError, err.Error())
+}
+
+type apiKeyRequest struct {
+	Name         *string   `json:"name"`
+	Scopes       *[]string `json:"scopes"`
+	Forms        *[]string `json:"forms"`
+	DailyQuota   *uint64   `json:"dailyQuota"`
+	MonthlyQuota *uint64   `json:"monthlyQuota"`
+}
+
+func (req apiKeyRequest) apply(key *apiKey) {
+	if req.Name != nil {
+		key.Name = *req.Name
+	}
+	if req.Scopes != nil {
+		key.Scopes = *req.Scopes
+	}
+	if req.Forms != nil {
+		key.Forms = *req.Forms
+	}
+	if req.DailyQuota != nil {
+		key.DailyQuota = *req.DailyQuota
+	}
+	if req.MonthlyQuota != nil {
+		key.MonthlyQuota = *req.MonthlyQuota
+	}
+}
+
+func adminListApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, r, http.StatusOK, map[string]any{"apiKeys": apiKeys.list()})
+}
+
+func adminGetApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := apiKeys.get(chi.URLParam(r, "id"))
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, key)
+}
+
+func adminCreateApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req := apiKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	key := &apiKey{}
+	req.apply(key)
+
+	secret, key, err := apiKeys.create(key)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "created api key", "key", key.ID)
+
+	events.publish(r.Context(), EVENT_API_KEY_CREATED, "", map[string]any{"key": key.ID})
+
+	writeResponse(w, r, http.StatusCreated, map[string]any{"apiKey": key, "key": secret})
+}
+
+func adminUpdateApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req := apiKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	key, err := apiKeys.update(chi.URLParam(r, "id"), func(key *apiKey) error {
+		req.apply(key)
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errApiKeyNotFound) {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, key)
+}
+
+// The previous key stops working straight away
+func adminRotateApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	secret, err := newApiKeySecret()
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	key, err := apiKeys.update(chi.URLParam(r, "id"), func(key *apiKey) error {
+		if key.RevokedAt != nil {
+			return errApiKeyRevoked
+		}
+
+		now := time.Now()
+		key.Hash = hashApiKey(secret)
+		key.RotatedAt = &now
+
+		return nil
+	})
+	if errors.Is(err, errApiKeyRevoked) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "rotated api key", "key", key.ID)
+
+	events.publish(r.Context(), EVENT_API_KEY_ROTATED, "", map[string]any{"key": key.ID})
+
+	writeResponse(w, r, http.StatusOK, map[string]any{"apiKey": key, "key": secret})
+}
+
+// Revoked keys are kept so their usage can still be reported
+func adminRevokeApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := apiKeys.update(chi.URLParam(r, "id"), func(key *apiKey) error {
+		if key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+		}
+
+		return nil
+	})
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "revoked api key", "key", key.ID)
+
+	events.publish(r.Context(), EVENT_API_KEY_REVOKED, "", map[string]any{"key": key.ID})
+
+	writeResponse(w, r, http.StatusOK, key)
+}
+
+func adminApiKeyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := apiKeys.usage(chi.URLParam(r, "id"), time.Now())
+	if err != nil {
+		apiKeyError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, usage)
+}
@@ -0,0 +1,1310 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/agoda-com/opentelemetry-go/otelslog"
+	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs"
+	"github.com/agoda-com/opentelemetry-logs-go/exporters/otlp/otlplogs/otlplogshttp"
+	sdklog "github.com/agoda-com/opentelemetry-logs-go/sdk/logs"
+	"github.com/dogmatiq/ferrite"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/httplog/v2"
+	"github.com/mrz1836/postmark"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/api/drive/v3"
+)
+
+const MAX_REQUEST_SIZE = 20 << 20 // 20 MB
+const MAX_UPLOAD_SIZE = 15 << 20  // 15 MB
+
+var (
+	LOG_LEVEL = ferrite.EnumAs[slog.Level]("LOG_LEVEL", "Log level").
+			WithMembers(slog.LevelDebug, slog.LevelError, slog.LevelInfo, slog.LevelWarn).
+			WithDefault(slog.LevelInfo).
+			Required()
+	SERVICE_NAME = ferrite.
+			String("SERVICE_NAME", "OpenTelemetry service name").
+			Required()
+	OTEL_EXPORTER_OTLP_ENDPOINT = ferrite.
+					String("OTEL_EXPORTER_OTLP_ENDPOINT", "OpenTelemetry exporter endpoint").
+					Required()
+	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT = ferrite.
+						String("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OpenTelemetry traces exporter endpoint").
+						Required()
+	OTEL_EXPORTER_OTLP_HEADERS = ferrite.
+					String("OTEL_EXPORTER_OTLP_HEADERS", "OpenTelemetry exporter headers").
+					Required()
+	OTEL_EXPORTER_OTLP_TRACES_HEADERS = ferrite.
+						String("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "OpenTelemetry exporter headers").
+						Required()
+	POSTMARK_TEMPLATE = ferrite.Signed[int]("POSTMARK_TEMPLATE", "Postmark template, required by the postmark mailer").
+				Optional()
+	POSTMARK_FROM = ferrite.String("POSTMARK_FROM", "Postmark from").
+			WithDefault("hey@skulpture.xyz").
+			Required()
+	POSTMARK_SERVER_TOKEN = ferrite.String("POSTMARK_SERVER_TOKEN", "Postmark server token").
+				Required()
+	POSTMARK_ACCOUNT_TOKEN = ferrite.String("POSTMARK_ACCOUNT_TOKEN", "Postmark account token").
+				Required()
+	POSTMARK_TEMPLATE_CONSULTATION = ferrite.
+					Signed[int]("POSTMARK_TEMPLATE_CONSULTATION", "Postmark template for consultation confirmations, the consultation email template is used when unset").
+					Optional()
+	CONSULTATION_DURATION = ferrite.
+				Duration("CONSULTATION_DURATION", "Length of a consultation when a booking does not give one").
+				WithDefault(30 * time.Minute).
+				Required()
+	DIGEST_RECIPIENTS = ferrite.
+				String("DIGEST_RECIPIENTS", "Comma separated recipients of the daily lead digest, which is not sent when unset").
+				Optional()
+	DIGEST_TIME = ferrite.
+			String("DIGEST_TIME", "Time of day the lead digest is sent in BUSINESS_TIMEZONE, as HH:MM").
+			WithDefault("08:00").
+			Required()
+	MAILER = ferrite.
+		Enum("MAILER", "Send auto-responses with Postmark-hosted templates or render the embedded email templates locally").
+		WithMembers(MAILER_POSTMARK, MAILER_LOCAL).
+		WithDefault(MAILER_POSTMARK).
+		Required()
+	EMAIL_TRANSPORT = ferrite.
+			Enum("EMAIL_TRANSPORT", "Send locally rendered emails and team notifications through Postmark or SMTP").
+			WithMembers(EMAIL_TRANSPORT_POSTMARK, EMAIL_TRANSPORT_SMTP).
+			WithDefault(EMAIL_TRANSPORT_POSTMARK).
+			Required()
+	EMAIL_TEMPLATES = ferrite.
+			String("EMAIL_TEMPLATES", "Directory of email templates used by the local mailer instead of the embedded ones").
+			Optional()
+	SMTP_HOST = ferrite.
+			String("SMTP_HOST", "SMTP server host, required by the smtp transport").
+			Optional()
+	SMTP_PORT = ferrite.
+			Unsigned[uint16]("SMTP_PORT", "SMTP server port").
+			WithDefault(587).
+			Required()
+	SMTP_USERNAME = ferrite.
+			String("SMTP_USERNAME", "SMTP username, authentication is skipped when unset").
+			Optional()
+	SMTP_PASSWORD = ferrite.
+			String("SMTP_PASSWORD", "SMTP password").
+			WithSensitiveContent().
+			Optional()
+	GO_ENV = ferrite.
+		String("GO_ENV", "Golang environment").
+		WithDefault("Development").
+		Required()
+	ATTACHMENT_SPOOL = ferrite.
+				String("ATTACHMENT_SPOOL", "Directory or gs://bucket/prefix attachments are spooled to while ATTACHMENT_STORAGE is unavailable, submissions with attachments fail while it is down when unset").
+				Optional()
+	ATTACHMENT_SPOOL_INTERVAL = ferrite.
+					Duration("ATTACHMENT_SPOOL_INTERVAL", "Time between attempts to upload spooled attachments to ATTACHMENT_STORAGE").
+					WithDefault(time.Minute).
+					Required()
+	ATTACHMENT_STORAGE = ferrite.
+				Enum("ATTACHMENT_STORAGE", "Backend attachments are stored in").
+				WithMembers("google-drive", "azure-blob").
+				WithDefault("google-drive").
+				Required()
+	AZURE_STORAGE_ACCOUNT_URL = ferrite.
+					URL("AZURE_STORAGE_ACCOUNT_URL", "Azure Blob Storage account URL, authenticated with the default Azure credential").
+					Optional()
+	AZURE_STORAGE_CONNECTION_STRING = ferrite.
+					String("AZURE_STORAGE_CONNECTION_STRING", "Azure Blob Storage connection string, used instead of the account URL").
+					WithSensitiveContent().
+					Optional()
+	AZURE_STORAGE_CONTAINER = ferrite.
+				String("AZURE_STORAGE_CONTAINER", "Azure Blob Storage container for attachments").
+				WithDefault("attachments").
+				Required()
+	ATTACHMENT_KMS_KEY = ferrite.
+				String("ATTACHMENT_KMS_KEY", "Cloud KMS key used to encrypt attachments before upload").
+				Optional()
+	PUBLIC_URL = ferrite.
+			URL("PUBLIC_URL", "Public URL of the API used in links sent by email").
+			Optional()
+	ATTACHMENT_LINK_SECRET = ferrite.
+				String("ATTACHMENT_LINK_SECRET", "Secret used to sign attachment download, verification and unsubscribe links, links are left out when unset").
+				WithSensitiveContent().
+				Optional()
+	ATTACHMENT_LINK_EXPIRY = ferrite.
+				Duration("ATTACHMENT_LINK_EXPIRY", "Validity of attachment download links").
+				WithDefault(7 * 24 * time.Hour).
+				Required()
+	HEIC_CONVERSION = ferrite.
+			Bool("HEIC_CONVERSION", "Convert HEIC/HEIF attachments to JPEG").
+			WithDefault(true).
+			Required()
+	HEIC_KEEP_ORIGINAL = ferrite.
+				Bool("HEIC_KEEP_ORIGINAL", "Store the original HEIC/HEIF attachment alongside the converted JPEG").
+				WithDefault(false).
+				Required()
+	MAX_ATTACHMENTS = ferrite.
+			Unsigned[uint]("MAX_ATTACHMENTS", "Maximum number of files attached to a lead").
+			WithDefault(10).
+			Required()
+	MAX_FILENAME_LENGTH = ferrite.
+				Unsigned[uint]("MAX_FILENAME_LENGTH", "Maximum length of an attached file name").
+				WithDefault(255).
+				Required()
+	UPLOAD_MIN_RATE = ferrite.
+			Unsigned[uint64]("UPLOAD_MIN_RATE", "Slowest upload to storage in bytes per second a file is given time for, on top of UPLOAD_MIN_TIMEOUT").
+			WithDefault(64 << 10).
+			WithMinimum(1).
+			Required()
+	UPLOAD_MIN_TIMEOUT = ferrite.
+				Duration("UPLOAD_MIN_TIMEOUT", "Time every file upload to storage is given regardless of its size").
+				WithDefault(10 * time.Second).
+				WithMinimum(time.Second).
+				Required()
+	HTTP_IDLE_CONN_TIMEOUT = ferrite.
+				Duration("HTTP_IDLE_CONN_TIMEOUT", "Time an idle connection to Drive or Postmark is kept open for reuse").
+				WithDefault(90 * time.Second).
+				WithMinimum(time.Second).
+				Required()
+	HTTP_RESPONSE_HEADER_TIMEOUT = ferrite.
+					Duration("HTTP_RESPONSE_HEADER_TIMEOUT", "Time Drive or Postmark is given to start responding once a request is sent").
+					WithDefault(30 * time.Second).
+					WithMinimum(time.Second).
+					Required()
+	DEPENDENCY_RETRY_INTERVAL = ferrite.
+					Duration("DEPENDENCY_RETRY_INTERVAL", "Time before retrying to create a Google Drive or OpenTelemetry client that failed at startup, backing off from it up to an hour").
+					WithDefault(10 * time.Second).
+					WithMinimum(time.Second).
+					Required()
+	DRIVE_QUOTA_CACHE_TTL = ferrite.
+				Duration("DRIVE_QUOTA_CACHE_TTL", "Time the Google Drive storage quota checked before uploads is cached for before it is refreshed in the background").
+				WithDefault(time.Minute).
+				WithMinimum(time.Second).
+				Required()
+	DRIVE_MAX_CONNS_PER_HOST = ferrite.
+					Unsigned[uint]("DRIVE_MAX_CONNS_PER_HOST", "Connections kept open to Google Drive, and the most used at once").
+					WithDefault(32).
+					WithMinimum(1).
+					Required()
+	POSTMARK_MAX_CONNS_PER_HOST = ferrite.
+					Unsigned[uint]("POSTMARK_MAX_CONNS_PER_HOST", "Connections kept open to Postmark, and the most used at once").
+					WithDefault(8).
+					WithMinimum(1).
+					Required()
+	POSTMARK_TIMEOUT = ferrite.
+				Duration("POSTMARK_TIMEOUT", "Time a request to Postmark is given to complete").
+				WithDefault(30 * time.Second).
+				WithMinimum(time.Second).
+				Required()
+	MULTIPART_MEMORY = ferrite.
+				Unsigned[uint64]("MULTIPART_MEMORY", "Bytes of a multipart submission held in memory, files past it are written to MULTIPART_TEMP_DIR").
+				WithDefault(MAX_UPLOAD_SIZE).
+				Required()
+	MULTIPART_TEMP_DIR = ferrite.
+				String("MULTIPART_TEMP_DIR", "Directory files of multipart submissions are written to while they are handled, such as an emptyDir or tmpfs, defaults to the system temp directory").
+				Optional()
+	UPLOAD_STRATEGY = ferrite.
+			Enum("UPLOAD_STRATEGY", "Upload the files of a submission one after another, which suits small instances, or concurrently").
+			WithMembers(UPLOAD_STRATEGY_SEQUENTIAL, UPLOAD_STRATEGY_CONCURRENT).
+			WithDefault(UPLOAD_STRATEGY_CONCURRENT).
+			Required()
+	UPLOAD_WORKERS = ferrite.
+			Unsigned[uint]("UPLOAD_WORKERS", "Files of a submission uploaded at once with the concurrent upload strategy, 0 uploads every file at once").
+			WithDefault(0).
+			Required()
+	UPLOAD_MAX_IN_FLIGHT = ferrite.
+				Unsigned[uint]("UPLOAD_MAX_IN_FLIGHT", "Most submissions and upload chunks handled at once before more are turned away, 0 for no limit").
+				WithDefault(0).
+				Required()
+	UPLOAD_MAX_IN_FLIGHT_BYTES = ferrite.
+					Unsigned[uint64]("UPLOAD_MAX_IN_FLIGHT_BYTES", "Most bytes of submissions and upload chunks handled at once before more are turned away, 0 for no limit").
+					WithDefault(256 << 20).
+					Required()
+	UPLOAD_RETRY_AFTER = ferrite.
+				Duration("UPLOAD_RETRY_AFTER", "Retry-After sent with submissions turned away while uploads are saturated").
+				WithDefault(5 * time.Second).
+				WithMinimum(time.Second).
+				Required()
+	ATTACHMENT_TYPES = ferrite.
+				String("ATTACHMENT_TYPES", "Comma separated file extensions or MIME types (image/* matches any image) accepted as attachments, any file is accepted when unset").
+				Optional()
+	FORM_RULES = ferrite.
+			File("FORM_RULES", "JSON file of per-field validation rules merged over the defaults").
+			Optional()
+	FORMS = ferrite.
+		File("FORMS", "JSON file of form IDs mapped to field rules merged over the default form, for landing pages with their own custom fields").
+		Optional()
+	PORT = ferrite.
+		NetworkPort("PORT", "Port to listen on").
+		WithDefault("80").
+		Required()
+	HTTP_ADDR = ferrite.
+			String("HTTP_ADDR", "Address to listen on, overrides PORT, use unix:<path> for a Unix socket").
+			Optional()
+	TLS_AUTOCERT_HOSTS = ferrite.
+				String("TLS_AUTOCERT_HOSTS", "Comma separated hostnames to serve TLS for with certificates from Let's Encrypt").
+				Optional()
+	TLS_AUTOCERT_EMAIL = ferrite.
+				String("TLS_AUTOCERT_EMAIL", "Contact email for the Let's Encrypt account").
+				Optional()
+	TLS_AUTOCERT_CACHE_DIR = ferrite.
+				String("TLS_AUTOCERT_CACHE_DIR", "Directory used to cache certificates from Let's Encrypt").
+				WithDefault("/var/cache/autocert").
+				Required()
+	TLS_CERT_FILE = ferrite.
+			String("TLS_CERT_FILE", "PEM certificate to serve TLS with on the listen address, used when not serving certificates from Let's Encrypt").
+			Optional()
+	TLS_KEY_FILE = ferrite.
+			String("TLS_KEY_FILE", "PEM private key for TLS_CERT_FILE").
+			Optional()
+	TLS_CLIENT_CA = ferrite.
+			File("TLS_CLIENT_CA", "PEM bundle of CAs client certificates are verified against, clients with one don't need an API key").
+			Optional()
+	TLS_CLIENT_AUTH = ferrite.
+			Enum("TLS_CLIENT_AUTH", "Whether every connection needs a client certificate or only those presenting one are verified").
+			WithMembers("require", "verify-if-given").
+			WithDefault("require").
+			Required()
+	STATIC_SITE = ferrite.
+			Bool("STATIC_SITE", "Serve the embedded static site").
+			WithDefault(false).
+			Required()
+	TUS_DIR = ferrite.
+		String("TUS_DIR", "Directory for in-progress tus uploads").
+		Optional()
+	TUS_UPLOAD_EXPIRY = ferrite.
+				Duration("TUS_UPLOAD_EXPIRY", "Time before an unused tus upload is removed").
+				WithDefault(24 * time.Hour).
+				Required()
+	LEAD_DRAFT_EXPIRY = ferrite.
+				Duration("LEAD_DRAFT_EXPIRY", "Time before an unconfirmed lead draft is removed").
+				WithDefault(24 * time.Hour).
+				Required()
+	LEAD_PROCESSORS = ferrite.
+			String("LEAD_PROCESSORS", "Comma separated lead processors, run in order within the validate, enrich and deliver stages").
+			WithDefault("fields,geoip,content,translate,llm,score,route,email,notify,crm").
+			Required()
+	GEOIP_DATABASE = ferrite.
+			File("GEOIP_DATABASE", "MaxMind GeoIP2 or GeoLite2 City database used to locate submitters").
+			Optional()
+	IPINFO_TOKEN = ferrite.
+			String("IPINFO_TOKEN", "ipinfo API token used to locate submitters when no GeoIP database is configured").
+			WithSensitiveContent().
+			Optional()
+	IP_DENY_LIST = ferrite.
+			String("IP_DENY_LIST", "Comma separated addresses or CIDR ranges that are refused").
+			Optional()
+	ADMIN_ALLOW_LIST = ferrite.
+				String("ADMIN_ALLOW_LIST", "Comma separated addresses or CIDR ranges allowed to reach admin routes").
+				Optional()
+	TRUSTED_PROXY_HOPS = ferrite.
+				Unsigned[uint]("TRUSTED_PROXY_HOPS", "Proxies in front of the server that append to X-Forwarded-For, the client address is taken that many entries from the end. The default of 1 suits Cloud Run or a single load balancer, set 0 when clients connect directly").
+				WithDefault(1).
+				Required()
+	LIMITER_STORE = ferrite.
+			Enum("LIMITER_STORE", "Where rate limit counters are kept, in memory per instance or in Redis such as Memorystore shared by every instance").
+			WithMembers(LIMITER_STORE_MEMORY, LIMITER_STORE_REDIS).
+			WithDefault(LIMITER_STORE_MEMORY).
+			Required()
+	REDIS_URL = ferrite.
+			String("REDIS_URL", "redis:// or rediss:// URL of the Redis server rate limit counters are kept in, required by the redis limiter store").
+			WithSensitiveContent().
+			Optional()
+	COUNTRY_RATE_LIMITS = ferrite.
+				String("COUNTRY_RATE_LIMITS", "Comma separated COUNTRY=tokens/interval limits applied on top of the IP rate limit, e.g. CN=1/1m").
+				Optional()
+	CSRF_PROTECTION = ferrite.
+			Bool("CSRF_PROTECTION", "Require a token from GET /lead/token on submissions from browsers").
+			WithDefault(true).
+			Required()
+	CSRF_SECRET = ferrite.
+			String("CSRF_SECRET", "Secret used to sign CSRF tokens, derived from ATTACHMENT_LINK_SECRET when unset").
+			WithSensitiveContent().
+			Optional()
+	FRONTEND_SIGNING_SECRET = ferrite.
+				String("FRONTEND_SIGNING_SECRET", "Secret the site's edge function signs submissions with, signed submissions skip the bot filter").
+				WithSensitiveContent().
+				Optional()
+	FRONTEND_SIGNATURE_REQUIRED = ferrite.
+					Bool("FRONTEND_SIGNATURE_REQUIRED", "Reject submissions without a signature from the edge function, an API key or a client certificate").
+					WithDefault(false).
+					Required()
+	LEAD_STORE = ferrite.
+			Enum("LEAD_STORE", "Where received leads are kept").
+			WithMembers("memory", "file").
+			WithDefault("memory").
+			Required()
+	LEAD_STORE_FILE = ferrite.
+			String("LEAD_STORE_FILE", "JSON file leads are kept in with the file lead store").
+			WithDefault("/var/lib/landing/leads.json").
+			Required()
+	ADMIN_TOKEN = ferrite.
+			String("ADMIN_TOKEN", "Bearer token for the admin API, which is disabled when unset").
+			WithSensitiveContent().
+			Optional()
+	TEAM_NOTIFICATION_EMAIL = ferrite.
+				String("TEAM_NOTIFICATION_EMAIL", "Comma separated addresses notified of new leads").
+				Optional()
+	CONTENT_FILTER_WORDS = ferrite.
+				File("CONTENT_FILTER_WORDS", "File of extra words or phrases, one per line, that quarantine a lead").
+				Optional()
+	TRANSLATION = ferrite.
+			Bool("TRANSLATION", "Translate enquiries that aren't in TRANSLATION_TARGET with the Cloud Translation API").
+			WithDefault(false).
+			Required()
+	TRANSLATION_TARGET = ferrite.
+				String("TRANSLATION_TARGET", "Language code enquiries are translated to").
+				WithDefault("en").
+				Required()
+	TRANSLATION_API_KEY = ferrite.
+				String("TRANSLATION_API_KEY", "Cloud Translation API key, client default credentials are used when unset").
+				WithSensitiveContent().
+				Optional()
+	LLM_ENDPOINT = ferrite.
+			URL("LLM_ENDPOINT", "OpenAI compatible chat completions endpoint used to summarise enquiries and draft a reply").
+			Optional()
+	LLM_API_KEY = ferrite.
+			String("LLM_API_KEY", "API key for LLM_ENDPOINT").
+			WithSensitiveContent().
+			Optional()
+	LLM_MODEL = ferrite.
+			String("LLM_MODEL", "Model requested from LLM_ENDPOINT").
+			WithDefault("gpt-4o-mini").
+			Required()
+	SCORING_RULES = ferrite.
+			File("SCORING_RULES", "JSON file of lead scoring rules replacing the defaults").
+			Optional()
+	POSTMARK_TEMPLATE_OUTSIDE_HOURS = ferrite.Signed[int]("POSTMARK_TEMPLATE_OUTSIDE_HOURS", "Postmark template for leads received outside business hours").
+					Optional()
+	BUSINESS_TIMEZONE = ferrite.
+				String("BUSINESS_TIMEZONE", "IANA time zone business hours are in").
+				WithDefault("UTC").
+				Required()
+	BUSINESS_HOURS = ferrite.
+			String("BUSINESS_HOURS", "Semicolon separated business hours, e.g. Mon-Fri 09:00-17:00; Sat 10:00-13:00").
+			WithDefault("Mon-Fri 09:00-17:00").
+			Required()
+	LEAD_SLA = ferrite.
+			Duration("LEAD_SLA", "Time a new lead can wait for its first status change before the team is alerted").
+			WithDefault(4 * time.Hour).
+			Required()
+	SLA_SLACK_WEBHOOK_URL = ferrite.
+				URL("SLA_SLACK_WEBHOOK_URL", "Slack incoming webhook alerted about SLA breaches, SLACK_WEBHOOK_URL is used when unset").
+				Optional()
+	API_LEGACY_SUNSET = ferrite.
+				String("API_LEGACY_SUNSET", "Date (YYYY-MM-DD) unversioned paths stop being served, sent in their Sunset header").
+				Optional()
+	METRICS_TOKEN = ferrite.
+			String("METRICS_TOKEN", "Bearer token for scraping /metrics, which is disabled when unset").
+			WithSensitiveContent().
+			Optional()
+	DEBUG_TOKEN = ferrite.
+			String("DEBUG_TOKEN", "Bearer token for the pprof and expvar endpoints under /debug, which are disabled when unset").
+			WithSensitiveContent().
+			Optional()
+	SENTRY_DSN = ferrite.
+			String("SENTRY_DSN", "Sentry DSN panics in request handlers are reported to alongside telemetry").
+			WithSensitiveContent().
+			Optional()
+	OUTBOX_RETRY_INTERVAL = ferrite.
+				Duration("OUTBOX_RETRY_INTERVAL", "Time between retries of delivery processors that failed for a lead, backing off from it up to an hour").
+				WithDefault(time.Minute).
+				WithMinimum(time.Second).
+				Required()
+	OUTBOX_MAX_ATTEMPTS = ferrite.
+				Unsigned[uint]("OUTBOX_MAX_ATTEMPTS", "Attempts at running a delivery processor for a lead before it is given up on").
+				WithDefault(5).
+				WithMinimum(1).
+				Required()
+	OUTGOING_SPOOL_DIR = ferrite.
+				String("OUTGOING_SPOOL_DIR", "Directory emails and webhook posts are written to before they are sent and replayed from after a crash or failure, they are sent once without it when unset").
+				Optional()
+	OUTGOING_RETRY_INTERVAL = ferrite.
+				Duration("OUTGOING_RETRY_INTERVAL", "Time between replays of OUTGOING_SPOOL_DIR, failed sends back off from it up to an hour").
+				WithDefault(30 * time.Second).
+				WithMinimum(time.Second).
+				Required()
+	OUTGOING_MAX_ATTEMPTS = ferrite.
+				Unsigned[uint]("OUTGOING_MAX_ATTEMPTS", "Attempts at sending an email or webhook post before it is moved to OUTGOING_SPOOL_DIR/failed").
+				WithDefault(10).
+				WithMinimum(1).
+				Required()
+	SLACK_WEBHOOK_URL = ferrite.
+				URL("SLACK_WEBHOOK_URL", "Slack incoming webhook notified of new leads").
+				Optional()
+	DISCORD_WEBHOOK_URL = ferrite.
+				URL("DISCORD_WEBHOOK_URL", "Discord webhook notified of new leads").
+				Optional()
+	TEAMS_WEBHOOK_URL = ferrite.
+				URL("TEAMS_WEBHOOK_URL", "Microsoft Teams incoming webhook or workflow notified of new leads").
+				Optional()
+	FCM_PROJECT_ID = ferrite.
+			String("FCM_PROJECT_ID", "Firebase project new leads are pushed to registered devices through, with the default Google credentials").
+			Optional()
+	TELEGRAM_BOT_TOKEN = ferrite.
+				String("TELEGRAM_BOT_TOKEN", "Telegram bot token leads are sent to chats with").
+				WithSensitiveContent().
+				Optional()
+	TELEGRAM_CHAT_ID = ferrite.
+				String("TELEGRAM_CHAT_ID", "Numeric ID of the Telegram chat notified of new leads").
+				Optional()
+	TELEGRAM_WEBHOOK_SECRET = ferrite.
+				String("TELEGRAM_WEBHOOK_SECRET", "Secret token the Telegram bot webhook is set with, enables the lead buttons in Telegram messages").
+				WithSensitiveContent().
+				Optional()
+	EXPERIMENTS = ferrite.
+			File("EXPERIMENTS", "JSON file of experiment names mapped to their variants, recorded with leads sending an experiment and variant").
+			Optional()
+	ENQUIRY_TYPES = ferrite.
+			File("ENQUIRY_TYPES", "JSON file of enquiry types mapped to a Postmark template and notification route, replacing general, project, careers and support").
+			Optional()
+	NOTIFICATION_ROUTES = ferrite.
+				File("NOTIFICATION_ROUTES", "JSON file of keyword routes sending notifications to other recipients than the default").
+				Optional()
+	TWILIO_ACCOUNT_SID = ferrite.
+				String("TWILIO_ACCOUNT_SID", "Twilio account SID").
+				Optional()
+	TWILIO_AUTH_TOKEN = ferrite.
+				String("TWILIO_AUTH_TOKEN", "Twilio auth token").
+				WithSensitiveContent().
+				Optional()
+	TWILIO_FROM = ferrite.
+			String("TWILIO_FROM", "Twilio number or messaging service SID SMS are sent from").
+			Optional()
+	WHATSAPP_PROVIDER = ferrite.
+				Enum("WHATSAPP_PROVIDER", "Send WhatsApp confirmations to leads with Twilio or the Meta Cloud API").
+				WithMembers(WHATSAPP_PROVIDER_TWILIO, WHATSAPP_PROVIDER_META).
+				WithDefault(WHATSAPP_PROVIDER_TWILIO).
+				Required()
+	WHATSAPP_TEMPLATE = ferrite.
+				String("WHATSAPP_TEMPLATE", "WhatsApp template confirming a lead, a content SID with Twilio or the template name with Meta").
+				Optional()
+	WHATSAPP_TEMPLATE_LANGUAGE = ferrite.
+					String("WHATSAPP_TEMPLATE_LANGUAGE", "Language code of the WhatsApp template with Meta").
+					WithDefault("en").
+					Required()
+	WHATSAPP_FROM = ferrite.
+			String("WHATSAPP_FROM", "Twilio WhatsApp sender number").
+			Optional()
+	WHATSAPP_PHONE_NUMBER_ID = ferrite.
+					String("WHATSAPP_PHONE_NUMBER_ID", "Meta WhatsApp Business phone number ID").
+					Optional()
+	WHATSAPP_ACCESS_TOKEN = ferrite.
+				String("WHATSAPP_ACCESS_TOKEN", "Meta WhatsApp Cloud API access token").
+				WithSensitiveContent().
+				Optional()
+	TWILIO_VERIFY_SERVICE_SID = ferrite.
+					String("TWILIO_VERIFY_SERVICE_SID", "Twilio Verify service sending the codes for forms that verify mobiles").
+					Optional()
+	SMS_NOTIFICATION_TO = ferrite.
+				String("SMS_NOTIFICATION_TO", "Comma separated numbers sent an SMS for high scoring leads").
+				Optional()
+	SMS_NOTIFICATION_MIN_SCORE = ferrite.
+					Unsigned[uint]("SMS_NOTIFICATION_MIN_SCORE", "Lead score from 0 to 100 at which an SMS is sent").
+					WithDefault(80).
+					Required()
+	BOT_FILTER = ferrite.
+			Enum("BOT_FILTER", "Whether requests scored as automation are only tagged or rejected").
+			WithMembers("off", "tag", "reject").
+			WithDefault("tag").
+			Required()
+	BOT_SCORE_THRESHOLD = ferrite.
+				Unsigned[uint]("BOT_SCORE_THRESHOLD", "Bot score from 0 to 100 at which a request is treated as automation").
+				WithDefault(60).
+				Required()
+	DUPLICATE_WINDOW = ferrite.
+				Duration("DUPLICATE_WINDOW", "Time an identical resubmission returns the original lead instead of creating another, 0 disables").
+				WithDefault(10 * time.Minute).
+				WithMinimum(0).
+				Required()
+	REDIRECT_ALLOWED_HOSTS = ferrite.
+				String("REDIRECT_ALLOWED_HOSTS", "Comma separated hostnames browser form posts may be redirected to after a lead is received").
+				Optional()
+	RECONCILE_INTERVAL = ferrite.
+				Duration("RECONCILE_INTERVAL", "Time between cross-checks of stored attachments against the lead store, 0 disables").
+				WithDefault(24 * time.Hour).
+				WithMinimum(0).
+				Required()
+	RECONCILE_CLEANUP = ferrite.
+				Bool("RECONCILE_CLEANUP", "Remove orphaned attachments and references to missing ones when reconciling instead of only reporting them").
+				WithDefault(false).
+				Required()
+	RETENTION_RULES = ferrite.
+			File("RETENTION_RULES", "JSON file of retention rules deleting attachments, anonymizing leads or purging deleted leads past an age, nothing is removed when unset").
+			Optional()
+	RETENTION_INTERVAL = ferrite.
+				Duration("RETENTION_INTERVAL", "Time between applying the retention rules, 0 disables").
+				WithDefault(24 * time.Hour).
+				WithMinimum(0).
+				Required()
+	RETENTION_DRY_RUN = ferrite.
+				Bool("RETENTION_DRY_RUN", "Only report what the retention rules would do on scheduled runs").
+				WithDefault(false).
+				Required()
+	RETENTION_AUDIT_LOG = ferrite.
+				String("RETENTION_AUDIT_LOG", "File retention actions are appended to as JSON lines").
+				Optional()
+	EMAIL_VERIFICATION = ferrite.
+				Bool("EMAIL_VERIFICATION", "Hold leads until the submitter confirms their email from a verification link").
+				WithDefault(false).
+				Required()
+	EMAIL_VERIFICATION_EXPIRY = ferrite.
+					Duration("EMAIL_VERIFICATION_EXPIRY", "Validity of email verification links").
+					WithDefault(48 * time.Hour).
+					Required()
+	SUPPRESSION_FILE = ferrite.
+				String("SUPPRESSION_FILE", "JSON file unsubscribed addresses are kept in, they are only kept in memory when unset").
+				Optional()
+	PRIVACY_POLICY_VERSION = ferrite.
+				String("PRIVACY_POLICY_VERSION", "Version of the privacy policy recorded with the consent of each lead").
+				Optional()
+	API_KEYS = ferrite.
+			File("API_KEYS", "JSON file of API keys for programmatic submitters, by the SHA-256 of the key with optional scopes, forms and quotas").
+			Optional()
+	API_KEY_STORE_FILE = ferrite.
+				String("API_KEY_STORE_FILE", "JSON file API keys managed from the admin API are kept in with the file lead store").
+				WithDefault("/var/lib/landing/api-keys.json").
+				Required()
+	PUSH_DEVICE_STORE_FILE = ferrite.
+				String("PUSH_DEVICE_STORE_FILE", "JSON file devices registered for push notifications are kept in with the file lead store").
+				WithDefault("/var/lib/landing/push-devices.json").
+				Required()
+	API_KEY_USAGE_FILE = ferrite.
+				String("API_KEY_USAGE_FILE", "JSON file API key usage is kept in, usage is only kept in memory when unset").
+				Optional()
+	FEATURE_FLAG_PROVIDER = ferrite.
+				Enum("FEATURE_FLAG_PROVIDER", "OpenFeature provider flags gating risky behaviour are evaluated with, flags keep their defaults with none").
+				WithMembers("none", "flagd", "launchdarkly").
+				WithDefault("none").
+				Required()
+	FLAGD_URL = ferrite.
+			URL("FLAGD_URL", "Base URL of the flagd OFREP service used by the flagd provider").
+			WithDefault("http://localhost:8016").
+			Required()
+	LAUNCHDARKLY_CLIENT_SIDE_ID = ferrite.
+					String("LAUNCHDARKLY_CLIENT_SIDE_ID", "LaunchDarkly client-side ID used by the launchdarkly provider, flags need to be available to client-side SDKs").
+					Optional()
+	BIGQUERY_TABLE = ferrite.
+			String("BIGQUERY_TABLE", "BigQuery table as project.dataset.table lead events are streamed to for analytics, nothing is streamed when unset").
+			Optional()
+	BIGQUERY_INCLUDE_PII = ferrite.
+				Bool("BIGQUERY_INCLUDE_PII", "Include the email, name and mobile of the lead in rows streamed to BIGQUERY_TABLE").
+				WithDefault(false).
+				Required()
+	EXPORT_BUCKET = ferrite.
+			URL("EXPORT_BUCKET", "gs:// or s3:// bucket and prefix daily lead snapshots are written to under date=YYYY-MM-DD/, nothing is exported when unset").
+			Optional()
+	EXPORT_FORMAT = ferrite.
+			Enum("EXPORT_FORMAT", "Format of the lead snapshots written to EXPORT_BUCKET").
+			WithMembers(EXPORT_FORMAT_NDJSON, EXPORT_FORMAT_PARQUET).
+			WithDefault(EXPORT_FORMAT_NDJSON).
+			Required()
+	EXPORT_INTERVAL = ferrite.
+			Duration("EXPORT_INTERVAL", "Time between lead snapshots written to EXPORT_BUCKET, 0 only exports from the admin API").
+			WithDefault(24 * time.Hour).
+			WithMinimum(0).
+			Required()
+	RUNTIME_CONFIG = ferrite.
+			File("RUNTIME_CONFIG", "JSON file of COUNTRY_RATE_LIMITS, IP_DENY_LIST and ADMIN_ALLOW_LIST overrides that are applied when config is reloaded").
+			Optional()
+	CONFIG_WATCH_INTERVAL = ferrite.
+				Duration("CONFIG_WATCH_INTERVAL", "Time between checking config files for changes to reload, 0 only reloads on SIGHUP").
+				WithDefault(0).
+				WithMinimum(0).
+				Required()
+	INCIDENT_PROVIDER = ferrite.
+				Enum("INCIDENT_PROVIDER", "Open incidents with PagerDuty or Opsgenie when email sends, attachment uploads or CRM syncs keep failing").
+				WithMembers(INCIDENT_PROVIDER_NONE, INCIDENT_PROVIDER_PAGERDUTY, INCIDENT_PROVIDER_OPSGENIE).
+				WithDefault(INCIDENT_PROVIDER_NONE).
+				Required()
+	INCIDENT_THRESHOLD = ferrite.
+				Unsigned[uint]("INCIDENT_THRESHOLD", "Failures of one kind within INCIDENT_WINDOW that open an incident").
+				WithDefault(5).
+				WithMinimum(1).
+				Required()
+	INCIDENT_WINDOW = ferrite.
+			Duration("INCIDENT_WINDOW", "Window failures are counted over, an incident is opened at most once a window for each kind of failure").
+			WithDefault(10 * time.Minute).
+			WithMinimum(time.Minute).
+			Required()
+	PAGERDUTY_ROUTING_KEY = ferrite.
+				String("PAGERDUTY_ROUTING_KEY", "PagerDuty Events API v2 integration key, required by the pagerduty incident provider").
+				WithSensitiveContent().
+				Optional()
+	OPSGENIE_API_KEY = ferrite.
+				String("OPSGENIE_API_KEY", "Opsgenie API integration key, required by the opsgenie incident provider").
+				WithSensitiveContent().
+				Optional()
+	OPSGENIE_API_URL = ferrite.
+				URL("OPSGENIE_API_URL", "Opsgenie API, https://api.eu.opsgenie.com for accounts in the EU").
+				WithDefault("https://api.opsgenie.com").
+				Required()
+	SELF_TEST_INTERVAL = ferrite.
+				Duration("SELF_TEST_INTERVAL", "Time between synthetic leads run through the lead pipeline to check it end to end, 0 disables").
+				WithDefault(0).
+				WithMinimum(0).
+				Required()
+	SELF_TEST_EMAIL = ferrite.
+			String("SELF_TEST_EMAIL", "Email of the synthetic leads run by the self test").
+			WithDefault("self-test@skulpture.xyz").
+			Required()
+	CRM_WEBHOOK_URL = ferrite.
+			URL("CRM_WEBHOOK_URL", "CRM endpoint leads are posted to as JSON by the crm processor and back-syncs, leads are not synced when unset").
+			Optional()
+)
+
+// Creates the router shared by every entrypoint around the handler, the
+// background jobs use the same storage and mailer
+func NewRouter(ctx context.Context, h *Handler) http.Handler {
+	checkMultipartTempDir(ctx)
+	spool = createAttachmentSpool(ctx)
+	suppressions = createSuppressionList(ctx)
+	kmsService = createKmsService(ctx)
+	tusUploads = createTusStore(ctx)
+	leadDrafts = createLeadDraftStore(ctx)
+	recentLeads = createRecentLeadStore(ctx)
+	attachmentStages = createAttachmentStages(ctx)
+	runtimeSettings = loadRuntimeSettings(ctx)
+	loadedConfig.Store(loadConfig(ctx))
+	apiKeys = createApiKeyRegistry(ctx)
+	checkMobileVerification(ctx)
+	checkEmailVerification(ctx)
+	checkCsrfProtection(ctx)
+	geo = createGeoResolver(ctx)
+	leads = createLeadStore(ctx)
+	createNotifiers(ctx)
+	translateService = createTranslateService(ctx)
+	businessHours = loadBusinessHours(ctx)
+	createRuntimeMetrics(ctx)
+	sentryEnabled = createSentry(ctx)
+	createSlaMetrics(ctx)
+	go watchSla(ctx, h)
+	go watchDigest(ctx, h)
+	go watchReconcile(ctx, h)
+	go watchRetention(ctx, h)
+	go watchAttachmentSpool(ctx, h)
+	featureFlags = createFeatureFlags(ctx)
+	processors = createProcessors(ctx, h)
+	go watchConfig(ctx)
+	go watchOutgoing(ctx, h)
+	go watchOutbox(ctx)
+	createSelfTestMetrics(ctx)
+	go watchSelfTest(ctx, h)
+
+	events.subscribe(EVENT_ALL, logEvent)
+	events.subscribe(EVENT_ALL, stats.record)
+	events.subscribe(EVENT_ALL, recordActivity)
+	events.subscribe(EVENT_ALL, adminChannels.broadcast)
+	if analytics = createAnalyticsSink(ctx); analytics != nil {
+		events.subscribe(EVENT_ALL, analytics.record)
+	}
+	if incidents = createIncidentTracker(ctx); incidents != nil {
+		for name := range INCIDENT_FAILURES {
+			events.subscribe(name, incidents.record)
+		}
+	}
+
+	exports = createExportBucket(ctx)
+	go watchExports(ctx)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(otelhttp.NewMiddleware(SERVICE_NAME.Value()))
+	r.Use(spanRouteMiddleware)
+	r.Use(httplog.RequestLogger(httplog.NewLogger(SERVICE_NAME.Value(), httplog.Options{
+		Concise: true,
+		Tags: map[string]string{
+			"env": GO_ENV.Value(),
+		},
+	})))
+	r.Use(middleware.Heartbeat("/ping"))
+	r.Use(realIPMiddleware)
+	ipFilters = createIpFilter(ctx)
+	r.Use(ipFilters.middleware)
+	r.Use(recovererMiddleware)
+	r.Use(multipartCleanupMiddleware)
+	r.Use(middleware.Compress(COMPRESSION_LEVEL))
+	r.Use(decompressMiddleware)
+
+	rateLimiter, err := httplimit.NewMiddleware(h.limiter, ipKeyFunc)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "init", err.Error())
+		panic(err)
+	}
+
+	countryLimits = createCountryRateLimiter(ctx)
+
+	v1 := v1Router(h, rateLimiter.Handle, countryLimits.Handle)
+
+	// Each version is mounted under its own prefix so the next one can be
+	// added alongside, unversioned paths are deprecated aliases of v1
+	r.Mount(API_V1_PREFIX, v1)
+
+	legacy := deprecatedMiddleware(API_V1_PREFIX)(v1)
+	for _, prefix := range LEGACY_PATH_PREFIXES {
+		r.Handle(prefix, legacy)
+		r.Handle(prefix+"/*", legacy)
+	}
+
+	r.Get("/status", statusHandler)
+	r.Get("/ready", readyHandler)
+
+	if token, ok := METRICS_TOKEN.Value(); ok {
+		r.With(bearerAuthMiddleware(token, "metrics")).Handle("/metrics", metricsHandler())
+	}
+
+	if token, ok := DEBUG_TOKEN.Value(); ok {
+		r.Mount(DEBUG_PATH_PREFIX, debugRouter(token))
+	}
+
+	if STATIC_SITE.Value() {
+		r.Get("/*", staticHandler())
+	}
+
+	return r
+}
+
+func (h *Handler) leadHandler(w http.ResponseWriter, r *http.Request) {
+	token := progressToken(r)
+
+	if err := parseLeadForm(r); err != nil {
+		leadError(w, r, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	form, formRules, ok := requestForm(r)
+	if !ok {
+		leadError(w, r, "Unknown form", http.StatusBadRequest)
+
+		return
+	}
+
+	values := map[string]string{}
+	for _, name := range formRules.names() {
+		values[name] = r.FormValue(name)
+	}
+
+	body := newLead(form, values)
+	body.BotScore = requestBotScore(r.Context())
+	body.IP = r.RemoteAddr
+	body.Attribution = requestAttribution(r)
+	body.Experiment = requestExperiment(r)
+	body.MobileVerifiedAt = requestMobileVerification(r, body.Mobile)
+	body.Synthetic = isSelfTest(r.Context())
+
+	slog.DebugContext(r.Context(), "begin", "enquiry", fmt.Sprintf("%+v", body))
+
+	if err := runProcessors(r.Context(), PROCESSOR_STAGE_VALIDATE, body); err != nil {
+		slog.ErrorContext(r.Context(), "error", "enquiry", body, "reason", err.Error())
+		leadError(w, r, err.Error(), rejectionStatus(err))
+
+		return
+	}
+
+	redirectUrl, err := leadRedirect(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "redirect url", err.Error(), "email", body.Email)
+		leadError(w, r, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	fingerprint := leadFingerprint(body)
+	if original, ok := recentLeads.claim(fingerprint, body.ID); !ok {
+		slog.InfoContext(r.Context(), "duplicate", "lead", original, "email", body.Email)
+		leadSuccess(w, r, original, redirectUrl)
+
+		return
+	}
+
+	// Undone in the background so the failure response isn't held up
+	undo := &compensations{}
+	accepted := false
+	defer func() {
+		if !accepted {
+			recentLeads.release(fingerprint, body.ID)
+			go undo.run(context.WithoutCancel(r.Context()))
+		}
+	}()
+
+	files := append([]attachment{}, multipartFiles(r)["files"]...)
+	uploaded := []uploadedAttachment{}
+
+	uploads := r.PostForm["uploads"]
+	for _, reference := range uploads {
+		file, err := tusUploads.attachment(tusUploadID(reference))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error", "tus attachment", err.Error(), "upload", reference)
+			leadError(w, r, tusUploadError(reference, err), http.StatusBadRequest)
+
+			return
+		}
+
+		files = append(files, file)
+	}
+
+	if errs := validateAttachments(files); len(errs) > 0 {
+		slog.ErrorContext(r.Context(), "error", "attachments", strings.Join(errs, "\n"), "email", body.Email)
+		leadError(w, r, fmt.Sprintf("Invalid attachments:\n%s", strings.Join(errs, "\n")), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	files, err = processAttachments(r.Context(), files)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "process attachments", err.Error(), "email", body.Email)
+		leadError(w, r, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	if len(files) > 0 {
+		// Storage being down only fails the submission without a spool
+		degraded := false
+		if err := h.storage.stats(r.Context()); err != nil {
+			slog.ErrorContext(r.Context(), "error", "storage stats", err.Error())
+			if spool == nil {
+				leadError(w, r, errUploadFailed.Error(), http.StatusInternalServerError)
+
+				return
+			}
+
+			degraded = true
+		}
+
+		uploadedFiles := make(chan uploadedAttachment)
+		spooledFiles := make(chan leadPendingAttachment, len(files))
+		failedToUpload := make(chan int, len(files))
+
+		// The first upload to fail cancels the rest, files that made it are
+		// removed again by the compensations
+		uploadCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		spoolFile := func(fileHeader attachment, hash string, metadata *attachmentMetadata) bool {
+			if spool == nil {
+				return false
+			}
+
+			pending, err := spoolAttachment(uploadCtx, body, fileHeader, hash, metadata)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error", "spool", err.Error(), "file", fileHeader.filename, "email", body.Email)
+
+				return false
+			}
+
+			slog.WarnContext(r.Context(), "spooled", "upload", fileHeader.filename, "spooled", pending.ID)
+
+			undo.add("spool "+pending.ID, func(ctx context.Context) error {
+				return spool.remove(ctx, pending.ID)
+			})
+
+			spooledFiles <- *pending
+			return true
+		}
+
+		uploadFile := func(fileHeader attachment, idx int) {
+			select {
+			case <-uploadCtx.Done():
+				return
+			default:
+			}
+
+			slog.DebugContext(r.Context(), "begin", "upload", fileHeader.filename, "size", fileHeader.size)
+
+			// A stalled upload times out on its own and falls back to the
+			// spool, rather than holding the request until the platform
+			// kills it
+			fileCtx, cancelFile := context.WithTimeout(uploadCtx, uploadTimeout(fileHeader.size))
+			defer cancelFile()
+
+			hash, err := hashAttachment(fileHeader)
+			if err != nil {
+				failedToUpload <- idx
+				slog.ErrorContext(r.Context(), "error", "hash file", err.Error(), "file", fileHeader.filename, "email", body.Email)
+
+				cancel()
+				return
+			}
+
+			metadata := readAttachmentMetadata(r.Context(), fileHeader, hash)
+
+			if degraded {
+				if !spoolFile(fileHeader, hash, metadata) {
+					failedToUpload <- idx
+					cancel()
+				}
+
+				return
+			}
+
+			existing, err := h.storage.findDuplicate(fileCtx, body.Email, hash)
+			if err != nil {
+				if uploadCtx.Err() != nil {
+					return
+				}
+
+				slog.ErrorContext(r.Context(), "error", "find duplicate", err.Error(), "email", body.Email)
+				if spoolFile(fileHeader, hash, metadata) {
+					return
+				}
+
+				failedToUpload <- idx
+
+				cancel()
+				return
+			}
+
+			if existing != nil {
+				slog.DebugContext(r.Context(), "duplicate", "upload", fileHeader.filename, "existing", existing.id, "sha256", hash)
+
+				uploadedFiles <- uploadedAttachment{file: *existing, metadata: metadata}
+				return
+			}
+
+			file, err := fileHeader.open()
+			if err != nil {
+
+				failedToUpload <- idx
+				slog.ErrorContext(r.Context(), "error", "open file", fileHeader.filename, "email", body.Email)
+
+				cancel()
+				return
+			}
+			defer file.Close()
+
+			storageFile := storedFile{
+				name: fileHeader.filename,
+				properties: map[string]string{
+					"lead":      body.ID,
+					"email":     body.Email,
+					"firstName": body.FirstName,
+					"lastName":  body.LastName,
+					"mobile":    body.Mobile,
+					"sha256":    hash,
+				},
+			}
+
+			var media io.Reader = file
+			checksum := hash
+			if isEncryptionEnabled() {
+				media, err = encryptAttachment(fileCtx, file)
+				if err != nil {
+					failedToUpload <- idx
+					slog.ErrorContext(r.Context(), "error", "encrypt", err.Error(), "email", body.Email)
+					events.publish(r.Context(), EVENT_ATTACHMENT_FAILED, body.ID, map[string]any{
+						"filename": fileHeader.filename,
+						"error":    err.Error(),
+					})
+
+					cancel()
+					return
+				}
+
+				storageFile.mimeType = "application/octet-stream"
+				storageFile.properties["encrypted"] = "true"
+
+				// Storage only sees ciphertext for encrypted attachments
+				checksum = ""
+			}
+
+			if token != "" {
+				media = storeProgress(token, media, idx, fileHeader)
+			}
+
+			res, err := h.storage.create(fileCtx, storageFile, media, checksum)
+			if err != nil {
+				// Cancelled by another file failing, which was already counted
+				if uploadCtx.Err() != nil {
+					return
+				}
+
+				if errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+					err = fmt.Errorf("upload of %d bytes timed out after %s: %w", fileHeader.size, uploadTimeout(fileHeader.size), err)
+				}
+
+				slog.ErrorContext(r.Context(), "error", "upload", err.Error(), "email", body.Email)
+				if spoolFile(fileHeader, hash, metadata) {
+					return
+				}
+
+				failedToUpload <- idx
+				events.publish(r.Context(), EVENT_ATTACHMENT_FAILED, body.ID, map[string]any{
+					"filename": fileHeader.filename,
+					"error":    err.Error(),
+				})
+
+				cancel()
+				return
+			}
+
+			slog.DebugContext(r.Context(), "end", "upload", fileHeader.filename, "file", res.id)
+
+			// Files reused from a previous lead or stored first by another
+			// submission are not registered, they are not ours to remove
+			if !res.existing {
+				undo.add("upload "+res.id, func(ctx context.Context) error {
+					err := h.storage.remove(ctx, res.id)
+					// Nothing left to undo, but a file that disappeared after
+					// its upload is worth knowing about
+					if errors.Is(err, errStoredFileNotFound) {
+						slog.WarnContext(ctx, "file not found", "compensation", "upload", "file", res.id, "lead", body.ID)
+
+						return nil
+					}
+
+					return err
+				})
+			}
+
+			uploadedFiles <- uploadedAttachment{file: *res, metadata: metadata, size: fileHeader.size, sha256: hash}
+		}
+		go func() {
+			runUploads(len(files), func(idx int) {
+				uploadFile(files[idx], idx)
+			})
+			close(uploadedFiles)
+			close(spooledFiles)
+			close(failedToUpload)
+		}()
+
+		for file := range uploadedFiles {
+			uploaded = append(uploaded, file)
+		}
+
+		// Uploads also stop without a failure when the request goes away, the
+		// lead would otherwise be saved without some of its files
+		if len(failedToUpload) > 0 || uploadCtx.Err() != nil {
+			leadError(w, r, errUploadFailed.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		attachedFiles := []string{}
+		for _, upload := range uploaded {
+			attachedFiles = append(attachedFiles, fmt.Sprintf("- %s", attachmentReference(upload.file.id, upload.file.name)))
+			body.Attachments = append(body.Attachments, leadAttachment{ID: upload.file.id, Name: upload.file.name, Metadata: upload.metadata})
+		}
+		if len(attachedFiles) > 0 {
+			body.Enquiry = string(fmt.Appendf([]byte(body.Enquiry), "\nAttached files:\n%s", strings.Join(attachedFiles, "\n")))
+		}
+
+		pendingFiles := []string{}
+		for pending := range spooledFiles {
+			pendingFiles = append(pendingFiles, fmt.Sprintf("- %s", pending.Name))
+			body.PendingAttachments = append(body.PendingAttachments, pending)
+		}
+		if len(pendingFiles) > 0 {
+			body.Enquiry = string(fmt.Appendf([]byte(body.Enquiry), "\nAttachments pending upload:\n%s", strings.Join(pendingFiles, "\n")))
+		}
+
+		for _, reference := range uploads {
+			if err := tusUploads.remove(tusUploadID(reference)); err != nil {
+				slog.ErrorContext(r.Context(), "error", "tus remove", err.Error(), "upload", reference)
+			}
+		}
+	}
+
+	slog.DebugContext(r.Context(), "processed", "enquiry", fmt.Sprintf("%+v", body))
+
+	runProcessors(r.Context(), PROCESSOR_STAGE_ENRICH, body)
+
+	if EMAIL_VERIFICATION.Value() && body.Status == LEAD_STATUS_NEW && !body.Synthetic {
+		body.Status = LEAD_STATUS_UNVERIFIED
+	}
+
+	if body.Status != LEAD_STATUS_UNVERIFIED {
+		queueDelivery(body)
+	}
+
+	// Delivery is only queued in the saved lead, a lead that can't be saved is
+	// turned away and its files removed rather than sent without a record
+	if err := leads.save(r.Context(), body); err != nil {
+		slog.ErrorContext(r.Context(), "error", "save lead", err.Error(), "lead", body.ID)
+		leadError(w, r, errSaveFailed.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// Published once the lead is saved so the timeline can record them
+	for _, upload := range uploaded {
+		events.publish(r.Context(), EVENT_ATTACHMENT_UPLOADED, body.ID, map[string]any{
+			"file":     upload.file.id,
+			"filename": upload.file.name,
+			"size":     upload.size,
+			"sha256":   upload.sha256,
+		})
+	}
+	for _, pending := range body.PendingAttachments {
+		events.publish(r.Context(), EVENT_ATTACHMENT_SPOOLED, body.ID, pending)
+	}
+
+	// Subscribers run alongside delivery, which keeps changing the lead, so
+	// they are given a copy of it as it was received
+	var snapshot any
+	if copied, err := copyLead(body); err != nil {
+		slog.ErrorContext(r.Context(), "error", "copy lead", err.Error(), "lead", body.ID)
+	} else {
+		snapshot = copied
+	}
+	events.publish(r.Context(), EVENT_LEAD_RECEIVED, body.ID, snapshot)
+
+	unverified := body.Status == LEAD_STATUS_UNVERIFIED
+
+	// The lead is saved so it isn't lost if delivery doesn't finish
+	if featureEnabled(r.Context(), FLAG_ASYNC_DELIVERY, body) {
+		go deliverLead(context.WithoutCancel(r.Context()), h.outgoing, body)
+	} else {
+		deliverLead(r.Context(), h.outgoing, body)
+	}
+
+	accepted = true
+	if unverified && isBrowserForm(r) && redirectUrl == "" {
+		w.Header().Set(LEAD_ID_HEADER, body.ID)
+		renderResult(w, r, http.StatusOK, "Check your email", "We have sent you a link to confirm your enquiry.", false)
+
+		return
+	}
+
+	leadSuccess(w, r, body.ID, redirectUrl)
+}
+
+var errUploadFailed = errors.New("Failed to upload")
+var errSaveFailed = errors.New("Failed to save")
+
+// Submissions without files don't need to be multipart, parsing is a no-op
+// when the form has already been read
+func parseLeadForm(r *http.Request) error {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		return parseMultipartForm(r)
+	}
+	if contentType == PROTOBUF_CONTENT_TYPE {
+		return parseProtobufForm(r)
+	}
+
+	return r.ParseForm()
+}
+
+func createGoogleDriveService(ctx context.Context) (*drive.Service, error) {
+	// Authenticate using client default credentials
+	// see: https://cloud.google.com/docs/authentication/client-libraries
+	// Note: Service Account Token Creator IAM role must be granted to the service account
+	client, err := googleTransportOption(ctx, tunedTransport(DRIVE_MAX_CONNS_PER_HOST.Value()), []string{drive.DriveScope})
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := drive.NewService(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "create google drive service")
+
+	return service, nil
+}
+
+func createPostmarkClient(ctx context.Context) *postmark.Client {
+	client := postmark.NewClient(POSTMARK_SERVER_TOKEN.Value(), POSTMARK_ACCOUNT_TOKEN.Value())
+	client.HTTPClient = &http.Client{
+		Timeout:   POSTMARK_TIMEOUT.Value(),
+		Transport: tracedTransport(tunedTransport(POSTMARK_MAX_CONNS_PER_HOST.Value())),
+	}
+
+	slog.DebugContext(ctx, "created postmark client")
+
+	return client
+}
+
+var telemetry = newDependency("opentelemetry", createOtel)
+
+// Leads are still taken while telemetry can't be set up, logs go to stderr
+// until it is
+func InitOtel(ctx context.Context) func(context.Context) error {
+	telemetry.start(ctx)
+
+	return func(ctx context.Context) error {
+		shutdown, err := telemetry.get()
+		if err != nil {
+			return nil
+		}
+
+		return shutdown(ctx)
+	}
+}
+
+func createOtel(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptrace.New(
+		ctx,
+		otlptracehttp.NewClient(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exporter: %w", err)
+	}
+
+	resources, err := resource.New(
+		ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", SERVICE_NAME.Value()),
+			attribute.String("library.language", "go"),
+		),
+	)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("could not set resources: %w", err), exporter.Shutdown(ctx))
+	}
+
+	enableExemplars()
+	meterProvider, err := createMeterProvider(resources)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to create meter provider: %w", err), exporter.Shutdown(ctx))
+	}
+	otel.SetMeterProvider(meterProvider)
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	spanMetrics, err := createSpanMetricsProcessor()
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to create span metrics: %w", err), exporter.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}
+
+	otel.SetTracerProvider(
+		sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.AlwaysSample()),
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithSpanProcessor(spanMetrics),
+			sdktrace.WithResource(resources),
+		),
+	)
+
+	logExporter, _ := otlplogs.NewExporter(ctx, otlplogs.WithClient(otlplogshttp.NewClient()))
+	loggerProvider := sdklog.NewLoggerProvider(
+		sdklog.WithBatcher(logExporter),
+		sdklog.WithResource(resources),
+	)
+
+	otelLogger := slog.New(otelslog.NewOtelHandler(loggerProvider, &otelslog.HandlerOptions{
+		Level: LOG_LEVEL.Value(),
+	}))
+	slog.SetDefault(otelLogger)
+
+	return func(ctx context.Context) error {
+		loggerErr := loggerProvider.Shutdown((ctx))
+		exporterErr := exporter.Shutdown(ctx)
+		meterErr := meterProvider.Shutdown(ctx)
+
+		return errors.Join(loggerErr, exporterErr, meterErr)
+	}, nil
+}
@@ -0,0 +1,151 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Small instances get through a submission faster one file at a time, larger
+// ones such as Cloud Run benefit from uploading them in parallel
+const UPLOAD_STRATEGY_SEQUENTIAL = "sequential"
+const UPLOAD_STRATEGY_CONCURRENT = "concurrent"
+
+type attachment struct {
+	filename string
+	size     int64
+	open     func() (io.ReadCloser, error)
+}
+
+func hashAttachment(file attachment) (string, error) {
+	reader, err := file.open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// The time a file of the size is given to reach storage at UPLOAD_MIN_RATE
+func uploadTimeout(size int64) time.Duration {
+	rate := UPLOAD_MIN_RATE.Value()
+
+	return UPLOAD_MIN_TIMEOUT.Value() + time.Duration(uint64(size)/rate)*time.Second
+}
+
+// Calls upload for each of count files as UPLOAD_STRATEGY says, returning
+// once every call has
+func runUploads(count int, upload func(idx int)) {
+	workers := count
+	if UPLOAD_STRATEGY.Value() == UPLOAD_STRATEGY_SEQUENTIAL {
+		workers = 1
+	} else if limit := int(UPLOAD_WORKERS.Value()); limit > 0 {
+		workers = min(workers, limit)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for idx := range indexes {
+				upload(idx)
+			}
+		}()
+	}
+
+	for idx := range count {
+		indexes <- idx
+	}
+	close(indexes)
+
+	wg.Wait()
+}
+
+// Checked before anything is sent to storage
+func validateAttachments(files []attachment) []string {
+	errs := []string{}
+
+	if maxAttachments := MAX_ATTACHMENTS.Value(); uint(len(files)) > maxAttachments {
+		errs = append(errs, fmt.Sprintf("- Too many files: %d attached, at most %d allowed", len(files), maxAttachments))
+	}
+
+	maxFilenameLength := MAX_FILENAME_LENGTH.Value()
+	for _, file := range files {
+		if file.size == 0 {
+			errs = append(errs, fmt.Sprintf("- File '%s' is empty", file.filename))
+		}
+
+		if !isAcceptedAttachment(file.filename) {
+			errs = append(errs, fmt.Sprintf("- File '%s' is not an accepted type", file.filename))
+		}
+
+		if uint(utf8.RuneCountInString(file.filename)) > maxFilenameLength {
+			// MAX_FILENAME_LENGTH can be set below the length shown
+			runes := []rune(file.filename)
+			errs = append(errs, fmt.Sprintf("- File name '%s...' is longer than %d characters", string(runes[:min(32, len(runes))]), maxFilenameLength))
+		}
+	}
+
+	return errs
+}
+
+func acceptedAttachmentTypes() []string {
+	configured, ok := ATTACHMENT_TYPES.Value()
+	if !ok {
+		return []string{}
+	}
+
+	accepted := []string{}
+	for _, t := range strings.Split(configured, ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			accepted = append(accepted, t)
+		}
+	}
+
+	return accepted
+}
+
+// Types are matched on the file extension, either directly or through the
+// MIME type it maps to
+func isAcceptedAttachment(filename string) bool {
+	accepted := acceptedAttachmentTypes()
+	if len(accepted) == 0 {
+		return true
+	}
+
+	extension := strings.ToLower(filepath.Ext(filename))
+	mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(extension))
+
+	for _, t := range accepted {
+		switch {
+		case strings.HasPrefix(t, "."):
+			if t == extension {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if mediaType != "" && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case t == mediaType:
+			return true
+		}
+	}
+
+	return false
+}
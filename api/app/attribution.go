@@ -0,0 +1,207 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Campaign parameters are sent as hidden form fields, copied from the query
+// string of the page the form is on, or taken from the Referer
+var ATTRIBUTION_FIELDS = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "referrer", "landingPage"}
+
+const ATTRIBUTION_FIELD_MAX_LENGTH = 500
+
+type leadAttribution struct {
+	Source      string `json:"source,omitempty"`
+	Medium      string `json:"medium,omitempty"`
+	Campaign    string `json:"campaign,omitempty"`
+	Term        string `json:"term,omitempty"`
+	Content     string `json:"content,omitempty"`
+	Referrer    string `json:"referrer,omitempty"`
+	LandingPage string `json:"landingPage,omitempty"`
+}
+
+func requestAttribution(r *http.Request) *leadAttribution {
+	values := map[string]string{}
+	for _, name := range ATTRIBUTION_FIELDS {
+		values[name] = truncate(strings.TrimSpace(r.PostFormValue(name)), ATTRIBUTION_FIELD_MAX_LENGTH)
+	}
+
+	// A form posted from the landing page itself carries the campaign in
+	// the Referer
+	if referer, err := url.Parse(r.Referer()); err == nil && r.Referer() != "" {
+		if values["landingPage"] == "" {
+			values["landingPage"] = truncate(referer.String(), ATTRIBUTION_FIELD_MAX_LENGTH)
+		}
+
+		for _, name := range ATTRIBUTION_FIELDS {
+			if values[name] == "" && strings.HasPrefix(name, "utm_") {
+				values[name] = truncate(referer.Query().Get(name), ATTRIBUTION_FIELD_MAX_LENGTH)
+			}
+		}
+	}
+
+	attribution := &leadAttribution{
+		Source:      strings.ToLower(values["utm_source"]),
+		Medium:      strings.ToLower(values["utm_medium"]),
+		Campaign:    values["utm_campaign"],
+		Term:        values["utm_term"],
+		Content:     values["utm_content"],
+		Referrer:    values["referrer"],
+		LandingPage: values["landingPage"],
+	}
+
+	if *attribution == (leadAttribution{}) {
+		return nil
+	}
+
+	return attribution
+}
+
+func truncate(value string, length int) string {
+	runes := []rune(value)
+	if len(runes) <= length {
+		return value
+	}
+
+	return string(runes[:length])
+}
+
+type attributionRollup struct {
+	Source         string         `json:"source"`
+	Medium         string         `json:"medium"`
+	Campaign       string         `json:"campaign"`
+	Leads          int            `json:"leads"`
+	Statuses       map[string]int `json:"statuses"`
+	Won            int            `json:"won"`
+	ConversionRate float64        `json:"conversionRate"`
+}
+
+// Rolls up leads by campaign, source and medium, leads without campaign
+// parameters are grouped by the host they were referred from
+func adminAttributionHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	until := time.Now()
+	if value := query.Get("until"); value != "" {
+		parsed, err := parseDate(value)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid until, expected YYYY-MM-DD or RFC 3339")
+
+			return
+		}
+
+		until = parsed
+	}
+
+	from := until.Add(-30 * 24 * time.Hour)
+	if value := query.Get("from"); value != "" {
+		parsed, err := parseDate(value)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid from, expected YYYY-MM-DD or RFC 3339")
+
+			return
+		}
+
+		from = parsed
+	}
+
+	groupBy := map[string]bool{"source": true, "medium": true, "campaign": true}
+	if value := query.Get("groupBy"); value != "" {
+		groupBy = map[string]bool{}
+		for _, dimension := range strings.Split(value, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if dimension != "source" && dimension != "medium" && dimension != "campaign" {
+				writeProblem(w, r, http.StatusBadRequest, "Invalid groupBy, expected source, medium and/or campaign")
+
+				return
+			}
+
+			groupBy[dimension] = true
+		}
+	}
+
+	stored, err := leads.list(r.Context(), leadFilter{})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	type attributionKey struct{ Source, Medium, Campaign string }
+
+	rollups := map[attributionKey]*attributionRollup{}
+	for _, l := range stored {
+		if l.CreatedAt.Before(from) || !l.CreatedAt.Before(until) {
+			continue
+		}
+
+		key := attributionKey{Source: "(direct)", Medium: "(none)", Campaign: "(none)"}
+		if a := l.Attribution; a != nil {
+			if a.Source != "" {
+				key.Source = a.Source
+			} else if referrer, err := url.Parse(a.Referrer); err == nil && referrer.Host != "" {
+				key.Source = referrer.Host
+				key.Medium = "referral"
+			}
+			if a.Medium != "" {
+				key.Medium = a.Medium
+			}
+			if a.Campaign != "" {
+				key.Campaign = a.Campaign
+			}
+		}
+
+		if !groupBy["source"] {
+			key.Source = ""
+		}
+		if !groupBy["medium"] {
+			key.Medium = ""
+		}
+		if !groupBy["campaign"] {
+			key.Campaign = ""
+		}
+
+		rollup, ok := rollups[key]
+		if !ok {
+			rollup = &attributionRollup{Source: key.Source, Medium: key.Medium, Campaign: key.Campaign, Statuses: map[string]int{}}
+			rollups[key] = rollup
+		}
+
+		rollup.Leads++
+		rollup.Statuses[l.Status]++
+		if l.Status == LEAD_STATUS_WON {
+			rollup.Won++
+		}
+	}
+
+	rows := []*attributionRollup{}
+	for _, rollup := range rollups {
+		rollup.ConversionRate = rate(rollup.Won, rollup.Leads)
+		rows = append(rows, rollup)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Leads != rows[j].Leads {
+			return rows[i].Leads > rows[j].Leads
+		}
+
+		return rows[i].Source+rows[i].Medium+rows[i].Campaign < rows[j].Source+rows[j].Medium+rows[j].Campaign
+	})
+
+	writeResponse(w, r, http.StatusOK, map[string]any{
+		"from":    from,
+		"until":   until,
+		"rollups": rows,
+	})
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Submissions and upload chunks are counted while they are handled, and new
+// ones are turned away with Retry-After once UPLOAD_MAX_IN_FLIGHT or
+// UPLOAD_MAX_IN_FLIGHT_BYTES is reached, so a burst of large uploads is shed
+// rather than running the instance out of memory
+var uploadsInFlight = struct {
+	sync.Mutex
+	count uint
+	bytes uint64
+}{}
+
+// Requests without a length are counted at the most they can send
+func uploadSize(r *http.Request) uint64 {
+	if r.ContentLength < 0 {
+		return MAX_REQUEST_SIZE
+	}
+
+	return uint64(r.ContentLength)
+}
+
+func acquireUpload(size uint64) bool {
+	uploadsInFlight.Lock()
+	defer uploadsInFlight.Unlock()
+
+	maxCount := UPLOAD_MAX_IN_FLIGHT.Value()
+	maxBytes := UPLOAD_MAX_IN_FLIGHT_BYTES.Value()
+
+	// One request is always let through, so a single upload over the byte
+	// limit isn't turned away forever
+	if uploadsInFlight.count > 0 {
+		if maxCount != 0 && uploadsInFlight.count >= maxCount {
+			return false
+		}
+		if maxBytes != 0 && uploadsInFlight.bytes+size > maxBytes {
+			return false
+		}
+	}
+
+	uploadsInFlight.count++
+	uploadsInFlight.bytes += size
+
+	return true
+}
+
+func releaseUpload(size uint64) {
+	uploadsInFlight.Lock()
+	defer uploadsInFlight.Unlock()
+
+	uploadsInFlight.count--
+	uploadsInFlight.bytes -= size
+}
+
+func uploadBackpressureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		size := uploadSize(r)
+		if !acquireUpload(size) {
+			slog.WarnContext(r.Context(), "shed upload", "size", size, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(UPLOAD_RETRY_AFTER.Value().Seconds())))
+			writeProblem(w, r, http.StatusServiceUnavailable, "Too many uploads in progress, try again shortly")
+
+			return
+		}
+		defer releaseUpload(size)
+
+		next.ServeHTTP(w, r)
+	})
+}
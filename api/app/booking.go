@@ -0,0 +1,236 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+const EVENT_CONSULTATION_BOOKED = "consultation.booked"
+
+const CONSULTATION_TIME_FORMAT = "Monday 2 January 3:04 PM MST"
+
+// Booking again moves the same event, calendars match it by UID and take the
+// highest sequence
+type leadConsultation struct {
+	UID      string    `json:"uid"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Location string    `json:"location,omitempty"`
+	Notes    string    `json:"notes,omitempty"`
+	Sequence int       `json:"sequence"`
+}
+
+func (h *Handler) adminBookConsultationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Start    time.Time `json:"start"`
+		Duration string    `json:"duration"`
+		Location string    `json:"location"`
+		Notes    string    `json:"notes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	if req.Start.IsZero() {
+		writeProblem(w, r, http.StatusBadRequest, "Missing start")
+
+		return
+	}
+
+	duration := CONSULTATION_DURATION.Value()
+	if req.Duration != "" {
+		parsed, err := time.ParseDuration(req.Duration)
+		if err != nil || parsed <= 0 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid duration")
+
+			return
+		}
+
+		duration = parsed
+	}
+
+	l, err := leads.update(r.Context(), chi.URLParam(r, "id"), func(l *lead) error {
+		consultation := &leadConsultation{UID: uuid.NewString() + "@skulpture.xyz"}
+		if l.Consultation != nil {
+			consultation.UID = l.Consultation.UID
+			consultation.Sequence = l.Consultation.Sequence + 1
+		}
+
+		consultation.Start = req.Start.UTC()
+		consultation.End = req.Start.Add(duration).UTC()
+		consultation.Location = req.Location
+		consultation.Notes = req.Notes
+		l.Consultation = consultation
+
+		return nil
+	})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	events.publish(r.Context(), EVENT_CONSULTATION_BOOKED, l.ID, map[string]any{
+		"start":    l.Consultation.Start,
+		"end":      l.Consultation.End,
+		"sequence": l.Consultation.Sequence,
+	})
+
+	if err := sendConsultationConfirmation(r.Context(), h.outgoing, l); err != nil {
+		slog.ErrorContext(r.Context(), "error", "consultation confirmation", err.Error(), "lead", l.ID)
+		writeProblem(w, r, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, l)
+}
+
+func sendConsultationConfirmation(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	c := l.Consultation
+	model := map[string]interface{}{
+		"firstName":      l.FirstName,
+		"start":          c.Start.In(businessHours.location).Format(CONSULTATION_TIME_FORMAT),
+		"end":            c.End.In(businessHours.location).Format(CONSULTATION_TIME_FORMAT),
+		"location":       c.Location,
+		"notes":          c.Notes,
+		"rescheduled":    c.Sequence > 0,
+		"unsubscribeUrl": unsubscribeUrl(l.Email),
+	}
+
+	invite := emailAttachment{
+		Name:        "invite.ics",
+		ContentType: "text/calendar; charset=utf-8; method=REQUEST",
+		Content:     consultationInvite(l),
+	}
+
+	if template, ok := POSTMARK_TEMPLATE_CONSULTATION.Value(); ok && MAILER.Value() == MAILER_POSTMARK {
+		if suppressions.contains(l.Email) {
+			return errEmailSuppressed
+		}
+
+		id, err := sendTemplatedEmail(ctx, outgoing, templatedEmail{
+			TemplateID:    int64(template),
+			From:          POSTMARK_FROM.Value(),
+			To:            l.Email,
+			TrackOpens:    true,
+			TemplateModel: model,
+			Attachments:   postmarkAttachments([]emailAttachment{invite}),
+			Headers:       postmarkHeaders(unsubscribeHeaders(l.Email)),
+		})
+		if err != nil {
+			return err
+		}
+
+		slog.DebugContext(ctx, "sent", "postmark message id", id, "to", l.Email, "lead", l.ID)
+
+		return nil
+	}
+
+	message, err := renderEmail("consultation", model)
+	if err != nil {
+		return err
+	}
+
+	message.From = POSTMARK_FROM.Value()
+	message.To = l.Email
+	message.Tag = "consultation"
+	message.Metadata = map[string]string{"lead": l.ID}
+	message.Attachments = []emailAttachment{invite}
+	message.Headers = unsubscribeHeaders(l.Email)
+
+	_, err = sendEmail(ctx, outgoing, message)
+
+	return err
+}
+
+// RFC 5545 invite for the consultation, sent as a request so calendars offer
+// to accept it
+// see: https://www.rfc-editor.org/rfc/rfc5545
+func consultationInvite(l *lead) []byte {
+	c := l.Consultation
+	organizer := POSTMARK_FROM.Value()
+	if address, err := mail.ParseAddress(organizer); err == nil {
+		organizer = address.Address
+	}
+
+	description := "Consultation with Skulpture"
+	if c.Notes != "" {
+		description += "\n\n" + c.Notes
+	}
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Skulpture//Landing//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:" + c.UID,
+		"SEQUENCE:" + fmt.Sprint(c.Sequence),
+		"DTSTAMP:" + icsTime(time.Now()),
+		"DTSTART:" + icsTime(c.Start),
+		"DTEND:" + icsTime(c.End),
+		"SUMMARY:" + icsEscape("Consultation with Skulpture"),
+		"DESCRIPTION:" + icsEscape(description),
+		"ORGANIZER;CN=Skulpture:mailto:" + organizer,
+		fmt.Sprintf("ATTENDEE;CN=%s;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:%s", icsParam(l.name()), l.Email),
+		"STATUS:CONFIRMED",
+	}
+	if c.Location != "" {
+		lines = append(lines, "LOCATION:"+icsEscape(c.Location))
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+
+	var ics bytes.Buffer
+	for _, line := range lines {
+		ics.WriteString(icsFold(line))
+		ics.WriteString("\r\n")
+	}
+
+	return ics.Bytes()
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func icsEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// Parameter values are quoted and cannot contain quotes
+func icsParam(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, "'") + `"`
+}
+
+// Lines longer than 75 octets continue on the next line after a space,
+// without splitting a UTF-8 sequence
+func icsFold(line string) string {
+	var folded strings.Builder
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > 75 {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+
+		folded.WriteRune(r)
+		length += size
+	}
+
+	return folded.String()
+}
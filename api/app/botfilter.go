@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Scores how likely a request is to come from automation, only obvious
+// automation is rejected, everything else is passed on with its score so the
+// lead can be tagged
+const BOT_SCORE_MAX = 100
+
+type botScoreKey struct{}
+
+var botUserAgents = regexp.MustCompile(`(?i)(bot|crawl|spider|slurp|scrape|headless|phantomjs|selenium|puppeteer|playwright|curl|wget|python-requests|python-urllib|aiohttp|httpx|go-http-client|java/|okhttp|libwww|scrapy|httpclient|postman|insomnia)`)
+
+type botSignal struct {
+	name  string
+	score int
+	match func(r *http.Request) bool
+}
+
+var botSignals = []botSignal{
+	{"user agent", 60, func(r *http.Request) bool { return botUserAgents.MatchString(r.UserAgent()) }},
+	{"no user agent", 60, func(r *http.Request) bool { return strings.TrimSpace(r.UserAgent()) == "" }},
+	{"no accept", 15, func(r *http.Request) bool { return r.Header.Get("Accept") == "" }},
+	{"no accept language", 20, func(r *http.Request) bool { return r.Header.Get("Accept-Language") == "" }},
+	{"no accept encoding", 10, func(r *http.Request) bool { return r.Header.Get("Accept-Encoding") == "" }},
+	// Sent by every current browser on navigations and fetches
+	{"no fetch metadata", 15, func(r *http.Request) bool { return r.Header.Get("Sec-Fetch-Mode") == "" }},
+}
+
+func botScore(r *http.Request) (int, []string) {
+	score := 0
+	matched := []string{}
+	for _, signal := range botSignals {
+		if signal.match(r) {
+			score += signal.score
+			matched = append(matched, signal.name)
+		}
+	}
+
+	return min(score, BOT_SCORE_MAX), matched
+}
+
+// Score of the request set by the bot filter, 0 when it isn't applied
+func requestBotScore(ctx context.Context) int {
+	score, _ := ctx.Value(botScoreKey{}).(int)
+
+	return score
+}
+
+func botFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := BOT_FILTER.Value()
+		if mode == "off" || isFrontendSigned(r) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		score, signals := botScore(r)
+		if score >= int(BOT_SCORE_THRESHOLD.Value()) {
+			slog.WarnContext(r.Context(), "bot", "score", score, "signals", strings.Join(signals, ","), "user agent", r.UserAgent(), "mode", mode)
+
+			events.publish(r.Context(), EVENT_SPAM_DETECTED, "", map[string]any{
+				"reason":   "bot",
+				"score":    score,
+				"signals":  signals,
+				"path":     r.URL.Path,
+				"rejected": mode == "reject",
+			})
+
+			if mode == "reject" {
+				writeProblem(w, r, http.StatusForbidden, "Forbidden")
+
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), botScoreKey{}, score)))
+	})
+}
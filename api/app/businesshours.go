@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// BUSINESS_HOURS is a semicolon separated list of day ranges and times in
+// BUSINESS_TIMEZONE, e.g. "Mon-Fri 09:00-17:30; Sat 10:00-13:00"
+type businessHoursRange struct {
+	days  map[time.Weekday]bool
+	open  time.Duration
+	close time.Duration
+}
+
+type businessSchedule struct {
+	location *time.Location
+	ranges   []businessHoursRange
+}
+
+var businessHours *businessSchedule
+
+var WEEKDAYS = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func loadBusinessHours(ctx context.Context) *businessSchedule {
+	location, err := time.LoadLocation(BUSINESS_TIMEZONE.Value())
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "business hours", err.Error())
+		panic(err)
+	}
+
+	schedule, err := parseBusinessHours(BUSINESS_HOURS.Value())
+	if err != nil {
+		err = fmt.Errorf("invalid BUSINESS_HOURS: %w", err)
+		slog.ErrorContext(ctx, "error", "business hours", err.Error())
+		panic(err)
+	}
+	schedule.location = location
+
+	return schedule
+}
+
+func parseBusinessHours(config string) (*businessSchedule, error) {
+	schedule := &businessSchedule{}
+
+	for _, entry := range strings.Split(config, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		dayRange, timeRange, ok := strings.Cut(entry, " ")
+		if !ok {
+			return nil, fmt.Errorf("expected days and times in %s", entry)
+		}
+
+		days, err := parseWeekdays(dayRange)
+		if err != nil {
+			return nil, err
+		}
+
+		opens, closes, ok := strings.Cut(strings.TrimSpace(timeRange), "-")
+		if !ok {
+			return nil, fmt.Errorf("expected open-close times in %s", entry)
+		}
+
+		open, err := parseTimeOfDay(opens)
+		if err != nil {
+			return nil, err
+		}
+		close, err := parseTimeOfDay(closes)
+		if err != nil {
+			return nil, err
+		}
+
+		schedule.ranges = append(schedule.ranges, businessHoursRange{days: days, open: open, close: close})
+	}
+
+	return schedule, nil
+}
+
+func parseWeekdays(config string) (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+
+	for _, part := range strings.Split(config, ",") {
+		first, last, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(part)), "-")
+
+		start, ok := WEEKDAYS[first]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %s", first)
+		}
+
+		end := start
+		if isRange {
+			end, ok = WEEKDAYS[last]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %s", last)
+			}
+		}
+
+		for day := start; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == end {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (s *businessSchedule) isOpen(at time.Time) bool {
+	local := at.In(s.location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+
+	for _, r := range s.ranges {
+		if r.days[local.Weekday()] && sinceMidnight >= r.open && sinceMidnight < r.close {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Next time the business opens after the given time, zero when no hours are
+// configured
+func (s *businessSchedule) nextOpen(at time.Time) time.Time {
+	local := at.In(s.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+
+	for days := 0; days < 8; days++ {
+		day := midnight.AddDate(0, 0, days)
+
+		var earliest time.Time
+		for _, r := range s.ranges {
+			if !r.days[day.Weekday()] {
+				continue
+			}
+
+			opens := day.Add(r.open)
+			if opens.After(at) && (earliest.IsZero() || opens.Before(earliest)) {
+				earliest = opens
+			}
+		}
+
+		if !earliest.IsZero() {
+			return earliest
+		}
+	}
+
+	return time.Time{}
+}
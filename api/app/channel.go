@@ -0,0 +1,306 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// A WebSocket on the admin API for live triage. The admin UI subscribes to
+// the lead events it wants and sends actions on the same connection. Actions
+// only apply when the lead is as the client last saw it, otherwise they fail
+// with a conflict carrying the lead as it is now.
+//
+// Browsers can't set the Authorization header on a WebSocket, so the admin
+// token can also be offered as a bearer.<token> subprotocol alongside admin
+const ADMIN_CHANNEL_PROTOCOL = "admin"
+const ADMIN_CHANNEL_BEARER_PROTOCOL_PREFIX = "bearer."
+
+const EVENT_LEAD_CLAIMED = "lead.claimed"
+const EVENT_LEAD_UNCLAIMED = "lead.unclaimed"
+
+const CHANNEL_ACTION_SUBSCRIBE = "subscribe"
+const CHANNEL_ACTION_CLAIM = "claim"
+const CHANNEL_ACTION_UNCLAIM = "unclaim"
+const CHANNEL_ACTION_STATUS = "status"
+
+const CHANNEL_MESSAGE_EVENT = "event"
+const CHANNEL_MESSAGE_RESULT = "result"
+const CHANNEL_MESSAGE_ERROR = "error"
+const CHANNEL_MESSAGE_CONFLICT = "conflict"
+
+// Events past this are dropped for a connection that isn't keeping up
+const CHANNEL_BUFFER = 64
+
+var errLeadClaimed = errors.New("lead is claimed by someone else")
+var errLeadNotClaimed = errors.New("lead is not claimed by you")
+var errLeadStatusConflict = errors.New("lead status has changed")
+
+var adminChannels = &channelHub{channels: map[*adminChannel]struct{}{}}
+
+type leadClaim struct {
+	By string    `json:"by"`
+	At time.Time `json:"at"`
+}
+
+type channelAction struct {
+	// Echoed on the reply so the client can match it to the action
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Lead   string `json:"lead,omitempty"`
+	By     string `json:"by,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Status the client last saw, the status action conflicts when it differs
+	From string `json:"from,omitempty"`
+	// Event names to receive, ending in * to match a prefix, and leads to
+	// receive them for. Everything when empty
+	Events []string `json:"events,omitempty"`
+	Leads  []string `json:"leads,omitempty"`
+}
+
+type channelMessage struct {
+	ID    string `json:"id,omitempty"`
+	Type  string `json:"type"`
+	Event *event `json:"event,omitempty"`
+	Lead  *lead  `json:"lead,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type adminChannel struct {
+	mu       sync.Mutex
+	events   []string
+	leads    []string
+	messages chan channelMessage
+}
+
+type channelHub struct {
+	mu       sync.Mutex
+	channels map[*adminChannel]struct{}
+}
+
+func (h *channelHub) add(c *adminChannel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.channels[c] = struct{}{}
+}
+
+func (h *channelHub) remove(c *adminChannel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.channels, c)
+}
+
+// Subscribed to every event, a slow connection misses events rather than
+// holding up the others. Synthetic leads of the self test aren't shown
+func (h *channelHub) broadcast(ctx context.Context, e event) {
+	if isSelfTest(ctx) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.channels {
+		if !c.subscribed(e) {
+			continue
+		}
+
+		select {
+		case c.messages <- channelMessage{Type: CHANNEL_MESSAGE_EVENT, Event: &e}:
+		default:
+			slog.DebugContext(ctx, "channel dropped event", "event", e.Name, "lead", e.Lead)
+		}
+	}
+}
+
+func (c *adminChannel) subscribed(e event) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.leads) > 0 && !slices.Contains(c.leads, e.Lead) {
+		return false
+	}
+
+	if len(c.events) == 0 {
+		return true
+	}
+
+	for _, name := range c.events {
+		if prefix, ok := strings.CutSuffix(name, "*"); (ok && strings.HasPrefix(e.Name, prefix)) || name == e.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The token offered as a subprotocol, for browsers
+func websocketBearer(r *http.Request) (string, bool) {
+	for _, protocol := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), ADMIN_CHANNEL_BEARER_PROTOCOL_PREFIX); ok {
+			return token, true
+		}
+	}
+
+	return "", false
+}
+
+// The token is a bearer token rather than a cookie, so the origin isn't checked
+func channelHandshake(config *websocket.Config, r *http.Request) error {
+	if slices.Contains(config.Protocol, ADMIN_CHANNEL_PROTOCOL) {
+		config.Protocol = []string{ADMIN_CHANNEL_PROTOCOL}
+	} else {
+		config.Protocol = nil
+	}
+
+	return nil
+}
+
+func adminChannelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+
+	websocket.Server{
+		Handshake: channelHandshake,
+		Handler: func(conn *websocket.Conn) {
+			serveChannel(ctx, conn)
+		},
+	}.ServeHTTP(w, r)
+}
+
+func serveChannel(ctx context.Context, conn *websocket.Conn) {
+	c := &adminChannel{messages: make(chan channelMessage, CHANNEL_BUFFER)}
+	adminChannels.add(c)
+	defer adminChannels.remove(c)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case message := <-c.messages:
+				if err := websocket.JSON.Send(conn, message); err != nil {
+					slog.DebugContext(ctx, "channel", "error", err.Error())
+					conn.Close()
+
+					return
+				}
+			}
+		}
+	}()
+
+	slog.InfoContext(ctx, "channel opened")
+
+	for {
+		action := channelAction{}
+		if err := websocket.JSON.Receive(conn, &action); err != nil {
+			slog.InfoContext(ctx, "channel closed", "reason", err.Error())
+
+			return
+		}
+
+		reply := c.handle(ctx, action)
+		reply.ID = action.ID
+
+		// Replies wait for room rather than being dropped like events
+		select {
+		case c.messages <- reply:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *adminChannel) handle(ctx context.Context, action channelAction) channelMessage {
+	var l *lead
+	var err error
+
+	switch action.Type {
+	case CHANNEL_ACTION_SUBSCRIBE:
+		c.mu.Lock()
+		c.events = action.Events
+		c.leads = action.Leads
+		c.mu.Unlock()
+
+		return channelMessage{Type: CHANNEL_MESSAGE_RESULT}
+	case CHANNEL_ACTION_CLAIM, CHANNEL_ACTION_UNCLAIM:
+		if action.Lead == "" || strings.TrimSpace(action.By) == "" {
+			return channelMessage{Type: CHANNEL_MESSAGE_ERROR, Error: "Missing lead or by"}
+		}
+
+		l, err = claimLead(ctx, action.Lead, truncate(strings.TrimSpace(action.By), 255), action.Type == CHANNEL_ACTION_CLAIM)
+	case CHANNEL_ACTION_STATUS:
+		if action.Lead == "" || !isAdminLeadStatus(action.Status) {
+			return channelMessage{Type: CHANNEL_MESSAGE_ERROR, Error: fmt.Sprintf("Invalid status %s", action.Status)}
+		}
+
+		l, _, err = changeLeadStatus(ctx, action.Lead, action.From, action.Status)
+	default:
+		return channelMessage{Type: CHANNEL_MESSAGE_ERROR, Error: fmt.Sprintf("Unknown action %s", action.Type)}
+	}
+
+	if errors.Is(err, errLeadClaimed) || errors.Is(err, errLeadNotClaimed) || errors.Is(err, errLeadStatusConflict) {
+		current, _ := leads.get(ctx, action.Lead)
+
+		return channelMessage{Type: CHANNEL_MESSAGE_CONFLICT, Lead: current, Error: err.Error()}
+	}
+	if err != nil {
+		if !errors.Is(err, errLeadNotFound) {
+			slog.ErrorContext(ctx, "error", "channel", err.Error(), "action", action.Type, "lead", action.Lead)
+		}
+
+		return channelMessage{Type: CHANNEL_MESSAGE_ERROR, Error: err.Error()}
+	}
+
+	return channelMessage{Type: CHANNEL_MESSAGE_RESULT, Lead: l}
+}
+
+// Claiming a lead already claimed by the same person does nothing
+func claimLead(ctx context.Context, id string, by string, claim bool) (*lead, error) {
+	changed := false
+	l, err := leads.update(ctx, id, func(l *lead) error {
+		if claim {
+			if l.Claim != nil && l.Claim.By != by {
+				return errLeadClaimed
+			}
+			if l.Claim == nil {
+				l.Claim = &leadClaim{By: by, At: time.Now()}
+				changed = true
+			}
+
+			return nil
+		}
+
+		if l.Claim == nil || l.Claim.By != by {
+			return errLeadNotClaimed
+		}
+
+		l.Claim = nil
+		changed = true
+
+		return nil
+	})
+	if err != nil || !changed {
+		return l, err
+	}
+
+	name := EVENT_LEAD_CLAIMED
+	if !claim {
+		name = EVENT_LEAD_UNCLAIMED
+	}
+	events.publish(ctx, name, l.ID, map[string]any{"by": by})
+
+	return l, nil
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Stages of a submission register how to undo what they did, so a later
+// failure can put things back the way they were. Compensations run in
+// reverse order and one failing doesn't stop the rest
+type compensation struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+type compensations struct {
+	mu    sync.Mutex
+	steps []compensation
+}
+
+// Safe to call from concurrent stages such as the file uploads
+func (c *compensations) add(name string, undo func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.steps = append(c.steps, compensation{name: name, undo: undo})
+}
+
+// Runs and clears the registered compensations, last registered first
+func (c *compensations) run(ctx context.Context) error {
+	c.mu.Lock()
+	steps := c.steps
+	c.steps = nil
+	c.mu.Unlock()
+
+	errs := []error{}
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		if err := step.undo(ctx); err != nil {
+			slog.ErrorContext(ctx, "error", "compensation", err.Error(), "step", step.name)
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+
+			continue
+		}
+
+		slog.DebugContext(ctx, "compensated", "step", step.name)
+	}
+
+	return errors.Join(errs...)
+}
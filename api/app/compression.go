@@ -0,0 +1,60 @@
+package app
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const COMPRESSION_LEVEL = 5
+
+type decompressedBody struct {
+	io.Reader
+	body          io.Closer
+	decompression io.Closer
+}
+
+func (b decompressedBody) Close() error {
+	b.decompression.Close()
+
+	return b.body.Close()
+}
+
+// Decompresses gzip and deflate encoded request bodies, size limits applied by
+// handlers then apply to the decompressed body
+func decompressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var decompression io.ReadCloser
+		var err error
+
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+
+			return
+		case "gzip", "x-gzip":
+			decompression, err = gzip.NewReader(r.Body)
+		case "deflate":
+			decompression, err = zlib.NewReader(r.Body)
+		default:
+			writeProblem(w, r, http.StatusUnsupportedMediaType, "Unsupported Content-Encoding")
+
+			return
+		}
+
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid compressed body")
+
+			return
+		}
+
+		r.Body = decompressedBody{Reader: decompression, body: r.Body, decompression: decompression}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,237 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dogmatiq/ferrite"
+)
+
+// Non-secret runtime config is reloaded on SIGHUP, from POST /admin/config/reload
+// and with CONFIG_WATCH_INTERVAL whenever one of its files changes. Clients,
+// stores and secrets still need a restart
+const EVENT_CONFIG_RELOADED = "config.reloaded"
+
+// Env settings RUNTIME_CONFIG can override, environment variables are only
+// read once so these can't change otherwise
+var RUNTIME_SETTINGS = []string{"COUNTRY_RATE_LIMITS", "IP_DENY_LIST", "ADMIN_ALLOW_LIST"}
+
+// Only read while loading, which happens at startup and under reloadMu
+var runtimeSettings = map[string]string{}
+
+// Reloads are serialised, everything is loaded before any of it is applied so
+// an invalid file leaves the running config as it was
+var reloadMu sync.Mutex
+
+// Config loaded from files, replaced as a whole on reload so readers never
+// see one half-applied
+type runtimeConfig struct {
+	rules          formRules
+	forms          map[string]formRules
+	enquiryTypes   map[string]*enquiryType
+	routes         []*notificationRoute
+	experiments    map[string][]string
+	scoring        scoringRules
+	contentFilter  *regexp.Regexp
+	retentionRules []retentionRule
+	emailTemplates map[string]*emailTemplate
+}
+
+var loadedConfig atomic.Pointer[runtimeConfig]
+
+// Callers working through a lead take the config once and keep it, so a
+// reload halfway through doesn't mix the old and the new
+func currentConfig() *runtimeConfig {
+	return loadedConfig.Load()
+}
+
+func loadConfig(ctx context.Context) *runtimeConfig {
+	rules := loadFormRules(ctx)
+	forms := loadForms(ctx, rules)
+	routes := loadNotificationRoutes(ctx)
+
+	return &runtimeConfig{
+		rules:          rules,
+		forms:          forms,
+		enquiryTypes:   loadEnquiryTypes(ctx, routes, forms),
+		routes:         routes,
+		experiments:    loadExperiments(ctx),
+		scoring:        loadScoringRules(ctx),
+		contentFilter:  createContentFilter(ctx),
+		retentionRules: loadRetentionRules(ctx),
+		emailTemplates: loadMailerTemplates(ctx),
+	}
+}
+
+func runtimeSetting(name string, value string, ok bool) (string, bool) {
+	if override, found := runtimeSettings[name]; found {
+		return override, override != ""
+	}
+
+	return value, ok
+}
+
+func loadRuntimeSettings(ctx context.Context) map[string]string {
+	settings := map[string]string{}
+
+	file, ok := RUNTIME_CONFIG.Value()
+	if !ok {
+		return settings
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "runtime config", err.Error())
+		panic(err)
+	}
+
+	if err := json.Unmarshal(content, &settings); err != nil {
+		slog.ErrorContext(ctx, "error", "runtime config", err.Error())
+		panic(err)
+	}
+
+	for name := range settings {
+		if !slices.Contains(RUNTIME_SETTINGS, name) {
+			err := fmt.Errorf("%s can't be set in RUNTIME_CONFIG", name)
+			slog.ErrorContext(ctx, "error", "runtime config", err.Error())
+			panic(err)
+		}
+	}
+
+	return settings
+}
+
+// Loaders panic on invalid config as they do at startup, that is turned back
+// into an error here. Requests in flight keep the config they already took
+func reloadConfig(ctx context.Context) (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	previous := runtimeSettings
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			runtimeSettings = previous
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+
+	runtimeSettings = loadRuntimeSettings(ctx)
+
+	loaded := loadConfig(ctx)
+	loadedIpFilter := createIpFilter(ctx)
+	loadedCountryLimits := createCountryRateLimiter(ctx)
+
+	loadedConfig.Store(loaded)
+	ipFilters.replace(loadedIpFilter)
+	countryLimits.replace(ctx, loadedCountryLimits)
+
+	slog.InfoContext(ctx, "reloaded config", "forms", len(loaded.forms), "routes", len(loaded.routes))
+
+	events.publish(ctx, EVENT_CONFIG_RELOADED, "", nil)
+
+	return nil
+}
+
+func configFiles() []string {
+	files := []string{}
+	for _, file := range []ferrite.Optional[ferrite.FileName]{
+		RUNTIME_CONFIG,
+		FORM_RULES,
+		FORMS,
+		ENQUIRY_TYPES,
+		NOTIFICATION_ROUTES,
+		EXPERIMENTS,
+		SCORING_RULES,
+		CONTENT_FILTER_WORDS,
+		RETENTION_RULES,
+	} {
+		if name, ok := file.Value(); ok {
+			files = append(files, string(name))
+		}
+	}
+
+	return files
+}
+
+// Files are compared by modification time and size, a missing file is a
+// change too
+func configFingerprint() string {
+	parts := []string{}
+	for _, file := range configFiles() {
+		info, err := os.Stat(file)
+		if err != nil {
+			parts = append(parts, file+":missing")
+
+			continue
+		}
+
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", file, info.ModTime().UnixNano(), info.Size()))
+	}
+
+	if dir, ok := EMAIL_TEMPLATES.Value(); ok {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				parts = append(parts, fmt.Sprintf("%s:%d:%d", entry.Name(), info.ModTime().UnixNano(), info.Size()))
+			}
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func watchConfig(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var changes <-chan time.Time
+	if interval := CONFIG_WATCH_INTERVAL.Value(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		changes = ticker.C
+	}
+
+	fingerprint := configFingerprint()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-changes:
+			if current := configFingerprint(); current == fingerprint {
+				continue
+			}
+		}
+
+		fingerprint = configFingerprint()
+		if err := reloadConfig(ctx); err != nil {
+			slog.ErrorContext(ctx, "error", "reload config", err.Error())
+		}
+	}
+}
+
+func adminReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if err := reloadConfig(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "error", "reload config", err.Error())
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
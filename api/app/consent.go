@@ -0,0 +1,23 @@
+package app
+
+import "time"
+
+// Consent is recorded with every lead along with the privacy policy version
+// in force, forms demand it by making the consent field required
+type leadConsent struct {
+	Given         bool      `json:"given"`
+	PolicyVersion string    `json:"policyVersion,omitempty"`
+	At            time.Time `json:"at"`
+}
+
+func newLeadConsent(value string) *leadConsent {
+	consent := &leadConsent{
+		Given: value == "on" || value == "true",
+		At:    time.Now(),
+	}
+	if version, ok := PRIVACY_POLICY_VERSION.Value(); ok {
+		consent.PolicyVersion = version
+	}
+
+	return consent
+}
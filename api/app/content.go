@@ -0,0 +1,98 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+//go:embed content/blocklist.txt
+var defaultBlocklist string
+
+const LEAD_FLAG_ABUSIVE = "abusive"
+
+// Words from CONTENT_FILTER_WORDS are added to the embedded list
+func createContentFilter(ctx context.Context) *regexp.Regexp {
+	words := blocklistWords(defaultBlocklist)
+
+	if file, ok := CONTENT_FILTER_WORDS.Value(); ok {
+		content, err := file.ReadString()
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "content filter", err.Error())
+			panic(err)
+		}
+
+		words = append(words, blocklistWords(content)...)
+	}
+
+	patterns := []string{}
+	for _, word := range words {
+		// Whitespace in a phrase matches any run of whitespace
+		patterns = append(patterns, strings.Join(strings.Fields(regexp.QuoteMeta(word)), `\s+`))
+	}
+
+	slog.DebugContext(ctx, "created content filter", "words", len(patterns))
+
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(patterns, "|") + `)\b`)
+}
+
+func blocklistWords(content string) []string {
+	words := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		words = append(words, strings.ToLower(line))
+	}
+
+	return words
+}
+
+// Flagged leads are quarantined rather than rejected, so a false positive
+// can still be released by an admin
+type contentProcessor struct{}
+
+var errContentMemoryStore = errors.New("quarantined leads are lost on restart with the memory store, the content processor needs LEAD_STORE=file")
+
+// Quarantined leads are only kept in the lead store until they are released
+func createContentProcessor(ctx context.Context, h *Handler) processor {
+	if LEAD_STORE.Value() != "file" {
+		slog.ErrorContext(ctx, "error", "content", errContentMemoryStore.Error())
+		panic(errContentMemoryStore)
+	}
+
+	return contentProcessor{}
+}
+
+func (contentProcessor) name() string { return "content" }
+
+func (contentProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (contentProcessor) process(ctx context.Context, l *lead) error {
+	text := strings.Join([]string{l.FirstName, l.LastName, l.Enquiry}, "\n")
+	for _, value := range l.CustomFields {
+		text += "\n" + value
+	}
+
+	match := currentConfig().contentFilter.FindString(text)
+	if match == "" {
+		return nil
+	}
+
+	l.flag(LEAD_FLAG_ABUSIVE)
+	l.Status = LEAD_STATUS_QUARANTINED
+
+	events.publish(ctx, EVENT_SPAM_DETECTED, l.ID, map[string]any{
+		"reason": LEAD_FLAG_ABUSIVE,
+	})
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// Leads are posted to CRM_WEBHOOK_URL as they are delivered, leads received
+// before it was set are sent with a back-sync over a date range
+const EVENT_LEAD_CRM_SYNCED = "lead.crm_synced"
+const EVENT_LEAD_CRM_FAILED = "lead.crm_failed"
+
+const CRM_SYNC_RUNNING = "running"
+const CRM_SYNC_COMPLETED = "completed"
+const CRM_SYNC_FAILED = "failed"
+
+var errCrmNotConfigured = errors.New("CRM is not configured")
+
+// Where leads are synced to, only a webhook for now
+type crmClient interface {
+	sync(ctx context.Context, l *lead) error
+}
+
+type webhookCrm struct {
+	endpoint string
+	outgoing *outgoingSpool
+}
+
+func createCrmClient(ctx context.Context, outgoing *outgoingSpool) crmClient {
+	endpoint, ok := CRM_WEBHOOK_URL.Value()
+	if !ok {
+		return nil
+	}
+
+	slog.DebugContext(ctx, "created crm client", "endpoint", endpoint.Host)
+
+	return webhookCrm{endpoint: endpoint.String(), outgoing: outgoing}
+}
+
+func (c webhookCrm) sync(ctx context.Context, l *lead) error {
+	return postWebhook(ctx, c.outgoing, c.endpoint, l)
+}
+
+type crmProcessor struct {
+	crm crmClient
+}
+
+func (crmProcessor) name() string { return "crm" }
+
+func (crmProcessor) stage() processorStage { return PROCESSOR_STAGE_DELIVER }
+
+func (p crmProcessor) process(ctx context.Context, l *lead) error {
+	if p.crm == nil || !featureEnabled(ctx, FLAG_CRM_SYNC, l) {
+		return nil
+	}
+
+	return syncLeadToCrm(ctx, p.crm, l)
+}
+
+func syncLeadToCrm(ctx context.Context, crm crmClient, l *lead) error {
+	if crm == nil {
+		return errCrmNotConfigured
+	}
+
+	if err := crm.sync(ctx, l); err != nil {
+		events.publish(ctx, EVENT_LEAD_CRM_FAILED, l.ID, map[string]any{"error": err.Error()})
+
+		return fmt.Errorf("crm: %w", err)
+	}
+
+	now := time.Now()
+	if _, err := leads.update(ctx, l.ID, func(stored *lead) error {
+		stored.CrmSyncedAt = &now
+
+		return nil
+	}); err != nil {
+		return err
+	}
+	l.CrmSyncedAt = &now
+
+	events.publish(ctx, EVENT_LEAD_CRM_SYNCED, l.ID, nil)
+
+	return nil
+}
+
+// A back-sync walks leads oldest first and stops at the first lead the CRM
+// fails on, resuming picks up after the last synced lead
+type crmSyncJob struct {
+	mu sync.Mutex
+	crmSyncProgress
+}
+
+type crmSyncProgress struct {
+	ID         string     `json:"id"`
+	From       time.Time  `json:"from"`
+	Until      time.Time  `json:"until"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Synced     int        `json:"synced"`
+	Cursor     string     `json:"cursor,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+var crmSyncJobs = struct {
+	sync.Mutex
+	jobs map[string]*crmSyncJob
+}{jobs: map[string]*crmSyncJob{}}
+
+func (h *Handler) adminStartCrmSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if h.crm == nil {
+		writeProblem(w, r, http.StatusServiceUnavailable, errCrmNotConfigured.Error())
+
+		return
+	}
+
+	var req struct {
+		From  string `json:"from"`
+		Until string `json:"until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	from, err := parseDate(req.From)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid from %s", req.From))
+
+		return
+	}
+
+	until := time.Now()
+	if req.Until != "" {
+		until, err = parseDate(req.Until)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid until %s", req.Until))
+
+			return
+		}
+	}
+
+	job := &crmSyncJob{crmSyncProgress: crmSyncProgress{
+		ID:        uuid.NewString(),
+		From:      from,
+		Until:     until,
+		Status:    CRM_SYNC_RUNNING,
+		StartedAt: time.Now(),
+	}}
+
+	crmSyncJobs.Lock()
+	crmSyncJobs.jobs[job.ID] = job
+	crmSyncJobs.Unlock()
+
+	slog.InfoContext(r.Context(), "crm sync", "job", job.ID, "from", from, "until", until)
+
+	go job.run(context.WithoutCancel(r.Context()), h.crm)
+
+	writeResponse(w, r, http.StatusAccepted, job.snapshot())
+}
+
+func adminGetCrmSyncHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := findCrmSyncJob(chi.URLParam(r, "id"))
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Sync not found")
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, job.snapshot())
+}
+
+func (h *Handler) adminResumeCrmSyncHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := findCrmSyncJob(chi.URLParam(r, "id"))
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Sync not found")
+
+		return
+	}
+
+	job.mu.Lock()
+	if job.Status != CRM_SYNC_FAILED {
+		job.mu.Unlock()
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Sync is %s", job.Status))
+
+		return
+	}
+	job.Status = CRM_SYNC_RUNNING
+	job.Error = ""
+	job.FinishedAt = nil
+	job.mu.Unlock()
+
+	slog.InfoContext(r.Context(), "crm sync resumed", "job", job.ID, "cursor", job.Cursor)
+
+	go job.run(context.WithoutCancel(r.Context()), h.crm)
+
+	writeResponse(w, r, http.StatusAccepted, job.snapshot())
+}
+
+func findCrmSyncJob(id string) (*crmSyncJob, bool) {
+	crmSyncJobs.Lock()
+	defer crmSyncJobs.Unlock()
+
+	job, ok := crmSyncJobs.jobs[id]
+
+	return job, ok
+}
+
+func (job *crmSyncJob) snapshot() crmSyncProgress {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	return job.crmSyncProgress
+}
+
+func (job *crmSyncJob) run(ctx context.Context, crm crmClient) {
+	pending, err := job.pending(ctx)
+	if err != nil {
+		job.finish(ctx, err)
+
+		return
+	}
+
+	for _, l := range pending {
+		if err := syncLeadToCrm(ctx, crm, l); err != nil {
+			job.finish(ctx, fmt.Errorf("lead %s: %w", l.ID, err))
+
+			return
+		}
+
+		job.mu.Lock()
+		job.Synced++
+		job.Cursor = l.ID
+		job.mu.Unlock()
+	}
+
+	job.finish(ctx, nil)
+}
+
+// Leads in range ordered oldest first, after the cursor when resuming
+func (job *crmSyncJob) pending(ctx context.Context) ([]*lead, error) {
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := []*lead{}
+	for _, l := range all {
+		if !l.CreatedAt.Before(job.From) && l.CreatedAt.Before(job.Until) {
+			inRange = append(inRange, l)
+		}
+	}
+
+	sort.Slice(inRange, func(i, j int) bool {
+		if inRange[i].CreatedAt.Equal(inRange[j].CreatedAt) {
+			return inRange[i].ID < inRange[j].ID
+		}
+
+		return inRange[i].CreatedAt.Before(inRange[j].CreatedAt)
+	})
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.Total = len(inRange)
+	for idx, l := range inRange {
+		if l.ID == job.Cursor {
+			return inRange[idx+1:], nil
+		}
+	}
+
+	return inRange, nil
+}
+
+func (job *crmSyncJob) finish(ctx context.Context, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = CRM_SYNC_COMPLETED
+
+	if err != nil {
+		job.Status = CRM_SYNC_FAILED
+		job.Error = err.Error()
+		slog.ErrorContext(ctx, "error", "crm sync", err.Error(), "job", job.ID, "synced", job.Synced, "total", job.Total)
+
+		return
+	}
+
+	slog.InfoContext(ctx, "crm synced", "job", job.ID, "synced", job.Synced, "total", job.Total)
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Browser submissions need a signed token both in a cookie and in the form,
+// a cross-site form post can't read the cookie to copy it into the form
+const CSRF_COOKIE = "lead_csrf"
+const CSRF_HEADER = "X-CSRF-Token"
+const CSRF_FIELD = "csrfToken"
+const CSRF_TOKEN_EXPIRY = 2 * time.Hour
+
+// Clients sending an API key or a client certificate aren't browsers, a
+// cross-site form can't set custom headers either
+const API_KEY_HEADER = "X-API-Key"
+
+// Fails at startup rather than signing tokens with an empty secret
+func checkCsrfProtection(ctx context.Context) {
+	if !CSRF_PROTECTION.Value() {
+		return
+	}
+
+	_, hasCsrfSecret := CSRF_SECRET.Value()
+	if _, ok := linkSecret(); !ok && !hasCsrfSecret {
+		err := errors.New("CSRF_PROTECTION needs CSRF_SECRET or ATTACHMENT_LINK_SECRET")
+		slog.ErrorContext(ctx, "error", "csrf", err.Error())
+		panic(err)
+	}
+}
+
+func csrfSecret() []byte {
+	if secret, ok := CSRF_SECRET.Value(); ok {
+		return []byte(secret)
+	}
+
+	secret, _ := linkSecret()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("csrf"))
+
+	return mac.Sum(nil)
+}
+
+func signCsrfToken(nonce string, expires int64) string {
+	mac := hmac.New(sha256.New, csrfSecret())
+	fmt.Fprintf(mac, "%s.%d", nonce, expires)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newCsrfToken() (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expires := time.Now().Add(CSRF_TOKEN_EXPIRY)
+	encoded := base64.RawURLEncoding.EncodeToString(nonce)
+
+	return fmt.Sprintf("%s.%d.%s", encoded, expires.Unix(), signCsrfToken(encoded, expires.Unix())), expires, nil
+}
+
+func verifyCsrfToken(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[2]), []byte(signCsrfToken(parts[0], expires)))
+}
+
+// Issues a token and sets its cookie, the token is also returned for forms
+// rendered by the server
+func issueCsrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, expires, err := newCsrfToken()
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRF_COOKIE,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   GO_ENV.Value() != "Development",
+		// Forms embedded on other sites post cross-site
+		SameSite: http.SameSiteNoneMode,
+	})
+
+	return token, nil
+}
+
+func csrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := issueCsrfToken(w, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "csrf token", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]string{"token": token})
+}
+
+// Browser requests are recognised by the headers browsers always send with
+// cross-origin and form requests
+func isBrowserRequest(r *http.Request) bool {
+	return r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Mode") != "" || isBrowserForm(r)
+}
+
+// Runs after the form is parsed so the token can come from a form field
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !CSRF_PROTECTION.Value() || r.Header.Get(API_KEY_HEADER) != "" || hasClientCertificate(r) || !isBrowserRequest(r) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		submitted := r.Header.Get(CSRF_HEADER)
+		if submitted == "" {
+			submitted = r.PostFormValue(CSRF_FIELD)
+		}
+
+		cookie, err := r.Cookie(CSRF_COOKIE)
+		if err != nil || submitted == "" || !hmac.Equal([]byte(cookie.Value), []byte(submitted)) || !verifyCsrfToken(submitted) {
+			slog.WarnContext(r.Context(), "csrf", "origin", r.Header.Get("Origin"), "path", r.URL.Path)
+			leadError(w, r, "Invalid or missing CSRF token", http.StatusForbidden)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits the body and parses the form once for everything after it, parsing
+// again in the handler is a no-op
+func leadFormMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE)
+
+		if token := progressToken(r); token != "" {
+			r.Body = receiveProgress(token, r.Body, r.ContentLength)
+			defer uploadProgress.end(token)
+		}
+
+		if err := parseLeadForm(r); err != nil {
+			leadError(w, r, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
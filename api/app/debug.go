@@ -0,0 +1,31 @@
+package app
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+// Profiles and runtime vars are served under /debug when DEBUG_TOKEN is set,
+// requests need it as a bearer token and are held to ADMIN_ALLOW_LIST
+const DEBUG_PATH_PREFIX = "/debug"
+
+func debugRouter(token string) http.Handler {
+	r := chi.NewRouter()
+	r.Use(bearerAuthMiddleware(token, "debug"))
+	r.Use(middleware.NoCache)
+
+	// pprof.Index serves the named profiles, such as heap and goroutine, from
+	// the path after /debug/pprof/
+	r.HandleFunc("/pprof/*", pprof.Index)
+	r.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/pprof/profile", pprof.Profile)
+	r.HandleFunc("/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/pprof/trace", pprof.Trace)
+	r.Handle("/vars", expvar.Handler())
+
+	return r
+}
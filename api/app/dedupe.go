@@ -0,0 +1,98 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resubmissions of the same enquiry from the same address within
+// DUPLICATE_WINDOW return the original lead instead of running the pipeline
+// again, which covers users hammering the submit button
+var recentLeads *recentLeadStore
+
+type recentLead struct {
+	id      string
+	expires time.Time
+}
+
+type recentLeadStore struct {
+	mu     sync.Mutex
+	window time.Duration
+	leads  map[string]recentLead
+}
+
+func createRecentLeadStore(ctx context.Context) *recentLeadStore {
+	store := &recentLeadStore{
+		window: DUPLICATE_WINDOW.Value(),
+		leads:  map[string]recentLead{},
+	}
+
+	go store.expire(ctx)
+
+	return store
+}
+
+func leadFingerprint(l *lead) string {
+	email := strings.ToLower(strings.TrimSpace(l.Email))
+	enquiry := strings.Join(strings.Fields(strings.ToLower(l.Enquiry)), " ")
+
+	hash := sha256.Sum256([]byte(email + "\x00" + enquiry))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// Claims the fingerprint for the lead, returning the ID of the lead that
+// already holds it so concurrent double submits can't both get through
+func (s *recentLeadStore) claim(fingerprint string, id string) (string, bool) {
+	if s.window <= 0 {
+		return "", true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.leads[fingerprint]; ok && time.Now().Before(existing.expires) {
+		return existing.id, false
+	}
+
+	s.leads[fingerprint] = recentLead{id: id, expires: time.Now().Add(s.window)}
+
+	return "", true
+}
+
+// Releases a claim of a lead that failed so it can be submitted again
+func (s *recentLeadStore) release(fingerprint string, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.leads[fingerprint]; ok && existing.id == id {
+		delete(s.leads, fingerprint)
+	}
+}
+
+func (s *recentLeadStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for fingerprint, lead := range s.leads {
+				if now.After(lead.expires) {
+					delete(s.leads, fingerprint)
+				}
+			}
+			s.mu.Unlock()
+
+			slog.DebugContext(ctx, "expired", "recent leads", len(s.leads))
+		}
+	}
+}
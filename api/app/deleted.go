@@ -0,0 +1,76 @@
+package app
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Deleting a lead from the admin API only marks it so it can be restored.
+// Deleted leads are left out of listings and the workers, and are removed for
+// good by a purge retention rule
+const EVENT_LEAD_DELETED = "lead.deleted"
+const EVENT_LEAD_RESTORED = "lead.restored"
+
+var errLeadDeleted = errors.New("lead is already deleted")
+var errLeadNotDeleted = errors.New("lead is not deleted")
+
+func adminDeleteLeadHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	l, err := leads.update(r.Context(), chi.URLParam(r, "id"), func(l *lead) error {
+		if l.DeletedAt != nil {
+			return errLeadDeleted
+		}
+
+		l.DeletedAt = &now
+
+		return nil
+	})
+	if errors.Is(err, errLeadDeleted) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "deleted", "lead", l.ID)
+
+	events.publish(r.Context(), EVENT_LEAD_DELETED, l.ID, nil)
+
+	writeResponse(w, r, http.StatusOK, l)
+}
+
+func adminRestoreLeadHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := leads.update(r.Context(), chi.URLParam(r, "id"), func(l *lead) error {
+		if l.DeletedAt == nil {
+			return errLeadNotDeleted
+		}
+
+		l.DeletedAt = nil
+
+		return nil
+	})
+	if errors.Is(err, errLeadNotDeleted) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "restored", "lead", l.ID)
+
+	events.publish(r.Context(), EVENT_LEAD_RESTORED, l.ID, nil)
+
+	writeResponse(w, r, http.StatusOK, l)
+}
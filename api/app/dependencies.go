@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// External clients a text-only lead doesn't need are created when the server
+// starts and retried in the background when that fails, rather than stopping
+// it. Until then whatever uses them fails on its own, and /ready lists them
+// as missing
+type dependency[T any] struct {
+	name   string
+	create func(ctx context.Context) (T, error)
+
+	mu       sync.Mutex
+	client   T
+	created  bool
+	err      error
+	attempts int
+}
+
+type dependencyStatus interface {
+	available() bool
+}
+
+var dependencies = struct {
+	sync.Mutex
+	registered map[string]dependencyStatus
+}{registered: map[string]dependencyStatus{}}
+
+func newDependency[T any](name string, create func(ctx context.Context) (T, error)) *dependency[T] {
+	d := &dependency[T]{name: name, create: create}
+
+	dependencies.Lock()
+	dependencies.registered[name] = d
+	dependencies.Unlock()
+
+	return d
+}
+
+// The first attempt is made before returning so the client is there for the
+// first request when nothing is wrong
+func (d *dependency[T]) start(ctx context.Context) {
+	if d.attempt(ctx) {
+		return
+	}
+
+	go func() {
+		for {
+			d.mu.Lock()
+			backoff := retryBackoff(DEPENDENCY_RETRY_INTERVAL.Value(), d.attempts)
+			d.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			if d.attempt(ctx) {
+				return
+			}
+		}
+	}()
+}
+
+func (d *dependency[T]) attempt(ctx context.Context) bool {
+	client, err := d.create(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts++
+	if err != nil {
+		d.err = err
+		slog.ErrorContext(ctx, "error", d.name, err.Error(), "attempts", d.attempts)
+
+		return false
+	}
+
+	d.client = client
+	d.created = true
+	d.err = nil
+
+	if d.attempts > 1 {
+		slog.InfoContext(ctx, "dependency available", "dependency", d.name, "attempts", d.attempts)
+	}
+
+	return true
+}
+
+func (d *dependency[T]) get() (T, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.created {
+		var zero T
+		if d.err == nil {
+			return zero, fmt.Errorf("%s is not available yet", d.name)
+		}
+
+		return zero, fmt.Errorf("%s is not available: %w", d.name, d.err)
+	}
+
+	return d.client, nil
+}
+
+func (d *dependency[T]) available() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.created
+}
+
+type readiness struct {
+	Status  string   `json:"status"`
+	Missing []string `json:"missing"`
+}
+
+// Always 200 as the server can still take leads without its dependencies,
+// missing ones are listed with the reason left in the logs
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ready := readiness{Status: STATUS_OPERATIONAL, Missing: []string{}}
+
+	dependencies.Lock()
+	for name, d := range dependencies.registered {
+		if !d.available() {
+			ready.Missing = append(ready.Missing, name)
+		}
+	}
+	dependencies.Unlock()
+
+	if len(ready.Missing) > 0 {
+		ready.Status = STATUS_DEGRADED
+		sort.Strings(ready.Missing)
+	}
+
+	writeResponse(w, r, http.StatusOK, ready)
+}
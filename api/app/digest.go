@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DIGEST_EXCERPT_LENGTH = 200
+
+type digestCount struct {
+	Status string
+	Count  int
+}
+
+type digestLead struct {
+	Name    string
+	Email   string
+	Type    string
+	Score   int
+	Excerpt string
+	Waiting string
+	Link    string
+}
+
+// Sends the digest every day at DIGEST_TIME in the business timezone
+func watchDigest(ctx context.Context, h *Handler) {
+	recipients, ok := DIGEST_RECIPIENTS.Value()
+	if !ok {
+		return
+	}
+
+	at, err := time.Parse("15:04", DIGEST_TIME.Value())
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "digest", err.Error())
+		panic(err)
+	}
+
+	for {
+		now := time.Now()
+		next := nextDigest(now, at, businessHours.location)
+
+		slog.DebugContext(ctx, "scheduled digest", "at", next)
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		case <-timer.C:
+			if err := sendDigest(ctx, h.outgoing, recipients, next.Add(-24*time.Hour), next); err != nil {
+				slog.ErrorContext(ctx, "error", "digest", err.Error())
+			}
+		}
+	}
+}
+
+func nextDigest(now time.Time, at time.Time, location *time.Location) time.Time {
+	local := now.In(location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), at.Hour(), at.Minute(), 0, 0, location)
+	if !next.After(local) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, at.Hour(), at.Minute(), 0, 0, location)
+	}
+
+	return next
+}
+
+func sendDigest(ctx context.Context, outgoing *outgoingSpool, recipients string, since time.Time, until time.Time) error {
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	received := []digestLead{}
+	breached := []digestLead{}
+	total := 0
+	for _, l := range all {
+		if l.Status == LEAD_STATUS_NEW && l.SlaBreachedAt != nil {
+			breached = append(breached, digestLead{
+				Name:    l.name(),
+				Email:   l.Email,
+				Waiting: until.Sub(l.CreatedAt).Round(time.Minute).String(),
+				Link:    adminLeadLink(l.ID),
+			})
+		}
+
+		if l.CreatedAt.Before(since) || !l.CreatedAt.Before(until) {
+			continue
+		}
+
+		total++
+		counts[l.Status]++
+
+		if l.Status == LEAD_STATUS_NEW {
+			received = append(received, digestLead{
+				Name:    l.name(),
+				Email:   l.Email,
+				Type:    l.EnquiryType,
+				Score:   l.Score,
+				Excerpt: excerpt(l.Enquiry, DIGEST_EXCERPT_LENGTH),
+				Link:    adminLeadLink(l.ID),
+			})
+		}
+	}
+
+	statuses := []digestCount{}
+	for status, count := range counts {
+		statuses = append(statuses, digestCount{Status: status, Count: count})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Status < statuses[j].Status })
+
+	message, err := renderEmail("digest", map[string]interface{}{
+		"since":    since.In(businessHours.location).Format(CONSULTATION_TIME_FORMAT),
+		"until":    until.In(businessHours.location).Format(CONSULTATION_TIME_FORMAT),
+		"total":    total,
+		"counts":   statuses,
+		"leads":    received,
+		"breached": breached,
+	})
+	if err != nil {
+		return err
+	}
+
+	message.From = POSTMARK_FROM.Value()
+	message.To = recipients
+	message.Tag = "lead-digest"
+
+	id, err := sendEmail(ctx, outgoing, message)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "sent digest", "message id", id, "leads", total, "breached", len(breached))
+
+	return nil
+}
+
+// Links need PUBLIC_URL as there is no request to take the host from
+func adminLeadLink(id string) string {
+	base, ok := PUBLIC_URL.Value()
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%s%s%s/leads/%s", strings.TrimSuffix(base.String(), "/"), API_V1_PREFIX, ADMIN_PATH_PREFIX, url.PathEscape(id))
+}
+
+func excerpt(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+
+	return strings.TrimSpace(string(runes[:length])) + "…"
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Posts an embed to a Discord webhook, the webhook decides the channel.
+// Attachments and the title only link anywhere with PUBLIC_URL set
+type discordNotifier struct {
+	webhook string
+}
+
+// Limits Discord puts on an embed
+const DISCORD_MAX_DESCRIPTION = 4096
+const DISCORD_MAX_FIELDS = 25
+const DISCORD_MAX_FIELD_VALUE = 1024
+
+const DISCORD_EMBED_COLOR = 0x5865F2
+
+func (discordNotifier) name() string { return "discord" }
+
+func (n discordNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	title := fmt.Sprintf("New lead from %s", l.name())
+
+	embed := map[string]any{
+		"title":       truncate(title, 256),
+		"description": truncate(discordEscape(l.Enquiry), DISCORD_MAX_DESCRIPTION),
+		"color":       DISCORD_EMBED_COLOR,
+		"fields":      discordFields(l),
+		"timestamp":   l.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if link := adminLeadLink(l.ID); link != "" {
+		embed["url"] = link
+	}
+
+	return postWebhook(ctx, outgoing, n.webhook, map[string]any{
+		"content": title,
+		"embeds":  []map[string]any{embed},
+		// Nothing in a lead should be able to ping the channel
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	})
+}
+
+func discordFields(l *lead) []map[string]any {
+	fields := []map[string]any{}
+	add := func(name string, value string, inline bool) {
+		if value == "" || len(fields) == DISCORD_MAX_FIELDS {
+			return
+		}
+
+		fields = append(fields, map[string]any{
+			"name":   truncate(name, 256),
+			"value":  truncate(value, DISCORD_MAX_FIELD_VALUE),
+			"inline": inline,
+		})
+	}
+
+	add("Email", discordEscape(l.Email), true)
+	add("Mobile", discordEscape(l.Mobile), true)
+	add("Enquiry type", discordEscape(l.EnquiryType), true)
+	if l.Form != DEFAULT_FORM {
+		add("Form", discordEscape(l.Form), true)
+	}
+	add("Score", fmt.Sprint(l.Score), true)
+	if l.Geo != nil {
+		add("Location", discordEscape(strings.Join(nonEmpty(l.Geo.City, l.Geo.Country, l.Geo.Timezone), ", ")), true)
+	}
+	if len(l.Flags) > 0 {
+		add("Flags", discordEscape(strings.Join(l.Flags, ", ")), true)
+	}
+
+	names := []string{}
+	for name := range l.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(fieldLabel(name), discordEscape(l.CustomFields[name]), true)
+	}
+
+	if l.Summary != "" {
+		add("Summary", discordEscape(l.Summary), false)
+	}
+	if l.Translation != nil {
+		add(fmt.Sprintf("Translation from %s", l.Language), discordEscape(l.Translation.Enquiry), false)
+	}
+
+	attachments := []string{}
+	for _, file := range l.Attachments {
+		if link := publicAttachmentLink(file.ID); link != "" {
+			attachments = append(attachments, fmt.Sprintf("[%s](%s)", discordEscape(file.Name), link))
+		} else {
+			attachments = append(attachments, discordEscape(file.Name))
+		}
+	}
+	add("Attachments", strings.Join(attachments, "\n"), false)
+
+	return fields
+}
+
+// Markdown characters are escaped so lead text shows as it was written
+func discordEscape(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune("\\*_~`|>[]#", r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String()
+}
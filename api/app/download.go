@@ -0,0 +1,194 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Emails link to attachments through the API rather than Drive so that access
+// is time-limited, can be revoked by setting the `revoked` property on the
+// file (or rotating the secret), and every download is logged. Links are only
+// built from PUBLIC_URL, never from the request, which the sender controls
+func publicAttachmentLink(id string) string {
+	if !attachmentLinksEnabled() {
+		return ""
+	}
+
+	base, _ := publicUrl()
+
+	return signedAttachmentLink(base, id)
+}
+
+func attachmentLinksEnabled() bool {
+	_, hasUrl := publicUrl()
+	_, hasSecret := linkSecret()
+
+	return hasUrl && hasSecret
+}
+
+// The link when there is one, the name otherwise
+func attachmentReference(id string, name string) string {
+	if link := publicAttachmentLink(id); link != "" {
+		return link
+	}
+
+	return name
+}
+
+func signedAttachmentLink(base string, id string) string {
+	expires := time.Now().Add(ATTACHMENT_LINK_EXPIRY.Value()).Unix()
+
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(expires, 10))
+	query.Set("sig", signAttachmentLink(id, expires))
+
+	return fmt.Sprintf("%s%s/attachments/%s?%s", base, API_V1_PREFIX, url.PathEscape(id), query.Encode())
+}
+
+// Everything signed with the secret is turned off without it, no links are
+// sent and any presented are refused
+func linkSecret() ([]byte, bool) {
+	secret, ok := ATTACHMENT_LINK_SECRET.Value()
+
+	return []byte(secret), ok
+}
+
+func signAttachmentLink(id string, expires int64) string {
+	secret, _ := linkSecret()
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s.%d", id, expires)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyAttachmentLink(id string, exp string, sig string) (bool, bool) {
+	if _, ok := linkSecret(); !ok {
+		return false, false
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return false, false
+	}
+
+	valid := hmac.Equal([]byte(sig), []byte(signAttachmentLink(id, expires)))
+	expired := time.Now().Unix() > expires
+
+	return valid, expired
+}
+
+// Without PUBLIC_URL there is nothing to build an absolute link from, the
+// Host and X-Forwarded-Proto of a request are whatever its sender chose
+func publicUrl() (string, bool) {
+	u, ok := PUBLIC_URL.Value()
+	if !ok {
+		return "", false
+	}
+
+	return strings.TrimSuffix(u.String(), "/"), true
+}
+
+func (h *Handler) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	valid, expired := verifyAttachmentLink(id, r.URL.Query().Get("exp"), r.URL.Query().Get("sig"))
+	if !valid {
+		slog.WarnContext(r.Context(), "denied", "attachment", id, "reason", "invalid signature", "ip", r.RemoteAddr)
+		writeProblem(w, r, http.StatusForbidden, "Invalid link")
+
+		return
+	}
+
+	if expired {
+		slog.WarnContext(r.Context(), "denied", "attachment", id, "reason", "expired", "ip", r.RemoteAddr)
+		writeProblem(w, r, http.StatusGone, "Link expired")
+
+		return
+	}
+
+	file, err := h.storage.get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, errStoredFileNotFound) {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "error", "storage get", err.Error(), "file", id)
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	// Only lead attachments are served
+	if file.properties["lead"] == "" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if file.properties["revoked"] == "true" {
+		slog.WarnContext(r.Context(), "denied", "attachment", id, "reason", "revoked", "lead", file.properties["lead"], "ip", r.RemoteAddr)
+		writeProblem(w, r, http.StatusGone, "Link revoked")
+
+		return
+	}
+
+	content, err := h.storage.open(r.Context(), id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "storage open", err.Error(), "file", id)
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	defer content.Close()
+
+	slog.InfoContext(r.Context(), "download", "attachment", id, "lead", file.properties["lead"], "ip", r.RemoteAddr)
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.name}))
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	if file.properties["encrypted"] != "true" {
+		w.Header().Set("Content-Type", file.mimeType)
+		io.Copy(w, content)
+
+		return
+	}
+
+	if !isEncryptionEnabled() {
+		slog.ErrorContext(r.Context(), "error", "decrypt", "encryption is not configured", "file", id)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to decrypt attachment")
+
+		return
+	}
+
+	plaintext, err := decryptAttachment(r.Context(), content)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "decrypt", err.Error(), "file", id)
+		writeProblem(w, r, http.StatusInternalServerError, "Failed to decrypt attachment")
+
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(file.name))
+	if contentType == "" {
+		contentType = http.DetectContentType(plaintext)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(plaintext)
+}
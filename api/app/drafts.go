@@ -0,0 +1,284 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+)
+
+// Multi-page forms save their progress as a draft and confirm it once, the
+// confirm call runs the same pipeline as a single submission
+var errLeadDraftNotFound = errors.New("draft not found")
+
+var leadDrafts *leadDraftStore
+
+type leadDraft struct {
+	id      string
+	values  url.Values
+	expires time.Time
+}
+
+type leadDraftStore struct {
+	mu     sync.Mutex
+	expiry time.Duration
+	drafts map[string]*leadDraft
+}
+
+func createLeadDraftStore(ctx context.Context) *leadDraftStore {
+	store := &leadDraftStore{
+		expiry: LEAD_DRAFT_EXPIRY.Value(),
+		drafts: map[string]*leadDraft{},
+	}
+
+	go store.expire(ctx)
+
+	slog.DebugContext(ctx, "created lead draft store", "expiry", store.expiry)
+
+	return store
+}
+
+func (s *leadDraftStore) create(values url.Values) *leadDraft {
+	draft := &leadDraft{
+		id:      uuid.NewString(),
+		values:  values,
+		expires: time.Now().Add(s.expiry),
+	}
+
+	s.mu.Lock()
+	s.drafts[draft.id] = draft
+	s.mu.Unlock()
+
+	return draft
+}
+
+// Only the fields sent are changed, saving also extends the expiry
+func (s *leadDraftStore) update(id string, values url.Values) (*leadDraft, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	draft, ok := s.drafts[id]
+	if !ok || time.Now().After(draft.expires) {
+		return nil, errLeadDraftNotFound
+	}
+
+	for name, value := range values {
+		draft.values[name] = value
+	}
+	draft.expires = time.Now().Add(s.expiry)
+
+	return draft.copy(), nil
+}
+
+func (s *leadDraftStore) get(id string) (*leadDraft, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	draft, ok := s.drafts[id]
+	if !ok || time.Now().After(draft.expires) {
+		return nil, errLeadDraftNotFound
+	}
+
+	return draft.copy(), nil
+}
+
+func (s *leadDraftStore) remove(id string) {
+	s.mu.Lock()
+	delete(s.drafts, id)
+	s.mu.Unlock()
+}
+
+func (s *leadDraftStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := 0
+
+			s.mu.Lock()
+			for id, draft := range s.drafts {
+				if now.After(draft.expires) {
+					delete(s.drafts, id)
+					expired++
+				}
+			}
+			s.mu.Unlock()
+
+			if expired > 0 {
+				slog.DebugContext(ctx, "expired", "lead drafts", expired)
+			}
+		}
+	}
+}
+
+func (d *leadDraft) copy() *leadDraft {
+	values := url.Values{}
+	for name, value := range d.values {
+		values[name] = append([]string{}, value...)
+	}
+
+	return &leadDraft{id: d.id, values: values, expires: d.expires}
+}
+
+func (d *leadDraft) MarshalJSON() ([]byte, error) {
+	form := d.values.Get("formId")
+	if form == "" {
+		form = DEFAULT_FORM
+	}
+
+	fields := map[string]string{}
+	for _, name := range currentConfig().forms[form].names() {
+		if value := d.values.Get(name); value != "" {
+			fields[name] = value
+		}
+	}
+
+	return json.Marshal(map[string]any{
+		"id":      d.id,
+		"form":    form,
+		"fields":  fields,
+		"uploads": d.values["uploads"],
+		"expires": d.expires.UTC(),
+	})
+}
+
+func (h *Handler) leadDraftCreateHandler(w http.ResponseWriter, r *http.Request) {
+	values, ok := h.leadDraftValues(w, r)
+	if !ok {
+		return
+	}
+
+	draft := leadDrafts.create(values)
+
+	slog.DebugContext(r.Context(), "created", "lead draft", draft.id)
+
+	w.Header().Set("Location", path.Join(r.URL.Path, draft.id))
+	writeLeadDraft(w, r, draft, http.StatusCreated)
+}
+
+func leadDraftGetHandler(w http.ResponseWriter, r *http.Request) {
+	draft, err := leadDrafts.get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	writeLeadDraft(w, r, draft, http.StatusOK)
+}
+
+func (h *Handler) leadDraftUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	values, ok := h.leadDraftValues(w, r)
+	if !ok {
+		return
+	}
+
+	draft, err := leadDrafts.update(chi.URLParam(r, "id"), values)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	slog.DebugContext(r.Context(), "updated", "lead draft", draft.id)
+
+	writeLeadDraft(w, r, draft, http.StatusOK)
+}
+
+// Fields in the confirm request take precedence over the saved draft, so the
+// last page can be submitted along with the confirmation
+func (h *Handler) leadDraftConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	draft, err := leadDrafts.get(id)
+	if err != nil {
+		leadError(w, r, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE)
+	if err := parseLeadForm(r); err != nil {
+		leadError(w, r, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	for name, value := range draft.values {
+		if len(r.PostForm[name]) > 0 {
+			continue
+		}
+
+		r.PostForm[name] = value
+		r.Form[name] = value
+	}
+
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	h.leadHandler(ww, r)
+
+	if ww.Status() < http.StatusBadRequest {
+		leadDrafts.remove(id)
+
+		slog.DebugContext(r.Context(), "confirmed", "lead draft", id)
+	}
+}
+
+func (h *Handler) leadDraftValues(w http.ResponseWriter, r *http.Request) (url.Values, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE)
+	if err := parseLeadForm(r); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return nil, false
+	}
+
+	if len(multipartFiles(r)) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Drafts do not accept files, upload them to /uploads and reference them in uploads")
+
+		return nil, false
+	}
+
+	_, rules, ok := requestForm(r)
+	if !ok {
+		writeProblem(w, r, http.StatusBadRequest, "Unknown form")
+
+		return nil, false
+	}
+
+	values := url.Values{}
+	for _, name := range append(append(append(rules.names(), ATTRIBUTION_FIELDS...), EXPERIMENT_FIELDS...), "formId", "uploads", "redirectUrl") {
+		if value, ok := r.PostForm[name]; ok {
+			values[name] = value
+		}
+	}
+
+	partial := map[string]string{}
+	for name := range values {
+		partial[name] = values.Get(name)
+	}
+
+	if errs := rules.validatePartial(h.validate, partial); len(errs) > 0 {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid field values:\n%s", strings.Join(errs, "\n")))
+
+		return nil, false
+	}
+
+	return values, true
+}
+
+func writeLeadDraft(w http.ResponseWriter, r *http.Request, draft *leadDraft, code int) {
+	writeResponse(w, r, code, draft)
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// Encrypted attachments are stored as:
+//
+//	magic | wrapped key length (uint16) | wrapped key | nonce | ciphertext
+//
+// where the data key is wrapped by the configured KMS key and the content is
+// sealed with AES-256-GCM
+const ENCRYPTED_ATTACHMENT_MAGIC = "SKE1"
+
+var errInvalidEncryptedAttachment = errors.New("invalid encrypted attachment")
+
+var kmsService *cloudkms.Service
+
+func createKmsService(ctx context.Context) *cloudkms.Service {
+	if _, ok := ATTACHMENT_KMS_KEY.Value(); !ok {
+		return nil
+	}
+
+	client, err := googleClientOption(ctx, []string{cloudkms.CloudkmsScope})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "kms service", err.Error())
+		panic(err)
+	}
+
+	service, err := cloudkms.NewService(ctx, client)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "kms service", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created kms service")
+
+	return service
+}
+
+func isEncryptionEnabled() bool {
+	return kmsService != nil
+}
+
+func encryptAttachment(ctx context.Context, plaintext io.Reader) (io.Reader, error) {
+	keyName, _ := ATTACHMENT_KMS_KEY.Value()
+
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	res, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.
+		Encrypt(keyName, &cloudkms.EncryptRequest{
+			Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+		}).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(res.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := createGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(ENCRYPTED_ATTACHMENT_MAGIC)
+	binary.Write(&out, binary.BigEndian, uint16(len(wrappedKey)))
+	out.Write(wrappedKey)
+	out.Write(nonce)
+	out.Write(gcm.Seal(nil, nonce, data, []byte(ENCRYPTED_ATTACHMENT_MAGIC)))
+
+	return &out, nil
+}
+
+func decryptAttachment(ctx context.Context, ciphertext io.Reader) ([]byte, error) {
+	keyName, _ := ATTACHMENT_KMS_KEY.Value()
+
+	data, err := io.ReadAll(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(ENCRYPTED_ATTACHMENT_MAGIC)) {
+		return nil, errInvalidEncryptedAttachment
+	}
+	data = data[len(ENCRYPTED_ATTACHMENT_MAGIC):]
+
+	if len(data) < 2 {
+		return nil, errInvalidEncryptedAttachment
+	}
+	wrappedKeyLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	if len(data) < wrappedKeyLength {
+		return nil, errInvalidEncryptedAttachment
+	}
+	wrappedKey, data := data[:wrappedKeyLength], data[wrappedKeyLength:]
+
+	res, err := kmsService.Projects.Locations.KeyRings.CryptoKeys.
+		Decrypt(keyName, &cloudkms.DecryptRequest{
+			Ciphertext: base64.StdEncoding.EncodeToString(wrappedKey),
+		}).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(res.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := createGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errInvalidEncryptedAttachment
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, data, []byte(ENCRYPTED_ATTACHMENT_MAGIC))
+}
+
+func createGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// Enquiries without a type are treated as general
+const DEFAULT_ENQUIRY_TYPE = "general"
+
+var ENQUIRY_TYPE_NAME = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// An enquiry type can reply with its own Postmark template and notify its own
+// route, either falls back to POSTMARK_TEMPLATE and keyword routing
+type enquiryType struct {
+	Template int    `json:"template,omitempty"`
+	Route    string `json:"route,omitempty"`
+}
+
+func defaultEnquiryTypes() map[string]*enquiryType {
+	return map[string]*enquiryType{
+		"general": {},
+		"project": {},
+		"careers": {},
+		"support": {},
+	}
+}
+
+// Loads ENQUIRY_TYPES and restricts the enquiryType field of the forms being
+// loaded with them to them, routes are checked against the routes being
+// loaded
+func loadEnquiryTypes(ctx context.Context, routes []*notificationRoute, forms map[string]formRules) map[string]*enquiryType {
+	types := defaultEnquiryTypes()
+
+	if file, ok := ENQUIRY_TYPES.Value(); ok {
+		content, err := file.ReadBytes()
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "enquiry types", err.Error())
+			panic(err)
+		}
+
+		types = map[string]*enquiryType{}
+		if err := json.Unmarshal(content, &types); err != nil {
+			slog.ErrorContext(ctx, "error", "enquiry types", err.Error())
+			panic(err)
+		}
+	}
+
+	if _, ok := types[DEFAULT_ENQUIRY_TYPE]; !ok {
+		types[DEFAULT_ENQUIRY_TYPE] = &enquiryType{}
+	}
+
+	names := []string{}
+	for name, t := range types {
+		if !ENQUIRY_TYPE_NAME.MatchString(name) {
+			err := fmt.Errorf("invalid enquiry type %s", name)
+			slog.ErrorContext(ctx, "error", "enquiry types", err.Error())
+			panic(err)
+		}
+
+		if t == nil {
+			types[name] = &enquiryType{}
+		} else if t.Route != "" && t.Route != DEFAULT_ROUTE && !slices.ContainsFunc(routes, func(route *notificationRoute) bool { return route.Name == t.Route }) {
+			err := fmt.Errorf("enquiry type %s has unknown route %s", name, t.Route)
+			slog.ErrorContext(ctx, "error", "enquiry types", err.Error())
+			panic(err)
+		}
+
+		if name != DEFAULT_ENQUIRY_TYPE {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	// Listed first so it is what the form selects by default
+	names = append([]string{DEFAULT_ENQUIRY_TYPE}, names...)
+
+	for _, form := range forms {
+		if rule, ok := form["enquiryType"]; ok && rule.Type == "" {
+			rule.Options = names
+		}
+	}
+
+	slog.DebugContext(ctx, "loaded enquiry types", "types", names)
+
+	return types
+}
+
+func (l *lead) enquiryType() *enquiryType {
+	enquiryTypes := currentConfig().enquiryTypes
+	if t, ok := enquiryTypes[l.EnquiryType]; ok {
+		return t
+	}
+
+	return enquiryTypes[DEFAULT_ENQUIRY_TYPE]
+}
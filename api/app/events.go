@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Side effects of a lead subscribe to these rather than being called inline
+// by the handler
+const EVENT_LEAD_RECEIVED = "lead.received"
+const EVENT_ATTACHMENT_UPLOADED = "attachment.uploaded"
+const EVENT_ATTACHMENT_FAILED = "attachment.failed"
+const EVENT_EMAIL_SENT = "email.sent"
+const EVENT_EMAIL_FAILED = "email.failed"
+const EVENT_SPAM_DETECTED = "spam.detected"
+const EVENT_LEAD_STATUS_CHANGED = "lead.status_changed"
+
+// Subscribing to EVENT_ALL receives every event
+const EVENT_ALL = "*"
+
+var events = newEventBus()
+
+func newEventBus() *eventBus {
+	b := &eventBus{handlers: map[string][]eventHandler{}}
+	b.idle = sync.NewCond(&b.pendingMu)
+
+	return b
+}
+
+type event struct {
+	ID   string    `json:"id"`
+	Name string    `json:"name"`
+	Lead string    `json:"lead,omitempty"`
+	At   time.Time `json:"at"`
+	Data any       `json:"data,omitempty"`
+}
+
+type eventHandler func(ctx context.Context, e event)
+
+type eventBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]eventHandler
+
+	// Handlers still running, counted under a mutex rather than with a
+	// WaitGroup as background jobs publish while an entrypoint waits
+	pendingMu sync.Mutex
+	pending   int
+	idle      *sync.Cond
+}
+
+func (b *eventBus) subscribe(name string, handler eventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers[name] = append(b.handlers[name], handler)
+}
+
+// Handlers run in the background so a slow subscriber never holds up the
+// response, they keep the request's values but not its cancellation
+func (b *eventBus) publish(ctx context.Context, name string, lead string, data any) {
+	e := event{
+		ID:   uuid.NewString(),
+		Name: name,
+		Lead: lead,
+		At:   time.Now(),
+		Data: data,
+	}
+
+	b.mu.RLock()
+	handlers := append(append([]eventHandler{}, b.handlers[name]...), b.handlers[EVENT_ALL]...)
+	b.mu.RUnlock()
+
+	ctx = context.WithoutCancel(ctx)
+	b.pendingMu.Lock()
+	b.pending += len(handlers)
+	b.pendingMu.Unlock()
+
+	for _, handler := range handlers {
+		go func() {
+			defer b.done()
+			defer func() {
+				if r := recover(); r != nil {
+					slog.ErrorContext(ctx, "error", "event handler", fmt.Sprint(r), "event", e.Name, "stack", string(debug.Stack()))
+				}
+			}()
+
+			handler(ctx, e)
+		}()
+	}
+}
+
+func (b *eventBus) done() {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+
+	b.pending--
+	if b.pending == 0 {
+		b.idle.Broadcast()
+	}
+}
+
+// Returns once no handler is running, including those of events published
+// while waiting
+func (b *eventBus) wait() {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+
+	for b.pending > 0 {
+		b.idle.Wait()
+	}
+}
+
+// Entrypoints that are frozen between requests call this before responding so
+// event handlers aren't suspended halfway through
+func WaitForEvents() {
+	events.wait()
+}
+
+func logEvent(ctx context.Context, e event) {
+	slog.DebugContext(ctx, "event", "name", e.Name, "lead", e.Lead, "id", e.ID)
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Experiments are configured as a map of experiment name to its variants,
+// the frontend sends the pair it showed with the submission
+var EXPERIMENT_FIELDS = []string{"experiment", "variant"}
+
+type leadExperiment struct {
+	Name    string `json:"name"`
+	Variant string `json:"variant"`
+}
+
+func loadExperiments(ctx context.Context) map[string][]string {
+	configured := map[string][]string{}
+
+	file, ok := EXPERIMENTS.Value()
+	if !ok {
+		return configured
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "experiments", err.Error())
+		panic(err)
+	}
+
+	if err := json.Unmarshal(content, &configured); err != nil {
+		slog.ErrorContext(ctx, "error", "experiments", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "loaded experiments", "experiments", len(configured))
+
+	return configured
+}
+
+// A pair that is not configured is dropped rather than rejecting the lead, a
+// stale frontend should not lose an enquiry
+func requestExperiment(r *http.Request) *leadExperiment {
+	name := strings.TrimSpace(r.PostFormValue("experiment"))
+	variant := strings.TrimSpace(r.PostFormValue("variant"))
+	if name == "" && variant == "" {
+		return nil
+	}
+
+	for _, v := range currentConfig().experiments[name] {
+		if v == variant {
+			return &leadExperiment{Name: name, Variant: variant}
+		}
+	}
+
+	slog.WarnContext(r.Context(), "unknown experiment", "experiment", name, "variant", variant)
+
+	return nil
+}
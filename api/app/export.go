@@ -0,0 +1,317 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/parquet-go/parquet-go"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// A snapshot of every lead is written to EXPORT_BUCKET each day under
+// date=YYYY-MM-DD/, the layout data lakes read as a date partition
+const EVENT_EXPORT_WRITTEN = "export.written"
+
+const EXPORT_FORMAT_NDJSON = "ndjson"
+const EXPORT_FORMAT_PARQUET = "parquet"
+
+const EXPORT_DATE_FORMAT = "2006-01-02"
+
+// Flat so both formats have the same columns, custom fields are kept as JSON
+type exportRow struct {
+	ID           string    `json:"id" parquet:"id"`
+	CreatedAt    time.Time `json:"createdAt" parquet:"created_at,timestamp(millisecond)"`
+	UpdatedAt    time.Time `json:"updatedAt" parquet:"updated_at,timestamp(millisecond)"`
+	Form         string    `json:"form" parquet:"form"`
+	EnquiryType  string    `json:"enquiryType" parquet:"enquiry_type"`
+	Status       string    `json:"status" parquet:"status"`
+	Score        int64     `json:"score" parquet:"score"`
+	BotScore     int64     `json:"botScore" parquet:"bot_score"`
+	Email        string    `json:"email" parquet:"email"`
+	FirstName    string    `json:"firstName" parquet:"first_name"`
+	LastName     string    `json:"lastName" parquet:"last_name"`
+	Mobile       string    `json:"mobile" parquet:"mobile"`
+	Enquiry      string    `json:"enquiry" parquet:"enquiry"`
+	CustomFields string    `json:"customFields" parquet:"custom_fields"`
+	Country      string    `json:"country" parquet:"country"`
+	Source       string    `json:"source" parquet:"source"`
+	Medium       string    `json:"medium" parquet:"medium"`
+	Campaign     string    `json:"campaign" parquet:"campaign"`
+	Experiment   string    `json:"experiment" parquet:"experiment"`
+	Variant      string    `json:"variant" parquet:"variant"`
+	Attachments  int64     `json:"attachments" parquet:"attachments"`
+	Anonymized   bool      `json:"anonymized" parquet:"anonymized"`
+}
+
+type exportReport struct {
+	Location  string    `json:"location"`
+	Format    string    `json:"format"`
+	Leads     int       `json:"leads"`
+	Bytes     int       `json:"bytes"`
+	WrittenAt time.Time `json:"writtenAt"`
+}
+
+// Where snapshots are written, picked by the scheme of EXPORT_BUCKET
+type exportBucket interface {
+	put(ctx context.Context, key string, contentType string, content []byte) error
+}
+
+var exports exportBucket
+
+// The bucket path without the scheme and bucket
+var exportPrefix string
+
+// The worker and an admin run don't write the same snapshot at once
+var exportMu sync.Mutex
+
+func createExportBucket(ctx context.Context) exportBucket {
+	location, ok := EXPORT_BUCKET.Value()
+	if !ok {
+		return nil
+	}
+
+	exportPrefix = strings.Trim(location.Path, "/")
+
+	var bucket exportBucket
+	switch location.Scheme {
+	case "gs":
+		// Authenticates with client default credentials
+		client, err := googleClientOption(ctx, []string{gcs.DevstorageReadWriteScope})
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "export bucket", err.Error())
+			panic(err)
+		}
+
+		service, err := gcs.NewService(ctx, client)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "export bucket", err.Error())
+			panic(err)
+		}
+
+		bucket = gcsBucket{service: service, bucket: location.Host}
+	case "s3":
+		// Credentials and region come from the usual AWS environment
+		config, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithHTTPClient(tracedClient(0)))
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "export bucket", err.Error())
+			panic(err)
+		}
+
+		bucket = s3Bucket{client: s3.NewFromConfig(config), bucket: location.Host}
+	default:
+		err := fmt.Errorf("EXPORT_BUCKET must be a gs:// or s3:// URL, got %s", location.Scheme)
+		slog.ErrorContext(ctx, "error", "export bucket", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created export bucket", "bucket", location.String(), "format", EXPORT_FORMAT.Value())
+
+	return bucket
+}
+
+func watchExports(ctx context.Context) {
+	interval := EXPORT_INTERVAL.Value()
+	if exports == nil || interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := writeExport(ctx, time.Now()); err != nil {
+				slog.ErrorContext(ctx, "error", "export", err.Error())
+			}
+		}
+	}
+}
+
+// A second run on the same day replaces that day's snapshot
+func writeExport(ctx context.Context, at time.Time) (*exportReport, error) {
+	exportMu.Lock()
+	defer exportMu.Unlock()
+
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]exportRow, 0, len(all))
+	for _, l := range all {
+		rows = append(rows, newExportRow(l))
+	}
+
+	format := EXPORT_FORMAT.Value()
+
+	var content []byte
+	contentType := ""
+	switch format {
+	case EXPORT_FORMAT_PARQUET:
+		content, err = encodeParquet(rows)
+		contentType = "application/vnd.apache.parquet"
+	default:
+		content, err = encodeNdjson(rows)
+		contentType = "application/x-ndjson"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := path.Join(exportPrefix, "date="+at.UTC().Format(EXPORT_DATE_FORMAT), "leads."+format)
+	if err := exports.put(ctx, key, contentType, content); err != nil {
+		return nil, err
+	}
+
+	report := &exportReport{
+		Location:  key,
+		Format:    format,
+		Leads:     len(rows),
+		Bytes:     len(content),
+		WrittenAt: time.Now(),
+	}
+
+	slog.InfoContext(ctx, "export", "location", key, "leads", report.Leads, "bytes", report.Bytes)
+
+	events.publish(ctx, EVENT_EXPORT_WRITTEN, "", report)
+
+	return report, nil
+}
+
+func newExportRow(l *lead) exportRow {
+	custom, _ := json.Marshal(l.CustomFields)
+
+	row := exportRow{
+		ID:           l.ID,
+		CreatedAt:    l.CreatedAt.UTC(),
+		UpdatedAt:    l.UpdatedAt.UTC(),
+		Form:         l.Form,
+		EnquiryType:  l.EnquiryType,
+		Status:       l.Status,
+		Score:        int64(l.Score),
+		BotScore:     int64(l.BotScore),
+		Email:        l.Email,
+		FirstName:    l.FirstName,
+		LastName:     l.LastName,
+		Mobile:       l.Mobile,
+		Enquiry:      l.Enquiry,
+		CustomFields: string(custom),
+		Attachments:  int64(len(l.Attachments)),
+		Anonymized:   l.AnonymizedAt != nil,
+	}
+
+	if l.Geo != nil {
+		row.Country = l.Geo.Country
+	}
+	if a := l.Attribution; a != nil {
+		row.Source = a.Source
+		row.Medium = a.Medium
+		row.Campaign = a.Campaign
+	}
+	if x := l.Experiment; x != nil {
+		row.Experiment = x.Name
+		row.Variant = x.Variant
+	}
+
+	return row
+}
+
+func encodeNdjson(rows []exportRow) ([]byte, error) {
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+
+	return content.Bytes(), nil
+}
+
+func encodeParquet(rows []exportRow) ([]byte, error) {
+	var content bytes.Buffer
+	writer := parquet.NewGenericWriter[exportRow](&content)
+	if _, err := writer.Write(rows); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return content.Bytes(), nil
+}
+
+type gcsBucket struct {
+	service *gcs.Service
+	bucket  string
+}
+
+func (b gcsBucket) put(ctx context.Context, key string, contentType string, content []byte) error {
+	_, err := b.service.Objects.Insert(b.bucket, &gcs.Object{Name: key, ContentType: contentType}).
+		Media(bytes.NewReader(content)).
+		Context(ctx).
+		Do()
+
+	return err
+}
+
+type s3Bucket struct {
+	client *s3.Client
+	bucket string
+}
+
+func (b s3Bucket) put(ctx context.Context, key string, contentType string, content []byte) error {
+	_, err := b.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(content),
+	})
+
+	return err
+}
+
+// Writes today's snapshot now, or the snapshot for ?date=YYYY-MM-DD
+func adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if exports == nil {
+		writeProblem(w, r, http.StatusConflict, "EXPORT_BUCKET is not configured")
+
+		return
+	}
+
+	at := time.Now()
+	if date := r.URL.Query().Get("date"); date != "" {
+		parsed, err := time.Parse(EXPORT_DATE_FORMAT, date)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid date")
+
+			return
+		}
+
+		at = parsed
+	}
+
+	report, err := writeExport(r.Context(), at)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "export", err.Error())
+		writeProblem(w, r, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusCreated, report)
+}
@@ -0,0 +1,288 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/open-feature/go-sdk/openfeature"
+)
+
+// Risky behaviour is gated behind flags evaluated per lead, so it can be
+// rolled out to a share of leads with FEATURE_FLAG_PROVIDER. Flags keep their
+// default when no provider is set or it can't be reached
+const FLAG_ASYNC_DELIVERY = "async-delivery"
+const FLAG_CRM_SYNC = "crm-sync"
+
+// CRM syncing predates the flag so it stays on unless it is turned off
+var FLAG_DEFAULTS = map[string]bool{
+	FLAG_ASYNC_DELIVERY: false,
+	FLAG_CRM_SYNC:       true,
+}
+
+const FEATURE_FLAG_TIMEOUT = 2 * time.Second
+
+// see: https://launchdarkly.com/docs/sdk/features/client-side-availability
+const LAUNCHDARKLY_EVAL_API = "https://clientsdk.launchdarkly.com/sdk/evalx"
+
+var featureFlags *openfeature.Client
+
+var flagClient = tracedClient(FEATURE_FLAG_TIMEOUT)
+
+func createFeatureFlags(ctx context.Context) *openfeature.Client {
+	var provider openfeature.FeatureProvider = openfeature.NoopProvider{}
+
+	switch FEATURE_FLAG_PROVIDER.Value() {
+	case "flagd":
+		provider = ofrepProvider{endpoint: strings.TrimSuffix(FLAGD_URL.Value().String(), "/")}
+	case "launchdarkly":
+		id, ok := LAUNCHDARKLY_CLIENT_SIDE_ID.Value()
+		if !ok {
+			err := errors.New("LAUNCHDARKLY_CLIENT_SIDE_ID is required by the launchdarkly provider")
+			slog.ErrorContext(ctx, "error", "feature flags", err.Error())
+			panic(err)
+		}
+
+		provider = launchDarklyProvider{clientSideID: id}
+	}
+
+	if err := openfeature.SetProvider(provider); err != nil {
+		slog.ErrorContext(ctx, "error", "feature flags", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created feature flags", "provider", provider.Metadata().Name)
+
+	return openfeature.NewClient(SERVICE_NAME.Value())
+}
+
+// Leads are the targeting key so a lead sees the same value at every stage
+func featureEnabled(ctx context.Context, flag string, l *lead) bool {
+	attributes := map[string]interface{}{
+		"form":        l.Form,
+		"enquiryType": l.EnquiryType,
+		"score":       l.Score,
+	}
+	if l.Geo != nil {
+		attributes["country"] = l.Geo.Country
+	}
+
+	enabled, err := featureFlags.BooleanValue(ctx, flag, FLAG_DEFAULTS[flag], openfeature.NewEvaluationContext(l.ID, attributes))
+	if err != nil {
+		slog.WarnContext(ctx, "feature flag", "flag", flag, "error", err.Error(), "lead", l.ID)
+	}
+
+	return enabled
+}
+
+// Resolves a flag to any value, the typed evaluations of the providers below
+// check it has the type asked for
+type flagResolver func(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (interface{}, string, error)
+
+func resolveFlag[T any](ctx context.Context, resolve flagResolver, flag string, defaultValue T, evalCtx openfeature.FlattenedContext) (T, openfeature.ProviderResolutionDetail) {
+	value, variant, err := resolve(ctx, flag, evalCtx)
+	if err != nil {
+		var resolution openfeature.ResolutionError
+		if !errors.As(err, &resolution) {
+			resolution = openfeature.NewGeneralResolutionError(err.Error())
+		}
+
+		return defaultValue, openfeature.ProviderResolutionDetail{ResolutionError: resolution, Reason: openfeature.ErrorReason}
+	}
+
+	typed, ok := value.(T)
+	if !ok {
+		return defaultValue, openfeature.ProviderResolutionDetail{
+			ResolutionError: openfeature.NewTypeMismatchResolutionError(fmt.Sprintf("flag %s is %T", flag, value)),
+			Reason:          openfeature.ErrorReason,
+		}
+	}
+
+	return typed, openfeature.ProviderResolutionDetail{Variant: variant, Reason: openfeature.TargetingMatchReason}
+}
+
+// Numbers decode as float64, integer flags are converted from them
+func resolveInt(ctx context.Context, resolve flagResolver, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	value, detail := resolveFlag(ctx, resolve, flag, float64(defaultValue), evalCtx)
+
+	return openfeature.IntResolutionDetail{Value: int64(value), ProviderResolutionDetail: detail}
+}
+
+// Evaluates with the OpenFeature Remote Evaluation Protocol, which flagd
+// serves on its OFREP port
+// see: https://openfeature.dev/specification/appendix-c
+type ofrepProvider struct {
+	endpoint string
+}
+
+func (p ofrepProvider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: "flagd"}
+}
+
+func (p ofrepProvider) Hooks() []openfeature.Hook { return []openfeature.Hook{} }
+
+func (p ofrepProvider) resolve(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (interface{}, string, error) {
+	body, err := json.Marshal(map[string]any{"context": evalCtx})
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/ofrep/v1/evaluate/flags/"+url.PathEscape(flag), bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := flagClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	var evaluation struct {
+		Value        interface{} `json:"value"`
+		Variant      string      `json:"variant"`
+		ErrorCode    string      `json:"errorCode"`
+		ErrorDetails string      `json:"errorDetails"`
+	}
+	json.NewDecoder(res.Body).Decode(&evaluation)
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, "", openfeature.NewFlagNotFoundResolutionError(flag)
+	case res.StatusCode != http.StatusOK:
+		return nil, "", fmt.Errorf("flagd: %s %s %s", res.Status, evaluation.ErrorCode, evaluation.ErrorDetails)
+	}
+
+	return evaluation.Value, evaluation.Variant, nil
+}
+
+func (p ofrepProvider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.BoolResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p ofrepProvider) StringEvaluation(ctx context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.StringResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p ofrepProvider) FloatEvaluation(ctx context.Context, flag string, defaultValue float64, evalCtx openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.FloatResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p ofrepProvider) IntEvaluation(ctx context.Context, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	return resolveInt(ctx, p.resolve, flag, defaultValue, evalCtx)
+}
+
+func (p ofrepProvider) ObjectEvaluation(ctx context.Context, flag string, defaultValue interface{}, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.InterfaceResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+// Evaluates with the LaunchDarkly client-side endpoint, so only flags made
+// available to client-side SDKs can be used and no SDK key is needed
+type launchDarklyProvider struct {
+	clientSideID string
+}
+
+func (p launchDarklyProvider) Metadata() openfeature.Metadata {
+	return openfeature.Metadata{Name: "launchdarkly"}
+}
+
+func (p launchDarklyProvider) Hooks() []openfeature.Hook { return []openfeature.Hook{} }
+
+func (p launchDarklyProvider) resolve(ctx context.Context, flag string, evalCtx openfeature.FlattenedContext) (interface{}, string, error) {
+	ldContext := map[string]interface{}{"kind": "user"}
+	for name, value := range evalCtx {
+		if name == openfeature.TargetingKey {
+			name = "key"
+		}
+
+		ldContext[name] = value
+	}
+
+	encoded, err := json.Marshal(ldContext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/contexts/%s", LAUNCHDARKLY_EVAL_API, url.PathEscape(p.clientSideID), base64.RawURLEncoding.EncodeToString(encoded))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := flagClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("launchdarkly: %s", res.Status)
+	}
+
+	evaluations := map[string]struct {
+		Value     interface{} `json:"value"`
+		Variation *int        `json:"variation"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&evaluations); err != nil {
+		return nil, "", err
+	}
+
+	evaluation, ok := evaluations[flag]
+	if !ok {
+		return nil, "", openfeature.NewFlagNotFoundResolutionError(flag)
+	}
+
+	variant := ""
+	if evaluation.Variation != nil {
+		variant = fmt.Sprint(*evaluation.Variation)
+	}
+
+	return evaluation.Value, variant, nil
+}
+
+func (p launchDarklyProvider) BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx openfeature.FlattenedContext) openfeature.BoolResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.BoolResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p launchDarklyProvider) StringEvaluation(ctx context.Context, flag string, defaultValue string, evalCtx openfeature.FlattenedContext) openfeature.StringResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.StringResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p launchDarklyProvider) FloatEvaluation(ctx context.Context, flag string, defaultValue float64, evalCtx openfeature.FlattenedContext) openfeature.FloatResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.FloatResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
+
+func (p launchDarklyProvider) IntEvaluation(ctx context.Context, flag string, defaultValue int64, evalCtx openfeature.FlattenedContext) openfeature.IntResolutionDetail {
+	return resolveInt(ctx, p.resolve, flag, defaultValue, evalCtx)
+}
+
+func (p launchDarklyProvider) ObjectEvaluation(ctx context.Context, flag string, defaultValue interface{}, evalCtx openfeature.FlattenedContext) openfeature.InterfaceResolutionDetail {
+	value, detail := resolveFlag(ctx, p.resolve, flag, defaultValue, evalCtx)
+
+	return openfeature.InterfaceResolutionDetail{Value: value, ProviderResolutionDetail: detail}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+const LEAD_ID_HEADER = "X-Lead-ID"
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+type formField struct {
+	Name      string
+	Label     string
+	Type      string
+	Required  bool
+	MaxLength int
+	Options   []string
+}
+
+// Renders a plain form for browsers without JavaScript, fields follow the
+// configured validation rules
+func formHandler(w http.ResponseWriter, r *http.Request) {
+	form, rules, ok := requestForm(r)
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Unknown form")
+
+		return
+	}
+
+	names := append([]string{}, CORE_FIELDS...)
+	names = append(names, rules.extraFields()...)
+
+	fields := []formField{}
+	for _, name := range names {
+		rule := rules[name]
+
+		fields = append(fields, formField{
+			Name:      name,
+			Label:     fieldLabel(name),
+			Type:      fieldInputType(name, rule),
+			Required:  rule.Required,
+			MaxLength: rule.MaxLength,
+			Options:   rule.Options,
+		})
+	}
+
+	csrfToken, err := issueCsrfToken(w, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "csrf token", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "lead.html", map[string]any{
+		"Action":      r.URL.Path,
+		"Form":        form,
+		"Fields":      fields,
+		"CsrfToken":   csrfToken,
+		"RedirectUrl": r.URL.Query().Get("redirectUrl"),
+		"Attribution": formAttribution(r),
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "error", "render form", err.Error())
+	}
+}
+
+// Campaign parameters on the link to the form are carried through the post
+func formAttribution(r *http.Request) map[string]string {
+	attribution := map[string]string{}
+	for _, name := range ATTRIBUTION_FIELDS {
+		if value := r.URL.Query().Get(name); value != "" {
+			attribution[name] = truncate(value, ATTRIBUTION_FIELD_MAX_LENGTH)
+		}
+	}
+
+	if _, ok := attribution["referrer"]; !ok && r.Referer() != "" {
+		attribution["referrer"] = truncate(r.Referer(), ATTRIBUTION_FIELD_MAX_LENGTH)
+	}
+
+	return attribution
+}
+
+// Form posts from browsers navigate to the response, so they get a page
+// rather than a bare body
+func isBrowserForm(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func leadError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if !isBrowserForm(r) {
+		writeProblem(w, r, code, message)
+
+		return
+	}
+
+	renderResult(w, r, code, "Something went wrong", message, true)
+}
+
+func leadSuccess(w http.ResponseWriter, r *http.Request, id string, redirectUrl string) {
+	w.Header().Set(LEAD_ID_HEADER, id)
+
+	if !isBrowserForm(r) {
+		// Clients that ask for a format get the ID in the body as well
+		if responseFormat(r) != "" {
+			writeResponse(w, r, http.StatusOK, leadReceipt{ID: id})
+		}
+
+		return
+	}
+
+	if redirectUrl != "" {
+		http.Redirect(w, r, redirectUrl, http.StatusSeeOther)
+
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, "Thank you", "We have received your enquiry and will be in touch soon.", false)
+}
+
+// Forms embedded on other sites can send the visitor back to their own thank
+// you page, only hosts in REDIRECT_ALLOWED_HOSTS are accepted
+func leadRedirect(r *http.Request) (string, error) {
+	redirectUrl := r.FormValue("redirectUrl")
+	if redirectUrl == "" || !isBrowserForm(r) {
+		return "", nil
+	}
+
+	u, err := url.Parse(redirectUrl)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return "", errors.New("Invalid redirect URL")
+	}
+
+	hosts, _ := REDIRECT_ALLOWED_HOSTS.Value()
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" && strings.ToLower(u.Hostname()) == host {
+			return u.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("Redirect URL host %s is not allowed", u.Hostname())
+}
+
+func renderResult(w http.ResponseWriter, r *http.Request, code int, title string, message string, retry bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	err := templates.ExecuteTemplate(w, "result.html", map[string]any{
+		"Title":   title,
+		"Message": message,
+		"Retry":   retry,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "render result", err.Error())
+	}
+}
+
+// firstName -> First name
+func fieldLabel(name string) string {
+	var label strings.Builder
+	for i, r := range name {
+		switch {
+		case i == 0:
+			label.WriteRune(unicode.ToUpper(r))
+		case unicode.IsUpper(r):
+			label.WriteRune(' ')
+			label.WriteRune(unicode.ToLower(r))
+		default:
+			label.WriteRune(r)
+		}
+	}
+
+	return label.String()
+}
+
+func fieldInputType(name string, rule *fieldRule) string {
+	switch {
+	case rule.Type != "":
+		return rule.Type
+	case name == "enquiry":
+		return "textarea"
+	case len(rule.Options) > 0:
+		return "select"
+	case rule.Format == "email":
+		return "email"
+	case rule.Format == "e164":
+		return "tel"
+	case rule.Format == "url":
+		return "url"
+	default:
+		return "text"
+	}
+}
@@ -0,0 +1,188 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Location of the submitter resolved from their IP with a MaxMind City
+// database, or the ipinfo API when no database is configured
+type leadGeo struct {
+	Country  string `json:"country"`
+	City     string `json:"city,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+type geoResolver interface {
+	lookup(ctx context.Context, ip net.IP) (*leadGeo, error)
+}
+
+var geo geoResolver
+
+// Lookups are cached as the rate limiter and the enrich stage both resolve
+// the same address for a submission
+const GEOIP_CACHE_TTL = time.Hour
+const GEOIP_CACHE_SIZE = 10000
+
+type geoCacheEntry struct {
+	location *leadGeo
+	expires  time.Time
+}
+
+var geoCache = struct {
+	sync.Mutex
+	entries map[string]geoCacheEntry
+}{entries: map[string]geoCacheEntry{}}
+
+func createGeoResolver(ctx context.Context) geoResolver {
+	if file, ok := GEOIP_DATABASE.Value(); ok {
+		db, err := geoip2.Open(string(file))
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "geoip database", err.Error())
+			panic(err)
+		}
+
+		slog.DebugContext(ctx, "opened geoip database", "path", string(file), "type", db.Metadata().DatabaseType)
+
+		return maxmindResolver{db}
+	}
+
+	if token, ok := IPINFO_TOKEN.Value(); ok {
+		slog.DebugContext(ctx, "using ipinfo for geoip")
+
+		return ipinfoResolver{token: token, client: tracedClient(2 * time.Second)}
+	}
+
+	return nil
+}
+
+// Returns nil when geoip isn't configured or the address is not public
+func lookupGeo(ctx context.Context, address string) (*leadGeo, error) {
+	if geo == nil {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+		return nil, nil
+	}
+
+	key := ip.String()
+
+	geoCache.Lock()
+	entry, ok := geoCache.entries[key]
+	geoCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.location, nil
+	}
+
+	location, err := geo.lookup(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	geoCache.Lock()
+	if len(geoCache.entries) >= GEOIP_CACHE_SIZE {
+		geoCache.entries = map[string]geoCacheEntry{}
+	}
+	geoCache.entries[key] = geoCacheEntry{location: location, expires: time.Now().Add(GEOIP_CACHE_TTL)}
+	geoCache.Unlock()
+
+	return location, nil
+}
+
+type maxmindResolver struct {
+	db *geoip2.Reader
+}
+
+func (m maxmindResolver) lookup(ctx context.Context, ip net.IP) (*leadGeo, error) {
+	record, err := m.db.City(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.Country.IsoCode == "" {
+		return nil, nil
+	}
+
+	return &leadGeo{
+		Country:  record.Country.IsoCode,
+		City:     record.City.Names["en"],
+		Timezone: record.Location.TimeZone,
+	}, nil
+}
+
+type ipinfoResolver struct {
+	token  string
+	client *http.Client
+}
+
+func (i ipinfoResolver) lookup(ctx context.Context, ip net.IP) (*leadGeo, error) {
+	endpoint := fmt.Sprintf("https://ipinfo.io/%s?token=%s", ip.String(), url.QueryEscape(i.token))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ipinfo: %s", res.Status)
+	}
+
+	var info struct {
+		Country  string `json:"country"`
+		City     string `json:"city"`
+		Timezone string `json:"timezone"`
+		Bogon    bool   `json:"bogon"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+
+	if info.Bogon || info.Country == "" {
+		return nil, nil
+	}
+
+	return &leadGeo{
+		Country:  info.Country,
+		City:     info.City,
+		Timezone: info.Timezone,
+	}, nil
+}
+
+type geoProcessor struct{}
+
+func (geoProcessor) name() string { return "geoip" }
+
+func (geoProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (geoProcessor) process(ctx context.Context, l *lead) error {
+	location, err := lookupGeo(ctx, l.IP)
+	if err != nil {
+		return err
+	}
+
+	l.Geo = location
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/sethvargo/go-limiter"
+)
+
+// What the lead routes call out to, given to the router rather than kept in
+// package state so the server and function entrypoints can wire their own
+// and a test can swap in fakes
+type Handler struct {
+	validate *validator.Validate
+	storage  attachmentStorage
+	mailer   mailer
+	// Emails and webhook posts go through it to be retried, sent with mailer
+	outgoing *outgoingSpool
+	// Nil when leads are not synced to a CRM
+	crm     crmClient
+	limiter limiter.Store
+}
+
+// Creates the handler with the backends selected by the environment
+func NewHandler(ctx context.Context) *Handler {
+	mailer := createMailer(ctx)
+	outgoing := createOutgoingSpool(ctx, mailer)
+
+	return newHandler(
+		validator.New(validator.WithRequiredStructEnabled()),
+		createAttachmentStorage(ctx),
+		mailer,
+		outgoing,
+		createCrmClient(ctx, outgoing),
+		createLimiterStore(ctx, "ip", 5, time.Minute),
+	)
+}
+
+func newHandler(validate *validator.Validate, storage attachmentStorage, mailer mailer, outgoing *outgoingSpool, crm crmClient, limiter limiter.Store) *Handler {
+	return &Handler{
+		validate: validate,
+		storage:  storage,
+		mailer:   mailer,
+		outgoing: outgoing,
+		crm:      crm,
+		limiter:  limiter,
+	}
+}
@@ -0,0 +1,227 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Leads brought over from elsewhere, such as an old inbox, are validated and
+// enriched like submissions but only delivered when asked for so old contacts
+// aren't sent an auto-response
+const EVENT_LEAD_IMPORTED = "lead.imported"
+
+const MAX_IMPORT_SIZE = 10 << 20
+
+const IMPORT_ROW_CREATED = "created"
+const IMPORT_ROW_EXISTS = "exists"
+const IMPORT_ROW_INVALID = "invalid"
+
+// Lead IDs are derived from the import ID and row so a retried import finds
+// the leads it already created instead of creating them again
+var IMPORT_NAMESPACE = uuid.MustParse("5b0d3c4e-9f3a-4c1e-8a53-2f7d6b1e0c9a")
+
+type importRow struct {
+	Row    int      `json:"row"`
+	Status string   `json:"status"`
+	ID     string   `json:"id,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type importResult struct {
+	ImportID string         `json:"importId"`
+	Counts   map[string]int `json:"counts"`
+	Rows     []importRow    `json:"rows"`
+}
+
+// Rows are CSV with a header of field names or a JSON array of objects,
+// besides the form fields a row can give its formId, status and createdAt
+func adminImportLeadsHandler(w http.ResponseWriter, r *http.Request) {
+	importID := r.Header.Get("Idempotency-Key")
+	if importID == "" {
+		importID = r.URL.Query().Get("importId")
+	}
+	if importID == "" {
+		importID = uuid.NewString()
+	}
+
+	deliver := r.URL.Query().Get("deliver") == "true"
+
+	rows, err := parseImport(w, r)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "Import too large")
+
+			return
+		}
+
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	res := importResult{
+		ImportID: importID,
+		Counts:   map[string]int{IMPORT_ROW_CREATED: 0, IMPORT_ROW_EXISTS: 0, IMPORT_ROW_INVALID: 0},
+		Rows:     []importRow{},
+	}
+	for idx, values := range rows {
+		row := importLead(r.Context(), importID, idx+1, values, deliver)
+		res.Counts[row.Status]++
+		res.Rows = append(res.Rows, row)
+	}
+
+	slog.InfoContext(r.Context(), "imported", "import", importID, "created", res.Counts[IMPORT_ROW_CREATED], "exists", res.Counts[IMPORT_ROW_EXISTS], "invalid", res.Counts[IMPORT_ROW_INVALID])
+
+	writeResponse(w, r, http.StatusOK, res)
+}
+
+func parseImport(w http.ResponseWriter, r *http.Request) ([]map[string]string, error) {
+	body := http.MaxBytesReader(w, r.Body, MAX_IMPORT_SIZE)
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "text/csv":
+		return parseImportCsv(body)
+	case "application/json", "":
+		return parseImportJson(body)
+	}
+
+	return nil, fmt.Errorf("unsupported content type %s", contentType)
+}
+
+func parseImportCsv(body io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	// Short rows are left to validation rather than failing the import
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+
+	rows := []map[string]string{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		values := map[string]string{}
+		for idx, name := range header {
+			if idx < len(record) {
+				values[strings.TrimSpace(name)] = record[idx]
+			}
+		}
+		rows = append(rows, values)
+	}
+}
+
+func parseImportJson(body io.Reader) ([]map[string]string, error) {
+	rows := []map[string]string{}
+	if err := json.NewDecoder(body).Decode(&rows); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func importLead(ctx context.Context, importID string, idx int, values map[string]string, deliver bool) importRow {
+	row := importRow{Row: idx}
+	id := uuid.NewSHA1(IMPORT_NAMESPACE, []byte(fmt.Sprintf("%s/%d", importID, idx))).String()
+
+	if _, err := leads.get(ctx, id); err == nil {
+		row.Status = IMPORT_ROW_EXISTS
+		row.ID = id
+
+		return row
+	}
+
+	form := values["formId"]
+	if form == "" {
+		form = DEFAULT_FORM
+	}
+	if _, ok := currentConfig().forms[form]; !ok {
+		row.Status = IMPORT_ROW_INVALID
+		row.Errors = []string{fmt.Sprintf("Unknown form %s", form)}
+
+		return row
+	}
+
+	status := values["status"]
+	if status != "" && !isLeadStatus(status) {
+		row.Status = IMPORT_ROW_INVALID
+		row.Errors = []string{fmt.Sprintf("Invalid status %s", status)}
+
+		return row
+	}
+
+	body := newLead(form, values)
+	body.ID = id
+	if createdAt := values["createdAt"]; createdAt != "" {
+		at, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			row.Status = IMPORT_ROW_INVALID
+			row.Errors = []string{fmt.Sprintf("Invalid createdAt %s", createdAt)}
+
+			return row
+		}
+
+		body.CreatedAt = at
+	}
+
+	if err := runProcessors(ctx, PROCESSOR_STAGE_VALIDATE, body); err != nil {
+		row.Status = IMPORT_ROW_INVALID
+		row.Errors = []string{err.Error()}
+
+		return row
+	}
+
+	runProcessors(ctx, PROCESSOR_STAGE_ENRICH, body)
+
+	// Leads that were already being worked on keep where they were left
+	if status != "" {
+		body.Status = status
+	}
+
+	if deliver {
+		queueDelivery(body)
+	}
+
+	if err := leads.save(ctx, body); err != nil {
+		slog.ErrorContext(ctx, "error", "save lead", err.Error(), "lead", body.ID, "import", importID)
+		row.Status = IMPORT_ROW_INVALID
+		row.Errors = []string{err.Error()}
+
+		return row
+	}
+
+	events.publish(ctx, EVENT_LEAD_IMPORTED, body.ID, map[string]any{
+		"import": importID,
+		"row":    idx,
+	})
+
+	if deliver {
+		deliverOutbox(ctx, body)
+	}
+
+	row.Status = IMPORT_ROW_CREATED
+	row.ID = id
+
+	return row
+}
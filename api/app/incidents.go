@@ -0,0 +1,205 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Opens an incident with PagerDuty or Opsgenie when email sends, attachment
+// uploads or CRM syncs fail INCIDENT_THRESHOLD times within INCIDENT_WINDOW.
+// Incidents are keyed by the failure so the provider groups repeats into the
+// one incident, and each failure is only raised once a window
+const INCIDENT_PROVIDER_NONE = "none"
+const INCIDENT_PROVIDER_PAGERDUTY = "pagerduty"
+const INCIDENT_PROVIDER_OPSGENIE = "opsgenie"
+
+const PAGERDUTY_EVENTS_API = "https://events.pagerduty.com/v2/enqueue"
+
+type incidentFailure struct {
+	key   string
+	label string
+}
+
+var INCIDENT_FAILURES = map[string]incidentFailure{
+	EVENT_EMAIL_FAILED:      {key: "email", label: "email send"},
+	EVENT_ATTACHMENT_FAILED: {key: "upload", label: "attachment upload"},
+	EVENT_LEAD_CRM_FAILED:   {key: "crm", label: "CRM sync"},
+}
+
+var incidentClient = tracedClient(10 * time.Second)
+
+var incidents *incidentTracker
+
+type incidentTracker struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	raised   map[string]time.Time
+}
+
+func createIncidentTracker(ctx context.Context) *incidentTracker {
+	if err := checkIncidents(); err != nil {
+		slog.ErrorContext(ctx, "error", "incidents", err.Error())
+		panic(err)
+	}
+
+	if INCIDENT_PROVIDER.Value() == INCIDENT_PROVIDER_NONE {
+		return nil
+	}
+
+	slog.DebugContext(ctx, "created incident tracker", "provider", INCIDENT_PROVIDER.Value())
+
+	return &incidentTracker{failures: map[string][]time.Time{}, raised: map[string]time.Time{}}
+}
+
+func checkIncidents() error {
+	switch INCIDENT_PROVIDER.Value() {
+	case INCIDENT_PROVIDER_PAGERDUTY:
+		if _, ok := PAGERDUTY_ROUTING_KEY.Value(); !ok {
+			return errors.New("PAGERDUTY_ROUTING_KEY is required by the pagerduty incident provider")
+		}
+	case INCIDENT_PROVIDER_OPSGENIE:
+		if _, ok := OPSGENIE_API_KEY.Value(); !ok {
+			return errors.New("OPSGENIE_API_KEY is required by the opsgenie incident provider")
+		}
+	}
+
+	return nil
+}
+
+func (t *incidentTracker) record(ctx context.Context, e event) {
+	failure, ok := INCIDENT_FAILURES[e.Name]
+	if !ok {
+		return
+	}
+
+	window := INCIDENT_WINDOW.Value()
+	threshold := int(INCIDENT_THRESHOLD.Value())
+
+	t.mu.Lock()
+
+	// Only the latest failures within the window are needed to reach the
+	// threshold
+	failures := []time.Time{}
+	for _, at := range t.failures[failure.key] {
+		if e.At.Sub(at) < window {
+			failures = append(failures, at)
+		}
+	}
+	failures = append(failures, e.At)
+	if len(failures) > threshold {
+		failures = failures[len(failures)-threshold:]
+	}
+	t.failures[failure.key] = failures
+
+	raise := len(failures) >= threshold && e.At.Sub(t.raised[failure.key]) >= window
+	if raise {
+		t.raised[failure.key] = e.At
+	}
+
+	t.mu.Unlock()
+
+	if !raise {
+		return
+	}
+
+	reason := ""
+	if data, ok := e.Data.(map[string]any); ok {
+		reason, _ = data["error"].(string)
+	}
+
+	summary := fmt.Sprintf("%d %s failures in the last %s", len(failures), failure.label, window)
+	if err := openIncident(ctx, failure.key, summary, truncate(reason, 1024)); err != nil {
+		slog.ErrorContext(ctx, "error", "incidents", err.Error(), "failure", failure.key)
+
+		// The next failure tries again
+		t.mu.Lock()
+		delete(t.raised, failure.key)
+		t.mu.Unlock()
+
+		return
+	}
+
+	slog.InfoContext(ctx, "opened incident", "failure", failure.key, "provider", INCIDENT_PROVIDER.Value())
+}
+
+// Sent straight to the provider rather than through the outgoing spool, which
+// may be what is failing
+func openIncident(ctx context.Context, key string, summary string, reason string) error {
+	dedup := fmt.Sprintf("%s/%s", SERVICE_NAME.Value(), key)
+
+	var req *http.Request
+	var err error
+	switch INCIDENT_PROVIDER.Value() {
+	case INCIDENT_PROVIDER_PAGERDUTY:
+		routingKey, _ := PAGERDUTY_ROUTING_KEY.Value()
+
+		req, err = incidentRequest(ctx, PAGERDUTY_EVENTS_API, map[string]any{
+			"routing_key":  routingKey,
+			"event_action": "trigger",
+			"dedup_key":    dedup,
+			"payload": map[string]any{
+				"summary":        summary,
+				"source":         SERVICE_NAME.Value(),
+				"severity":       "error",
+				"component":      key,
+				"custom_details": map[string]string{"error": reason},
+			},
+		})
+	case INCIDENT_PROVIDER_OPSGENIE:
+		apiKey, _ := OPSGENIE_API_KEY.Value()
+
+		req, err = incidentRequest(ctx, OPSGENIE_API_URL.Value().JoinPath("v2", "alerts").String(), map[string]any{
+			"message":     summary,
+			"alias":       dedup,
+			"description": reason,
+			"source":      SERVICE_NAME.Value(),
+			"priority":    "P2",
+			"tags":        []string{key},
+		})
+		if req != nil {
+			req.Header.Set("Authorization", "GenieKey "+apiKey)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := incidentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("%s: %s: %s", INCIDENT_PROVIDER.Value(), res.Status, message)
+	}
+
+	return nil
+}
+
+func incidentRequest(ctx context.Context, endpoint string, payload any) (*http.Request, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
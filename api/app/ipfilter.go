@@ -0,0 +1,187 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Admin routes are served under this prefix and are the only ones the allow
+// list applies to
+const ADMIN_PATH_PREFIX = "/admin"
+
+var ipDenied metric.Int64Counter
+
+type ipFilter struct {
+	mu         sync.RWMutex
+	deny       []*net.IPNet
+	adminAllow []*net.IPNet
+}
+
+// Kept so a config reload can replace the lists
+var ipFilters *ipFilter
+
+func createIpFilter(ctx context.Context) *ipFilter {
+	filter := &ipFilter{}
+
+	list, ok := IP_DENY_LIST.Value()
+	if list, ok := runtimeSetting("IP_DENY_LIST", list, ok); ok {
+		filter.deny = parseIpList(ctx, "IP_DENY_LIST", list)
+	}
+	list, ok = ADMIN_ALLOW_LIST.Value()
+	if list, ok := runtimeSetting("ADMIN_ALLOW_LIST", list, ok); ok {
+		filter.adminAllow = parseIpList(ctx, "ADMIN_ALLOW_LIST", list)
+	}
+
+	counter, err := otel.Meter(SERVICE_NAME.Value()).Int64Counter("http.server.ip_denied",
+		metric.WithDescription("Requests rejected by the IP deny or admin allow list"))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "ip filter", err.Error())
+		panic(err)
+	}
+	ipDenied = counter
+
+	slog.DebugContext(ctx, "created ip filter", "deny", len(filter.deny), "admin allow", len(filter.adminAllow))
+
+	return filter
+}
+
+// Entries are comma separated addresses or CIDR ranges, an address on its own
+// is treated as a single host range
+func parseIpList(ctx context.Context, name string, list string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				err := fmt.Errorf("invalid address %s in %s", entry, name)
+				slog.ErrorContext(ctx, "error", "ip filter", err.Error())
+				panic(err)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			err = fmt.Errorf("invalid range %s in %s: %w", entry, name, err)
+			slog.ErrorContext(ctx, "error", "ip filter", err.Error())
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+func ipInList(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *ipFilter) replace(loaded *ipFilter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.deny = loaded.deny
+	f.adminAllow = loaded.adminAllow
+}
+
+// Runs after realIPMiddleware so the remote address is the client rather
+// than a proxy
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := requestIP(r)
+
+		f.mu.RLock()
+		deny, adminAllow := f.deny, f.adminAllow
+		f.mu.RUnlock()
+
+		reason := ""
+		switch {
+		case ip != nil && ipInList(ip, deny):
+			reason = "deny list"
+		case len(adminAllow) > 0 && isAdminPath(r.URL.Path) && (ip == nil || !ipInList(ip, adminAllow)):
+			reason = "admin allow list"
+		}
+
+		if reason == "" {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		slog.WarnContext(r.Context(), "denied", "ip", r.RemoteAddr, "reason", reason, "path", r.URL.Path)
+		ipDenied.Add(r.Context(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+
+		writeProblem(w, r, http.StatusForbidden, "Forbidden")
+	})
+}
+
+// Headers a client sent are passed on by proxies, only the entries appended
+// by the TRUSTED_PROXY_HOPS proxies in front of the server can be relied on.
+// X-Real-IP is ignored as there is no telling who set it
+func realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops := int(TRUSTED_PROXY_HOPS.Value())
+		if hops == 0 {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		forwarded := []string{}
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+
+		if len(forwarded) >= hops {
+			client := strings.TrimSpace(forwarded[len(forwarded)-hops])
+			// Given a port as the connection address has one, which the rate
+			// limiters split off
+			if net.ParseIP(client) != nil {
+				r.RemoteAddr = net.JoinHostPort(client, "0")
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+func isAdminPath(p string) bool {
+	return strings.HasPrefix(p, ADMIN_PATH_PREFIX) || strings.HasPrefix(p, API_V1_PREFIX+ADMIN_PATH_PREFIX) || strings.HasPrefix(p, DEBUG_PATH_PREFIX)
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const LEAD_STATUS_NEW = "new"
+
+// Held back from the team until released by an admin
+const LEAD_STATUS_QUARANTINED = "quarantined"
+
+// Held back until the submitter follows the link in the verification email
+const LEAD_STATUS_UNVERIFIED = "unverified"
+const LEAD_STATUS_CONTACTED = "contacted"
+const LEAD_STATUS_QUALIFIED = "qualified"
+const LEAD_STATUS_WON = "won"
+const LEAD_STATUS_LOST = "lost"
+const LEAD_STATUS_SPAM = "spam"
+
+var LEAD_STATUSES = []string{
+	LEAD_STATUS_NEW,
+	LEAD_STATUS_QUARANTINED,
+	LEAD_STATUS_UNVERIFIED,
+	LEAD_STATUS_CONTACTED,
+	LEAD_STATUS_QUALIFIED,
+	LEAD_STATUS_WON,
+	LEAD_STATUS_LOST,
+	LEAD_STATUS_SPAM,
+}
+
+func isLeadStatus(status string) bool {
+	for _, s := range LEAD_STATUSES {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+type lead struct {
+	ID           string            `json:"id"`
+	Email        string            `json:"email"`
+	Mobile       string            `json:"mobile"`
+	FirstName    string            `json:"firstName"`
+	LastName     string            `json:"lastName"`
+	EnquiryType  string            `json:"enquiryType"`
+	Enquiry      string            `json:"enquiry"`
+	Form         string            `json:"form"`
+	CustomFields map[string]string `json:"customFields"`
+	Attachments  []leadAttachment  `json:"attachments,omitempty"`
+	// Attachments spooled while storage was unavailable, see spool.go
+	PendingAttachments []leadPendingAttachment `json:"pendingAttachments,omitempty"`
+	// Delivery processors still to run, see outbox.go
+	Outbox         []leadOutboxEntry `json:"outbox,omitempty"`
+	BotScore       int               `json:"botScore"`
+	IP             string            `json:"ip"`
+	Geo            *leadGeo          `json:"geo,omitempty"`
+	Attribution    *leadAttribution  `json:"attribution,omitempty"`
+	Experiment     *leadExperiment   `json:"experiment,omitempty"`
+	Language       string            `json:"language,omitempty"`
+	Translation    *leadTranslation  `json:"translation,omitempty"`
+	Summary        string            `json:"summary,omitempty"`
+	SuggestedReply string            `json:"suggestedReply,omitempty"`
+	Consultation   *leadConsultation `json:"consultation,omitempty"`
+	Consent        *leadConsent      `json:"consent,omitempty"`
+	Score          int               `json:"score"`
+	Routes         []string          `json:"routes,omitempty"`
+	// Notifiers the lead has been sent to, so a retry only goes to the ones
+	// that failed, see notify.go
+	Notified []string `json:"notified,omitempty"`
+	Status   string   `json:"status"`
+	Flags    []string `json:"flags,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// Who is triaging the lead, see channel.go
+	Claim *leadClaim `json:"claim,omitempty"`
+	// Run through the pipeline by the self test, see selftest.go
+	Synthetic bool `json:"synthetic,omitempty"`
+	// Kept for the timeline, see timeline.go
+	Notes    []leadNote     `json:"notes,omitempty"`
+	Activity []leadActivity `json:"activity,omitempty"`
+	// Leads merged into this one, and the lead this one was merged into, see
+	// merge.go
+	Merges           []leadMerge `json:"merges,omitempty"`
+	MergedInto       string      `json:"mergedInto,omitempty"`
+	FirstResponseAt  *time.Time  `json:"firstResponseAt,omitempty"`
+	VerifiedAt       *time.Time  `json:"verifiedAt,omitempty"`
+	MobileVerifiedAt *time.Time  `json:"mobileVerifiedAt,omitempty"`
+	SlaBreachedAt    *time.Time  `json:"slaBreachedAt,omitempty"`
+	CrmSyncedAt      *time.Time  `json:"crmSyncedAt,omitempty"`
+	AnonymizedAt     *time.Time  `json:"anonymizedAt,omitempty"`
+	// Soft deleted, see deleted.go
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+type leadAttachment struct {
+	ID       string              `json:"id"`
+	Name     string              `json:"name"`
+	Metadata *attachmentMetadata `json:"metadata,omitempty"`
+}
+
+func newLead(form string, values map[string]string) *lead {
+	l := &lead{
+		ID:           uuid.NewString(),
+		Email:        values["email"],
+		Mobile:       values["mobile"],
+		FirstName:    values["firstName"],
+		LastName:     values["lastName"],
+		EnquiryType:  values["enquiryType"],
+		Enquiry:      values["enquiry"],
+		Form:         form,
+		CustomFields: map[string]string{},
+		Consent:      newLeadConsent(values["consent"]),
+		Status:       LEAD_STATUS_NEW,
+		CreatedAt:    time.Now(),
+	}
+
+	if l.EnquiryType == "" {
+		l.EnquiryType = DEFAULT_ENQUIRY_TYPE
+	}
+
+	for _, name := range l.rules().extraFields() {
+		if values[name] != "" {
+			l.CustomFields[name] = values[name]
+		}
+	}
+
+	return l
+}
+
+// Form values of the lead keyed by field name, as they are validated
+func (l *lead) values() map[string]string {
+	values := map[string]string{
+		"email":       l.Email,
+		"mobile":      l.Mobile,
+		"firstName":   l.FirstName,
+		"lastName":    l.LastName,
+		"enquiryType": l.EnquiryType,
+		"enquiry":     l.Enquiry,
+		"consent":     "",
+	}
+	if l.Consent != nil && l.Consent.Given {
+		values["consent"] = "true"
+	}
+	for name, value := range l.CustomFields {
+		values[name] = value
+	}
+
+	return values
+}
+
+// Rules of the form the lead was submitted with, leads from a form that has
+// since been removed fall back to the default form
+func (l *lead) rules() formRules {
+	forms := currentConfig().forms
+	if rules, ok := forms[l.Form]; ok {
+		return rules
+	}
+
+	return forms[DEFAULT_FORM]
+}
+
+func (l *lead) flag(flag string) {
+	for _, existing := range l.Flags {
+		if existing == flag {
+			return
+		}
+	}
+
+	l.Flags = append(l.Flags, flag)
+}
+
+func (l *lead) name() string {
+	return strings.TrimSpace(l.FirstName + " " + l.LastName)
+}
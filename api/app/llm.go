@@ -0,0 +1,102 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Any endpoint implementing the OpenAI chat completions API can be used, the
+// enquiry is sent without contact details
+const LLM_TIMEOUT = 20 * time.Second
+
+const LLM_PROMPT = `You help a design and development studio triage enquiries from their website.
+Respond with a JSON object with two string properties:
+"summary": a summary of the enquiry in at most two sentences,
+"reply": a short, friendly draft reply to the enquiry signed "The Skulpture team".`
+
+var llmClient = tracedClient(LLM_TIMEOUT)
+
+type llmProcessor struct{}
+
+func (llmProcessor) name() string { return "llm" }
+
+func (llmProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (llmProcessor) process(ctx context.Context, l *lead) error {
+	endpoint, ok := LLM_ENDPOINT.Value()
+	if !ok || strings.TrimSpace(l.Enquiry) == "" || l.Status == LEAD_STATUS_QUARANTINED {
+		return nil
+	}
+
+	enquiry := l.Enquiry
+	if l.Translation != nil {
+		enquiry = l.Translation.Enquiry
+	}
+
+	payload, err := json.Marshal(map[string]any{
+		"model": LLM_MODEL.Value(),
+		"messages": []map[string]string{
+			{"role": "system", "content": LLM_PROMPT},
+			{"role": "user", "content": fmt.Sprintf("First name: %s\n\n%s", l.FirstName, enquiry)},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key, ok := LLM_API_KEY.Value(); ok {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	res, err := llmClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("llm: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("llm: %s: %s", res.Status, body)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&completion); err != nil {
+		return fmt.Errorf("llm: %w", err)
+	}
+
+	if len(completion.Choices) == 0 {
+		return fmt.Errorf("llm: no choices in response")
+	}
+
+	var result struct {
+		Summary string `json:"summary"`
+		Reply   string `json:"reply"`
+	}
+	if err := json.Unmarshal([]byte(completion.Choices[0].Message.Content), &result); err != nil {
+		return fmt.Errorf("llm: %w", err)
+	}
+
+	l.Summary = strings.TrimSpace(result.Summary)
+	l.SuggestedReply = strings.TrimSpace(result.Reply)
+
+	return nil
+}
@@ -0,0 +1,513 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mrz1836/postmark"
+)
+
+// The postmark mailer sends auto-responses with the Postmark-hosted
+// templates, the local mailer renders the files in email/ (or EMAIL_TEMPLATES)
+// and sends the result over EMAIL_TRANSPORT
+const MAILER_POSTMARK = "postmark"
+const MAILER_LOCAL = "local"
+
+const EMAIL_TRANSPORT_POSTMARK = "postmark"
+const EMAIL_TRANSPORT_SMTP = "smtp"
+
+//go:embed email/*
+var emailTemplateFiles embed.FS
+
+// Each email is a subject, text and HTML template sharing a name, styles are
+// written inline as most mail clients drop style blocks
+type emailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+type email struct {
+	From        string
+	To          string
+	ReplyTo     string
+	Subject     string
+	TextBody    string
+	HTMLBody    string
+	Tag         string
+	Metadata    map[string]string
+	Headers     map[string]string
+	Attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// Where emails are sent, selected by EMAIL_TRANSPORT
+type mailer interface {
+	send(ctx context.Context, e email) (string, error)
+	sendTemplated(ctx context.Context, e templatedEmail) (string, error)
+	// Renders a Postmark template with the model without sending it
+	previewTemplate(ctx context.Context, templateId int, model map[string]interface{}) (postmark.ValidateTemplateResponse, error)
+}
+
+var errTemplatesNeedPostmark = errors.New("Postmark templates can only be sent with the postmark transport")
+
+type postmarkMailer struct {
+	client *postmark.Client
+}
+
+type smtpMailer struct{}
+
+func createMailer(ctx context.Context) mailer {
+	_, hasTemplate := POSTMARK_TEMPLATE.Value()
+	if MAILER.Value() == MAILER_POSTMARK && !hasTemplate {
+		err := errors.New("POSTMARK_TEMPLATE is required by the postmark mailer")
+		slog.ErrorContext(ctx, "error", "mailer", err.Error())
+		panic(err)
+	}
+
+	if MAILER.Value() == MAILER_POSTMARK && EMAIL_TRANSPORT.Value() == EMAIL_TRANSPORT_SMTP {
+		err := errTemplatesNeedPostmark
+		slog.ErrorContext(ctx, "error", "mailer", err.Error())
+		panic(err)
+	}
+
+	if EMAIL_TRANSPORT.Value() == EMAIL_TRANSPORT_SMTP {
+		if _, ok := SMTP_HOST.Value(); !ok {
+			err := errors.New("SMTP_HOST is required by the smtp transport")
+			slog.ErrorContext(ctx, "error", "mailer", err.Error())
+			panic(err)
+		}
+	}
+
+	slog.DebugContext(ctx, "created mailer", "mailer", MAILER.Value(), "transport", EMAIL_TRANSPORT.Value())
+
+	if EMAIL_TRANSPORT.Value() == EMAIL_TRANSPORT_SMTP {
+		return smtpMailer{}
+	}
+
+	return postmarkMailer{client: createPostmarkClient(ctx)}
+}
+
+// Loaded with either mailer, emails without a Postmark template fall back
+// to them
+func loadMailerTemplates(ctx context.Context) map[string]*emailTemplate {
+	var files fs.FS
+	files, _ = fs.Sub(emailTemplateFiles, "email")
+	if dir, ok := EMAIL_TEMPLATES.Value(); ok {
+		files = os.DirFS(dir)
+	}
+
+	templates, err := loadEmailTemplates(files)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "email templates", err.Error())
+		panic(err)
+	}
+	if _, ok := templates["auto-response"]; !ok && MAILER.Value() == MAILER_LOCAL {
+		err := errors.New("missing auto-response email template")
+		slog.ErrorContext(ctx, "error", "email templates", err.Error())
+		panic(err)
+	}
+
+	return templates
+}
+
+// Templates are named by their HTML file, the subject and text parts are
+// <name>.subject.txt and <name>.txt
+func loadEmailTemplates(files fs.FS) (map[string]*emailTemplate, error) {
+	names, err := fs.Glob(files, "*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*emailTemplate{}
+	for _, file := range names {
+		name := strings.TrimSuffix(file, ".html")
+
+		html, err := htmltemplate.ParseFS(files, file)
+		if err != nil {
+			return nil, err
+		}
+
+		subject, err := template.ParseFS(files, name+".subject.txt")
+		if err != nil {
+			return nil, err
+		}
+
+		text, err := template.ParseFS(files, name+".txt")
+		if err != nil {
+			return nil, err
+		}
+
+		templates[name] = &emailTemplate{subject: subject, text: text, html: html}
+	}
+
+	return templates, nil
+}
+
+// Enquiry types and leads outside business hours use a more specific template
+// when one exists, auto-response-<type> and auto-response-outside-hours
+func autoResponseTemplate(l *lead, model map[string]interface{}) string {
+	names := []string{}
+	if model["outsideBusinessHours"] == true {
+		names = append(names, "auto-response-"+l.EnquiryType+"-outside-hours", "auto-response-outside-hours")
+	}
+	names = append(names, "auto-response-"+l.EnquiryType)
+
+	for _, name := range names {
+		if _, ok := currentConfig().emailTemplates[name]; ok {
+			return name
+		}
+	}
+
+	return "auto-response"
+}
+
+func renderEmail(name string, model map[string]interface{}) (email, error) {
+	t, ok := currentConfig().emailTemplates[name]
+	if !ok {
+		return email{}, fmt.Errorf("unknown email template %s", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, model); err != nil {
+		return email{}, err
+	}
+	if err := t.text.Execute(&text, model); err != nil {
+		return email{}, err
+	}
+	if err := t.html.Execute(&html, model); err != nil {
+		return email{}, err
+	}
+
+	return email{
+		Subject:  strings.TrimSpace(subject.String()),
+		TextBody: text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
+
+// Sends a rendered email, returning the message ID
+func sendEmail(ctx context.Context, outgoing *outgoingSpool, e email) (string, error) {
+	return outgoing.send(ctx, OUTGOING_EMAIL, e)
+}
+
+// Suppressions are checked on every attempt, an address may have been
+// unsubscribed while the email was spooled
+func deliverEmail(ctx context.Context, m mailer, key string, e email) (string, error) {
+	if key != "" {
+		headers := map[string]string{EMAIL_IDEMPOTENCY_KEY_HEADER: key}
+		for name, value := range e.Headers {
+			headers[name] = value
+		}
+		e.Headers = headers
+	}
+
+	to, err := suppressions.filter(e.To)
+	if err != nil {
+		return "", err
+	}
+	e.To = to
+
+	return m.send(ctx, e)
+}
+
+func (m postmarkMailer) send(ctx context.Context, e email) (string, error) {
+	res, err := m.client.SendEmail(ctx, postmark.Email{
+		Attachments: postmarkAttachments(e.Attachments),
+		From:        e.From,
+		To:          e.To,
+		ReplyTo:     e.ReplyTo,
+		Subject:     e.Subject,
+		TextBody:    e.TextBody,
+		HTMLBody:    e.HTMLBody,
+		Tag:         e.Tag,
+		Metadata:    e.Metadata,
+		Headers:     postmarkHeaders(e.Headers),
+		TrackOpens:  e.HTMLBody != "",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return res.MessageID, nil
+}
+
+type templatedEmail = postmark.TemplatedEmail
+
+// Sends an email rendered from a Postmark template, returning the message ID
+func sendTemplatedEmail(ctx context.Context, outgoing *outgoingSpool, e templatedEmail) (string, error) {
+	return outgoing.send(ctx, OUTGOING_TEMPLATED_EMAIL, e)
+}
+
+func deliverTemplatedEmail(ctx context.Context, m mailer, key string, e templatedEmail) (string, error) {
+	if key != "" {
+		e.Headers = append([]postmark.Header{{Name: EMAIL_IDEMPOTENCY_KEY_HEADER, Value: key}}, e.Headers...)
+	}
+
+	to, err := suppressions.filter(e.To)
+	if err != nil {
+		return "", err
+	}
+	e.To = to
+
+	return m.sendTemplated(ctx, e)
+}
+
+func (m postmarkMailer) sendTemplated(ctx context.Context, e templatedEmail) (string, error) {
+	res, err := m.client.SendTemplatedEmail(ctx, e)
+	if err != nil {
+		return "", err
+	}
+
+	return res.MessageID, nil
+}
+
+func (m postmarkMailer) previewTemplate(ctx context.Context, templateId int, model map[string]interface{}) (postmark.ValidateTemplateResponse, error) {
+	template, err := m.client.GetTemplate(ctx, strconv.Itoa(templateId))
+	if err != nil {
+		return postmark.ValidateTemplateResponse{}, err
+	}
+
+	return m.client.ValidateTemplate(ctx, postmark.ValidateTemplateBody{
+		Subject:                    template.Subject,
+		TextBody:                   template.TextBody,
+		HTMLBody:                   template.HTMLBody,
+		TestRenderModel:            model,
+		InlineCSSForHTMLTestRender: true,
+	})
+}
+
+func (smtpMailer) sendTemplated(ctx context.Context, e templatedEmail) (string, error) {
+	return "", fmt.Errorf("%w: %w", errOutgoingRejected, errTemplatesNeedPostmark)
+}
+
+func (smtpMailer) previewTemplate(ctx context.Context, templateId int, model map[string]interface{}) (postmark.ValidateTemplateResponse, error) {
+	return postmark.ValidateTemplateResponse{}, errTemplatesNeedPostmark
+}
+
+func postmarkHeaders(headers map[string]string) []postmark.Header {
+	converted := []postmark.Header{}
+	for name, value := range headers {
+		converted = append(converted, postmark.Header{Name: name, Value: value})
+	}
+
+	return converted
+}
+
+func postmarkAttachments(attachments []emailAttachment) []postmark.Attachment {
+	converted := []postmark.Attachment{}
+	for _, a := range attachments {
+		converted = append(converted, postmark.Attachment{
+			Name:        a.Name,
+			ContentType: a.ContentType,
+			Content:     base64.StdEncoding.EncodeToString(a.Content),
+		})
+	}
+
+	return converted
+}
+
+func (smtpMailer) send(ctx context.Context, e email) (string, error) {
+	host, _ := SMTP_HOST.Value()
+	addr := net.JoinHostPort(host, strconv.Itoa(int(SMTP_PORT.Value())))
+
+	from, err := mail.ParseAddress(e.From)
+	if err != nil {
+		return "", err
+	}
+
+	recipients, err := mail.ParseAddressList(e.To)
+	if err != nil {
+		return "", err
+	}
+
+	to := []string{}
+	for _, recipient := range recipients {
+		to = append(to, recipient.Address)
+	}
+
+	// Display names are encoded for the headers
+	e.From = from.String()
+	e.To = strings.Join(addressStrings(recipients), ", ")
+
+	id, message, err := mimeMessage(e, from.Address)
+	if err != nil {
+		return "", err
+	}
+
+	var auth smtp.Auth
+	if username, ok := SMTP_USERNAME.Value(); ok {
+		password, _ := SMTP_PASSWORD.Value()
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	// net/smtp does not take a context, so the send is abandoned rather than
+	// cancelled once the context is done
+	result := make(chan error, 1)
+	go func() {
+		result <- smtp.SendMail(addr, auth, from.Address, to, message)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case err := <-result:
+		if err != nil {
+			return "", err
+		}
+	}
+
+	slog.DebugContext(ctx, "sent", "smtp message id", id, "to", e.To)
+
+	return id, nil
+}
+
+func mimeMessage(e email, sender string) (string, []byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	domain := "localhost"
+	if _, d, ok := strings.Cut(sender, "@"); ok {
+		domain = d
+	}
+	id := fmt.Sprintf("<%s@%s>", hex.EncodeToString(nonce), domain)
+
+	var message bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", e.From)
+	header.Set("To", e.To)
+	if e.ReplyTo != "" {
+		header.Set("Reply-To", e.ReplyTo)
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", id)
+	header.Set("MIME-Version", "1.0")
+	for key, value := range e.Metadata {
+		header.Set("X-Metadata-"+key, value)
+	}
+	for key, value := range e.Headers {
+		header.Set(key, value)
+	}
+
+	// Bodies are alternatives of each other, attachments wrap them in a
+	// mixed part
+	var alternative bytes.Buffer
+	bodies := multipart.NewWriter(&alternative)
+	for _, body := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", e.TextBody},
+		{"text/html; charset=utf-8", e.HTMLBody},
+	} {
+		if body.body == "" {
+			continue
+		}
+
+		part, err := bodies.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		writer := quotedprintable.NewWriter(part)
+		if _, err := writer.Write([]byte(body.body)); err != nil {
+			return "", nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := bodies.Close(); err != nil {
+		return "", nil, err
+	}
+
+	content := alternative.Bytes()
+	contentType := "multipart/alternative; boundary=" + bodies.Boundary()
+
+	if len(e.Attachments) > 0 {
+		var mixed bytes.Buffer
+		parts := multipart.NewWriter(&mixed)
+
+		part, err := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := part.Write(content); err != nil {
+			return "", nil, err
+		}
+
+		for _, a := range e.Attachments {
+			part, err := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {a.ContentType},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return "", nil, err
+			}
+
+			encoded := base64.StdEncoding.EncodeToString(a.Content)
+			for len(encoded) > 76 {
+				fmt.Fprintf(part, "%s\r\n", encoded[:76])
+				encoded = encoded[76:]
+			}
+			fmt.Fprintf(part, "%s\r\n", encoded)
+		}
+
+		if err := parts.Close(); err != nil {
+			return "", nil, err
+		}
+
+		content = mixed.Bytes()
+		contentType = "multipart/mixed; boundary=" + parts.Boundary()
+	}
+
+	header.Set("Content-Type", contentType)
+	for key, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(&message, "%s: %s\r\n", key, value)
+		}
+	}
+	message.WriteString("\r\n")
+	message.Write(content)
+
+	return id, message.Bytes(), nil
+}
+
+func addressStrings(addresses []*mail.Address) []string {
+	formatted := []string{}
+	for _, address := range addresses {
+		formatted = append(formatted, address.String())
+	}
+
+	return formatted
+}
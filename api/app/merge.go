@@ -0,0 +1,262 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Another lead from the same person, usually a second submission with a typo,
+// is folded into the lead kept. The merged lead stays in the store pointing
+// at the kept one but is left out of listings, and its values are kept on the
+// merge record so nothing it said is lost
+const EVENT_LEAD_MERGED = "lead.merged"
+
+var errLeadMerged = errors.New("lead has been merged into another lead")
+
+// Merges are serialised so two leads can't be merged into each other at once,
+// which would hide both from every listing
+var mergeMu sync.Mutex
+
+type leadMerge struct {
+	Lead string    `json:"lead"`
+	At   time.Time `json:"at"`
+	// Form values of the merged lead as it was submitted
+	Values    map[string]string `json:"values"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// What mergeLead changed on the kept lead, so a merge that can't be finished
+// is undone without losing what was written to the lead since
+type leadMergeChanges struct {
+	mobile       bool
+	firstName    bool
+	lastName     bool
+	customFields []string
+	// The enquiry before the merged one was appended to it
+	enquiry     *string
+	attachments []string
+	tags        []string
+	flags       []string
+	score       int
+}
+
+func mergeLead(target *lead, source *lead, now time.Time) leadMergeChanges {
+	values := source.values()
+	changes := leadMergeChanges{score: target.Score}
+
+	// The kept lead's values win, the merged lead only fills in what's missing
+	if target.Mobile == "" && source.Mobile != "" {
+		target.Mobile = source.Mobile
+		changes.mobile = true
+	}
+	if target.FirstName == "" && source.FirstName != "" {
+		target.FirstName = source.FirstName
+		changes.firstName = true
+	}
+	if target.LastName == "" && source.LastName != "" {
+		target.LastName = source.LastName
+		changes.lastName = true
+	}
+	if target.CustomFields == nil {
+		target.CustomFields = map[string]string{}
+	}
+	for name, value := range source.CustomFields {
+		if target.CustomFields[name] == "" {
+			target.CustomFields[name] = value
+			changes.customFields = append(changes.customFields, name)
+		}
+	}
+
+	if source.Enquiry != "" && source.Enquiry != target.Enquiry {
+		enquiry := target.Enquiry
+		changes.enquiry = &enquiry
+		target.Enquiry = fmt.Sprintf("%s\n\nMerged from %s received %s:\n%s", target.Enquiry, source.ID, source.CreatedAt.UTC().Format(time.RFC3339), source.Enquiry)
+	}
+
+	for _, attachment := range source.Attachments {
+		if !slices.ContainsFunc(target.Attachments, func(a leadAttachment) bool { return a.ID == attachment.ID }) {
+			target.Attachments = append(target.Attachments, attachment)
+			changes.attachments = append(changes.attachments, attachment.ID)
+		}
+	}
+	target.PendingAttachments = append(target.PendingAttachments, source.PendingAttachments...)
+
+	for _, tag := range source.Tags {
+		if !slices.Contains(target.Tags, tag) {
+			changes.tags = append(changes.tags, tag)
+		}
+	}
+	target.addTags(source.Tags...)
+	for _, flag := range source.Flags {
+		if !slices.Contains(target.Flags, flag) {
+			changes.flags = append(changes.flags, flag)
+		}
+		target.flag(flag)
+	}
+	target.Score = max(target.Score, source.Score)
+
+	target.Notes = append(target.Notes, source.Notes...)
+	target.Activity = append(target.Activity, source.Activity...)
+	sort.SliceStable(target.Activity, func(i, j int) bool {
+		return target.Activity[i].At.Before(target.Activity[j].At)
+	})
+
+	target.Merges = append(target.Merges, source.Merges...)
+	target.Merges = append(target.Merges, leadMerge{Lead: source.ID, At: now, Values: values, CreatedAt: source.CreatedAt})
+
+	return changes
+}
+
+// Takes back what mergeLead added, values changed on the lead since are kept
+func unmergeLead(target *lead, source *lead, changes leadMergeChanges) {
+	if changes.mobile && target.Mobile == source.Mobile {
+		target.Mobile = ""
+	}
+	if changes.firstName && target.FirstName == source.FirstName {
+		target.FirstName = ""
+	}
+	if changes.lastName && target.LastName == source.LastName {
+		target.LastName = ""
+	}
+	for _, name := range changes.customFields {
+		if target.CustomFields[name] == source.CustomFields[name] {
+			delete(target.CustomFields, name)
+		}
+	}
+
+	if changes.enquiry != nil {
+		target.Enquiry = *changes.enquiry
+	}
+
+	target.Attachments = slices.DeleteFunc(target.Attachments, func(a leadAttachment) bool {
+		return slices.Contains(changes.attachments, a.ID)
+	})
+	target.PendingAttachments = slices.DeleteFunc(target.PendingAttachments, func(p leadPendingAttachment) bool {
+		return slices.ContainsFunc(source.PendingAttachments, func(s leadPendingAttachment) bool { return s.ID == p.ID })
+	})
+
+	target.removeTags(changes.tags...)
+	target.Flags = slices.DeleteFunc(target.Flags, func(flag string) bool {
+		return slices.Contains(changes.flags, flag)
+	})
+	if target.Score == max(changes.score, source.Score) {
+		target.Score = changes.score
+	}
+
+	target.Notes = slices.DeleteFunc(target.Notes, func(n leadNote) bool {
+		return slices.ContainsFunc(source.Notes, func(s leadNote) bool { return s.ID == n.ID })
+	})
+	target.Activity = slices.DeleteFunc(target.Activity, func(a leadActivity) bool {
+		return slices.ContainsFunc(source.Activity, func(s leadActivity) bool { return s.ID == a.ID })
+	})
+	target.Merges = slices.DeleteFunc(target.Merges, func(m leadMerge) bool {
+		return m.Lead == source.ID || slices.ContainsFunc(source.Merges, func(s leadMerge) bool { return s.Lead == m.Lead })
+	})
+}
+
+func adminMergeLeadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Lead string `json:"lead"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	if req.Lead == "" || req.Lead == id {
+		writeProblem(w, r, http.StatusBadRequest, "Give the lead to merge into this one as lead")
+
+		return
+	}
+
+	mergeMu.Lock()
+	defer mergeMu.Unlock()
+
+	source, err := leads.get(r.Context(), req.Lead)
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+	if source.MergedInto != "" {
+		writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Lead %s has already been merged into %s", source.ID, source.MergedInto))
+
+		return
+	}
+
+	now := time.Now()
+	var changes leadMergeChanges
+	l, err := leads.update(r.Context(), id, func(l *lead) error {
+		if l.MergedInto != "" {
+			return errLeadMerged
+		}
+
+		changes = mergeLead(l, source, now)
+
+		return nil
+	})
+	if errors.Is(err, errLeadMerged) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	// Attachments belong to the kept lead now, so retention and reconcile
+	// only see them there. The source is checked again in case it was merged
+	// by another instance sharing the store since it was read
+	_, err = leads.update(r.Context(), source.ID, func(stored *lead) error {
+		if stored.MergedInto != "" {
+			return errLeadMerged
+		}
+
+		stored.MergedInto = l.ID
+		stored.Attachments = nil
+		stored.PendingAttachments = nil
+
+		return nil
+	})
+	if err != nil {
+		// The merge is taken back so the source isn't merged into it twice
+		_, undoErr := leads.update(context.WithoutCancel(r.Context()), id, func(l *lead) error {
+			unmergeLead(l, source, changes)
+
+			return nil
+		})
+		if undoErr != nil {
+			slog.ErrorContext(r.Context(), "error", "merge undo", undoErr.Error(), "lead", id, "merged", source.ID)
+		}
+
+		if errors.Is(err, errLeadMerged) {
+			writeProblem(w, r, http.StatusConflict, fmt.Sprintf("Lead %s has already been merged into another lead", source.ID))
+
+			return
+		}
+
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "merged", "lead", l.ID, "merged", source.ID)
+
+	events.publish(r.Context(), EVENT_LEAD_MERGED, l.ID, map[string]any{"merged": source.ID})
+
+	writeResponse(w, r, http.StatusOK, l)
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"image"
+	_ "image/gif"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Described on the lead so the team can tell what was attached without
+// downloading it. Metadata is read from the file as it was submitted, before
+// it is encrypted
+type attachmentMetadata struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Sha256   string `json:"sha256"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Pages    int    `json:"pages,omitempty"`
+}
+
+const PDF_MIME_TYPE = "application/pdf"
+
+type uploadedAttachment struct {
+	file     storedFile
+	metadata *attachmentMetadata
+	size     int64
+	sha256   string
+}
+
+// Page objects in the PDF, as opposed to the /Pages tree nodes holding them
+var pdfPagePattern = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// The sniffed type is used unless it is only generic, where the extension
+// says more
+func attachmentMimeType(filename string, header []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(header))
+	// Office documents are zip files underneath
+	if sniffed != "application/octet-stream" && sniffed != "text/plain" && sniffed != "application/zip" {
+		return sniffed
+	}
+
+	if byExtension, _, err := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))); err == nil {
+		return byExtension
+	}
+
+	return sniffed
+}
+
+// What can't be read is left out rather than failing the upload
+func readAttachmentMetadata(ctx context.Context, file attachment, hash string) *attachmentMetadata {
+	metadata := &attachmentMetadata{Size: file.size, Sha256: hash}
+
+	reader, err := file.open()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "attachment metadata", err.Error(), "file", file.filename)
+
+		return metadata
+	}
+	defer reader.Close()
+
+	buffered := bufio.NewReaderSize(reader, 512)
+	header, _ := buffered.Peek(512)
+	metadata.MimeType = attachmentMimeType(file.filename, header)
+
+	switch {
+	case strings.HasPrefix(metadata.MimeType, "image/"):
+		config, _, err := image.DecodeConfig(buffered)
+		if err != nil {
+			slog.DebugContext(ctx, "attachment metadata", "file", file.filename, "error", err.Error())
+
+			break
+		}
+
+		metadata.Width = config.Width
+		metadata.Height = config.Height
+	case metadata.MimeType == PDF_MIME_TYPE:
+		content, err := io.ReadAll(io.LimitReader(buffered, MAX_UPLOAD_SIZE))
+		if err != nil {
+			slog.DebugContext(ctx, "attachment metadata", "file", file.filename, "error", err.Error())
+
+			break
+		}
+
+		metadata.Pages = countPdfPages(content)
+	}
+
+	return metadata
+}
+
+// Counts page objects rather than parsing the page tree. Pages in compressed
+// object streams aren't seen, the count is left out when none are found
+func countPdfPages(content []byte) int {
+	if !bytes.HasPrefix(content, []byte("%PDF-")) {
+		return 0
+	}
+
+	return len(pdfPagePattern.FindAllIndex(content, -1))
+}
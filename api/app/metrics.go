@@ -0,0 +1,32 @@
+package app
+
+import (
+	"net/http"
+
+	prometheusclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// Metrics are exposed for scraping on /metrics when METRICS_TOKEN is set
+func createMeterProvider(resources *resource.Resource) (*sdkmetric.MeterProvider, error) {
+	// The service name is put on every series as well as target_info, so
+	// runtime metrics can be told apart when several services are scraped
+	exporter, err := prometheus.New(prometheus.WithResourceAsConstantLabels(attribute.NewAllowKeysFilter("service.name")))
+	if err != nil {
+		return nil, err
+	}
+
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(exporter),
+		sdkmetric.WithResource(resources),
+	), nil
+}
+
+func metricsHandler() http.Handler {
+	// Exemplars are only served to scrapers asking for OpenMetrics
+	return promhttp.HandlerFor(prometheusclient.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Forms with verify set on their mobile rule only accept a lead with a token
+// from POST /lead/verify-mobile, which sends a code with Twilio Verify and
+// exchanges it for the token once it is checked
+// see: https://www.twilio.com/docs/verify/api
+const TWILIO_VERIFY_API = "https://verify.twilio.com/v2"
+
+// Time a submitter has to send the form after confirming their mobile
+const MOBILE_TOKEN_EXPIRY = 30 * time.Minute
+
+const TWILIO_VERIFY_APPROVED = "approved"
+
+var errMobileNotVerified = errors.New("Mobile number is not verified")
+
+type twilioVerification struct {
+	Status string `json:"status"`
+}
+
+// Fails at startup rather than rejecting every lead of a form
+func checkMobileVerification(ctx context.Context) {
+	_, hasService := TWILIO_VERIFY_SERVICE_SID.Value()
+	_, hasSecret := linkSecret()
+
+	for id, form := range currentConfig().forms {
+		rule, ok := form["mobile"]
+		if !ok || !rule.Verify {
+			continue
+		}
+
+		var err error
+		switch {
+		case !hasService || !twilioConfigured():
+			err = fmt.Errorf("form %s verifies mobiles but TWILIO_VERIFY_SERVICE_SID or the Twilio credentials are not set", id)
+		case !hasSecret:
+			err = fmt.Errorf("form %s verifies mobiles but ATTACHMENT_LINK_SECRET, which signs mobile tokens, is not set", id)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "mobile verification", err.Error())
+			panic(err)
+		}
+	}
+}
+
+func mobileVerificationRequired(l *lead) bool {
+	rule, ok := l.rules()["mobile"]
+
+	return ok && rule.Verify
+}
+
+// Sends a code to the mobile, or checks the code when one is given and
+// responds with the token to submit the form with
+func (h *Handler) verifyMobileHandler(w http.ResponseWriter, r *http.Request) {
+	service, ok := TWILIO_VERIFY_SERVICE_SID.Value()
+	if !ok || !twilioConfigured() {
+		writeProblem(w, r, http.StatusServiceUnavailable, "Mobile verification is not configured")
+
+		return
+	}
+
+	mobile := strings.TrimSpace(r.PostFormValue("mobile"))
+	if err := h.validate.Var(mobile, "required,e164"); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid mobile")
+
+		return
+	}
+
+	code := strings.TrimSpace(r.PostFormValue("code"))
+	if code == "" {
+		form := url.Values{}
+		form.Set("To", mobile)
+		form.Set("Channel", "sms")
+
+		if err := twilioPost(r.Context(), fmt.Sprintf("%s/Services/%s/Verifications", TWILIO_VERIFY_API, url.PathEscape(service)), form, nil); err != nil {
+			slog.ErrorContext(r.Context(), "error", "verify mobile", err.Error())
+			writeProblem(w, r, http.StatusBadGateway, "Failed to send the code")
+
+			return
+		}
+
+		writeResponse(w, r, http.StatusAccepted, map[string]string{"status": "pending"})
+
+		return
+	}
+
+	form := url.Values{}
+	form.Set("To", mobile)
+	form.Set("Code", code)
+
+	// Twilio answers an expired or used verification with 404
+	verification := twilioVerification{}
+	err := twilioPost(r.Context(), fmt.Sprintf("%s/Services/%s/VerificationCheck", TWILIO_VERIFY_API, url.PathEscape(service)), form, &verification)
+	if err != nil || verification.Status != TWILIO_VERIFY_APPROVED {
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error", "verify mobile", err.Error())
+		}
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Invalid code")
+
+		return
+	}
+
+	expires := time.Now().Add(MOBILE_TOKEN_EXPIRY).Unix()
+
+	writeResponse(w, r, http.StatusOK, map[string]string{
+		"status":      TWILIO_VERIFY_APPROVED,
+		"mobileToken": fmt.Sprintf("%d.%s", expires, signMobileToken(mobile, expires)),
+	})
+}
+
+func signMobileToken(mobile string, expires int64) string {
+	secret, _ := linkSecret()
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "mobile.%s.%d", mobile, expires)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns when the mobile was verified if the submission has a valid token
+// for it
+func requestMobileVerification(r *http.Request, mobile string) *time.Time {
+	if _, ok := linkSecret(); !ok {
+		return nil
+	}
+
+	exp, sig, ok := strings.Cut(r.FormValue("mobileToken"), ".")
+	if !ok {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signMobileToken(strings.TrimSpace(mobile), expires))) {
+		return nil
+	}
+
+	verified := time.Unix(expires, 0).Add(-MOBILE_TOKEN_EXPIRY)
+
+	return &verified
+}
@@ -0,0 +1,315 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+)
+
+// Canned responses for the lead routes, served by cmd/mockapi so the form
+// flows can be developed without any backend credentials. Nothing here reads
+// the environment. Any route answers with an error or slowly when asked:
+//
+//	?mock=error&status=422  problem with the status, 500 by default
+//	?mock=slow&delay=5s     responds after the delay, 3s by default
+const MOCK_DEFAULT_DELAY = 3 * time.Second
+
+const MOCK_PROBLEM_DETAIL = "Mock error"
+
+func NewMockRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Use(middleware.Logger)
+	r.Use(mockCorsMiddleware)
+	r.Use(mockBehaviourMiddleware)
+
+	routes := mockRoutes()
+	r.Mount(API_V1_PREFIX, routes)
+	r.Mount("/", routes)
+
+	return r
+}
+
+func mockRoutes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/lead/token", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, r, http.StatusOK, map[string]string{"token": "mock-csrf-token"})
+	})
+	r.Get("/lead/schema", mockSchemaHandler)
+	r.Post("/lead", mockLeadHandler)
+	r.Get("/lead/progress/{token}", mockProgressHandler)
+
+	r.Get("/lead/verify", func(w http.ResponseWriter, r *http.Request) {
+		renderResult(w, r, http.StatusOK, "Thank you", "Your enquiry is confirmed, we will be in touch soon.", false)
+	})
+	r.Post("/lead/verify-mobile", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") == "" {
+			writeResponse(w, r, http.StatusAccepted, map[string]string{"status": "pending"})
+
+			return
+		}
+
+		writeResponse(w, r, http.StatusOK, map[string]string{"status": "approved", "token": "mock-mobile-token"})
+	})
+	r.Post("/lead/verify/resend", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	r.Route("/lead/draft", func(r chi.Router) {
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			id := uuid.NewString()
+			w.Header().Set("Location", path.Join(r.URL.Path, id))
+			writeResponse(w, r, http.StatusCreated, mockDraft(id, r))
+		})
+		r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			writeResponse(w, r, http.StatusOK, mockDraft(chi.URLParam(r, "id"), r))
+		})
+		r.Put("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			writeResponse(w, r, http.StatusOK, mockDraft(chi.URLParam(r, "id"), r))
+		})
+		r.Post("/{id}/confirm", mockLeadHandler)
+	})
+
+	r.Get("/unsubscribe", mockUnsubscribeHandler)
+	r.Post("/unsubscribe", mockUnsubscribeHandler)
+
+	r.Route("/uploads", func(r chi.Router) {
+		r.Use(tusMiddleware)
+
+		r.Options("/", tusOptionsHandler)
+		r.Post("/", mockUploads.create)
+		r.Head("/{id}", mockUploads.head)
+		r.Patch("/{id}", mockUploads.patch)
+		r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+
+	return r
+}
+
+func mockBehaviourMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("mock") {
+		case "error":
+			code, err := strconv.Atoi(r.URL.Query().Get("status"))
+			if err != nil || code < 400 || code > 599 {
+				code = http.StatusInternalServerError
+			}
+
+			leadError(w, r, MOCK_PROBLEM_DETAIL, code)
+
+			return
+		case "slow":
+			delay, err := time.ParseDuration(r.URL.Query().Get("delay"))
+			if err != nil {
+				delay = MOCK_DEFAULT_DELAY
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Any origin is allowed, the dev server of the frontend is usually on
+// another port
+func mockCorsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", LEAD_ID_HEADER+", Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.WriteHeader(http.StatusNoContent)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func mockLeadHandler(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && contentType != "application/x-www-form-urlencoded" {
+		r.ParseMultipartForm(MAX_UPLOAD_SIZE)
+	}
+
+	leadSuccess(w, r, uuid.NewString(), r.FormValue("redirectUrl"))
+}
+
+func mockUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	renderResult(w, r, http.StatusOK, "Unsubscribed", "You will no longer receive emails from us.", false)
+}
+
+func mockDraft(id string, r *http.Request) map[string]any {
+	r.ParseForm()
+
+	values := map[string]string{}
+	for name := range r.PostForm {
+		values[name] = r.PostForm.Get(name)
+	}
+
+	return map[string]any{
+		"id":      id,
+		"values":  values,
+		"uploads": r.PostForm["uploads"],
+		"expires": time.Now().Add(24 * time.Hour).UTC(),
+	}
+}
+
+func mockSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query().Get("formId")
+	if form == "" {
+		form = "default"
+	}
+
+	properties := map[string]any{}
+	for _, name := range CORE_FIELDS {
+		properties[name] = map[string]any{"type": "string", "title": fieldLabel(name)}
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]any{
+		"$schema":    JSON_SCHEMA_DIALECT,
+		"title":      form,
+		"type":       "object",
+		"properties": properties,
+		"required":   []string{"firstName", "email", "enquiry"},
+		"x-order":    CORE_FIELDS,
+		"x-files": map[string]any{
+			"field":        "files",
+			"uploadsField": "uploads",
+			"uploadUrl":    API_V1_PREFIX + "/uploads",
+			"maxFiles":     10,
+			"maxFileSize":  MAX_UPLOAD_SIZE,
+		},
+	})
+}
+
+// Sends a receiving then storing pass over a made up file so the progress UI
+// can be worked on without uploading anything
+func mockProgressHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "Streaming unsupported")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	const total = 4 << 20
+	for _, phase := range []fileProgress{
+		{Phase: "receiving", Index: -1, Total: total},
+		{Phase: "storing", Index: 0, File: "mock.jpg", Total: total},
+	} {
+		for loaded := int64(0); loaded <= total; loaded += total / 8 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(250 * time.Millisecond):
+			}
+
+			phase.Loaded = loaded
+			data, _ := json.Marshal(phase)
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// Uploads are only counted, their content is thrown away
+var mockUploads = &mockUploadStore{uploads: map[string]*mockUpload{}}
+
+type mockUpload struct {
+	offset int64
+	length int64
+}
+
+type mockUploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]*mockUpload
+}
+
+func (s *mockUploadStore) create(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid Upload-Length")
+
+		return
+	}
+
+	id := uuid.NewString()
+
+	s.mu.Lock()
+	s.uploads[id] = &mockUpload{length: length}
+	s.mu.Unlock()
+
+	w.Header().Set("Location", path.Join(r.URL.Path, id))
+	w.Header().Set("Upload-Expires", time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *mockUploadStore) head(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	upload, ok := s.uploads[chi.URLParam(r, "id")]
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *mockUploadStore) patch(w http.ResponseWriter, r *http.Request) {
+	received, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[chi.URLParam(r, "id")]
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Unknown upload")
+
+		return
+	}
+
+	upload.offset = min(upload.offset+received, upload.length)
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
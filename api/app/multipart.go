@@ -0,0 +1,215 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Parts of a multipart submission over MULTIPART_MEMORY are written to
+// MULTIPART_TEMP_DIR, which can point at an emptyDir or tmpfs in containers.
+// The temp files are removed once the request is done, including when a
+// handler panics
+type multipartFormContextKey struct{}
+
+// Bytes of the values of a multipart submission, on top of MULTIPART_MEMORY
+// as the standard library allows
+const MAX_MULTIPART_VALUES = 10 << 20
+
+var errMultipartCleanup = errors.New("multipart forms are only parsed behind multipartCleanupMiddleware")
+
+// Handlers see copies of the request, so the files of the form are kept here
+// rather than on the request
+type multipartForm struct {
+	mu    sync.Mutex
+	files map[string][]attachment
+	temp  []string
+}
+
+func checkMultipartTempDir(ctx context.Context) {
+	dir, ok := MULTIPART_TEMP_DIR.Value()
+	if !ok {
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		slog.ErrorContext(ctx, "error", "multipart temp dir", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created multipart temp dir", "dir", dir)
+}
+
+// Values are added to the form of the request as ParseMultipartForm would,
+// files are read back with multipartFiles
+func parseMultipartForm(r *http.Request) error {
+	// Already parsed, the body has been read
+	if r.PostForm != nil {
+		return nil
+	}
+
+	form, ok := r.Context().Value(multipartFormContextKey{}).(*multipartForm)
+	if !ok {
+		return errMultipartCleanup
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	memory := int64(MULTIPART_MEMORY.Value())
+	valueMemory := int64(MAX_MULTIPART_VALUES)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+
+			continue
+		}
+
+		if part.FileName() == "" {
+			var value strings.Builder
+			n, err := io.CopyN(&value, part, valueMemory+1)
+			part.Close()
+			if err != nil && err != io.EOF {
+				return err
+			}
+
+			valueMemory -= n
+			if valueMemory < 0 {
+				return multipart.ErrMessageTooLarge
+			}
+
+			r.PostForm.Add(name, value.String())
+
+			continue
+		}
+
+		file, err := form.store(part, &memory)
+		part.Close()
+		if err != nil {
+			return err
+		}
+
+		form.mu.Lock()
+		if form.files == nil {
+			form.files = map[string][]attachment{}
+		}
+		form.files[name] = append(form.files[name], file)
+		form.mu.Unlock()
+	}
+
+	// Posted values come before those of the query, as in the standard library
+	for name, values := range r.PostForm {
+		r.Form[name] = append(values, r.Form[name]...)
+	}
+
+	return nil
+}
+
+// Kept in memory while the form is within MULTIPART_MEMORY, written to
+// MULTIPART_TEMP_DIR past it
+func (f *multipartForm) store(part *multipart.Part, memory *int64) (attachment, error) {
+	filename := part.FileName()
+
+	var content bytes.Buffer
+	size, err := io.CopyN(&content, part, *memory+1)
+	if err != nil && err != io.EOF {
+		return attachment{}, err
+	}
+
+	if size <= *memory {
+		*memory -= size
+		buffered := content.Bytes()
+
+		return attachment{
+			filename: filename,
+			size:     size,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(buffered)), nil
+			},
+		}, nil
+	}
+
+	// Empty uses the system temp directory
+	dir, _ := MULTIPART_TEMP_DIR.Value()
+
+	temp, err := os.CreateTemp(dir, "multipart-")
+	if err != nil {
+		return attachment{}, err
+	}
+
+	f.mu.Lock()
+	f.temp = append(f.temp, temp.Name())
+	f.mu.Unlock()
+
+	size, err = io.Copy(temp, io.MultiReader(&content, part))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return attachment{}, err
+	}
+
+	path := temp.Name()
+
+	return attachment{
+		filename: filename,
+		size:     size,
+		open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, nil
+}
+
+// Files of the parsed multipart form by field name, empty when the request
+// wasn't multipart
+func multipartFiles(r *http.Request) map[string][]attachment {
+	form, ok := r.Context().Value(multipartFormContextKey{}).(*multipartForm)
+	if !ok {
+		return nil
+	}
+
+	form.mu.Lock()
+	defer form.mu.Unlock()
+
+	return form.files
+}
+
+func multipartCleanupMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		form := &multipartForm{}
+		defer func() {
+			form.mu.Lock()
+			defer form.mu.Unlock()
+
+			for _, path := range form.temp {
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+					slog.ErrorContext(r.Context(), "error", "multipart cleanup", err.Error())
+				}
+			}
+		}()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), multipartFormContextKey{}, form)))
+	})
+}
@@ -0,0 +1,448 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Tells the team about a new lead through the notifiers of every route it
+// matches, or the default route when it matches none
+const EVENT_LEAD_NOTIFIED = "lead.notified"
+const EVENT_NOTIFICATION_FAILED = "notification.failed"
+
+type notifier interface {
+	name() string
+	notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error
+}
+
+type notificationRoute struct {
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords"`
+	Email    string   `json:"email,omitempty"`
+	Slack    string   `json:"slack,omitempty"`
+	Discord  string   `json:"discord,omitempty"`
+	Teams    string   `json:"teams,omitempty"`
+	// Numeric ID of the chat the Telegram bot sends to
+	Telegram string `json:"telegram,omitempty"`
+	// Leads from these forms are sent to the route whatever they say
+	Forms []string `json:"forms,omitempty"`
+	// Added to leads sent to the route
+	Tags []string `json:"tags,omitempty"`
+	// Matched independently of other routes, leads matching no route go to
+	// the default route
+	notifiers []notifier
+}
+
+const DEFAULT_ROUTE = "default"
+
+var defaultRoute *notificationRoute
+
+// Sent for every lead that meets their threshold whatever the route
+var escalationNotifiers []notifier
+
+func createNotifiers(ctx context.Context) {
+	defaultRoute = &notificationRoute{Name: DEFAULT_ROUTE}
+	if recipients, ok := TEAM_NOTIFICATION_EMAIL.Value(); ok {
+		defaultRoute.Email = recipients
+	}
+	if webhook, ok := SLACK_WEBHOOK_URL.Value(); ok {
+		defaultRoute.Slack = webhook.String()
+	}
+	if webhook, ok := DISCORD_WEBHOOK_URL.Value(); ok {
+		defaultRoute.Discord = webhook.String()
+	}
+	if webhook, ok := TEAMS_WEBHOOK_URL.Value(); ok {
+		defaultRoute.Teams = webhook.String()
+	}
+	if chat, ok := TELEGRAM_CHAT_ID.Value(); ok {
+		defaultRoute.Telegram = chat
+	}
+	defaultRoute.notifiers = defaultRoute.createNotifiers()
+
+	escalationNotifiers = []notifier{}
+	if recipients, ok := SMS_NOTIFICATION_TO.Value(); ok {
+		escalationNotifiers = append(escalationNotifiers, smsNotifier{
+			recipients: strings.Split(recipients, ","),
+			minScore:   int(SMS_NOTIFICATION_MIN_SCORE.Value()),
+		})
+	}
+
+	if project, ok := FCM_PROJECT_ID.Value(); ok {
+		pushDevices = createPushDeviceRegistry(ctx)
+		escalationNotifiers = append(escalationNotifiers, pushNotifier{project: project, service: createFcmService(ctx)})
+	}
+
+	slog.DebugContext(ctx, "created notifiers", "default", len(defaultRoute.notifiers), "escalation", len(escalationNotifiers))
+}
+
+func loadNotificationRoutes(ctx context.Context) []*notificationRoute {
+	file, ok := NOTIFICATION_ROUTES.Value()
+	if !ok {
+		return []*notificationRoute{}
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "notification routes", err.Error())
+		panic(err)
+	}
+
+	configured := []*notificationRoute{}
+	if err := json.Unmarshal(content, &configured); err != nil {
+		slog.ErrorContext(ctx, "error", "notification routes", err.Error())
+		panic(err)
+	}
+
+	for _, route := range configured {
+		tags, err := normalizeTags(route.Tags)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "notification routes", err.Error())
+			panic(err)
+		}
+		route.Tags = tags
+
+		route.notifiers = route.createNotifiers()
+		if len(route.notifiers) == 0 {
+			err := fmt.Errorf("route %s has no recipients", route.Name)
+			slog.ErrorContext(ctx, "error", "notification routes", err.Error())
+			panic(err)
+		}
+	}
+
+	return configured
+}
+
+func (route *notificationRoute) createNotifiers() []notifier {
+	configured := []notifier{}
+	if route.Email != "" {
+		configured = append(configured, emailNotifier{recipients: route.Email})
+	}
+	if route.Slack != "" {
+		configured = append(configured, slackNotifier{webhook: route.Slack})
+	}
+	if route.Discord != "" {
+		configured = append(configured, discordNotifier{webhook: route.Discord})
+	}
+	if route.Teams != "" {
+		configured = append(configured, teamsNotifier{webhook: route.Teams})
+	}
+	if route.Telegram != "" {
+		configured = append(configured, telegramNotifier{chat: route.Telegram})
+	}
+
+	return configured
+}
+
+func (route *notificationRoute) matches(l *lead) bool {
+	if slices.Contains(route.Forms, l.Form) {
+		return true
+	}
+
+	enquiry := strings.ToLower(l.Enquiry)
+	if l.Translation != nil {
+		enquiry += "\n" + strings.ToLower(l.Translation.Enquiry)
+	}
+
+	for _, keyword := range route.Keywords {
+		if containsWord(enquiry, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsWord(text string, word string) bool {
+	if word == "" {
+		return false
+	}
+
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }) {
+		if field == word {
+			return true
+		}
+	}
+
+	// Phrases are matched as a substring
+	return strings.Contains(word, " ") && strings.Contains(text, word)
+}
+
+func matchRoutes(l *lead) []*notificationRoute {
+	matched := []*notificationRoute{}
+	if name := l.enquiryType().Route; name != "" {
+		matched = append(matched, findRoute(name))
+	}
+
+	for _, route := range currentConfig().routes {
+		if route.matches(l) && (len(matched) == 0 || route != matched[0]) {
+			matched = append(matched, route)
+		}
+	}
+
+	if len(matched) == 0 {
+		return []*notificationRoute{defaultRoute}
+	}
+
+	return matched
+}
+
+func routeLead(l *lead) {
+	l.Routes = []string{}
+	for _, route := range matchRoutes(l) {
+		l.Routes = append(l.Routes, route.Name)
+		l.addTags(route.Tags...)
+	}
+}
+
+func findRoute(name string) *notificationRoute {
+	for _, route := range currentConfig().routes {
+		if route.Name == name {
+			return route
+		}
+	}
+
+	if name == DEFAULT_ROUTE {
+		return defaultRoute
+	}
+
+	return nil
+}
+
+func notifyTeam(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	if len(l.Routes) == 0 {
+		routeLead(l)
+	}
+
+	// Keyed by route as each route has its own notifier of a kind
+	selected := map[string]notifier{}
+	keys := []string{}
+	for _, name := range l.Routes {
+		if route := findRoute(name); route != nil {
+			for _, n := range route.notifiers {
+				key := route.Name + "/" + n.name()
+				if _, ok := selected[key]; ok {
+					continue
+				}
+				selected[key] = n
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	// Notifiers with a minimum score are kept for the leads worth
+	// interrupting someone for
+	for _, n := range escalationNotifiers {
+		if threshold, ok := n.(interface{ threshold() int }); ok && l.Score < threshold.threshold() {
+			continue
+		}
+
+		key := "escalation/" + n.name()
+		selected[key] = n
+		keys = append(keys, key)
+	}
+
+	errs := []error{}
+	for _, key := range keys {
+		n := selected[key]
+		if slices.Contains(l.Notified, key) {
+			continue
+		}
+
+		err := n.notify(ctx, outgoing, l)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "notify", err.Error(), "notifier", n.name(), "lead", l.ID)
+			events.publish(ctx, EVENT_NOTIFICATION_FAILED, l.ID, map[string]any{"notifier": n.name(), "error": err.Error()})
+		} else {
+			events.publish(ctx, EVENT_LEAD_NOTIFIED, l.ID, map[string]any{"notifier": n.name()})
+		}
+
+		// Sends the outgoing spool has taken are retried there rather than by
+		// the outbox
+		if err != nil && !isDelivered(err) {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+
+			continue
+		}
+
+		l.Notified = append(l.Notified, key)
+	}
+
+	slog.DebugContext(ctx, "notified", "lead", l.ID, "routes", strings.Join(l.Routes, ","), "notifiers", len(keys))
+
+	// Only failures are returned, the outbox retries them and skips the
+	// notifiers in l.Notified
+	if len(errs) > 0 {
+		return fmt.Errorf("notify: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// Sends a JSON payload to a chat webhook
+func postWebhook(ctx context.Context, outgoing *outgoingSpool, endpoint string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = outgoing.send(ctx, OUTGOING_WEBHOOK, outgoingWebhook{Endpoint: endpoint, Body: body})
+
+	return err
+}
+
+// Client errors other than timeouts and rate limits won't succeed on a retry
+func deliverWebhook(ctx context.Context, key string, w outgoingWebhook) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Endpoint, bytes.NewReader(w.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(IDEMPOTENCY_KEY_HEADER, key)
+	}
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		if res.StatusCode < http.StatusInternalServerError && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %s: %s", errOutgoingRejected, res.Status, message)
+		}
+
+		return fmt.Errorf("%s: %s", res.Status, message)
+	}
+
+	return nil
+}
+
+// Plain text summary of a lead used in team notifications
+func leadSummary(l *lead) string {
+	var summary strings.Builder
+
+	fmt.Fprintf(&summary, "Name: %s\n", l.name())
+	fmt.Fprintf(&summary, "Email: %s\n", l.Email)
+	fmt.Fprintf(&summary, "Mobile: %s\n", l.Mobile)
+	fmt.Fprintf(&summary, "Enquiry type: %s\n", l.EnquiryType)
+	if l.Form != DEFAULT_FORM {
+		fmt.Fprintf(&summary, "Form: %s\n", l.Form)
+	}
+
+	names := []string{}
+	for name := range l.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&summary, "%s: %s\n", fieldLabel(name), l.CustomFields[name])
+	}
+
+	if l.Geo != nil {
+		fmt.Fprintf(&summary, "Location: %s\n", strings.Join(nonEmpty(l.Geo.City, l.Geo.Country, l.Geo.Timezone), ", "))
+	}
+	fmt.Fprintf(&summary, "Score: %d\n", l.Score)
+	if len(l.Flags) > 0 {
+		fmt.Fprintf(&summary, "Flags: %s\n", strings.Join(l.Flags, ", "))
+	}
+
+	if l.Summary != "" {
+		fmt.Fprintf(&summary, "\nSummary:\n%s\n", l.Summary)
+	}
+
+	fmt.Fprintf(&summary, "\n%s\n", l.Enquiry)
+
+	if l.Translation != nil {
+		fmt.Fprintf(&summary, "\nTranslation from %s:\n%s\n", l.Language, l.Translation.Enquiry)
+	}
+
+	if l.SuggestedReply != "" {
+		fmt.Fprintf(&summary, "\nSuggested reply:\n%s\n", l.SuggestedReply)
+	}
+
+	return summary.String()
+}
+
+func nonEmpty(values ...string) []string {
+	present := []string{}
+	for _, value := range values {
+		if value != "" {
+			present = append(present, value)
+		}
+	}
+
+	return present
+}
+
+var webhookClient = tracedClient(10 * time.Second)
+
+type emailNotifier struct {
+	recipients string
+}
+
+func (emailNotifier) name() string { return "email" }
+
+func (n emailNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	id, err := sendEmail(ctx, outgoing, email{
+		From:     POSTMARK_FROM.Value(),
+		To:       n.recipients,
+		ReplyTo:  l.Email,
+		Subject:  fmt.Sprintf("New lead from %s", l.name()),
+		TextBody: leadSummary(l),
+		Tag:      "lead-notification",
+		Metadata: map[string]string{"lead": l.ID},
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.DebugContext(ctx, "notified", "message id", id, "to", n.recipients, "lead", l.ID)
+
+	return nil
+}
+
+// Quarantined leads are only sent to the team once they are released
+type notifyProcessor struct {
+	outgoing *outgoingSpool
+}
+
+func (notifyProcessor) name() string { return "notify" }
+
+func (notifyProcessor) stage() processorStage { return PROCESSOR_STAGE_DELIVER }
+
+func (p notifyProcessor) process(ctx context.Context, l *lead) error {
+	if l.Status == LEAD_STATUS_QUARANTINED {
+		slog.InfoContext(ctx, "quarantined", "lead", l.ID, "flags", strings.Join(l.Flags, ","))
+
+		return nil
+	}
+
+	return notifyTeam(ctx, p.outgoing, l)
+}
+
+// Routes are chosen while enriching so they are stored with the lead
+type routeProcessor struct{}
+
+func (routeProcessor) name() string { return "route" }
+
+func (routeProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (routeProcessor) process(ctx context.Context, l *lead) error {
+	routeLead(l)
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Delivery processors a lead is due are saved with the lead itself, so the
+// lead and its side effects are written together and a crash between saving
+// and sending leaves them to be delivered rather than skipped. Each entry is
+// removed once its processor succeeds and retried with a backoff otherwise
+const EVENT_OUTBOX_FAILED = "outbox.failed"
+
+type leadOutboxEntry struct {
+	Processor     string    `json:"processor"`
+	Attempts      int       `json:"attempts,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+}
+
+// Leads being delivered, so the worker doesn't deliver one a request is
+// still on
+var delivering = struct {
+	sync.Mutex
+	leads map[string]bool
+}{leads: map[string]bool{}}
+
+// Called before the lead is saved, or in the update that makes it deliverable
+func queueDelivery(l *lead) {
+	now := time.Now()
+	for _, p := range processors {
+		if p.stage() == PROCESSOR_STAGE_DELIVER {
+			l.Outbox = append(l.Outbox, leadOutboxEntry{Processor: p.name(), NextAttemptAt: now})
+		}
+	}
+}
+
+// Queues one delivery processor again for a lead that skipped it, nothing is
+// queued when the processor isn't configured or is already queued
+func queueProcessor(l *lead, name string) {
+	if findProcessor(name) == nil {
+		return
+	}
+
+	for _, entry := range l.Outbox {
+		if entry.Processor == name {
+			return
+		}
+	}
+
+	l.Outbox = append(l.Outbox, leadOutboxEntry{Processor: name, NextAttemptAt: time.Now()})
+}
+
+func findProcessor(name string) processor {
+	for _, p := range processors {
+		if p.name() == name {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func claimDelivery(id string) bool {
+	delivering.Lock()
+	defer delivering.Unlock()
+
+	if delivering.leads[id] {
+		return false
+	}
+	delivering.leads[id] = true
+
+	return true
+}
+
+func releaseDelivery(id string) {
+	delivering.Lock()
+	defer delivering.Unlock()
+
+	delete(delivering.leads, id)
+}
+
+// Errors the outbox doesn't retry, the outgoing spool already has the send or
+// it can't succeed
+func isDelivered(err error) bool {
+	return errors.Is(err, errOutgoingSpooled) || errors.Is(err, errOutgoingRejected) || errors.Is(err, errEmailSuppressed)
+}
+
+// Runs the due entries of the outbox in order, each outcome is saved before
+// the next runs so a crash repeats at most one of them
+func deliverOutbox(ctx context.Context, l *lead) {
+	if !claimDelivery(l.ID) {
+		return
+	}
+	defer releaseDelivery(l.ID)
+
+	now := time.Now()
+	for _, entry := range l.Outbox {
+		if entry.NextAttemptAt.After(now) {
+			continue
+		}
+
+		p := findProcessor(entry.Processor)
+
+		var err error
+		switch {
+		case p == nil:
+			err = fmt.Errorf("unknown lead processor %s", entry.Processor)
+			entry.Attempts = int(OUTBOX_MAX_ATTEMPTS.Value())
+		case l.Synthetic:
+			// Synthetic leads go through the outbox without being sent anywhere
+		default:
+			err = p.process(ctx, l)
+		}
+
+		delivered := err == nil || isDelivered(err)
+		if !delivered {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			entry.NextAttemptAt = time.Now().Add(retryBackoff(OUTBOX_RETRY_INTERVAL.Value(), entry.Attempts))
+
+			slog.ErrorContext(ctx, "error", "processor", err.Error(), "processor", entry.Processor, "lead", l.ID, "attempts", entry.Attempts)
+		}
+
+		failed := !delivered && entry.Attempts >= int(OUTBOX_MAX_ATTEMPTS.Value())
+		if failed {
+			events.publish(ctx, EVENT_OUTBOX_FAILED, l.ID, map[string]any{
+				"processor": entry.Processor,
+				"attempts":  entry.Attempts,
+				"error":     err.Error(),
+			})
+		}
+
+		updated, err := leads.update(ctx, l.ID, func(stored *lead) error {
+			outbox := []leadOutboxEntry{}
+			for _, e := range stored.Outbox {
+				switch {
+				case e.Processor != entry.Processor:
+					outbox = append(outbox, e)
+				case !delivered && !failed:
+					outbox = append(outbox, entry)
+				}
+			}
+			stored.Outbox = outbox
+			// Kept whatever the outcome as a failed notify has still reached
+			// some of its notifiers
+			stored.Notified = l.Notified
+
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "outbox", err.Error(), "lead", l.ID)
+
+			return
+		}
+
+		l.Outbox = updated.Outbox
+	}
+}
+
+func watchOutbox(ctx context.Context) {
+	deliverPending(ctx)
+
+	ticker := time.NewTicker(OUTBOX_RETRY_INTERVAL.Value())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deliverPending(ctx)
+		}
+	}
+}
+
+// The first run after a restart picks up leads saved but never delivered
+func deliverPending(ctx context.Context) {
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "outbox", err.Error())
+
+		return
+	}
+
+	for _, l := range all {
+		if len(l.Outbox) > 0 {
+			deliverOutbox(ctx, l)
+		}
+	}
+}
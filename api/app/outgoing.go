@@ -0,0 +1,311 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Emails and webhook posts are written to OUTGOING_SPOOL_DIR before they are
+// sent and removed once the provider accepts them, so a crash or an outage
+// leaves them to be replayed rather than lost. Replays send the same
+// idempotency key as the first attempt so receivers can drop duplicates
+const EVENT_OUTGOING_FAILED = "outgoing.failed"
+const EVENT_OUTGOING_REPLAYED = "outgoing.replayed"
+
+const OUTGOING_EMAIL = "email"
+const OUTGOING_TEMPLATED_EMAIL = "templated-email"
+const OUTGOING_WEBHOOK = "webhook"
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+const EMAIL_IDEMPOTENCY_KEY_HEADER = "X-Idempotency-Key"
+
+const OUTGOING_MAX_BACKOFF = time.Hour
+
+// Jobs that used up their attempts or were rejected are moved here
+const OUTGOING_FAILED_DIR = "failed"
+
+// The provider refused the request, sending it again won't change that
+var errOutgoingRejected = errors.New("rejected")
+
+// The send failed and is kept in the spool to be retried
+var errOutgoingSpooled = errors.New("spooled")
+
+type outgoingJob struct {
+	ID            string          `json:"id"`
+	Kind          string          `json:"kind"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+}
+
+type outgoingWebhook struct {
+	Endpoint string          `json:"endpoint"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Sends a payload of a kind, the key is empty when the spool is disabled.
+// Returns the message ID where the provider gives one
+type outgoingSender func(ctx context.Context, m mailer, key string, payload json.RawMessage) (string, error)
+
+var outgoingSenders = map[string]outgoingSender{
+	OUTGOING_EMAIL: func(ctx context.Context, m mailer, key string, payload json.RawMessage) (string, error) {
+		var e email
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return "", err
+		}
+
+		return deliverEmail(ctx, m, key, e)
+	},
+	OUTGOING_TEMPLATED_EMAIL: func(ctx context.Context, m mailer, key string, payload json.RawMessage) (string, error) {
+		var e templatedEmail
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return "", err
+		}
+
+		return deliverTemplatedEmail(ctx, m, key, e)
+	},
+	OUTGOING_WEBHOOK: func(ctx context.Context, m mailer, key string, payload json.RawMessage) (string, error) {
+		var w outgoingWebhook
+		if err := json.Unmarshal(payload, &w); err != nil {
+			return "", err
+		}
+
+		return "", deliverWebhook(ctx, key, w)
+	},
+}
+
+// Emails are sent with the mailer of the handler, without a dir nothing is
+// spooled
+type outgoingSpool struct {
+	dir    string
+	mailer mailer
+
+	mu sync.Mutex
+	// Jobs being sent, so a replay doesn't send one a request is still on
+	sending map[string]bool
+}
+
+func createOutgoingSpool(ctx context.Context, m mailer) *outgoingSpool {
+	dir, ok := OUTGOING_SPOOL_DIR.Value()
+	if !ok {
+		return &outgoingSpool{mailer: m}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, OUTGOING_FAILED_DIR), 0o700); err != nil {
+		slog.ErrorContext(ctx, "error", "outgoing spool", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created outgoing spool", "dir", dir)
+
+	return &outgoingSpool{dir: dir, mailer: m, sending: map[string]bool{}}
+}
+
+func (s *outgoingSpool) send(ctx context.Context, kind string, payload any) (string, error) {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if s.dir == "" {
+		return outgoingSenders[kind](ctx, s.mailer, "", content)
+	}
+
+	job := &outgoingJob{
+		ID:        uuid.NewString(),
+		Kind:      kind,
+		Payload:   content,
+		CreatedAt: time.Now(),
+	}
+	job.NextAttemptAt = job.CreatedAt
+
+	s.claim(job.ID)
+	defer s.release(job.ID)
+
+	if err := s.write(job); err != nil {
+		return "", err
+	}
+
+	return s.attempt(ctx, job)
+}
+
+func (s *outgoingSpool) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *outgoingSpool) write(job *outgoingJob) error {
+	return writeJsonFile(s.path(job.ID), job)
+}
+
+func (s *outgoingSpool) claim(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sending[id] {
+		return false
+	}
+	s.sending[id] = true
+
+	return true
+}
+
+func (s *outgoingSpool) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sending, id)
+}
+
+// The job is removed once sent, kept with a later attempt when it failed,
+// and moved aside once it can't be sent. Callers claim the job first
+func (s *outgoingSpool) attempt(ctx context.Context, job *outgoingJob) (string, error) {
+	send, ok := outgoingSenders[job.Kind]
+	if !ok {
+		err := fmt.Errorf("unknown outgoing kind %s", job.Kind)
+		s.fail(ctx, job, err)
+
+		return "", err
+	}
+
+	id, err := send(ctx, s.mailer, job.ID, job.Payload)
+	if err == nil {
+		if err := os.Remove(s.path(job.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "outgoing spool remove", err.Error(), "job", job.ID)
+		}
+
+		return id, nil
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+
+	if errors.Is(err, errOutgoingRejected) || errors.Is(err, errEmailSuppressed) || job.Attempts >= int(OUTGOING_MAX_ATTEMPTS.Value()) {
+		s.fail(ctx, job, err)
+
+		return "", err
+	}
+
+	job.NextAttemptAt = time.Now().Add(retryBackoff(OUTGOING_RETRY_INTERVAL.Value(), job.Attempts))
+
+	if err := s.write(job); err != nil {
+		slog.ErrorContext(ctx, "error", "outgoing spool write", err.Error(), "job", job.ID)
+	}
+
+	slog.WarnContext(ctx, "outgoing spooled", "job", job.ID, "kind", job.Kind, "attempts", job.Attempts, "retry at", job.NextAttemptAt, "error", err.Error())
+
+	return "", fmt.Errorf("%w: %w", errOutgoingSpooled, err)
+}
+
+// Doubles from the interval with each attempt, up to an hour
+func retryBackoff(interval time.Duration, attempts int) time.Duration {
+	backoff := interval << (attempts - 1)
+	if backoff <= 0 || backoff > OUTGOING_MAX_BACKOFF {
+		return OUTGOING_MAX_BACKOFF
+	}
+
+	return backoff
+}
+
+func (s *outgoingSpool) fail(ctx context.Context, job *outgoingJob, err error) {
+	slog.ErrorContext(ctx, "error", "outgoing", err.Error(), "job", job.ID, "kind", job.Kind, "attempts", job.Attempts)
+
+	if err := writeJsonFile(filepath.Join(s.dir, OUTGOING_FAILED_DIR, job.ID+".json"), job); err != nil {
+		slog.ErrorContext(ctx, "error", "outgoing spool write", err.Error(), "job", job.ID)
+	}
+	if err := os.Remove(s.path(job.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.ErrorContext(ctx, "error", "outgoing spool remove", err.Error(), "job", job.ID)
+	}
+
+	events.publish(ctx, EVENT_OUTGOING_FAILED, "", map[string]any{
+		"job":      job.ID,
+		"kind":     job.Kind,
+		"attempts": job.Attempts,
+		"error":    err.Error(),
+	})
+}
+
+// Jobs left from before a restart are due straight away
+func (s *outgoingSpool) replay(ctx context.Context) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		job := &outgoingJob{}
+		if err := json.Unmarshal(content, job); err != nil {
+			slog.ErrorContext(ctx, "error", "outgoing spool", err.Error(), "file", entry.Name())
+
+			continue
+		}
+
+		if job.NextAttemptAt.After(now) || !s.claim(job.ID) {
+			continue
+		}
+
+		// The job may have been sent and removed since it was read
+		if _, err := os.Stat(s.path(job.ID)); err != nil {
+			s.release(job.ID)
+
+			continue
+		}
+
+		if _, err := s.attempt(ctx, job); err == nil {
+			slog.InfoContext(ctx, "outgoing replayed", "job", job.ID, "kind", job.Kind, "attempts", job.Attempts+1)
+
+			events.publish(ctx, EVENT_OUTGOING_REPLAYED, "", map[string]any{"job": job.ID, "kind": job.Kind})
+		}
+		s.release(job.ID)
+	}
+
+	return nil
+}
+
+func watchOutgoing(ctx context.Context, h *Handler) {
+	if h.outgoing.dir == "" {
+		return
+	}
+
+	if err := h.outgoing.replay(ctx); err != nil {
+		slog.ErrorContext(ctx, "error", "outgoing replay", err.Error())
+	}
+
+	ticker := time.NewTicker(OUTGOING_RETRY_INTERVAL.Value())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.outgoing.replay(ctx); err != nil {
+				slog.ErrorContext(ctx, "error", "outgoing replay", err.Error())
+			}
+		}
+	}
+}
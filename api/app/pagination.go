@@ -0,0 +1,167 @@
+package app
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Leads are listed a page at a time after the cursor of the last lead on the
+// previous page. The cursor holds the sort key and ID of that lead rather than
+// an offset, so leads received while paging don't shift later pages
+const LIST_DEFAULT_LIMIT = 50
+const LIST_MAX_LIMIT = 200
+
+const LEAD_SORT_CREATED_AT = "createdAt"
+const LEAD_SORT_SCORE = "score"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Descending when prefixed with -, ties are ordered by ID
+type leadSort struct {
+	field      string
+	descending bool
+}
+
+type leadCursor struct {
+	Sort      string    `json:"sort"`
+	CreatedAt time.Time `json:"createdAt"`
+	Score     int       `json:"score"`
+	ID        string    `json:"id"`
+}
+
+func parseLeadSort(value string) (leadSort, error) {
+	if value == "" {
+		return leadSort{field: LEAD_SORT_CREATED_AT, descending: true}, nil
+	}
+
+	field, descending := strings.CutPrefix(value, "-")
+	if field != LEAD_SORT_CREATED_AT && field != LEAD_SORT_SCORE {
+		return leadSort{}, errors.New("invalid sort, expected createdAt or score, prefixed with - for descending")
+	}
+
+	return leadSort{field: field, descending: descending}, nil
+}
+
+func (s leadSort) String() string {
+	if s.descending {
+		return "-" + s.field
+	}
+
+	return s.field
+}
+
+func (s leadSort) compare(a *lead, b *lead) int {
+	order := 0
+	switch s.field {
+	case LEAD_SORT_CREATED_AT:
+		order = a.CreatedAt.Compare(b.CreatedAt)
+	case LEAD_SORT_SCORE:
+		order = cmp.Compare(a.Score, b.Score)
+	}
+	if order == 0 {
+		order = strings.Compare(a.ID, b.ID)
+	}
+
+	if s.descending {
+		return -order
+	}
+
+	return order
+}
+
+func encodeLeadCursor(s leadSort, l *lead) string {
+	content, _ := json.Marshal(leadCursor{Sort: s.String(), CreatedAt: l.CreatedAt, Score: l.Score, ID: l.ID})
+
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// A cursor is only valid for the sort it was made with
+func decodeLeadCursor(s leadSort, value string) (*lead, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	cursor := leadCursor{}
+	if err := json.Unmarshal(content, &cursor); err != nil || cursor.ID == "" || cursor.Sort != s.String() {
+		return nil, errInvalidCursor
+	}
+
+	return &lead{ID: cursor.ID, CreatedAt: cursor.CreatedAt, Score: cursor.Score}, nil
+}
+
+// The page after the cursor and the cursor for the page after it, which is
+// empty on the last page
+func paginateLeads(all []*lead, s leadSort, after *lead, limit int) ([]*lead, string) {
+	slices.SortFunc(all, s.compare)
+
+	page := []*lead{}
+	for _, l := range all {
+		if after != nil && s.compare(l, after) <= 0 {
+			continue
+		}
+
+		if len(page) == limit {
+			return page, encodeLeadCursor(s, page[len(page)-1])
+		}
+
+		page = append(page, l)
+	}
+
+	return page, ""
+}
+
+func requestLeadFilter(r *http.Request) (leadFilter, error) {
+	query := r.URL.Query()
+
+	tags, err := requestTagFilter(r)
+	if err != nil {
+		return leadFilter{}, err
+	}
+
+	filter := leadFilter{
+		status:  query.Get("status"),
+		tags:    tags,
+		form:    query.Get("form"),
+		deleted: query.Get("deleted") == "true",
+	}
+
+	if value := query.Get("minScore"); value != "" {
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			return leadFilter{}, errors.New("invalid minScore")
+		}
+
+		filter.minScore = &score
+	}
+	if value := query.Get("maxScore"); value != "" {
+		score, err := strconv.Atoi(value)
+		if err != nil {
+			return leadFilter{}, errors.New("invalid maxScore")
+		}
+
+		filter.maxScore = &score
+	}
+
+	if value := query.Get("from"); value != "" {
+		filter.from, err = parseDate(value)
+		if err != nil {
+			return leadFilter{}, errors.New("invalid from, expected YYYY-MM-DD or RFC 3339")
+		}
+	}
+	if value := query.Get("until"); value != "" {
+		filter.until, err = parseDate(value)
+		if err != nil {
+			return leadFilter{}, errors.New("invalid until, expected YYYY-MM-DD or RFC 3339")
+		}
+	}
+
+	return filter, nil
+}
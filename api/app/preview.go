@@ -0,0 +1,96 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Renders an auto-response through Postmark's template validation, or locally
+// with the local mailer, so a template can be checked before it goes live for
+// a stored lead or a sample
+func (h *Handler) adminEmailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	l := sampleLead()
+	if id := r.URL.Query().Get("leadId"); id != "" {
+		stored, err := leads.get(r.Context(), id)
+		if err != nil {
+			leadStoreError(w, r, err)
+
+			return
+		}
+
+		l = stored
+	}
+
+	templateId, model := autoResponse(l)
+
+	if MAILER.Value() == MAILER_LOCAL {
+		name := r.URL.Query().Get("template")
+		if name == "" {
+			name = autoResponseTemplate(l, model)
+		}
+
+		message, err := renderEmail(name, model)
+		if err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Email-Subject", message.Subject)
+		w.Header().Set("X-Email-Template", name)
+		w.Write([]byte(message.HTMLBody))
+
+		return
+	}
+
+	if template := r.URL.Query().Get("template"); template != "" {
+		id, err := strconv.Atoi(template)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid template")
+
+			return
+		}
+
+		templateId = id
+	}
+
+	res, err := h.mailer.previewTemplate(r.Context(), templateId, model)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "email preview", err.Error(), "template", templateId)
+		writeProblem(w, r, http.StatusBadGateway, err.Error())
+
+		return
+	}
+
+	if !res.AllContentIsValid {
+		writeResponse(w, r, http.StatusUnprocessableEntity, res)
+
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Email-Subject", res.Subject.RenderedContent)
+	w.Header().Set("X-Email-Template", strconv.Itoa(templateId))
+	w.Write([]byte(res.HTMLBody.RenderedContent))
+}
+
+func sampleLead() *lead {
+	return &lead{
+		ID:           "sample",
+		Email:        "jane@example.com",
+		Mobile:       "+61400000000",
+		FirstName:    "Jane",
+		LastName:     "Citizen",
+		EnquiryType:  DEFAULT_ENQUIRY_TYPE,
+		Enquiry:      "We would like a quote for a new website.",
+		Form:         DEFAULT_FORM,
+		CustomFields: map[string]string{},
+		Status:       LEAD_STATUS_NEW,
+		CreatedAt:    time.Now(),
+	}
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/gen2brain/heic"
+)
+
+const HEIC_JPEG_QUALITY = 90
+
+// Stages transform attachments before they are stored, a stage may replace an
+// attachment with any number of attachments
+type attachmentStage interface {
+	name() string
+	process(ctx context.Context, file attachment) ([]attachment, error)
+}
+
+var attachmentStages []attachmentStage
+
+func createAttachmentStages(ctx context.Context) []attachmentStage {
+	stages := []attachmentStage{}
+
+	if HEIC_CONVERSION.Value() {
+		stages = append(stages, heicStage{keepOriginal: HEIC_KEEP_ORIGINAL.Value()})
+	}
+
+	for _, stage := range stages {
+		slog.DebugContext(ctx, "attachment stage", "name", stage.name())
+	}
+
+	return stages
+}
+
+func processAttachments(ctx context.Context, files []attachment) ([]attachment, error) {
+	for _, stage := range attachmentStages {
+		processed := []attachment{}
+
+		for _, file := range files {
+			out, err := stage.process(ctx, file)
+			if err != nil {
+				return nil, err
+			}
+
+			processed = append(processed, out...)
+		}
+
+		files = processed
+	}
+
+	return files, nil
+}
+
+// Transcodes HEIC/HEIF images from Apple devices to JPEG
+type heicStage struct {
+	keepOriginal bool
+}
+
+func (s heicStage) name() string {
+	return "heic"
+}
+
+func (s heicStage) process(ctx context.Context, file attachment) ([]attachment, error) {
+	reader, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(reader, header); err != nil || !isHeic(header) {
+		return []attachment{file}, nil
+	}
+
+	img, err := heic.Decode(io.MultiReader(bytes.NewReader(header), reader))
+	if err != nil {
+		// The original is still more useful than failing the lead
+		slog.WarnContext(ctx, "error", "heic decode", err.Error(), "file", file.filename)
+
+		return []attachment{file}, nil
+	}
+
+	var converted bytes.Buffer
+	if err := jpeg.Encode(&converted, img, &jpeg.Options{Quality: HEIC_JPEG_QUALITY}); err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "converted", "heic", file.filename, "size", file.size, "jpeg size", converted.Len())
+
+	content := converted.Bytes()
+	jpegFile := attachment{
+		filename: strings.TrimSuffix(file.filename, filepath.Ext(file.filename)) + ".jpg",
+		size:     int64(len(content)),
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(content)), nil
+		},
+	}
+
+	if s.keepOriginal {
+		return []attachment{jpegFile, file}, nil
+	}
+
+	return []attachment{jpegFile}, nil
+}
+
+// HEIF files are ISO base media files with an ftyp box naming a HEIF brand
+func isHeic(header []byte) bool {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+
+	switch string(header[8:12]) {
+	case "heic", "heix", "hevc", "hevx", "heim", "heis", "hevm", "hevs", "mif1", "msf1":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// A lead runs through every configured processor of a stage before moving on
+// to the next stage, validation rejects the lead, enrichment adds to it and
+// delivery sends it somewhere
+type processorStage int
+
+const (
+	PROCESSOR_STAGE_VALIDATE processorStage = iota
+	PROCESSOR_STAGE_ENRICH
+	PROCESSOR_STAGE_DELIVER
+)
+
+type processor interface {
+	name() string
+	stage() processorStage
+	process(ctx context.Context, l *lead) error
+}
+
+// Returned by validation processors to reject a lead with a status code
+type leadRejection struct {
+	status  int
+	message string
+}
+
+func (err *leadRejection) Error() string {
+	return err.message
+}
+
+// Processors that can be named in LEAD_PROCESSORS
+var PROCESSORS = map[string]func(ctx context.Context, h *Handler) processor{
+	"fields":    func(ctx context.Context, h *Handler) processor { return fieldsProcessor{validate: h.validate} },
+	"geoip":     func(ctx context.Context, h *Handler) processor { return geoProcessor{} },
+	"content":   createContentProcessor,
+	"translate": func(ctx context.Context, h *Handler) processor { return translateProcessor{} },
+	"llm":       func(ctx context.Context, h *Handler) processor { return llmProcessor{} },
+	"score":     func(ctx context.Context, h *Handler) processor { return scoreProcessor{} },
+	"route":     func(ctx context.Context, h *Handler) processor { return routeProcessor{} },
+	"email":     func(ctx context.Context, h *Handler) processor { return emailProcessor{outgoing: h.outgoing} },
+	"notify":    func(ctx context.Context, h *Handler) processor { return notifyProcessor{outgoing: h.outgoing} },
+	"crm":       func(ctx context.Context, h *Handler) processor { return crmProcessor{crm: h.crm} },
+	"whatsapp":  createWhatsappProcessor,
+}
+
+var processors []processor
+
+func createProcessors(ctx context.Context, h *Handler) []processor {
+	configured := []processor{}
+	for _, name := range strings.Split(LEAD_PROCESSORS.Value(), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		create, ok := PROCESSORS[name]
+		if !ok {
+			err := fmt.Errorf("unknown lead processor %s", name)
+			slog.ErrorContext(ctx, "error", "processors", err.Error())
+			panic(err)
+		}
+
+		configured = append(configured, create(ctx, h))
+	}
+
+	slog.DebugContext(ctx, "created processors", "processors", LEAD_PROCESSORS.Value())
+
+	return configured
+}
+
+// Validation stops at the first rejection, enrichment and delivery are best
+// effort so a failing processor is logged and the rest still run
+func runProcessors(ctx context.Context, stage processorStage, l *lead) error {
+	for _, p := range processors {
+		if p.stage() != stage {
+			continue
+		}
+
+		if err := p.process(ctx, l); err != nil {
+			if stage == PROCESSOR_STAGE_VALIDATE {
+				return err
+			}
+
+			slog.ErrorContext(ctx, "error", "processor", err.Error(), "processor", p.name(), "lead", l.ID)
+		}
+	}
+
+	return nil
+}
+
+func rejectionStatus(err error) int {
+	var rejection *leadRejection
+	if errors.As(err, &rejection) {
+		return rejection.status
+	}
+
+	return http.StatusInternalServerError
+}
+
+type fieldsProcessor struct {
+	validate *validator.Validate
+}
+
+func (fieldsProcessor) name() string { return "fields" }
+
+func (fieldsProcessor) stage() processorStage { return PROCESSOR_STAGE_VALIDATE }
+
+func (p fieldsProcessor) process(ctx context.Context, l *lead) error {
+	if errs := l.rules().validate(p.validate, l.values()); len(errs) > 0 {
+		return &leadRejection{
+			status:  http.StatusBadRequest,
+			message: fmt.Sprintf("Invalid field values:\n%s", strings.Join(errs, "\n")),
+		}
+	}
+
+	if mobileVerificationRequired(l) && l.MobileVerifiedAt == nil {
+		return &leadRejection{status: http.StatusForbidden, message: errMobileNotVerified.Error()}
+	}
+
+	return nil
+}
+
+type emailProcessor struct {
+	outgoing *outgoingSpool
+}
+
+func (emailProcessor) name() string { return "email" }
+
+func (emailProcessor) stage() processorStage { return PROCESSOR_STAGE_DELIVER }
+
+func (p emailProcessor) process(ctx context.Context, l *lead) error {
+	id, err := sendAutoResponse(ctx, p.outgoing, l)
+	if err != nil {
+		events.publish(ctx, EVENT_EMAIL_FAILED, l.ID, map[string]any{
+			"to":    l.Email,
+			"error": err.Error(),
+		})
+
+		return err
+	}
+
+	events.publish(ctx, EVENT_EMAIL_SENT, l.ID, map[string]any{
+		"messageId": id,
+		"to":        l.Email,
+	})
+
+	return nil
+}
+
+func sendAutoResponse(ctx context.Context, outgoing *outgoingSpool, l *lead) (string, error) {
+	templateId, model := autoResponse(l)
+	postmarkFrom := POSTMARK_FROM.Value()
+
+	if MAILER.Value() == MAILER_LOCAL {
+		message, err := renderEmail(autoResponseTemplate(l, model), model)
+		if err != nil {
+			return "", err
+		}
+
+		message.From = postmarkFrom
+		message.To = l.Email
+		message.Tag = "auto-response"
+		message.Metadata = map[string]string{"lead": l.ID}
+		message.Headers = unsubscribeHeaders(l.Email)
+
+		return sendEmail(ctx, outgoing, message)
+	}
+
+	if suppressions.contains(l.Email) {
+		return "", errEmailSuppressed
+	}
+
+	id, err := sendTemplatedEmail(ctx, outgoing, templatedEmail{
+		TemplateID:    int64(templateId),
+		From:          postmarkFrom,
+		To:            l.Email,
+		TrackOpens:    true,
+		TemplateModel: model,
+		Headers:       postmarkHeaders(unsubscribeHeaders(l.Email)),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "sent", "postmark message id", id, "to", l.Email, "lead", l.ID)
+
+	return id, nil
+}
+
+// Template and model of the auto-response sent to a lead
+func autoResponse(l *lead) (int, map[string]interface{}) {
+	templateId, _ := POSTMARK_TEMPLATE.Value()
+	if t := l.enquiryType(); t.Template != 0 {
+		templateId = t.Template
+	}
+
+	model := map[string]interface{}{
+		"firstName":      l.FirstName,
+		"enquiryType":    l.EnquiryType,
+		"customFields":   l.CustomFields,
+		"unsubscribeUrl": unsubscribeUrl(l.Email),
+	}
+
+	// Leads arriving after hours are told when to expect a reply, with its
+	// own template when one is configured
+	if !businessHours.isOpen(l.CreatedAt) {
+		model["outsideBusinessHours"] = true
+		if opens := businessHours.nextOpen(l.CreatedAt); !opens.IsZero() {
+			model["nextBusinessDay"] = opens.Format("Monday")
+			model["nextBusinessOpen"] = opens.Format("Monday 3:04 PM MST")
+		}
+
+		if template, ok := POSTMARK_TEMPLATE_OUTSIDE_HOURS.Value(); ok {
+			templateId = template
+		}
+	}
+
+	return templateId, model
+}
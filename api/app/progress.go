@@ -0,0 +1,223 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Direct uploads can report progress to the frontend, the client picks a
+// token, subscribes to GET /lead/progress/{token} with an EventSource and
+// passes the same token as ?progressToken= when posting the lead
+const PROGRESS_INTERVAL = 256 << 10 // 256 KB
+const MAX_PROGRESS_TOKEN_LENGTH = 64
+
+var uploadProgress = &progressHub{topics: map[string]*progressTopic{}}
+
+type progressEvent struct {
+	name string
+	data any
+}
+
+type fileProgress struct {
+	Phase  string `json:"phase"`
+	Index  int    `json:"index"`
+	File   string `json:"file,omitempty"`
+	Loaded int64  `json:"loaded"`
+	Total  int64  `json:"total"`
+}
+
+type progressTopic struct {
+	subscribers map[chan progressEvent]struct{}
+}
+
+type progressHub struct {
+	mu     sync.Mutex
+	topics map[string]*progressTopic
+}
+
+func (h *progressHub) subscribe(token string) (chan progressEvent, func()) {
+	events := make(chan progressEvent, 16)
+
+	h.mu.Lock()
+	topic, ok := h.topics[token]
+	if !ok {
+		topic = &progressTopic{subscribers: map[chan progressEvent]struct{}{}}
+		h.topics[token] = topic
+	}
+	topic.subscribers[events] = struct{}{}
+	h.mu.Unlock()
+
+	return events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := topic.subscribers[events]; !ok {
+			return
+		}
+
+		delete(topic.subscribers, events)
+		close(events)
+		if len(topic.subscribers) == 0 && h.topics[token] == topic {
+			delete(h.topics, token)
+		}
+	}
+}
+
+// A slow subscriber misses intermediate events rather than holding up the
+// upload
+func (h *progressHub) publish(token string, event progressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	topic, ok := h.topics[token]
+	if !ok {
+		return
+	}
+
+	for events := range topic.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+func (h *progressHub) end(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	topic, ok := h.topics[token]
+	if !ok {
+		return
+	}
+
+	for events := range topic.subscribers {
+		select {
+		case events <- progressEvent{name: "end", data: map[string]any{}}:
+		default:
+		}
+		delete(topic.subscribers, events)
+		close(events)
+	}
+	delete(h.topics, token)
+}
+
+func progressToken(r *http.Request) string {
+	token := r.URL.Query().Get("progressToken")
+	if len(token) > MAX_PROGRESS_TOKEN_LENGTH {
+		return ""
+	}
+
+	return token
+}
+
+type progressReader struct {
+	reader   io.Reader
+	loaded   int64
+	reported int64
+	report   func(loaded int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.loaded += int64(n)
+
+	if r.loaded-r.reported >= PROGRESS_INTERVAL || (err == io.EOF && r.loaded != r.reported) {
+		r.reported = r.loaded
+		r.report(r.loaded)
+	}
+
+	return n, err
+}
+
+type progressReadCloser struct {
+	progressReader
+	io.Closer
+}
+
+// Reports the request body as it is received, before any file can be told
+// apart
+func receiveProgress(token string, body io.ReadCloser, total int64) io.ReadCloser {
+	return &progressReadCloser{
+		progressReader{reader: body, report: func(loaded int64) {
+			uploadProgress.publish(token, progressEvent{name: "progress", data: fileProgress{
+				Phase:  "receiving",
+				Index:  -1,
+				Loaded: loaded,
+				Total:  total,
+			}})
+		}},
+		body,
+	}
+}
+
+func storeProgress(token string, reader io.Reader, idx int, file attachment) io.Reader {
+	return &progressReader{reader: reader, report: func(loaded int64) {
+		uploadProgress.publish(token, progressEvent{name: "progress", data: fileProgress{
+			Phase:  "storing",
+			Index:  idx,
+			File:   file.filename,
+			Loaded: min(loaded, file.size),
+			Total:  file.size,
+		}})
+	}}
+}
+
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	if token == "" || len(token) > MAX_PROGRESS_TOKEN_LENGTH {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid progress token")
+
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProblem(w, r, http.StatusInternalServerError, "Streaming unsupported")
+
+		return
+	}
+
+	events, unsubscribe := uploadProgress.subscribe(token)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event.data)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error", "progress", err.Error())
+
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.name, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Messages in proto/lead/v1/lead.proto are small enough to be read and
+// written with protowire directly instead of generated code, submissions are
+// turned into form values so they share the multipart path from there
+const PROTOBUF_CONTENT_TYPE = "application/x-protobuf"
+
+var errInvalidProtobuf = errors.New("invalid protobuf")
+
+// Field numbers of LeadSubmission mapped to their form field
+var LEAD_SUBMISSION_FIELDS = map[protowire.Number]string{
+	1:  "email",
+	2:  "mobile",
+	3:  "firstName",
+	4:  "lastName",
+	5:  "enquiry",
+	6:  "enquiryType",
+	7:  "formId",
+	9:  "uploads",
+	11: "experiment",
+	12: "variant",
+	14: "mobileToken",
+}
+
+const LEAD_SUBMISSION_CUSTOM_FIELDS protowire.Number = 8
+const LEAD_SUBMISSION_ATTRIBUTION protowire.Number = 10
+const LEAD_SUBMISSION_CONSENT protowire.Number = 13
+
+type protoMarshaler interface {
+	marshalProto() []byte
+}
+
+func parseProtobufForm(r *http.Request) error {
+	// Already parsed, the body has been read
+	if r.PostForm != nil {
+		return nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	values, err := decodeLeadSubmission(body)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		r.PostForm[name] = value
+		r.Form[name] = append(value, r.Form[name]...)
+	}
+
+	return nil
+}
+
+func decodeLeadSubmission(b []byte) (url.Values, error) {
+	values := url.Values{}
+
+	for len(b) > 0 {
+		number, kind, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+
+		if number == LEAD_SUBMISSION_CONSENT && kind == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errInvalidProtobuf
+			}
+			b = b[n:]
+
+			if value != 0 {
+				values.Set("consent", "true")
+			}
+
+			continue
+		}
+
+		if kind != protowire.BytesType {
+			// Unknown fields are skipped as proto3 requires
+			n = protowire.ConsumeFieldValue(number, kind, b)
+			if n < 0 {
+				return nil, errInvalidProtobuf
+			}
+			b = b[n:]
+
+			continue
+		}
+
+		value, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, errInvalidProtobuf
+		}
+		b = b[n:]
+
+		switch number {
+		case LEAD_SUBMISSION_CUSTOM_FIELDS, LEAD_SUBMISSION_ATTRIBUTION:
+			key, entry, err := decodeMapEntry(value)
+			if err != nil {
+				return nil, err
+			}
+
+			if number == LEAD_SUBMISSION_ATTRIBUTION && !slices.Contains(ATTRIBUTION_FIELDS, key) {
+				return nil, fmt.Errorf("%w: unknown attribution %s", errInvalidProtobuf, key)
+			}
+
+			values.Set(key, entry)
+		default:
+			if name, ok := LEAD_SUBMISSION_FIELDS[number]; ok {
+				values.Add(name, string(value))
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func decodeMapEntry(b []byte) (string, string, error) {
+	key, value := "", ""
+	for len(b) > 0 {
+		number, kind, n := protowire.ConsumeTag(b)
+		if n < 0 || kind != protowire.BytesType {
+			return "", "", errInvalidProtobuf
+		}
+		b = b[n:]
+
+		field, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return "", "", errInvalidProtobuf
+		}
+		b = b[n:]
+
+		switch number {
+		case 1:
+			key = string(field)
+		case 2:
+			value = string(field)
+		}
+	}
+
+	return key, value, nil
+}
+
+type leadReceipt struct {
+	ID string `json:"id"`
+}
+
+func (receipt leadReceipt) marshalProto() []byte {
+	return appendString(nil, 1, receipt.ID)
+}
+
+func (p problem) marshalProto() []byte {
+	b := appendString(nil, 1, p.Type)
+	b = appendString(b, 2, p.Title)
+	if p.Status != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.Status))
+	}
+	b = appendString(b, 4, p.Detail)
+
+	return appendString(b, 5, p.Instance)
+}
+
+// Empty strings are the proto3 default and are left out
+func appendString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+
+	return protowire.AppendString(b, value)
+}
+
+func writeProtobuf(w http.ResponseWriter, code int, message protoMarshaler) {
+	w.Header().Set("Content-Type", PROTOBUF_CONTENT_TYPE)
+	w.WriteHeader(code)
+	w.Write(message.marshalProto())
+}
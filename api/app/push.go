@@ -0,0 +1,306 @@
+package app
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/fcm/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Pushes new leads to the team's phones through Firebase Cloud Messaging when
+// FCM_PROJECT_ID is set. The app registers each device from the admin API with
+// the user it belongs to and the routes the user wants leads from, a user
+// without routes gets every lead
+const MAX_PUSH_DEVICE_TOKEN_LENGTH = 4096
+const MAX_PUSH_DEVICES = 1000
+
+var pushDevices *pushDeviceRegistry
+
+type pushDevice struct {
+	Token        string    `json:"token"`
+	User         string    `json:"user"`
+	Routes       []string  `json:"routes,omitempty"`
+	Platform     string    `json:"platform,omitempty"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+type pushDeviceRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	devices map[string]*pushDevice
+}
+
+func createPushDeviceRegistry(ctx context.Context) *pushDeviceRegistry {
+	registry := &pushDeviceRegistry{devices: map[string]*pushDevice{}}
+
+	if LEAD_STORE.Value() == "file" {
+		registry.path = PUSH_DEVICE_STORE_FILE.Value()
+
+		content, err := os.ReadFile(registry.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "push devices", err.Error())
+			panic(err)
+		}
+		if err == nil {
+			stored := []*pushDevice{}
+			if err := json.Unmarshal(content, &stored); err != nil {
+				slog.ErrorContext(ctx, "error", "push devices", err.Error())
+				panic(err)
+			}
+
+			for _, device := range stored {
+				registry.devices[device.Token] = device
+			}
+		}
+	}
+
+	slog.DebugContext(ctx, "created push device registry", "devices", len(registry.devices))
+
+	return registry
+}
+
+func (p *pushDeviceRegistry) persist() error {
+	if p.path == "" {
+		return nil
+	}
+
+	devices := make([]*pushDevice, 0, len(p.devices))
+	for _, device := range p.devices {
+		devices = append(devices, device)
+	}
+
+	return writeJsonFile(p.path, devices)
+}
+
+func (p *pushDeviceRegistry) register(device *pushDevice) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.devices[device.Token]; !ok && len(p.devices) >= MAX_PUSH_DEVICES {
+		return errors.New("too many push devices are registered")
+	}
+
+	// Routes are the user's, so every device they have gets the same leads
+	for _, other := range p.devices {
+		if other.User == device.User {
+			other.Routes = device.Routes
+		}
+	}
+	p.devices[device.Token] = device
+
+	return p.persist()
+}
+
+func (p *pushDeviceRegistry) remove(token string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.devices[token]; !ok {
+		return false, nil
+	}
+
+	delete(p.devices, token)
+
+	return true, p.persist()
+}
+
+// Devices wanting leads from any of the routes
+func (p *pushDeviceRegistry) subscribed(routes []string) []pushDevice {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	matched := []pushDevice{}
+	for _, device := range p.devices {
+		if len(device.Routes) == 0 || slices.ContainsFunc(device.Routes, func(route string) bool { return slices.Contains(routes, route) }) {
+			matched = append(matched, *device)
+		}
+	}
+
+	return matched
+}
+
+func (p *pushDeviceRegistry) list() []pushDevice {
+	return p.subscribed(nil)
+}
+
+func createFcmService(ctx context.Context) *fcm.Service {
+	client, err := googleTransportOption(ctx, http.DefaultTransport, []string{fcm.FirebaseMessagingScope})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "fcm service", err.Error())
+		panic(err)
+	}
+
+	service, err := fcm.NewService(ctx, client)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "fcm service", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created fcm service")
+
+	return service
+}
+
+// Sent for every lead like an escalation, the devices decide which routes
+// they get
+type pushNotifier struct {
+	project string
+	service *fcm.Service
+}
+
+func (pushNotifier) name() string { return "push" }
+
+func (n pushNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	errs := []error{}
+	for _, device := range pushDevices.subscribed(l.Routes) {
+		message := &fcm.Message{
+			Token: device.Token,
+			Notification: &fcm.Notification{
+				Title: fmt.Sprintf("New lead from %s", l.name()),
+				Body:  excerpt(cmp.Or(l.Summary, l.Enquiry), 160),
+			},
+			// Opens the lead in the app
+			Data: map[string]string{"lead": l.ID, "score": fmt.Sprint(l.Score)},
+		}
+
+		_, err := n.service.Projects.Messages.Send("projects/"+n.project, &fcm.SendMessageRequest{Message: message}).Context(ctx).Do()
+
+		// Tokens of uninstalled apps are dropped rather than retried
+		var apiError *googleapi.Error
+		if errors.As(err, &apiError) && apiError.Code == http.StatusNotFound {
+			slog.InfoContext(ctx, "push device unregistered", "user", device.User)
+			if _, err := pushDevices.remove(device.Token); err != nil {
+				slog.ErrorContext(ctx, "error", "push devices", err.Error())
+			}
+
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", device.User, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func adminRegisterPushDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if pushDevices == nil {
+		writeProblem(w, r, http.StatusNotFound, "Push notifications are not configured")
+
+		return
+	}
+
+	var req struct {
+		Token    string   `json:"token"`
+		User     string   `json:"user"`
+		Routes   []string `json:"routes"`
+		Platform string   `json:"platform"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	req.User = strings.TrimSpace(req.User)
+	if req.Token == "" || len(req.Token) > MAX_PUSH_DEVICE_TOKEN_LENGTH || req.User == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Missing device token or user")
+
+		return
+	}
+
+	for _, route := range req.Routes {
+		if findRoute(route) == nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("Unknown route %s", route))
+
+			return
+		}
+	}
+
+	device := &pushDevice{
+		Token:        req.Token,
+		User:         truncate(req.User, 255),
+		Routes:       req.Routes,
+		Platform:     truncate(req.Platform, 32),
+		RegisteredAt: time.Now(),
+	}
+	if err := pushDevices.register(device); err != nil {
+		slog.ErrorContext(r.Context(), "error", "push devices", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "registered push device", "user", device.User, "routes", strings.Join(device.Routes, ","))
+
+	writeResponse(w, r, http.StatusOK, device)
+}
+
+func adminListPushDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if pushDevices == nil {
+		writeProblem(w, r, http.StatusNotFound, "Push notifications are not configured")
+
+		return
+	}
+
+	// Tokens are left out, they are enough to send to the device
+	devices := []map[string]any{}
+	for _, device := range pushDevices.list() {
+		if user := r.URL.Query().Get("user"); user != "" && device.User != user {
+			continue
+		}
+
+		devices = append(devices, map[string]any{
+			"user":         device.User,
+			"routes":       device.Routes,
+			"platform":     device.Platform,
+			"registeredAt": device.RegisteredAt,
+		})
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]any{"devices": devices})
+}
+
+func adminRemovePushDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if pushDevices == nil {
+		writeProblem(w, r, http.StatusNotFound, "Push notifications are not configured")
+
+		return
+	}
+
+	// The token is sent in the body as it's enough to send to the device
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	removed, err := pushDevices.remove(req.Token)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "push devices", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	if !removed {
+		writeProblem(w, r, http.StatusNotFound, "Unknown device")
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
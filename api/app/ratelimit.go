@@ -0,0 +1,196 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sethvargo/go-limiter"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/sethvargo/go-limiter/memorystore"
+	"github.com/sethvargo/go-limiter/noopstore"
+)
+
+const LIMITER_STORE_MEMORY = "memory"
+const LIMITER_STORE_REDIS = "redis"
+
+// Stores for every limiter come from here so they can all move to a shared
+// backend together. The name keeps the counters of each limiter apart when
+// they share a backend
+func createLimiterStore(ctx context.Context, name string, tokens uint64, interval time.Duration) limiter.Store {
+	if GO_ENV.Value() == "Development" {
+		noopStore, err := noopstore.New()
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "init", err.Error())
+			panic(err)
+		}
+
+		return noopStore
+	}
+
+	if LIMITER_STORE.Value() == LIMITER_STORE_REDIS {
+		redisStore, err := createRedisStore(ctx, name, tokens, interval)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "init", err.Error())
+			panic(err)
+		}
+
+		return redisStore
+	}
+
+	memoryStore, err := memorystore.New(&memorystore.Config{
+		Tokens:   tokens,
+		Interval: interval,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "init", err.Error())
+		panic(err)
+	}
+
+	return memoryStore
+}
+
+// Applies on top of the IP limiter with limits chosen by the country of the
+// request, countries without a limit are only subject to the IP limiter
+type countryRateLimiter struct {
+	mu     sync.RWMutex
+	limits map[string]*httplimit.Middleware
+	// Behind the limits, closed once they are replaced
+	stores []limiter.Store
+}
+
+// Kept so a config reload can replace the limits, counts start over
+var countryLimits *countryRateLimiter
+
+// COUNTRY_RATE_LIMITS is a comma separated list of COUNTRY=tokens/interval,
+// e.g. CN=1/1m,RU=1/10m
+func createCountryRateLimiter(ctx context.Context) *countryRateLimiter {
+	limiter := &countryRateLimiter{limits: map[string]*httplimit.Middleware{}}
+
+	config, ok := COUNTRY_RATE_LIMITS.Value()
+	config, ok = runtimeSetting("COUNTRY_RATE_LIMITS", config, ok)
+	if !ok {
+		return limiter
+	}
+
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		country, limit, _ := strings.Cut(entry, "=")
+		tokens, interval, err := parseRateLimit(limit)
+		if err != nil {
+			err = fmt.Errorf("invalid rate limit %s in COUNTRY_RATE_LIMITS: %w", entry, err)
+			slog.ErrorContext(ctx, "error", "init", err.Error())
+			panic(err)
+		}
+
+		country = strings.ToUpper(strings.TrimSpace(country))
+
+		store := createLimiterStore(ctx, "country:"+country, tokens, interval)
+		limiter.stores = append(limiter.stores, store)
+
+		middleware, err := httplimit.NewMiddleware(store, ipKeyFunc)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "init", err.Error())
+			panic(err)
+		}
+
+		limiter.limits[country] = middleware
+	}
+
+	if len(limiter.limits) > 0 && geo == nil {
+		slog.WarnContext(ctx, "country rate limits need GEOIP_DATABASE or IPINFO_TOKEN, they will not be applied")
+	}
+
+	slog.DebugContext(ctx, "created country rate limiter", "countries", len(limiter.limits))
+
+	return limiter
+}
+
+// Limiters are keyed by the client address. httplimit.IPKeyFunc fails on an
+// address without a port, which is how the Lambda adapter sets the source IP
+func ipKeyFunc(r *http.Request) (string, error) {
+	ip := requestIP(r)
+	if ip == nil {
+		return "", fmt.Errorf("invalid remote address %q", r.RemoteAddr)
+	}
+
+	return ip.String(), nil
+}
+
+func parseRateLimit(limit string) (uint64, time.Duration, error) {
+	tokens, interval, ok := strings.Cut(limit, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected tokens/interval")
+	}
+
+	count, err := strconv.ParseUint(strings.TrimSpace(tokens), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	duration, err := time.ParseDuration(strings.TrimSpace(interval))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, duration, nil
+}
+
+// The previous stores are closed so their sweepers and connections don't
+// outlive them
+func (l *countryRateLimiter) replace(ctx context.Context, loaded *countryRateLimiter) {
+	l.mu.Lock()
+	previous := l.stores
+	l.limits = loaded.limits
+	l.stores = loaded.stores
+	l.mu.Unlock()
+
+	for _, store := range previous {
+		if err := store.Close(ctx); err != nil {
+			slog.ErrorContext(ctx, "error", "close limiter store", err.Error())
+		}
+	}
+}
+
+func (l *countryRateLimiter) Handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.RLock()
+		limits := l.limits
+		l.mu.RUnlock()
+
+		if len(limits) == 0 {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		location, err := lookupGeo(r.Context(), r.RemoteAddr)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error", "country rate limit", err.Error())
+		}
+
+		if location == nil {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		limit, ok := limits[location.Country]
+		if !ok {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		limit.Handle(next).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Counters kept in Redis, such as Memorystore, are shared by every instance,
+// so a function scaled out to many instances limits as a single server does.
+// Each key is a fixed window counted with INCR that expires with the window
+const REDIS_KEY_PREFIX = "landing:ratelimit"
+
+// Connections kept open to Redis between requests
+const REDIS_MAX_IDLE_CONNS = 8
+
+const REDIS_DIAL_TIMEOUT = 5 * time.Second
+
+// Counts the request and returns the count and the time left in the window,
+// the limit of the key is read from KEYS[2] when it was set
+var redisTakeScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+local limit = tonumber(redis.call('GET', KEYS[2]) or ARGV[2])
+return {count, redis.call('PTTL', KEYS[1]), limit}
+`)
+
+// Takes the extra tokens off the count, a window started by the burst expires
+// as one started by a request would
+var redisBurstScript = redis.NewScript(`
+local count = redis.call('DECRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return count
+`)
+
+// Each store has its own connections so closing a replaced store doesn't
+// affect the others
+type redisStore struct {
+	client   *redis.Client
+	name     string
+	tokens   uint64
+	interval time.Duration
+}
+
+// Takes redis://[[user]:password@]host[:port][/db], or rediss:// for TLS
+// as Memorystore uses with in-transit encryption
+func createRedisStore(ctx context.Context, name string, tokens uint64, interval time.Duration) (*redisStore, error) {
+	value, ok := REDIS_URL.Value()
+	if !ok {
+		return nil, errors.New("REDIS_URL is required by the redis limiter store")
+	}
+
+	options, err := redis.ParseURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+
+	options.DialTimeout = REDIS_DIAL_TIMEOUT
+	options.ReadTimeout = HTTP_RESPONSE_HEADER_TIMEOUT.Value()
+	options.WriteTimeout = HTTP_RESPONSE_HEADER_TIMEOUT.Value()
+	options.MaxIdleConns = REDIS_MAX_IDLE_CONNS
+
+	client := redis.NewClient(options)
+
+	slog.DebugContext(ctx, "created redis limiter store", "name", name, "addr", options.Addr)
+
+	return &redisStore{client: client, name: name, tokens: tokens, interval: interval}, nil
+}
+
+func (s *redisStore) key(key string) string {
+	return fmt.Sprintf("%s:%s:%s", REDIS_KEY_PREFIX, s.name, key)
+}
+
+// Requests are let through while Redis can't be reached, losing the limit
+// for a while is better than turning leads away
+func (s *redisStore) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	values, err := redisTakeScript.Run(ctx, s.client, []string{s.key(key), s.key(key) + ":tokens"}, s.interval.Milliseconds(), s.tokens).Int64Slice()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "redis rate limit", err.Error())
+
+		return s.tokens, s.tokens, uint64(time.Now().Add(s.interval).UnixNano()), true, nil
+	}
+
+	if len(values) != 3 {
+		return 0, 0, 0, false, fmt.Errorf("unexpected redis reply %v", values)
+	}
+
+	count, ttl, limit := values[0], values[1], values[2]
+
+	tokens := uint64(max(limit, 0))
+	remaining := uint64(max(limit-count, 0))
+	reset := uint64(time.Now().Add(time.Duration(max(ttl, 0)) * time.Millisecond).UnixNano())
+
+	return tokens, remaining, reset, uint64(max(count, 0)) <= tokens, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	values, err := s.client.MGet(ctx, s.key(key), s.key(key)+":tokens").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(values) != 2 {
+		return 0, 0, fmt.Errorf("unexpected redis reply %v", values)
+	}
+
+	tokens := s.tokens
+	if value, ok := values[1].(string); ok {
+		tokens, _ = strconv.ParseUint(value, 10, 64)
+	}
+
+	count := uint64(0)
+	if value, ok := values[0].(string); ok {
+		count, _ = strconv.ParseUint(value, 10, 64)
+	}
+
+	if count >= tokens {
+		return tokens, 0, nil
+	}
+
+	return tokens, tokens - count, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.key(key)+":tokens", tokens, interval)
+		pipe.Del(ctx, s.key(key))
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *redisStore) Burst(ctx context.Context, key string, tokens uint64) error {
+	return redisBurstScript.Run(ctx, s.client, []string{s.key(key)}, tokens, s.interval.Milliseconds()).Err()
+}
+
+// Stores are closed when the country limits are reloaded and replace them
+func (s *redisStore) Close(ctx context.Context) error {
+	return s.client.Close()
+}
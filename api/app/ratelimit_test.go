@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	lambdaevents "github.com/aws/aws-lambda-go/events"
+	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+	"github.com/sethvargo/go-limiter/httplimit"
+	"github.com/sethvargo/go-limiter/memorystore"
+)
+
+// The Lambda adapter sets the source IP without a port, the limiters have to
+// key it all the same
+func TestRateLimitThroughLambdaAdapter(t *testing.T) {
+	store, err := memorystore.New(&memorystore.Config{Tokens: 1, Interval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+
+	limiter, err := httplimit.NewMiddleware(store, ipKeyFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := httpadapter.NewV2(limiter.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	request := lambdaevents.APIGatewayV2HTTPRequest{
+		RawPath: API_V1_PREFIX + "/lead",
+		RequestContext: lambdaevents.APIGatewayV2HTTPRequestContext{
+			HTTP: lambdaevents.APIGatewayV2HTTPRequestContextHTTPDescription{
+				Method:   http.MethodPost,
+				Path:     API_V1_PREFIX + "/lead",
+				SourceIP: "203.0.113.7",
+			},
+		},
+	}
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		res, err := adapter.ProxyWithContext(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != want {
+			t.Fatalf("got status %d, want %d", res.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cross-checks attachments in storage against the leads referencing them, a
+// failed upload clean up or delete otherwise leaves files behind for good
+const EVENT_STORAGE_RECONCILED = "storage.reconciled"
+
+// Files this new may belong to a submission that hasn't been saved yet
+const RECONCILE_MIN_AGE = time.Hour
+
+var errReconcileMemoryStore = errors.New("leads are lost on restart with the memory store, cleanup needs LEAD_STORE=file")
+
+type orphanedFile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Lead string `json:"lead"`
+}
+
+type missingFile struct {
+	Lead string `json:"lead"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type reconcileReport struct {
+	Cleanup bool `json:"cleanup"`
+	Files   int  `json:"files"`
+	Leads   int  `json:"leads"`
+	// Stored files tagged with a lead that no lead references
+	OrphanedFiles []orphanedFile `json:"orphanedFiles"`
+	// Attachments of leads that are no longer in storage
+	MissingFiles []missingFile `json:"missingFiles"`
+	Removed      int           `json:"removed"`
+	Errors       []string      `json:"errors,omitempty"`
+	StartedAt    time.Time     `json:"startedAt"`
+	FinishedAt   time.Time     `json:"finishedAt"`
+}
+
+var lastReconcile = struct {
+	sync.Mutex
+	report *reconcileReport
+}{}
+
+// Only the file store outlives the process, so with the memory store every
+// older file would look orphaned
+func watchReconcile(ctx context.Context, h *Handler) {
+	interval := RECONCILE_INTERVAL.Value()
+	if interval == 0 || LEAD_STORE.Value() != "file" {
+		slog.DebugContext(ctx, "reconcile disabled", "store", LEAD_STORE.Value())
+
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := reconcileStorage(ctx, h.storage, RECONCILE_CLEANUP.Value()); err != nil {
+				slog.ErrorContext(ctx, "error", "reconcile", err.Error())
+			}
+		}
+	}
+}
+
+func reconcileStorage(ctx context.Context, storage attachmentStorage, cleanup bool) (*reconcileReport, error) {
+	if cleanup && LEAD_STORE.Value() != "file" {
+		return nil, errReconcileMemoryStore
+	}
+
+	report := &reconcileReport{
+		Cleanup:       cleanup,
+		OrphanedFiles: []orphanedFile{},
+		MissingFiles:  []missingFile{},
+		StartedAt:     time.Now(),
+	}
+
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		return nil, err
+	}
+	report.Leads = len(all)
+
+	// Files reused for a later lead are referenced by more than one
+	referenced := map[string]bool{}
+	for _, l := range all {
+		for _, file := range l.Attachments {
+			referenced[file.ID] = true
+		}
+	}
+
+	stored := map[string]bool{}
+	err = storage.list(ctx, func(file storedFile) error {
+		stored[file.id] = true
+		if file.properties["lead"] == "" {
+			return nil
+		}
+		report.Files++
+
+		if referenced[file.id] || report.StartedAt.Sub(file.createdAt) < RECONCILE_MIN_AGE {
+			return nil
+		}
+
+		report.OrphanedFiles = append(report.OrphanedFiles, orphanedFile{
+			ID:   file.id,
+			Name: file.name,
+			Lead: file.properties["lead"],
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range all {
+		for _, file := range l.Attachments {
+			if !stored[file.ID] {
+				report.MissingFiles = append(report.MissingFiles, missingFile{Lead: l.ID, ID: file.ID, Name: file.Name})
+			}
+		}
+	}
+
+	if cleanup {
+		cleanupStorage(ctx, storage, report)
+	}
+
+	report.FinishedAt = time.Now()
+
+	lastReconcile.Lock()
+	lastReconcile.report = report
+	lastReconcile.Unlock()
+
+	slog.InfoContext(ctx, "reconciled", "files", report.Files, "leads", report.Leads, "orphaned", len(report.OrphanedFiles), "missing", len(report.MissingFiles), "removed", report.Removed)
+
+	events.publish(ctx, EVENT_STORAGE_RECONCILED, "", map[string]any{
+		"orphaned": len(report.OrphanedFiles),
+		"missing":  len(report.MissingFiles),
+		"removed":  report.Removed,
+	})
+
+	return report, nil
+}
+
+func cleanupStorage(ctx context.Context, storage attachmentStorage, report *reconcileReport) {
+	for _, file := range report.OrphanedFiles {
+		if err := storage.remove(ctx, file.ID); err != nil {
+			slog.ErrorContext(ctx, "error", "reconcile remove", err.Error(), "file", file.ID)
+			report.Errors = append(report.Errors, err.Error())
+
+			continue
+		}
+
+		report.Removed++
+	}
+
+	missing := map[string]map[string]bool{}
+	for _, file := range report.MissingFiles {
+		if missing[file.Lead] == nil {
+			missing[file.Lead] = map[string]bool{}
+		}
+		missing[file.Lead][file.ID] = true
+	}
+
+	for id, files := range missing {
+		_, err := leads.update(ctx, id, func(l *lead) error {
+			kept := []leadAttachment{}
+			for _, file := range l.Attachments {
+				if !files[file.ID] {
+					kept = append(kept, file)
+				}
+			}
+			l.Attachments = kept
+
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "reconcile lead", err.Error(), "lead", id)
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+}
+
+func (h *Handler) adminReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	cleanup := RECONCILE_CLEANUP.Value()
+	if value := r.URL.Query().Get("cleanup"); value != "" {
+		cleanup = value == "true"
+	}
+
+	report, err := reconcileStorage(r.Context(), h.storage, cleanup)
+	if errors.Is(err, errReconcileMemoryStore) {
+		writeProblem(w, r, http.StatusConflict, err.Error())
+
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "reconcile", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, report)
+}
+
+func adminGetReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	lastReconcile.Lock()
+	report := lastReconcile.report
+	lastReconcile.Unlock()
+
+	if report == nil {
+		writeProblem(w, r, http.StatusNotFound, "Storage has not been reconciled yet")
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, report)
+}
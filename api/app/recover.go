@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Panics in handlers are logged with their stack through the OTel log
+// pipeline and recorded on the request span, and sent to Sentry when
+// SENTRY_DSN is set
+const SENTRY_FLUSH_TIMEOUT = 2 * time.Second
+
+var sentryEnabled bool
+
+func createSentry(ctx context.Context) bool {
+	dsn, ok := SENTRY_DSN.Value()
+	if !ok {
+		return false
+	}
+
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: GO_ENV.Value(),
+		ServerName:  SERVICE_NAME.Value(),
+	}); err != nil {
+		slog.ErrorContext(ctx, "error", "sentry", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created sentry client")
+
+	return true
+}
+
+func recovererMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Aborting a response is how net/http is told to drop the
+			// connection, it has to reach the server
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			stack := debug.Stack()
+
+			if r.Header.Get("Connection") != "Upgrade" {
+				writeProblem(w, r, http.StatusInternalServerError, "Internal Server Error")
+			}
+
+			reportPanic(r, recovered, stack)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func reportPanic(r *http.Request, recovered any, stack []byte) {
+	ctx := r.Context()
+	message := fmt.Sprint(recovered)
+
+	slog.ErrorContext(ctx, "error", "panic", message, "stack", string(stack), "method", r.Method, "path", r.URL.Path)
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(fmt.Errorf("panic: %s", message), trace.WithAttributes(
+		semconv.ExceptionType(fmt.Sprintf("%T", recovered)),
+		semconv.ExceptionStacktrace(string(stack)),
+	))
+	span.SetStatus(codes.Error, "panic: "+message)
+
+	if sentryEnabled {
+		hub := sentry.CurrentHub().Clone()
+		hub.Scope().SetRequest(r)
+		if span.SpanContext().HasTraceID() {
+			hub.Scope().SetTag("trace_id", span.SpanContext().TraceID().String())
+		}
+
+		hub.RecoverWithContext(ctx, recovered)
+		hub.Flush(SENTRY_FLUSH_TIMEOUT)
+	}
+}
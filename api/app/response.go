@@ -0,0 +1,261 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Responses are encoded as JSON unless the client prefers XML, errors are
+// problem details in either format and plain text for clients asking for
+// neither
+// see: https://www.rfc-editor.org/rfc/rfc9457
+const RESPONSE_FORMAT_JSON = "json"
+const RESPONSE_FORMAT_XML = "xml"
+const RESPONSE_FORMAT_PROTOBUF = "protobuf"
+
+const PROBLEM_XML_NAMESPACE = "urn:ietf:rfc:7807"
+
+var RESPONSE_MEDIA_TYPES = map[string]string{
+	"application/json":         RESPONSE_FORMAT_JSON,
+	"application/problem+json": RESPONSE_FORMAT_JSON,
+	"application/xml":          RESPONSE_FORMAT_XML,
+	"application/problem+xml":  RESPONSE_FORMAT_XML,
+	"text/xml":                 RESPONSE_FORMAT_XML,
+	PROTOBUF_CONTENT_TYPE:      RESPONSE_FORMAT_PROTOBUF,
+	"application/protobuf":     RESPONSE_FORMAT_PROTOBUF,
+}
+
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Returns the format the client prefers by Accept quality, or "" when it
+// accepts none explicitly, protobuf requests are answered in kind
+func responseFormat(r *http.Request) string {
+	if format := acceptedFormat(r); format != "" {
+		return format
+	}
+
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == PROTOBUF_CONTENT_TYPE {
+		return RESPONSE_FORMAT_PROTOBUF
+	}
+
+	return ""
+}
+
+func acceptedFormat(r *http.Request) string {
+	best := ""
+	bestQuality := 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		format, ok := RESPONSE_MEDIA_TYPES[mediaType]
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		if quality > bestQuality {
+			best = format
+			bestQuality = quality
+		}
+	}
+
+	return best
+}
+
+// Responses aren't cached unless the handler set its own Cache-Control
+func writeResponse(w http.ResponseWriter, r *http.Request, code int, v any) {
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	w.Header().Add("Vary", "Accept")
+
+	switch responseFormat(r) {
+	case RESPONSE_FORMAT_XML:
+		writeXml(w, r, code, "application/xml; charset=utf-8", "response", "", v)
+
+		return
+	case RESPONSE_FORMAT_PROTOBUF:
+		// Only messages in the published proto have a protobuf encoding,
+		// anything else is sent as JSON
+		if message, ok := v.(protoMarshaler); ok {
+			writeProtobuf(w, code, message)
+
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "error", "encode response", err.Error())
+	}
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	p := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(code),
+		Status:   code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+
+	w.Header().Add("Vary", "Accept")
+
+	switch responseFormat(r) {
+	case RESPONSE_FORMAT_PROTOBUF:
+		writeProtobuf(w, code, p)
+	case RESPONSE_FORMAT_XML:
+		writeXml(w, r, code, "application/problem+xml; charset=utf-8", "problem", PROBLEM_XML_NAMESPACE, p)
+	case RESPONSE_FORMAT_JSON:
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(code)
+
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			slog.ErrorContext(r.Context(), "error", "encode problem", err.Error())
+		}
+	default:
+		http.Error(w, detail, code)
+	}
+}
+
+// Values are encoded through their JSON form so XML responses have the same
+// names and shape as the JSON ones
+func writeXml(w http.ResponseWriter, r *http.Request, code int, contentType string, root string, namespace string, v any) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "encode response", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+
+	encoder := xml.NewEncoder(&body)
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+
+	start := xml.StartElement{Name: xml.Name{Local: root}}
+	if namespace != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: namespace}}
+	}
+
+	if err := jsonToXml(encoder, decoder, start); err != nil {
+		slog.ErrorContext(r.Context(), "error", "encode response", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+	if err := encoder.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "error", "encode response", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write(body.Bytes())
+}
+
+// Objects become child elements named by key, array items are repeated
+// <item> elements
+func jsonToXml(encoder *xml.Encoder, decoder *json.Decoder, start xml.StartElement) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+
+				if err := jsonToXml(encoder, decoder, xml.StartElement{Name: xml.Name{Local: xmlName(key.(string))}}); err != nil {
+					return err
+				}
+			}
+		case '[':
+			for decoder.More() {
+				if err := jsonToXml(encoder, decoder, xml.StartElement{Name: xml.Name{Local: "item"}}); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	case nil:
+	case string:
+		if err := encoder.EncodeToken(xml.CharData(t)); err != nil {
+			return err
+		}
+	case json.Number:
+		if err := encoder.EncodeToken(xml.CharData(t.String())); err != nil {
+			return err
+		}
+	case bool:
+		if err := encoder.EncodeToken(xml.CharData(strconv.FormatBool(t))); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unexpected JSON token")
+	}
+
+	return encoder.EncodeToken(start.End())
+}
+
+// Keys that are not valid element names have the invalid characters replaced
+func xmlName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+
+		return '_'
+	}, key)
+
+	if first := []rune(name); len(first) == 0 || !(unicode.IsLetter(first[0]) || first[0] == '_') || strings.HasPrefix(strings.ToLower(name), "xml") {
+		name = "_" + name
+	}
+
+	return name
+}
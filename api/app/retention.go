@@ -0,0 +1,380 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Rules in RETENTION_RULES are applied to leads older than their age, every
+// action taken is written to the audit log
+const EVENT_RETENTION_APPLIED = "retention.applied"
+
+const RETENTION_DELETE_ATTACHMENTS = "delete-attachments"
+const RETENTION_ANONYMIZE = "anonymize"
+
+// Removes soft deleted leads and their attachments for good, the age is from
+// when the lead was deleted
+const RETENTION_PURGE = "purge"
+
+var RETENTION_ACTIONS = []string{RETENTION_DELETE_ATTACHMENTS, RETENTION_ANONYMIZE, RETENTION_PURGE}
+
+const ANONYMIZED = "anonymized"
+
+type retentionRule struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Age from when the lead was received, as a duration or a number of days
+	// such as 180d
+	After string `json:"after"`
+	// Only leads in these statuses, any status when empty
+	Statuses []string `json:"statuses,omitempty"`
+	after    time.Duration
+}
+
+type retentionAudit struct {
+	Rule   string    `json:"rule"`
+	Action string    `json:"action"`
+	Lead   string    `json:"lead"`
+	Files  []string  `json:"files,omitempty"`
+	DryRun bool      `json:"dryRun"`
+	Error  string    `json:"error,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+type retentionReport struct {
+	DryRun     bool             `json:"dryRun"`
+	Actions    []retentionAudit `json:"actions"`
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt time.Time        `json:"finishedAt"`
+}
+
+// Runs are serialised so the worker and an admin run don't act on the same
+// lead twice
+var retentionMu sync.Mutex
+
+func loadRetentionRules(ctx context.Context) []retentionRule {
+	file, ok := RETENTION_RULES.Value()
+	if !ok {
+		return []retentionRule{}
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "retention rules", err.Error())
+		panic(err)
+	}
+
+	configured := []retentionRule{}
+	if err := json.Unmarshal(content, &configured); err != nil {
+		slog.ErrorContext(ctx, "error", "retention rules", err.Error())
+		panic(err)
+	}
+
+	for idx := range configured {
+		rule := &configured[idx]
+		if err := rule.check(); err != nil {
+			slog.ErrorContext(ctx, "error", "retention rules", err.Error())
+			panic(err)
+		}
+	}
+
+	slog.DebugContext(ctx, "loaded retention rules", "rules", len(configured))
+
+	return configured
+}
+
+func (rule *retentionRule) check() (err error) {
+	if !slices.Contains(RETENTION_ACTIONS, rule.Action) {
+		return fmt.Errorf("retention rule %s has unknown action %s", rule.Name, rule.Action)
+	}
+
+	for _, status := range rule.Statuses {
+		if !isLeadStatus(status) {
+			return fmt.Errorf("retention rule %s has unknown status %s", rule.Name, status)
+		}
+	}
+
+	rule.after, err = parsePeriod(rule.After)
+	if err != nil || rule.after <= 0 {
+		return fmt.Errorf("retention rule %s has invalid age %s", rule.Name, rule.After)
+	}
+
+	return nil
+}
+
+func (rule retentionRule) matches(l *lead, now time.Time) bool {
+	if rule.Action == RETENTION_PURGE {
+		return l.DeletedAt != nil && now.Sub(*l.DeletedAt) >= rule.after && (len(rule.Statuses) == 0 || slices.Contains(rule.Statuses, l.Status))
+	}
+
+	if now.Sub(l.CreatedAt) < rule.after {
+		return false
+	}
+
+	if len(rule.Statuses) > 0 && !slices.Contains(rule.Statuses, l.Status) {
+		return false
+	}
+
+	switch rule.Action {
+	case RETENTION_DELETE_ATTACHMENTS:
+		return len(l.Attachments) > 0 || len(l.PendingAttachments) > 0
+	case RETENTION_ANONYMIZE:
+		return l.AnonymizedAt == nil
+	}
+
+	return false
+}
+
+func watchRetention(ctx context.Context, h *Handler) {
+	interval := RETENTION_INTERVAL.Value()
+	if len(currentConfig().retentionRules) == 0 || interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := applyRetention(ctx, h.storage, RETENTION_DRY_RUN.Value()); err != nil {
+				slog.ErrorContext(ctx, "error", "retention", err.Error())
+			}
+		}
+	}
+}
+
+// A dry run reports what each rule would do without changing anything
+func applyRetention(ctx context.Context, storage attachmentStorage, dryRun bool) (*retentionReport, error) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	report := &retentionReport{
+		DryRun:    dryRun,
+		Actions:   []retentionAudit{},
+		StartedAt: time.Now(),
+	}
+
+	all, err := leads.list(ctx, leadFilter{merged: true, deleted: true})
+	if err != nil {
+		return nil, err
+	}
+
+	// Files reused for a later lead are kept until no lead references them
+	referencedBy := map[string]map[string]bool{}
+	for _, l := range all {
+		for _, file := range l.Attachments {
+			if referencedBy[file.ID] == nil {
+				referencedBy[file.ID] = map[string]bool{}
+			}
+			referencedBy[file.ID][l.ID] = true
+		}
+	}
+
+	// Actions change the listed leads as they change the store, dry runs
+	// included, so a later rule sees what an earlier one did rather than
+	// reporting the same lead again
+	purged := map[string]bool{}
+	for _, rule := range currentConfig().retentionRules {
+		for _, l := range all {
+			if purged[l.ID] || !rule.matches(l, report.StartedAt) {
+				continue
+			}
+
+			audit := retentionAudit{
+				Rule:   rule.Name,
+				Action: rule.Action,
+				Lead:   l.ID,
+				DryRun: dryRun,
+				At:     time.Now(),
+			}
+
+			switch rule.Action {
+			case RETENTION_DELETE_ATTACHMENTS:
+				audit.Files, err = deleteLeadAttachments(ctx, storage, l, referencedBy, dryRun)
+			case RETENTION_ANONYMIZE:
+				audit.Files, err = anonymizeLead(ctx, storage, l, referencedBy, dryRun)
+			case RETENTION_PURGE:
+				audit.Files, err = purgeLead(ctx, storage, l, referencedBy, dryRun)
+				purged[l.ID] = err == nil
+			}
+			if err != nil {
+				slog.ErrorContext(ctx, "error", "retention", err.Error(), "rule", rule.Name, "lead", l.ID)
+				audit.Error = err.Error()
+			}
+
+			report.Actions = append(report.Actions, audit)
+			writeRetentionAudit(ctx, audit)
+		}
+	}
+
+	report.FinishedAt = time.Now()
+
+	slog.InfoContext(ctx, "retention", "actions", len(report.Actions), "dry run", dryRun)
+
+	return report, nil
+}
+
+func deleteLeadAttachments(ctx context.Context, storage attachmentStorage, l *lead, referencedBy map[string]map[string]bool, dryRun bool) ([]string, error) {
+	removed := []string{}
+	for _, file := range l.Attachments {
+		delete(referencedBy[file.ID], l.ID)
+		if len(referencedBy[file.ID]) > 0 {
+			continue
+		}
+
+		removed = append(removed, file.ID)
+		if dryRun {
+			continue
+		}
+
+		if err := storage.remove(ctx, file.ID); err != nil && !errors.Is(err, errStoredFileNotFound) {
+			return removed, err
+		}
+	}
+
+	for _, pending := range l.PendingAttachments {
+		removed = append(removed, pending.ID)
+		if dryRun || spool == nil {
+			continue
+		}
+
+		if err := spool.remove(ctx, pending.ID); err != nil {
+			return removed, err
+		}
+	}
+
+	l.Attachments = nil
+	l.PendingAttachments = nil
+
+	if dryRun {
+		return removed, nil
+	}
+
+	_, err := leads.update(ctx, l.ID, func(stored *lead) error {
+		stored.Attachments = nil
+		stored.PendingAttachments = nil
+
+		return nil
+	})
+
+	return removed, err
+}
+
+func purgeLead(ctx context.Context, storage attachmentStorage, l *lead, referencedBy map[string]map[string]bool, dryRun bool) ([]string, error) {
+	removed, err := deleteLeadAttachments(ctx, storage, l, referencedBy, dryRun)
+	if err != nil || dryRun {
+		return removed, err
+	}
+
+	return removed, leads.remove(ctx, l.ID)
+}
+
+// Keeps what reporting needs, such as status, form, score and attribution,
+// and drops what identifies the person. Attachments are removed as well, as
+// storage keeps the person's details with each file
+func anonymizeLead(ctx context.Context, storage attachmentStorage, l *lead, referencedBy map[string]map[string]bool, dryRun bool) ([]string, error) {
+	removed, err := deleteLeadAttachments(ctx, storage, l, referencedBy, dryRun)
+	if err != nil {
+		return removed, err
+	}
+
+	now := time.Now()
+	l.AnonymizedAt = &now
+
+	if dryRun {
+		return removed, nil
+	}
+
+	_, err = leads.update(ctx, l.ID, func(stored *lead) error {
+		stored.Email = ANONYMIZED
+		stored.Mobile = ANONYMIZED
+		stored.FirstName = ANONYMIZED
+		stored.LastName = ANONYMIZED
+		stored.Enquiry = ANONYMIZED
+		stored.CustomFields = map[string]string{}
+		stored.IP = ""
+		stored.Geo = nil
+		stored.Translation = nil
+		stored.Summary = ""
+		stored.SuggestedReply = ""
+		stored.Consultation = nil
+		stored.Notes = nil
+		for idx := range stored.Merges {
+			stored.Merges[idx].Values = nil
+		}
+		// Activity is kept for reporting, its data can hold contact details
+		for idx := range stored.Activity {
+			stored.Activity[idx].Data = nil
+		}
+		stored.AnonymizedAt = &now
+
+		return nil
+	})
+
+	return removed, err
+}
+
+// Appended as JSON lines to RETENTION_AUDIT_LOG when set, and published so
+// subscribers see each action taken
+func writeRetentionAudit(ctx context.Context, audit retentionAudit) {
+	slog.InfoContext(ctx, "retention audit", "rule", audit.Rule, "action", audit.Action, "lead", audit.Lead, "dry run", audit.DryRun)
+
+	if !audit.DryRun && audit.Error == "" {
+		events.publish(ctx, EVENT_RETENTION_APPLIED, audit.Lead, audit)
+	}
+
+	path, ok := RETENTION_AUDIT_LOG.Value()
+	if !ok {
+		return
+	}
+
+	line, err := json.Marshal(audit)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "retention audit", err.Error())
+
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "retention audit", err.Error())
+
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.ErrorContext(ctx, "error", "retention audit", err.Error())
+	}
+}
+
+func (h *Handler) adminRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	if len(currentConfig().retentionRules) == 0 {
+		writeProblem(w, r, http.StatusConflict, "No retention rules are configured")
+
+		return
+	}
+
+	// Runs from the admin API are reports unless asked otherwise
+	dryRun := r.URL.Query().Get("dryRun") != "false"
+
+	report, err := applyRetention(r.Context(), h.storage, dryRun)
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, report)
+}
@@ -0,0 +1,44 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/runtime"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Goroutines, GC pauses and the heap are read from the runtime, open file
+// descriptors from /proc so leaked upload handles show up where it exists
+const RUNTIME_METRICS_INTERVAL = 15 * time.Second
+
+const PROC_FD_DIR = "/proc/self/fd"
+
+func createRuntimeMetrics(ctx context.Context) {
+	if err := runtime.Start(runtime.WithMinimumReadMemStatsInterval(RUNTIME_METRICS_INTERVAL)); err != nil {
+		slog.ErrorContext(ctx, "error", "runtime metrics", err.Error())
+		panic(err)
+	}
+
+	_, err := otel.Meter(SERVICE_NAME.Value()).Int64ObservableUpDownCounter("process.open_file_descriptors",
+		metric.WithDescription("File descriptors open in the process"),
+		metric.WithInt64Callback(func(ctx context.Context, observer metric.Int64Observer) error {
+			entries, err := os.ReadDir(PROC_FD_DIR)
+			if err != nil {
+				return nil
+			}
+
+			observer.Observe(int64(len(entries)))
+
+			return nil
+		}))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "runtime metrics", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created runtime metrics")
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const JSON_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+// Validator formats that JSON Schema has a format or pattern for, anything
+// else is only enforced by the backend
+var SCHEMA_FORMATS = map[string]map[string]any{
+	"email":               {"format": "email"},
+	"url":                 {"format": "uri"},
+	"e164":                {"pattern": `^\+[1-9][0-9]{1,14}$`},
+	"numeric":             {"pattern": `^[-+]?[0-9]+(\.[0-9]+)?$`},
+	"datetime=2006-01-02": {"format": "date"},
+}
+
+// Describes a form as a JSON Schema of its fields so a frontend can build and
+// validate it from the backend rules, files are described under x-files
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	form, rules, ok := requestForm(r)
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "Unknown form")
+
+		return
+	}
+
+	names := append([]string{}, CORE_FIELDS...)
+	names = append(names, rules.extraFields()...)
+
+	properties := map[string]any{}
+	required := []string{}
+	for _, name := range names {
+		rule := rules[name]
+		properties[name] = fieldSchema(name, rule)
+
+		if rule.Required {
+			required = append(required, name)
+		}
+	}
+
+	// Relative to the API when PUBLIC_URL is unset
+	base, _ := publicUrl()
+
+	schema := map[string]any{
+		"$schema":    JSON_SCHEMA_DIALECT,
+		"$id":        base + API_V1_PREFIX + "/lead/schema?formId=" + url.QueryEscape(form),
+		"title":      form,
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+		"x-order":    names,
+		"x-files": map[string]any{
+			"field":             "files",
+			"uploadsField":      "uploads",
+			"uploadUrl":         base + API_V1_PREFIX + "/uploads",
+			"maxFiles":          MAX_ATTACHMENTS.Value(),
+			"maxFileSize":       MAX_UPLOAD_SIZE,
+			"maxFilenameLength": MAX_FILENAME_LENGTH.Value(),
+			"accept":            acceptedAttachmentTypes(),
+		},
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/schema+json")
+	if err := json.NewEncoder(w).Encode(schema); err != nil {
+		slog.ErrorContext(r.Context(), "error", "encode schema", err.Error())
+	}
+}
+
+func fieldSchema(name string, rule *fieldRule) map[string]any {
+	schema := map[string]any{
+		"type":    "string",
+		"title":   fieldLabel(name),
+		"x-input": fieldInputType(name, rule),
+	}
+
+	format := rule.Format
+	if format == "" {
+		format = FIELD_TYPE_FORMATS[rule.Type]
+	}
+
+	if keywords, ok := SCHEMA_FORMATS[format]; ok {
+		for keyword, value := range keywords {
+			schema[keyword] = value
+		}
+	} else if options, ok := strings.CutPrefix(format, "oneof="); ok {
+		schema["enum"] = strings.Fields(options)
+	}
+
+	if len(rule.Options) > 0 {
+		schema["enum"] = rule.Options
+	}
+	// Submitted with a mobileToken from /v1/lead/verify-mobile
+	if rule.Verify {
+		schema["x-verify"] = true
+	}
+	if rule.MinLength > 0 {
+		schema["minLength"] = rule.MinLength
+	}
+	if rule.MaxLength > 0 {
+		schema["maxLength"] = rule.MaxLength
+	}
+	// Patterns given with a format are both applied, so they are combined
+	if rule.Pattern != "" {
+		if _, ok := schema["pattern"]; ok {
+			schema["allOf"] = []any{map[string]any{"pattern": rule.Pattern}}
+		} else {
+			schema["pattern"] = rule.Pattern
+		}
+	}
+
+	return schema
+}
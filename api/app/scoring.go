@@ -0,0 +1,179 @@
+package app
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+//go:embed content/free_email_domains.txt
+var freeEmailDomainList string
+
+var freeEmailDomains = map[string]bool{}
+
+func init() {
+	for _, domain := range blocklistWords(freeEmailDomainList) {
+		freeEmailDomains[domain] = true
+	}
+}
+
+// Each matching rule adds its points to the base score, the total is clamped
+// to 0-100
+type scoreRule struct {
+	// keyword, attachments, freeEmail, businessEmail, country or field
+	Type   string   `json:"type"`
+	Match  []string `json:"match,omitempty"`
+	Field  string   `json:"field,omitempty"`
+	Points int      `json:"points"`
+	// Added to leads the rule matches
+	Tags []string `json:"tags,omitempty"`
+}
+
+type scoringRules struct {
+	Base  int         `json:"base"`
+	Rules []scoreRule `json:"rules"`
+}
+
+func defaultScoringRules() scoringRules {
+	return scoringRules{
+		Base: 40,
+		Rules: []scoreRule{
+			{Type: "keyword", Match: []string{"budget", "quote", "proposal", "project", "launch", "deadline", "website", "app", "platform", "rebuild"}, Points: 15},
+			{Type: "attachments", Points: 10},
+			{Type: "businessEmail", Points: 15},
+			{Type: "freeEmail", Points: -5},
+			{Type: "field", Field: "budget", Points: 10},
+			{Type: "field", Field: "company", Points: 10},
+		},
+	}
+}
+
+func loadScoringRules(ctx context.Context) scoringRules {
+	file, ok := SCORING_RULES.Value()
+	if !ok {
+		return defaultScoringRules()
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "scoring rules", err.Error())
+		panic(err)
+	}
+
+	configured := scoringRules{}
+	if err := json.Unmarshal(content, &configured); err != nil {
+		slog.ErrorContext(ctx, "error", "scoring rules", err.Error())
+		panic(err)
+	}
+
+	for _, rule := range configured.Rules {
+		switch rule.Type {
+		case "keyword", "attachments", "freeEmail", "businessEmail", "country", "field":
+		default:
+			err := fmt.Errorf("unknown scoring rule type %s", rule.Type)
+			slog.ErrorContext(ctx, "error", "scoring rules", err.Error())
+			panic(err)
+		}
+	}
+
+	for i, rule := range configured.Rules {
+		tags, err := normalizeTags(rule.Tags)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "scoring rules", err.Error())
+			panic(err)
+		}
+
+		configured.Rules[i].Tags = tags
+	}
+
+	slog.DebugContext(ctx, "loaded scoring rules", "rules", len(configured.Rules))
+
+	return configured
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+
+	return domain
+}
+
+func (rule scoreRule) matches(l *lead) bool {
+	switch rule.Type {
+	case "keyword":
+		enquiry := strings.ToLower(l.Enquiry)
+		if l.Translation != nil {
+			enquiry += "\n" + strings.ToLower(l.Translation.Enquiry)
+		}
+
+		for _, keyword := range rule.Match {
+			if strings.Contains(enquiry, strings.ToLower(keyword)) {
+				return true
+			}
+		}
+	case "attachments":
+		return len(l.Attachments) > 0
+	case "freeEmail":
+		return freeEmailDomains[emailDomain(l.Email)]
+	case "businessEmail":
+		domain := emailDomain(l.Email)
+
+		return domain != "" && !freeEmailDomains[domain]
+	case "country":
+		if l.Geo == nil {
+			return false
+		}
+
+		for _, country := range rule.Match {
+			if strings.EqualFold(country, l.Geo.Country) {
+				return true
+			}
+		}
+	case "field":
+		value := l.values()[rule.Field]
+		if len(rule.Match) == 0 {
+			return value != ""
+		}
+
+		for _, match := range rule.Match {
+			if strings.EqualFold(match, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (rules scoringRules) score(l *lead) int {
+	score := rules.Base
+	for _, rule := range rules.Rules {
+		if rule.matches(l) {
+			score += rule.Points
+		}
+	}
+
+	return max(0, min(100, score))
+}
+
+type scoreProcessor struct{}
+
+func (scoreProcessor) name() string { return "score" }
+
+func (scoreProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (scoreProcessor) process(ctx context.Context, l *lead) error {
+	scoring := currentConfig().scoring
+	l.Score = scoring.score(l)
+	for _, rule := range scoring.Rules {
+		if len(rule.Tags) > 0 && rule.matches(l) {
+			l.addTags(rule.Tags...)
+		}
+	}
+
+	slog.DebugContext(ctx, "scored", "lead", l.ID, "score", l.Score)
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Searches the enquiry, names and email of leads in the store. Terms match
+// words they are a prefix of, rarer terms and matches in the names or email
+// rank higher. There is no index, every lead is scanned for each search, which
+// is fine for the number of leads the memory and file stores hold
+const SEARCH_DEFAULT_LIMIT = 20
+const SEARCH_MAX_LIMIT = 100
+
+// Characters either side of the first match in a highlight
+const SEARCH_SNIPPET_CONTEXT = 60
+
+const SEARCH_HIGHLIGHT_START = "<mark>"
+const SEARCH_HIGHLIGHT_END = "</mark>"
+
+type searchField struct {
+	name   string
+	weight float64
+	value  func(l *lead) string
+}
+
+var searchFields = []searchField{
+	{name: "firstName", weight: 3, value: func(l *lead) string { return l.FirstName }},
+	{name: "lastName", weight: 3, value: func(l *lead) string { return l.LastName }},
+	{name: "email", weight: 3, value: func(l *lead) string { return l.Email }},
+	{name: "enquiry", weight: 1, value: func(l *lead) string { return l.Enquiry }},
+	{name: "translation", weight: 1, value: func(l *lead) string {
+		if l.Translation == nil {
+			return ""
+		}
+
+		return l.Translation.Enquiry
+	}},
+}
+
+type searchResult struct {
+	Lead  *lead   `json:"lead"`
+	Score float64 `json:"score"`
+	// Snippets of the matching fields, HTML escaped with the matches marked
+	Highlights map[string]string `json:"highlights"`
+}
+
+type searchWord struct {
+	start, end int
+	text       string
+}
+
+// Words are runs of letters and digits, so emails split on @ and dots
+func searchWords(s string) []searchWord {
+	words := []searchWord{}
+	start := -1
+	for i, r := range s {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		}
+		if !isWord && start >= 0 {
+			words = append(words, searchWord{start: start, end: i, text: strings.ToLower(s[start:i])})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, searchWord{start: start, end: len(s), text: strings.ToLower(s[start:])})
+	}
+
+	return words
+}
+
+func searchTerms(q string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, word := range searchWords(q) {
+		if !seen[word.text] {
+			seen[word.text] = true
+			terms = append(terms, word.text)
+		}
+	}
+
+	return terms
+}
+
+func matchesTerm(word string, terms []string) (string, bool) {
+	for _, term := range terms {
+		if strings.HasPrefix(word, term) {
+			return term, true
+		}
+	}
+
+	return "", false
+}
+
+func searchLeads(all []*lead, terms []string) []searchResult {
+	type fieldMatches struct {
+		words []searchWord
+		terms map[string]int
+	}
+
+	// Matches per lead and field, and the leads each term is in for ranking
+	matches := make([]map[string]*fieldMatches, len(all))
+	frequency := map[string]int{}
+	for i, l := range all {
+		matches[i] = map[string]*fieldMatches{}
+		inLead := map[string]bool{}
+
+		for _, field := range searchFields {
+			m := &fieldMatches{terms: map[string]int{}}
+			for _, word := range searchWords(field.value(l)) {
+				if term, ok := matchesTerm(word.text, terms); ok {
+					m.words = append(m.words, word)
+					m.terms[term]++
+					inLead[term] = true
+				}
+			}
+
+			if len(m.words) > 0 {
+				matches[i][field.name] = m
+			}
+		}
+
+		for term := range inLead {
+			frequency[term]++
+		}
+	}
+
+	results := []searchResult{}
+	for i, l := range all {
+		score := 0.0
+		highlights := map[string]string{}
+		for _, field := range searchFields {
+			m, ok := matches[i][field.name]
+			if !ok {
+				continue
+			}
+
+			for term, count := range m.terms {
+				idf := math.Log(1 + float64(len(all))/float64(frequency[term]))
+				score += field.weight * idf * (1 + math.Log(float64(count)))
+			}
+
+			highlights[field.name] = searchHighlight(field.value(l), m.words)
+		}
+
+		if score > 0 {
+			results = append(results, searchResult{Lead: l, Score: math.Round(score*1000) / 1000, Highlights: highlights})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].Lead.CreatedAt.After(results[j].Lead.CreatedAt)
+	})
+
+	return results
+}
+
+// A window around the first match with every match in it marked
+func searchHighlight(value string, words []searchWord) string {
+	start := max(words[0].start-SEARCH_SNIPPET_CONTEXT, 0)
+	end := min(words[0].end+SEARCH_SNIPPET_CONTEXT, len(value))
+	for start > 0 && !utf8.RuneStart(value[start]) {
+		start--
+	}
+	for end < len(value) && !utf8.RuneStart(value[end]) {
+		end++
+	}
+
+	var snippet strings.Builder
+	if start > 0 {
+		snippet.WriteString("…")
+	}
+
+	position := start
+	for _, word := range words {
+		if word.start < position || word.end > end {
+			continue
+		}
+
+		snippet.WriteString(html.EscapeString(value[position:word.start]))
+		snippet.WriteString(SEARCH_HIGHLIGHT_START)
+		snippet.WriteString(html.EscapeString(value[word.start:word.end]))
+		snippet.WriteString(SEARCH_HIGHLIGHT_END)
+		position = word.end
+	}
+	snippet.WriteString(html.EscapeString(value[position:end]))
+
+	if end < len(value) {
+		snippet.WriteString("…")
+	}
+
+	return snippet.String()
+}
+
+func adminSearchLeadsHandler(w http.ResponseWriter, r *http.Request) {
+	terms := searchTerms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Missing search terms in q")
+
+		return
+	}
+
+	limit := SEARCH_DEFAULT_LIMIT
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > SEARCH_MAX_LIMIT {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid limit, it must be between 1 and "+strconv.Itoa(SEARCH_MAX_LIMIT))
+
+			return
+		}
+
+		limit = parsed
+	}
+
+	filter, err := requestLeadFilter(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	all, err := leads.list(r.Context(), filter)
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	results := searchLeads(all, terms)
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]any{"results": results, "total": total})
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fake leads for developing and demoing the admin API against a store that
+// isn't empty, written by cmd/seed to a LEAD_STORE_FILE. Attachments are only
+// records, there is nothing behind them in storage
+const SEED_ATTACHMENT_PREFIX = "seed-"
+
+const SEED_MAX_AGE = 90 * 24 * time.Hour
+
+var seedFirstNames = []string{"Olivia", "Noah", "Amelia", "Jack", "Isla", "Leo", "Mia", "Oliver", "Ava", "Henry", "Priya", "Wei", "Aroha", "Mateo", "Zara", "Kai"}
+var seedLastNames = []string{"Smith", "Nguyen", "Williams", "Brown", "Patel", "Wilson", "Taylor", "Chen", "Singh", "Martin", "Kelly", "Walker", "Ngata", "Garcia"}
+var seedEnquiryTypes = []string{DEFAULT_ENQUIRY_TYPE, "project", "project", "careers", "support"}
+var seedEnquiries = []string{
+	"We're looking to renovate our kitchen and would love a quote for custom joinery.",
+	"Could you send through your availability for a site visit next month?",
+	"I'm interested in a sculpture commission for our office foyer, roughly 2m tall.",
+	"Following up on the proposal you sent last week, we have a few questions on timing.",
+	"Do you have any openings for a junior designer? I've attached my portfolio.",
+	"The handle on the cabinet we bought has come loose, can someone take a look?",
+	"We're planning a garden installation and wanted to know what materials you work with.",
+	"Hi, just wondering what your lead times are at the moment for a dining table.",
+}
+var seedAttachmentNames = []string{"plans.pdf", "site-photo.jpg", "portfolio.pdf", "sketch.png", "brief.docx"}
+var seedCountries = []leadGeo{
+	{Country: "NZ", City: "Auckland", Timezone: "Pacific/Auckland"},
+	{Country: "NZ", City: "Wellington", Timezone: "Pacific/Auckland"},
+	{Country: "AU", City: "Sydney", Timezone: "Australia/Sydney"},
+	{Country: "AU", City: "Melbourne", Timezone: "Australia/Melbourne"},
+	{Country: "GB", City: "London", Timezone: "Europe/London"},
+	{Country: "US", City: "San Francisco", Timezone: "America/Los_Angeles"},
+}
+var seedSources = []leadAttribution{
+	{Source: "google", Medium: "cpc", Campaign: "brand"},
+	{Source: "google", Medium: "organic"},
+	{Source: "instagram", Medium: "social", Campaign: "spring"},
+	{Source: "newsletter", Medium: "email", Campaign: "monthly"},
+	{Referrer: "https://www.houzz.com/"},
+	{},
+}
+
+// Weighted towards leads that are still being worked on
+var seedStatuses = []string{
+	LEAD_STATUS_NEW,
+	LEAD_STATUS_NEW,
+	LEAD_STATUS_CONTACTED,
+	LEAD_STATUS_CONTACTED,
+	LEAD_STATUS_QUALIFIED,
+	LEAD_STATUS_WON,
+	LEAD_STATUS_LOST,
+	LEAD_STATUS_SPAM,
+	LEAD_STATUS_QUARANTINED,
+	LEAD_STATUS_UNVERIFIED,
+}
+
+func pick[T any](random *rand.Rand, values []T) T {
+	return values[random.Intn(len(values))]
+}
+
+func seedLead(random *rand.Rand, now time.Time) *lead {
+	firstName := pick(random, seedFirstNames)
+	lastName := pick(random, seedLastNames)
+	age := time.Duration(random.Int63n(int64(SEED_MAX_AGE)))
+	createdAt := now.Add(-age)
+
+	geo := pick(random, seedCountries)
+	attribution := pick(random, seedSources)
+
+	l := &lead{
+		ID:           uuid.NewString(),
+		Email:        fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(firstName), strings.ToLower(lastName), random.Intn(100)),
+		Mobile:       fmt.Sprintf("+6421%07d", random.Intn(10_000_000)),
+		FirstName:    firstName,
+		LastName:     lastName,
+		EnquiryType:  pick(random, seedEnquiryTypes),
+		Enquiry:      pick(random, seedEnquiries),
+		Form:         DEFAULT_FORM,
+		CustomFields: map[string]string{},
+		BotScore:     random.Intn(30),
+		IP:           fmt.Sprintf("203.0.113.%d", random.Intn(254)+1),
+		Geo:          &geo,
+		Attribution:  &attribution,
+		Language:     "en",
+		Consent:      &leadConsent{Given: random.Intn(4) > 0, At: createdAt},
+		Score:        random.Intn(100),
+		Status:       pick(random, seedStatuses),
+		CreatedAt:    createdAt,
+	}
+
+	for i := random.Intn(4) - 1; i > 0; i-- {
+		l.Attachments = append(l.Attachments, leadAttachment{
+			ID:   SEED_ATTACHMENT_PREFIX + uuid.NewString(),
+			Name: pick(random, seedAttachmentNames),
+		})
+	}
+
+	switch l.Status {
+	case LEAD_STATUS_CONTACTED, LEAD_STATUS_QUALIFIED, LEAD_STATUS_WON, LEAD_STATUS_LOST:
+		respondedAt := createdAt.Add(time.Duration(random.Int63n(int64(min(age, 48*time.Hour)) + 1)))
+		l.FirstResponseAt = &respondedAt
+	case LEAD_STATUS_SPAM:
+		l.BotScore = 70 + random.Intn(30)
+	case LEAD_STATUS_QUARANTINED:
+		l.flag(LEAD_FLAG_ABUSIVE)
+	}
+
+	if l.Status != LEAD_STATUS_UNVERIFIED {
+		verifiedAt := createdAt.Add(time.Duration(random.Intn(600)) * time.Second)
+		l.VerifiedAt = &verifiedAt
+	}
+
+	return l
+}
+
+// Adds count leads to the file store at path, keeping any already in it. The
+// same seed gives the same leads, apart from their IDs and their dates being
+// relative to now
+func SeedLeads(ctx context.Context, path string, count int, seed int64) error {
+	store := &memoryLeadStore{path: path, leads: map[string]*lead{}}
+	if err := store.load(); err != nil {
+		return err
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	now := time.Now()
+	for range count {
+		l := seedLead(random, now)
+		l.UpdatedAt = now
+
+		store.leads[l.ID] = l
+	}
+
+	return store.persist()
+}
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Runs a synthetic lead with an attachment through the lead handler every
+// SELF_TEST_INTERVAL, so an upload, processor or store that silently stops
+// working is noticed before a real lead is lost. Synthetic leads go through
+// the outbox without being sent anywhere, are left out of analytics and are
+// removed with their attachments once checked
+const EVENT_SELF_TEST_PASSED = "self_test.passed"
+const EVENT_SELF_TEST_FAILED = "self_test.failed"
+
+// Time the handler and the outbox are given before the run fails
+const SELF_TEST_TIMEOUT = 2 * time.Minute
+
+const SELF_TEST_MOBILE = "+15555550100"
+
+type selfTestContextKey struct{}
+
+type selfTestResult struct {
+	Passed     bool      `json:"passed"`
+	Lead       string    `json:"lead,omitempty"`
+	Status     int       `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Latency    string    `json:"latency"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+var lastSelfTest = struct {
+	sync.Mutex
+	result *selfTestResult
+}{}
+
+var selfTestDuration metric.Float64Histogram
+
+func createSelfTestMetrics(ctx context.Context) {
+	meter := otel.Meter(SERVICE_NAME.Value())
+
+	var err error
+	selfTestDuration, err = meter.Float64Histogram("lead.self_test.duration",
+		metric.WithDescription("Time a synthetic lead took from submission to its outbox being delivered"),
+		metric.WithUnit("s"))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "self test metrics", err.Error())
+		panic(err)
+	}
+}
+
+func isSelfTest(ctx context.Context) bool {
+	synthetic, _ := ctx.Value(selfTestContextKey{}).(bool)
+
+	return synthetic
+}
+
+func watchSelfTest(ctx context.Context, h *Handler) {
+	interval := SELF_TEST_INTERVAL.Value()
+	if interval == 0 {
+		slog.DebugContext(ctx, "self test disabled")
+
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runSelfTest(ctx, h)
+		}
+	}
+}
+
+func runSelfTest(ctx context.Context, h *Handler) *selfTestResult {
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, selfTestContextKey{}, true), SELF_TEST_TIMEOUT)
+	defer cancel()
+
+	result := &selfTestResult{StartedAt: time.Now()}
+
+	err := submitSelfTest(ctx, h, result)
+	if result.Lead != "" {
+		if cleanupErr := removeSelfTestLead(ctx, h, result.Lead); cleanupErr != nil {
+			slog.ErrorContext(ctx, "error", "self test cleanup", cleanupErr.Error(), "lead", result.Lead)
+		}
+	}
+
+	result.FinishedAt = time.Now()
+	result.Passed = err == nil
+	result.Latency = result.FinishedAt.Sub(result.StartedAt).String()
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	selfTestDuration.Record(ctx, result.FinishedAt.Sub(result.StartedAt).Seconds(), metric.WithAttributes(attribute.Bool("passed", result.Passed)))
+
+	lastSelfTest.Lock()
+	previous := lastSelfTest.result
+	lastSelfTest.result = result
+	lastSelfTest.Unlock()
+
+	if result.Passed {
+		slog.InfoContext(ctx, "self test passed", "latency", result.Latency)
+		events.publish(ctx, EVENT_SELF_TEST_PASSED, "", result)
+
+		return result
+	}
+
+	slog.ErrorContext(ctx, "error", "self test", result.Error, "status", result.Status, "lead", result.Lead)
+	events.publish(ctx, EVENT_SELF_TEST_FAILED, "", result)
+
+	// Only the first failure in a row alerts, the next pass clears it
+	if previous == nil || previous.Passed {
+		if err := alertSelfTest(context.WithoutCancel(ctx), h.outgoing, result); err != nil {
+			slog.ErrorContext(ctx, "error", "self test alert", err.Error())
+		}
+	}
+
+	return result
+}
+
+// Goes through the same handler as a submission without the middleware in
+// front of it, which turns away requests by caller rather than by what's in
+// them
+func submitSelfTest(ctx context.Context, h *Handler, result *selfTestResult) error {
+	req, err := selfTestRequest(ctx)
+	if err != nil {
+		return err
+	}
+
+	res := httptest.NewRecorder()
+	multipartCleanupMiddleware(leadFormMiddleware(http.HandlerFunc(h.leadHandler))).ServeHTTP(res, req)
+
+	result.Status = res.Code
+	result.Lead = res.Header().Get(LEAD_ID_HEADER)
+	if res.Code != http.StatusOK {
+		return fmt.Errorf("submission failed with %d: %s", res.Code, truncate(res.Body.String(), 1024))
+	}
+	if result.Lead == "" {
+		return errors.New("submission returned no lead")
+	}
+
+	return awaitSelfTestDelivery(ctx, result.Lead)
+}
+
+func selfTestRequest(ctx context.Context) (*http.Request, error) {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+
+	// The time keeps runs from being taken as duplicates of each other
+	values := map[string]string{
+		"email":     SELF_TEST_EMAIL.Value(),
+		"mobile":    SELF_TEST_MOBILE,
+		"firstName": "Self",
+		"lastName":  "Test",
+		"enquiry":   fmt.Sprintf("Synthetic lead checking the lead pipeline at %s", time.Now().UTC().Format(time.RFC3339Nano)),
+	}
+	for name, value := range values {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := form.CreateFormFile("files", "self-test.txt")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write([]byte(values["enquiry"])); err != nil {
+		return nil, err
+	}
+
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, API_V1_PREFIX+"/lead", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.RemoteAddr = "127.0.0.1"
+
+	return req, nil
+}
+
+// Delivery may carry on after the response, the run passes once the lead is
+// saved with its attachment and nothing is left in its outbox
+func awaitSelfTestDelivery(ctx context.Context, id string) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		l, err := leads.get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("saved lead: %w", err)
+		}
+
+		switch {
+		case len(l.PendingAttachments) > 0:
+			return errors.New("attachment was spooled instead of uploaded")
+		case len(l.Attachments) == 0:
+			return errors.New("attachment is missing from the lead")
+		case len(l.Outbox) == 0:
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("outbox not delivered: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func removeSelfTestLead(ctx context.Context, h *Handler, id string) error {
+	ctx = context.WithoutCancel(ctx)
+
+	l, err := leads.get(ctx, id)
+	if errors.Is(err, errLeadNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, file := range l.Attachments {
+		if err := h.storage.remove(ctx, file.ID); err != nil && !errors.Is(err, errStoredFileNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	for _, pending := range l.PendingAttachments {
+		errs = append(errs, spool.remove(ctx, pending.ID))
+	}
+
+	errs = append(errs, leads.remove(ctx, id))
+
+	return errors.Join(errs...)
+}
+
+// Sent to the SLA Slack webhook and as an incident when a provider is set,
+// both straight rather than through the outgoing spool
+func alertSelfTest(ctx context.Context, outgoing *outgoingSpool, result *selfTestResult) error {
+	message := fmt.Sprintf("Self test failed after %s: %s", result.Latency, result.Error)
+
+	errs := []error{}
+
+	webhook, ok := SLA_SLACK_WEBHOOK_URL.Value()
+	if !ok {
+		webhook, ok = SLACK_WEBHOOK_URL.Value()
+	}
+	if ok {
+		errs = append(errs, postWebhook(ctx, outgoing, webhook.String(), map[string]any{"text": ":rotating_light: " + slackEscape(message)}))
+	}
+
+	errs = append(errs, openIncident(ctx, "self-test", "Synthetic lead failed to go through the lead pipeline", truncate(result.Error, 1024)))
+
+	return errors.Join(errs...)
+}
+
+func (h *Handler) adminSelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	result := runSelfTest(context.WithoutCancel(r.Context()), h)
+
+	writeResponse(w, r, http.StatusOK, result)
+}
+
+func adminGetSelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	lastSelfTest.Lock()
+	result := lastSelfTest.result
+	lastSelfTest.Unlock()
+
+	if result == nil {
+		writeProblem(w, r, http.StatusNotFound, "The self test has not run yet")
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, result)
+}
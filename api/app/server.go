@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const UNIX_SOCKET_PREFIX = "unix:"
+
+func Serve(ctx context.Context, handler http.Handler) error {
+	clientCas, err := clientCertificatePool()
+	if err != nil {
+		return err
+	}
+
+	if hosts, ok := TLS_AUTOCERT_HOSTS.Value(); ok {
+		return serveAutocert(ctx, handler, strings.Split(hosts, ","), clientCas)
+	}
+
+	listener, err := listen(ctx, listenAddress())
+	if err != nil {
+		return err
+	}
+
+	certFile, ok := TLS_CERT_FILE.Value()
+	if !ok {
+		if clientCas != nil {
+			listener.Close()
+
+			return errors.New("TLS_CLIENT_CA needs TLS_CERT_FILE or TLS_AUTOCERT_HOSTS")
+		}
+
+		return http.Serve(listener, handler)
+	}
+
+	keyFile, ok := TLS_KEY_FILE.Value()
+	if !ok {
+		listener.Close()
+
+		return errors.New("TLS_CERT_FILE needs TLS_KEY_FILE")
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	withClientAuth(config, clientCas)
+
+	server := &http.Server{Handler: handler, TLSConfig: config}
+
+	slog.DebugContext(ctx, "serving tls", "client certificates", clientCas != nil)
+
+	return server.ServeTLS(listener, certFile, keyFile)
+}
+
+// Server to server clients behind a gateway can authenticate with a
+// certificate issued by TLS_CLIENT_CA instead of an API key
+func clientCertificatePool() (*x509.CertPool, error) {
+	file, ok := TLS_CLIENT_CA.Value()
+	if !ok {
+		return nil, nil
+	}
+
+	bundle, err := file.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("TLS_CLIENT_CA has no certificates")
+	}
+
+	return pool, nil
+}
+
+// Browsers can still connect without a certificate unless TLS_CLIENT_AUTH is
+// require
+func withClientAuth(config *tls.Config, clientCas *x509.CertPool) {
+	if clientCas == nil {
+		return
+	}
+
+	config.ClientCAs = clientCas
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if TLS_CLIENT_AUTH.Value() == "require" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+}
+
+// Only certificates verified against TLS_CLIENT_CA count
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// HTTP_ADDR takes precedence over PORT, which is injected by Cloud Run
+func listenAddress() string {
+	if addr, ok := HTTP_ADDR.Value(); ok {
+		return addr
+	}
+
+	return ":" + PORT.Value()
+}
+
+// Addresses prefixed with unix: are served from a Unix socket for deployments
+// behind a reverse proxy on the same host
+func listen(ctx context.Context, addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, UNIX_SOCKET_PREFIX)
+	if !isUnix {
+		slog.DebugContext(ctx, "listening", "addr", addr)
+
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a previous process would fail the listen
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "listening", "socket", path)
+
+	return listener, nil
+}
+
+// Serves TLS with certificates from Let's Encrypt for the allowed hosts, plain
+// HTTP is only used for ACME challenges and redirects to HTTPS
+func serveAutocert(ctx context.Context, handler http.Handler, hosts []string, clientCas *x509.CertPool) error {
+	for i := range hosts {
+		hosts[i] = strings.TrimSpace(hosts[i])
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(TLS_AUTOCERT_CACHE_DIR.Value()),
+	}
+	if email, ok := TLS_AUTOCERT_EMAIL.Value(); ok {
+		manager.Email = email
+	}
+
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := "https://" + r.Host + r.URL.RequestURI()
+
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- http.ListenAndServe(":80", manager.HTTPHandler(redirect))
+	}()
+
+	go func() {
+		config := &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", "acme-tls/1"},
+			MinVersion:     tls.VersionTLS12,
+		}
+		withClientAuth(config, clientCas)
+
+		server := &http.Server{
+			Addr:      ":443",
+			Handler:   handler,
+			TLSConfig: config,
+		}
+
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	slog.DebugContext(ctx, "serving tls", "hosts", strings.Join(hosts, ","))
+
+	return <-errs
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The site's edge function signs what it forwards with FRONTEND_SIGNING_SECRET
+// as t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">, signed
+// requests skip the bot filter as the edge has already seen the visitor
+const FRONTEND_SIGNATURE_HEADER = "X-Frontend-Signature"
+
+// How far the timestamp can be from now, signatures are remembered for as
+// long so one can't be replayed
+const FRONTEND_SIGNATURE_TOLERANCE = 5 * time.Minute
+
+type frontendSignedKey struct{}
+
+var frontendSignatures = &seenSignatures{seen: map[string]time.Time{}}
+
+type seenSignatures struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// Reports whether the signature is new and remembers it until it expires
+func (s *seenSignatures) first(signature string, expires time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for seen, at := range s.seen {
+		if now.After(at) {
+			delete(s.seen, seen)
+		}
+	}
+
+	if _, ok := s.seen[signature]; ok {
+		return false
+	}
+	s.seen[signature] = expires
+
+	return true
+}
+
+func signFrontendRequest(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func parseFrontendSignature(header string) (int64, string, bool) {
+	var timestamp int64
+	signature := ""
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+
+	return timestamp, signature, timestamp != 0 && signature != ""
+}
+
+// Whether the request carried a valid signature from the frontend
+func isFrontendSigned(r *http.Request) bool {
+	signed, _ := r.Context().Value(frontendSignedKey{}).(bool)
+
+	return signed
+}
+
+// Runs ahead of the bot filter, the body is read into memory to check the
+// signature. With FRONTEND_SIGNATURE_REQUIRED requests without one are only
+// let through with an API key or a client certificate
+func frontendSignatureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := FRONTEND_SIGNING_SECRET.Value()
+		if !ok {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		header := r.Header.Get(FRONTEND_SIGNATURE_HEADER)
+		if header == "" {
+			if FRONTEND_SIGNATURE_REQUIRED.Value() && r.Header.Get(API_KEY_HEADER) == "" && !hasClientCertificate(r) {
+				slog.WarnContext(r.Context(), "denied", "signature", "missing", "ip", r.RemoteAddr)
+				writeProblem(w, r, http.StatusUnauthorized, "Missing request signature")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		timestamp, signature, ok := parseFrontendSignature(header)
+		signedAt := time.Unix(timestamp, 0)
+		if !ok || time.Since(signedAt).Abs() > FRONTEND_SIGNATURE_TOLERANCE {
+			slog.WarnContext(r.Context(), "denied", "signature", "invalid timestamp", "ip", r.RemoteAddr)
+			writeProblem(w, r, http.StatusUnauthorized, "Invalid request signature")
+
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE))
+		if err != nil {
+			leadError(w, r, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !hmac.Equal([]byte(signature), []byte(signFrontendRequest(secret, timestamp, body))) {
+			slog.WarnContext(r.Context(), "denied", "signature", "mismatch", "ip", r.RemoteAddr)
+			writeProblem(w, r, http.StatusUnauthorized, "Invalid request signature")
+
+			return
+		}
+
+		if !frontendSignatures.first(signature, signedAt.Add(FRONTEND_SIGNATURE_TOLERANCE)) {
+			slog.WarnContext(r.Context(), "denied", "signature", "replayed", "ip", r.RemoteAddr)
+			writeProblem(w, r, http.StatusUnauthorized, "Request signature was already used")
+
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), frontendSignedKey{}, true)))
+	})
+}
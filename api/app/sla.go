@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// A lead is responded to when its status first changes from new, leads still
+// new after LEAD_SLA alert the team once
+const EVENT_LEAD_SLA_BREACHED = "lead.sla_breached"
+
+var slaResponseTime metric.Float64Histogram
+var slaBreaches metric.Int64Counter
+
+func createSlaMetrics(ctx context.Context) {
+	meter := otel.Meter(SERVICE_NAME.Value())
+
+	var err error
+	slaResponseTime, err = meter.Float64Histogram("lead.first_response.duration",
+		metric.WithDescription("Time from a lead being received to its first status change"),
+		metric.WithUnit("s"))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "sla metrics", err.Error())
+		panic(err)
+	}
+
+	slaBreaches, err = meter.Int64Counter("lead.sla.breaches",
+		metric.WithDescription("Leads that waited longer than the SLA for a first response"))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "sla metrics", err.Error())
+		panic(err)
+	}
+
+	_, err = meter.Int64ObservableGauge("lead.sla.awaiting_response",
+		metric.WithDescription("New leads waiting for a first response"),
+		metric.WithInt64Callback(func(ctx context.Context, observer metric.Int64Observer) error {
+			waiting, err := leads.list(ctx, leadFilter{status: LEAD_STATUS_NEW})
+			if err != nil {
+				return err
+			}
+
+			breached := int64(0)
+			for _, l := range waiting {
+				if l.SlaBreachedAt != nil {
+					breached++
+				}
+			}
+
+			observer.Observe(int64(len(waiting))-breached, metric.WithAttributes(attribute.Bool("breached", false)))
+			observer.Observe(breached, metric.WithAttributes(attribute.Bool("breached", true)))
+
+			return nil
+		}))
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "sla metrics", err.Error())
+		panic(err)
+	}
+}
+
+// Changes the status of a lead, recording the first response
+// With from the status is only changed when the lead is still in it
+func changeLeadStatus(ctx context.Context, id string, from string, status string) (*lead, string, error) {
+	previous := ""
+	l, err := leads.update(ctx, id, func(l *lead) error {
+		if from != "" && l.Status != from {
+			return errLeadStatusConflict
+		}
+
+		previous = l.Status
+		l.Status = status
+
+		if l.FirstResponseAt == nil && previous == LEAD_STATUS_NEW && status != LEAD_STATUS_NEW {
+			now := time.Now()
+			l.FirstResponseAt = &now
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if previous == status {
+		return l, previous, nil
+	}
+
+	if l.FirstResponseAt != nil && previous == LEAD_STATUS_NEW {
+		slaResponseTime.Record(ctx, l.FirstResponseAt.Sub(l.CreatedAt).Seconds(),
+			metric.WithAttributes(attribute.Bool("breached", l.SlaBreachedAt != nil)))
+	}
+
+	events.publish(ctx, EVENT_LEAD_STATUS_CHANGED, l.ID, map[string]any{
+		"from": previous,
+		"to":   status,
+	})
+
+	return l, previous, nil
+}
+
+func watchSla(ctx context.Context, h *Handler) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := checkSla(ctx, h.outgoing, now); err != nil {
+				slog.ErrorContext(ctx, "error", "sla", err.Error())
+			}
+		}
+	}
+}
+
+func checkSla(ctx context.Context, outgoing *outgoingSpool, now time.Time) error {
+	waiting, err := leads.list(ctx, leadFilter{status: LEAD_STATUS_NEW})
+	if err != nil {
+		return err
+	}
+
+	sla := LEAD_SLA.Value()
+	for _, l := range waiting {
+		if l.SlaBreachedAt != nil || now.Sub(l.CreatedAt) < sla {
+			continue
+		}
+
+		breached, err := leads.update(ctx, l.ID, func(l *lead) error {
+			if l.SlaBreachedAt != nil || l.Status != LEAD_STATUS_NEW {
+				return errSlaNotBreached
+			}
+
+			l.SlaBreachedAt = &now
+
+			return nil
+		})
+		if errors.Is(err, errSlaNotBreached) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		slaBreaches.Add(ctx, 1)
+		slog.WarnContext(ctx, "sla breached", "lead", l.ID, "waiting", now.Sub(l.CreatedAt).String())
+
+		events.publish(ctx, EVENT_LEAD_SLA_BREACHED, l.ID, map[string]any{
+			"waiting": now.Sub(l.CreatedAt).String(),
+		})
+
+		if err := escalate(ctx, outgoing, breached, fmt.Sprintf("Lead from %s (%s) has waited %s without a response", breached.name(), breached.Email, now.Sub(breached.CreatedAt).Round(time.Minute))); err != nil {
+			slog.ErrorContext(ctx, "error", "sla escalation", err.Error(), "lead", l.ID)
+		}
+	}
+
+	return nil
+}
+
+var errSlaNotBreached = errors.New("sla not breached")
+
+// Escalations go to the SLA Slack webhook and every SMS recipient whatever
+// the lead scored
+func escalate(ctx context.Context, outgoing *outgoingSpool, l *lead, message string) error {
+	errs := []error{}
+
+	webhook, ok := SLA_SLACK_WEBHOOK_URL.Value()
+	if !ok {
+		webhook, ok = SLACK_WEBHOOK_URL.Value()
+	}
+	if ok {
+		errs = append(errs, postWebhook(ctx, outgoing, webhook.String(), map[string]any{"text": ":rotating_light: " + slackEscape(message)}))
+	}
+
+	for _, n := range escalationNotifiers {
+		if sms, ok := n.(smsNotifier); ok {
+			for _, to := range sms.recipients {
+				errs = append(errs, sendSms(ctx, to, message))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,50 @@
+package app
+
+import (
+	"context"
+	"fmt"
+)
+
+// Posts to a Slack incoming webhook, the webhook decides the channel
+type slackNotifier struct {
+	webhook string
+}
+
+func (slackNotifier) name() string { return "slack" }
+
+func (n slackNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	title := fmt.Sprintf("New lead from %s", l.name())
+
+	return postWebhook(ctx, outgoing, n.webhook, map[string]any{
+		"text": title,
+		"blocks": []map[string]any{
+			{
+				"type": "header",
+				"text": map[string]any{"type": "plain_text", "text": title},
+			},
+			{
+				"type": "section",
+				"text": map[string]any{"type": "mrkdwn", "text": slackEscape(leadSummary(l))},
+			},
+		},
+	})
+}
+
+// Slack only needs these three escaped in mrkdwn text
+func slackEscape(text string) string {
+	escaped := []rune{}
+	for _, r := range text {
+		switch r {
+		case '&':
+			escaped = append(escaped, []rune("&amp;")...)
+		case '<':
+			escaped = append(escaped, []rune("&lt;")...)
+		case '>':
+			escaped = append(escaped, []rune("&gt;")...)
+		default:
+			escaped = append(escaped, r)
+		}
+	}
+
+	return string(escaped)
+}
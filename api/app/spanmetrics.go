@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Rate, errors and duration per route are derived from the request spans, the
+// measurements are taken in the span context so each carries an exemplar
+// linking back to its trace
+const SPAN_METRICS_UNMATCHED_ROUTE = "unmatched"
+
+// Exemplars are experimental in the metrics SDK and have to be turned on
+// before the meter provider is created
+func enableExemplars() {
+	if _, ok := os.LookupEnv("OTEL_GO_X_EXEMPLAR"); !ok {
+		os.Setenv("OTEL_GO_X_EXEMPLAR", "true")
+	}
+}
+
+type spanMetricsProcessor struct {
+	requests metric.Int64Counter
+	errors   metric.Int64Counter
+	duration metric.Float64Histogram
+}
+
+func createSpanMetricsProcessor() (*spanMetricsProcessor, error) {
+	meter := otel.Meter(SERVICE_NAME.Value())
+
+	requests, err := meter.Int64Counter("http.server.route.requests",
+		metric.WithDescription("Requests handled per route, from the request spans"))
+	if err != nil {
+		return nil, err
+	}
+
+	failures, err := meter.Int64Counter("http.server.route.errors",
+		metric.WithDescription("Requests per route whose span ended with an error status"))
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := meter.Float64Histogram("http.server.route.duration",
+		metric.WithDescription("Duration of the request spans per route"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	return &spanMetricsProcessor{requests: requests, errors: failures, duration: duration}, nil
+}
+
+func (p *spanMetricsProcessor) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {}
+
+func (p *spanMetricsProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanKind() != trace.SpanKindServer {
+		return
+	}
+
+	route := SPAN_METRICS_UNMATCHED_ROUTE
+	method := ""
+	status := ""
+	for _, kv := range s.Attributes() {
+		switch kv.Key {
+		case semconv.HTTPRouteKey:
+			route = kv.Value.AsString()
+		case semconv.HTTPMethodKey:
+			method = kv.Value.AsString()
+		case semconv.HTTPStatusCodeKey:
+			status = strconv.FormatInt(kv.Value.AsInt64(), 10)
+		}
+	}
+
+	ctx := trace.ContextWithSpanContext(context.Background(), s.SpanContext())
+	attributes := metric.WithAttributes(
+		semconv.HTTPRoute(route),
+		semconv.HTTPMethod(method),
+		attribute.String("http.status_code", status),
+	)
+
+	p.requests.Add(ctx, 1, attributes)
+	if s.Status().Code == codes.Error {
+		p.errors.Add(ctx, 1, attributes)
+	}
+	p.duration.Record(ctx, s.EndTime().Sub(s.StartTime()).Seconds(), attributes)
+}
+
+func (p *spanMetricsProcessor) Shutdown(ctx context.Context) error { return nil }
+
+func (p *spanMetricsProcessor) ForceFlush(ctx context.Context) error { return nil }
+
+// The route is only known once chi has matched it, so it is added to the
+// request span after the handler returns
+func spanRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || rctx.RoutePattern() == "" {
+			return
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		span.SetName(r.Method + " " + rctx.RoutePattern())
+	})
+}
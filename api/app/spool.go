@@ -0,0 +1,300 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// Attachments are spooled to ATTACHMENT_SPOOL when ATTACHMENT_STORAGE can't
+// take them, the lead is accepted with them pending and they are uploaded
+// once storage is back. Pending attachments are kept on the lead, so they
+// only survive a restart with LEAD_STORE=file
+const EVENT_ATTACHMENT_SPOOLED = "attachment.spooled"
+
+type leadPendingAttachment struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	SpooledAt time.Time `json:"spooledAt"`
+	// Moved to the attachment once it is uploaded
+	Metadata *attachmentMetadata `json:"metadata,omitempty"`
+}
+
+type attachmentSpool interface {
+	put(ctx context.Context, id string, content io.Reader) error
+	open(ctx context.Context, id string) (io.ReadCloser, error)
+	remove(ctx context.Context, id string) error
+}
+
+var spool attachmentSpool
+
+// ATTACHMENT_SPOOL is a local directory or a gs://bucket/prefix
+func createAttachmentSpool(ctx context.Context) attachmentSpool {
+	location, ok := ATTACHMENT_SPOOL.Value()
+	if !ok {
+		return nil
+	}
+
+	if !strings.HasPrefix(location, "gs://") {
+		if err := os.MkdirAll(location, 0o700); err != nil {
+			slog.ErrorContext(ctx, "error", "attachment spool", err.Error())
+			panic(err)
+		}
+
+		slog.DebugContext(ctx, "created attachment spool", "dir", location)
+
+		return dirSpool{dir: location}
+	}
+
+	bucket, err := url.Parse(location)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "attachment spool", err.Error())
+		panic(err)
+	}
+
+	client, err := googleClientOption(ctx, []string{gcs.DevstorageReadWriteScope})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "attachment spool", err.Error())
+		panic(err)
+	}
+
+	service, err := gcs.NewService(ctx, client)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "attachment spool", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created attachment spool", "bucket", location)
+
+	return gcsSpool{service: service, bucket: bucket.Host, prefix: strings.Trim(bucket.Path, "/")}
+}
+
+func newSpoolID(leadID string) string {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+
+	return leadID + "-" + hex.EncodeToString(suffix)
+}
+
+// The content is encrypted before it is spooled when encryption is enabled,
+// so the spool never holds more than storage would
+func spoolAttachment(ctx context.Context, l *lead, file attachment, hash string, metadata *attachmentMetadata) (*leadPendingAttachment, error) {
+	reader, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	pending := &leadPendingAttachment{
+		ID:        newSpoolID(l.ID),
+		Name:      file.filename,
+		Size:      file.size,
+		Sha256:    hash,
+		SpooledAt: time.Now(),
+		Metadata:  metadata,
+	}
+
+	var content io.Reader = reader
+	if isEncryptionEnabled() {
+		content, err = encryptAttachment(ctx, reader)
+		if err != nil {
+			return nil, err
+		}
+
+		pending.Encrypted = true
+	}
+
+	if err := spool.put(ctx, pending.ID, content); err != nil {
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+func watchAttachmentSpool(ctx context.Context, h *Handler) {
+	interval := ATTACHMENT_SPOOL_INTERVAL.Value()
+	if spool == nil || interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := uploadSpooledAttachments(ctx, h.storage); err != nil {
+				slog.ErrorContext(ctx, "error", "attachment spool", err.Error())
+			}
+		}
+	}
+}
+
+// Stops at the first failed upload, storage is most likely still down
+func uploadSpooledAttachments(ctx context.Context, storage attachmentStorage) error {
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		return err
+	}
+
+	for _, l := range all {
+		for _, pending := range l.PendingAttachments {
+			if err := uploadSpooledAttachment(ctx, storage, l, pending); err != nil {
+				return fmt.Errorf("%s: %w", pending.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func uploadSpooledAttachment(ctx context.Context, storage attachmentStorage, l *lead, pending leadPendingAttachment) error {
+	content, err := spool.open(ctx, pending.ID)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	file := storedFile{
+		name: pending.Name,
+		properties: map[string]string{
+			"lead":      l.ID,
+			"email":     l.Email,
+			"firstName": l.FirstName,
+			"lastName":  l.LastName,
+			"mobile":    l.Mobile,
+			"sha256":    pending.Sha256,
+		},
+	}
+
+	checksum := pending.Sha256
+	if pending.Encrypted {
+		file.mimeType = "application/octet-stream"
+		file.properties["encrypted"] = "true"
+		checksum = ""
+	}
+
+	res, err := storage.create(ctx, file, content, checksum)
+	if err != nil {
+		return err
+	}
+
+	_, err = leads.update(ctx, l.ID, func(l *lead) error {
+		remaining := []leadPendingAttachment{}
+		for _, p := range l.PendingAttachments {
+			if p.ID != pending.ID {
+				remaining = append(remaining, p)
+			}
+		}
+
+		l.PendingAttachments = remaining
+		l.Attachments = append(l.Attachments, leadAttachment{ID: res.id, Name: res.name, Metadata: pending.Metadata})
+
+		return nil
+	})
+	if err != nil {
+		// Removed so the next run doesn't store it a second time, unless
+		// another submission stored it first
+		if !res.existing {
+			go storage.remove(context.WithoutCancel(ctx), res.id)
+		}
+
+		return err
+	}
+
+	if err := spool.remove(ctx, pending.ID); err != nil {
+		slog.ErrorContext(ctx, "error", "attachment spool remove", err.Error(), "spooled", pending.ID)
+	}
+
+	slog.InfoContext(ctx, "uploaded spooled attachment", "lead", l.ID, "file", res.id, "spooled", pending.SpooledAt)
+
+	events.publish(ctx, EVENT_ATTACHMENT_UPLOADED, l.ID, map[string]any{
+		"file":     res.id,
+		"filename": res.name,
+		"size":     pending.Size,
+		"sha256":   pending.Sha256,
+	})
+
+	return nil
+}
+
+type dirSpool struct {
+	dir string
+}
+
+func (s dirSpool) put(ctx context.Context, id string, content io.Reader) error {
+	temp, err := os.CreateTemp(s.dir, ".spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := io.Copy(temp, content); err != nil {
+		temp.Close()
+
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), filepath.Join(s.dir, id))
+}
+
+func (s dirSpool) open(ctx context.Context, id string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.Base(id)))
+}
+
+func (s dirSpool) remove(ctx context.Context, id string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.Base(id)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+type gcsSpool struct {
+	service *gcs.Service
+	bucket  string
+	prefix  string
+}
+
+func (s gcsSpool) put(ctx context.Context, id string, content io.Reader) error {
+	_, err := s.service.Objects.Insert(s.bucket, &gcs.Object{Name: path.Join(s.prefix, id)}).
+		Media(content).
+		Context(ctx).
+		Do()
+
+	return err
+}
+
+func (s gcsSpool) open(ctx context.Context, id string) (io.ReadCloser, error) {
+	res, err := s.service.Objects.Get(s.bucket, path.Join(s.prefix, id)).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s gcsSpool) remove(ctx context.Context, id string) error {
+	return s.service.Objects.Delete(s.bucket, path.Join(s.prefix, id)).Context(ctx).Do()
+}
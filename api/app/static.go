@@ -0,0 +1,66 @@
+package app
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The static site is copied here before building single-binary deployments:
+//
+//	(cd client && pnpm build) && cp -r client/dist/. api/app/static/
+//
+//go:embed all:static
+var staticFiles embed.FS
+
+// Serves the embedded site, unknown paths without an extension fall back to
+// index.html so client side routes resolve
+func staticHandler() http.HandlerFunc {
+	site, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" {
+			name = "."
+		}
+
+		candidates := []string{name, path.Join(name, "index.html"), name + ".html"}
+		for _, candidate := range candidates {
+			info, err := fs.Stat(site, candidate)
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			serveStaticFile(w, r, site, candidate)
+
+			return
+		}
+
+		if path.Ext(name) == "" {
+			serveStaticFile(w, r, site, "index.html")
+
+			return
+		}
+
+		http.NotFound(w, r)
+	}
+}
+
+func serveStaticFile(w http.ResponseWriter, r *http.Request, site fs.FS, name string) {
+	switch {
+	// Astro fingerprints everything it emits under _astro
+	case strings.HasPrefix(name, "_astro/"):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	case path.Ext(name) == ".html":
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	http.ServeFileFS(w, r, site, name)
+}
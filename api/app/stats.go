@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Submissions are counted from the lead store, outcomes that are not stored
+// with a lead are tallied from events by the hour and kept for STATS_RETENTION
+const STATS_RETENTION = 31 * 24 * time.Hour
+
+var stats = &statsRecorder{hours: map[time.Time]map[string]int{}}
+
+type statsRecorder struct {
+	mu    sync.Mutex
+	hours map[time.Time]map[string]int
+}
+
+type statsBucket struct {
+	Start              time.Time `json:"start"`
+	Submissions        int       `json:"submissions"`
+	Quarantined        int       `json:"quarantined"`
+	Rejected           int       `json:"rejected"`
+	Spam               int       `json:"spam"`
+	Attachments        int       `json:"attachments"`
+	AttachmentFailures int       `json:"attachmentFailures"`
+	EmailsSent         int       `json:"emailsSent"`
+	EmailFailures      int       `json:"emailFailures"`
+}
+
+type experimentStats struct {
+	Experiment     string  `json:"experiment"`
+	Variant        string  `json:"variant"`
+	Submissions    int     `json:"submissions"`
+	Won            int     `json:"won"`
+	ConversionRate float64 `json:"conversionRate"`
+}
+
+// Synthetic leads of the self test are left out of the counts
+func (s *statsRecorder) record(ctx context.Context, e event) {
+	if isSelfTest(ctx) {
+		return
+	}
+
+	name := e.Name
+	// Bot rejections never become a lead, so are counted separately from
+	// spam that was stored
+	if data, ok := e.Data.(map[string]any); ok && e.Name == EVENT_SPAM_DETECTED && data["rejected"] == true {
+		name = "spam.rejected"
+	}
+
+	hour := e.At.UTC().Truncate(time.Hour)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hours[hour] == nil {
+		s.hours[hour] = map[string]int{}
+	}
+	s.hours[hour][name]++
+
+	for h := range s.hours {
+		if e.At.Sub(h) > STATS_RETENTION {
+			delete(s.hours, h)
+		}
+	}
+}
+
+func (s *statsRecorder) tally(from time.Time, until time.Time) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := map[string]int{}
+	for hour, counts := range s.hours {
+		if hour.Before(from) || !hour.Before(until) {
+			continue
+		}
+
+		for name, count := range counts {
+			total[name] += count
+		}
+	}
+
+	return total
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	period := 7 * 24 * time.Hour
+	if value := query.Get("period"); value != "" {
+		parsed, err := parsePeriod(value)
+		if err != nil || parsed <= 0 || parsed > STATS_RETENTION {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid period, expected up to %dd", int(STATS_RETENTION.Hours()/24)))
+
+			return
+		}
+
+		period = parsed
+	}
+
+	bucket := 24 * time.Hour
+	if period <= 48*time.Hour {
+		bucket = time.Hour
+	}
+	if value := query.Get("bucket"); value != "" {
+		parsed, err := parsePeriod(value)
+		if err != nil || parsed < time.Hour || parsed%time.Hour != 0 || period/parsed > 1000 {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid bucket, expected whole hours")
+
+			return
+		}
+
+		bucket = parsed
+	}
+
+	until := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	from := until.Add(-period).Truncate(bucket)
+
+	buckets := []*statsBucket{}
+	for start := from; start.Before(until); start = start.Add(bucket) {
+		counts := stats.tally(start, start.Add(bucket))
+		buckets = append(buckets, &statsBucket{
+			Start:              start,
+			Rejected:           counts["spam.rejected"],
+			Spam:               counts[EVENT_SPAM_DETECTED] + counts["spam.rejected"],
+			Attachments:        counts[EVENT_ATTACHMENT_UPLOADED],
+			AttachmentFailures: counts[EVENT_ATTACHMENT_FAILED],
+			EmailsSent:         counts[EVENT_EMAIL_SENT],
+			EmailFailures:      counts[EVENT_EMAIL_FAILED],
+		})
+	}
+
+	stored, err := leads.list(r.Context(), leadFilter{})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	variants := map[leadExperiment]*experimentStats{}
+	for _, l := range stored {
+		if l.CreatedAt.Before(from) || !l.CreatedAt.Before(until) {
+			continue
+		}
+
+		b := buckets[int(l.CreatedAt.Sub(from)/bucket)]
+		b.Submissions++
+		if l.Status == LEAD_STATUS_QUARANTINED {
+			b.Quarantined++
+		}
+
+		if l.Experiment != nil {
+			v, ok := variants[*l.Experiment]
+			if !ok {
+				v = &experimentStats{Experiment: l.Experiment.Name, Variant: l.Experiment.Variant}
+				variants[*l.Experiment] = v
+			}
+
+			v.Submissions++
+			if l.Status == LEAD_STATUS_WON {
+				v.Won++
+			}
+		}
+	}
+
+	experimentRows := []*experimentStats{}
+	for _, v := range variants {
+		v.ConversionRate = rate(v.Won, v.Submissions)
+		experimentRows = append(experimentRows, v)
+	}
+	sort.Slice(experimentRows, func(i, j int) bool {
+		if experimentRows[i].Experiment != experimentRows[j].Experiment {
+			return experimentRows[i].Experiment < experimentRows[j].Experiment
+		}
+
+		return experimentRows[i].Variant < experimentRows[j].Variant
+	})
+
+	totals := statsBucket{Start: from}
+	for _, b := range buckets {
+		totals.Submissions += b.Submissions
+		totals.Quarantined += b.Quarantined
+		totals.Rejected += b.Rejected
+		totals.Spam += b.Spam
+		totals.Attachments += b.Attachments
+		totals.AttachmentFailures += b.AttachmentFailures
+		totals.EmailsSent += b.EmailsSent
+		totals.EmailFailures += b.EmailFailures
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]any{
+		"from":              from,
+		"until":             until,
+		"bucket":            bucket.String(),
+		"buckets":           buckets,
+		"totals":            totals,
+		"spamRate":          rate(totals.Spam, totals.Submissions+totals.Rejected),
+		"uploadFailureRate": rate(totals.AttachmentFailures, totals.Attachments+totals.AttachmentFailures),
+		"emailDeliveryRate": rate(totals.EmailsSent, totals.EmailsSent+totals.EmailFailures),
+		"experiments":       experimentRows,
+		// Event tallies are kept in memory and start again when the
+		// process does
+		"since": statsSince,
+	})
+}
+
+var statsSince = time.Now().UTC()
+
+func rate(count int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(count) / float64(total)
+}
+
+// Periods are a Go duration or a number of days such as 7d
+func parsePeriod(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
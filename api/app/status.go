@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Coarse health of the subsystems for a public status page, from the failure
+// rates of the last hour and day and how far behind deliveries are. Unlike
+// /ping it always responds 200, and it leaves out anything about the leads
+// or the errors themselves
+const STATUS_OPERATIONAL = "operational"
+const STATUS_DEGRADED = "degraded"
+const STATUS_OUTAGE = "outage"
+
+// Rates over the last hour decide the status, the day is there for context
+const STATUS_DEGRADED_ERROR_RATE = 0.05
+const STATUS_OUTAGE_ERROR_RATE = 0.5
+
+// Deliveries this far past due mean the outbox isn't keeping up
+const STATUS_DEGRADED_QUEUE_LAG = 5 * time.Minute
+const STATUS_OUTAGE_QUEUE_LAG = time.Hour
+
+// Responses are cached so the endpoint can't be used to load the lead store
+const STATUS_CACHE_TTL = 30 * time.Second
+
+var STATUS_WINDOWS = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+}
+
+type subsystemStatus struct {
+	Status    string             `json:"status"`
+	ErrorRate map[string]float64 `json:"errorRate"`
+}
+
+type serviceStatus struct {
+	Status     string                      `json:"status"`
+	Subsystems map[string]*subsystemStatus `json:"subsystems"`
+	UpdatedAt  time.Time                   `json:"updatedAt"`
+}
+
+var cachedStatus = struct {
+	sync.Mutex
+	status *serviceStatus
+}{}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	cachedStatus.Lock()
+	if cachedStatus.status == nil || time.Since(cachedStatus.status.UpdatedAt) >= STATUS_CACHE_TTL {
+		cachedStatus.status = currentStatus(r.Context(), time.Now())
+	}
+	status := cachedStatus.status
+	cachedStatus.Unlock()
+
+	w.Header().Set("Cache-Control", "public, max-age=30")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeResponse(w, r, http.StatusOK, status)
+}
+
+func currentStatus(ctx context.Context, now time.Time) *serviceStatus {
+	// Counted in hour buckets, the current hour is partial so each window
+	// also takes the whole hour before it
+	until := now.UTC().Truncate(time.Hour).Add(time.Hour)
+	counts := map[string]map[string]int{}
+	for window, period := range STATUS_WINDOWS {
+		counts[window] = stats.tally(until.Add(-period-time.Hour), until)
+	}
+
+	attachments := errorRates(counts, []string{EVENT_ATTACHMENT_UPLOADED}, []string{EVENT_ATTACHMENT_FAILED, EVENT_ATTACHMENT_SPOOLED})
+	emails := errorRates(counts, []string{EVENT_EMAIL_SENT}, []string{EVENT_EMAIL_FAILED})
+
+	// Given up deliveries for every lead taken
+	queue := errorRates(counts, []string{EVENT_LEAD_RECEIVED}, []string{EVENT_OUTBOX_FAILED})
+	queue.Status = worstStatus(queue.Status, queueStatus(ctx, now))
+
+	return &serviceStatus{
+		Status: worstStatus(attachments.Status, emails.Status, queue.Status),
+		Subsystems: map[string]*subsystemStatus{
+			"storage": attachments,
+			"email":   emails,
+			"queue":   queue,
+		},
+		UpdatedAt: now,
+	}
+}
+
+// Failures are events that are also counted as attempts
+func errorRates(counts map[string]map[string]int, succeeded []string, failed []string) *subsystemStatus {
+	status := &subsystemStatus{Status: STATUS_OPERATIONAL, ErrorRate: map[string]float64{}}
+
+	for window, tally := range counts {
+		failures := 0
+		for _, name := range failed {
+			failures += tally[name]
+		}
+		attempts := failures
+		for _, name := range succeeded {
+			attempts += tally[name]
+		}
+
+		rate := 0.0
+		if attempts > 0 {
+			rate = math.Min(float64(failures)/float64(attempts), 1)
+		}
+		status.ErrorRate[window] = math.Round(rate*1000) / 1000
+
+		if STATUS_WINDOWS[window] != time.Hour {
+			continue
+		}
+
+		switch {
+		case rate >= STATUS_OUTAGE_ERROR_RATE:
+			status.Status = STATUS_OUTAGE
+		case rate >= STATUS_DEGRADED_ERROR_RATE:
+			status.Status = STATUS_DEGRADED
+		}
+	}
+
+	return status
+}
+
+func queueStatus(ctx context.Context, now time.Time) string {
+	all, err := leads.list(ctx, leadFilter{})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "status", err.Error())
+
+		return STATUS_OUTAGE
+	}
+
+	lag := time.Duration(0)
+	for _, l := range all {
+		for _, entry := range l.Outbox {
+			lag = max(lag, now.Sub(entry.NextAttemptAt))
+		}
+	}
+
+	switch {
+	case lag >= STATUS_OUTAGE_QUEUE_LAG:
+		return STATUS_OUTAGE
+	case lag >= STATUS_DEGRADED_QUEUE_LAG:
+		return STATUS_DEGRADED
+	default:
+		return STATUS_OPERATIONAL
+	}
+}
+
+func worstStatus(statuses ...string) string {
+	worst := STATUS_OPERATIONAL
+	for _, status := range statuses {
+		if status == STATUS_OUTAGE || (status == STATUS_DEGRADED && worst == STATUS_OPERATIONAL) {
+			worst = status
+		}
+	}
+
+	return worst
+}
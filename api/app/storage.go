@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+var errStoredFileNotFound = errors.New("file not found")
+
+type storedFile struct {
+	id         string
+	name       string
+	mimeType   string
+	properties map[string]string
+	createdAt  time.Time
+	// Set by create when the content was already stored by someone else, the
+	// file is shared so it is not removed when the caller rolls back
+	existing bool
+}
+
+// Backend that attachments are uploaded to, selected by ATTACHMENT_STORAGE
+type attachmentStorage interface {
+	// Logs usage of the backend where it is available
+	stats(ctx context.Context) error
+	// Returns a file with the same content previously stored for the email
+	findDuplicate(ctx context.Context, email string, hash string) (*storedFile, error)
+	// Stores the content, checksum is the SHA-256 of the content to verify
+	// against the backend where supported, and may be empty
+	create(ctx context.Context, file storedFile, content io.Reader, checksum string) (*storedFile, error)
+	get(ctx context.Context, id string) (*storedFile, error)
+	open(ctx context.Context, id string) (io.ReadCloser, error)
+	remove(ctx context.Context, id string) error
+	// Calls fn with every stored file
+	list(ctx context.Context, fn func(file storedFile) error) error
+}
+
+func createAttachmentStorage(ctx context.Context) attachmentStorage {
+	switch ATTACHMENT_STORAGE.Value() {
+	case "azure-blob":
+		return createBlobStorage(ctx)
+	default:
+		service := newDependency("google drive", createGoogleDriveService)
+		service.start(ctx)
+
+		slog.DebugContext(ctx, "created drive storage")
+
+		return driveStorage{service: service, quota: &driveQuotaCache{}}
+	}
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// Azure Blob Storage can't query metadata, so blobs are named after a hash of
+// the email and the content hash, which makes finding a duplicate a lookup
+type blobStorage struct {
+	container *container.Client
+}
+
+func createBlobStorage(ctx context.Context) attachmentStorage {
+	var client *azblob.Client
+	var err error
+	options := &azblob.ClientOptions{ClientOptions: azcore.ClientOptions{Transport: tracedClient(0)}}
+
+	if connectionString, ok := AZURE_STORAGE_CONNECTION_STRING.Value(); ok {
+		client, err = azblob.NewClientFromConnectionString(connectionString, options)
+	} else {
+		// Uses the managed identity of the Function App when deployed
+		accountUrl, ok := AZURE_STORAGE_ACCOUNT_URL.Value()
+		if !ok {
+			err := errors.New("AZURE_STORAGE_ACCOUNT_URL or AZURE_STORAGE_CONNECTION_STRING is required for blob storage")
+			slog.ErrorContext(ctx, "error", "blob storage", err.Error())
+			panic(err)
+		}
+
+		var credential *azidentity.DefaultAzureCredential
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+		if err == nil {
+			client, err = azblob.NewClient(accountUrl.String(), credential, options)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "blob storage", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created blob storage", "container", AZURE_STORAGE_CONTAINER.Value())
+
+	return blobStorage{
+		container: client.ServiceClient().NewContainerClient(AZURE_STORAGE_CONTAINER.Value()),
+	}
+}
+
+func (s blobStorage) stats(ctx context.Context) error {
+	return nil
+}
+
+func (s blobStorage) findDuplicate(ctx context.Context, email string, hash string) (*storedFile, error) {
+	file, err := s.get(ctx, blobName(email, hash))
+	if err == errStoredFileNotFound {
+		return nil, nil
+	}
+
+	return file, err
+}
+
+func (s blobStorage) create(ctx context.Context, file storedFile, content io.Reader, checksum string) (*storedFile, error) {
+	name := blobName(file.properties["email"], file.properties["sha256"])
+
+	metadata := map[string]*string{
+		"filename": blobMetadataValue(file.name),
+	}
+	for key, value := range file.properties {
+		metadata[strings.ToLower(key)] = blobMetadataValue(value)
+	}
+
+	etagAny := azcore.ETagAny
+	options := &blockblob.UploadStreamOptions{
+		Metadata: metadata,
+		AccessConditions: &blob.AccessConditions{
+			ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &etagAny},
+		},
+	}
+	if file.mimeType != "" {
+		options.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &file.mimeType}
+	}
+
+	_, err := s.container.NewBlockBlobClient(name).UploadStream(ctx, content, options)
+
+	// Another submission stored the same content first
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet) {
+		existing, err := s.get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		existing.existing = true
+
+		return existing, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slog.DebugContext(ctx, "blob create", "file", name)
+
+	created := file
+	created.id = name
+
+	return &created, nil
+}
+
+func (s blobStorage) get(ctx context.Context, id string) (*storedFile, error) {
+	res, err := s.container.NewBlobClient(id).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, errStoredFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	file := blobStoredFile(id, res.Metadata)
+	if res.ContentType != nil {
+		file.mimeType = *res.ContentType
+	}
+	if res.CreationTime != nil {
+		file.createdAt = *res.CreationTime
+	}
+
+	return file, nil
+}
+
+func (s blobStorage) list(ctx context.Context, fn func(file storedFile) error) error {
+	pager := s.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Include: container.ListBlobsInclude{Metadata: true},
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+
+			file := blobStoredFile(*item.Name, item.Metadata)
+			if item.Properties != nil {
+				if item.Properties.ContentType != nil {
+					file.mimeType = *item.Properties.ContentType
+				}
+				if item.Properties.CreationTime != nil {
+					file.createdAt = *item.Properties.CreationTime
+				}
+			}
+
+			if err := fn(*file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Metadata keys come back with their case changed by the transport
+func blobStoredFile(id string, metadata map[string]*string) *storedFile {
+	properties := map[string]string{}
+	for key, value := range metadata {
+		if value == nil {
+			continue
+		}
+
+		decoded, err := url.QueryUnescape(*value)
+		if err != nil {
+			decoded = *value
+		}
+
+		properties[strings.ToLower(key)] = decoded
+	}
+
+	file := &storedFile{
+		id:         id,
+		name:       properties["filename"],
+		properties: properties,
+	}
+	delete(properties, "filename")
+
+	return file
+}
+
+func (s blobStorage) open(ctx context.Context, id string) (io.ReadCloser, error) {
+	res, err := s.container.NewBlobClient(id).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s blobStorage) remove(ctx context.Context, id string) error {
+	_, err := s.container.NewBlobClient(id).Delete(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return errStoredFileNotFound
+	}
+
+	return err
+}
+
+func blobName(email string, hash string) string {
+	emailHash := sha256.Sum256([]byte(strings.ToLower(email)))
+
+	return fmt.Sprintf("%s-%s", hex.EncodeToString(emailHash[:16]), hash)
+}
+
+// Metadata is sent as headers so values are limited to ASCII
+func blobMetadataValue(value string) *string {
+	escaped := url.QueryEscape(value)
+
+	return &escaped
+}
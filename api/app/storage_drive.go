@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const DRIVE_FILE_FIELDS = "id, name, mimeType, webContentLink, properties, sha256Checksum, createdTime"
+
+// Time a quota refresh in the background is given
+const DRIVE_QUOTA_REFRESH_TIMEOUT = 30 * time.Second
+
+type driveStorage struct {
+	service *dependency[*drive.Service]
+	quota   *driveQuotaCache
+}
+
+// Every submission with files checks the quota, so it is only fetched from
+// Drive when missing and otherwise refreshed in the background once it is
+// older than DRIVE_QUOTA_CACHE_TTL or a file was added or removed
+type driveQuotaCache struct {
+	mu         sync.Mutex
+	quota      *drive.AboutStorageQuota
+	fetchedAt  time.Time
+	stale      bool
+	refreshing bool
+}
+
+func (s driveStorage) stats(ctx context.Context) error {
+	s.quota.mu.Lock()
+	quota := s.quota.quota
+	refresh := quota != nil && !s.quota.refreshing && (s.quota.stale || time.Since(s.quota.fetchedAt) >= DRIVE_QUOTA_CACHE_TTL.Value())
+	if refresh {
+		s.quota.refreshing = true
+	}
+	s.quota.mu.Unlock()
+
+	if quota == nil {
+		return s.fetchQuota(ctx)
+	}
+
+	if refresh {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DRIVE_QUOTA_REFRESH_TIMEOUT)
+			defer cancel()
+
+			if err := s.fetchQuota(ctx); err != nil {
+				slog.ErrorContext(ctx, "error", "gdrive quota", err.Error())
+			}
+		}()
+	}
+
+	slog.DebugContext(ctx, "stats", "gdrive usage", quota.UsageInDrive, "gdrive limit", quota.Limit, "cached", true)
+
+	return nil
+}
+
+// A failed fetch drops the cached quota, so the next submission checks Drive
+// itself and finds out it is unavailable
+func (s driveStorage) fetchQuota(ctx context.Context) error {
+	service, err := s.service.get()
+	if err != nil {
+		return err
+	}
+
+	about, err := service.About.
+		Get().
+		Fields("storageQuota").
+		Context(ctx).
+		Do()
+
+	s.quota.mu.Lock()
+	defer s.quota.mu.Unlock()
+
+	s.quota.refreshing = false
+	if err != nil {
+		s.quota.quota = nil
+
+		return err
+	}
+
+	s.quota.quota = about.StorageQuota
+	s.quota.fetchedAt = time.Now()
+	s.quota.stale = false
+
+	slog.DebugContext(ctx, "stats", "gdrive usage", about.StorageQuota.UsageInDrive, "gdrive limit", about.StorageQuota.Limit)
+
+	return nil
+}
+
+func (s driveStorage) invalidateQuota() {
+	s.quota.mu.Lock()
+	s.quota.stale = true
+	s.quota.mu.Unlock()
+}
+
+func (s driveStorage) findDuplicate(ctx context.Context, email string, hash string) (*storedFile, error) {
+	service, err := s.service.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := service.Files.
+		List().
+		Q(fmt.Sprintf(
+			"properties has { key='sha256' and value='%s' } and properties has { key='email' and value='%s' } and trashed = false",
+			driveQueryValue(hash),
+			driveQueryValue(email),
+		)).
+		Fields(googleapi.Field(fmt.Sprintf("files(%s)", DRIVE_FILE_FIELDS))).
+		PageSize(1).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Files) == 0 {
+		return nil, nil
+	}
+
+	return driveStoredFile(res.Files[0]), nil
+}
+
+func (s driveStorage) create(ctx context.Context, file storedFile, content io.Reader, checksum string) (*storedFile, error) {
+	service, err := s.service.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := service.Files.
+		Create(&drive.File{
+			Name:       file.name,
+			MimeType:   file.mimeType,
+			Properties: file.properties,
+		}).
+		Media(content).
+		Fields(DRIVE_FILE_FIELDS).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return nil, err
+	}
+
+	if checksum != "" && res.Sha256Checksum != "" && res.Sha256Checksum != checksum {
+		return nil, fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, res.Sha256Checksum)
+	}
+
+	s.invalidateQuota()
+
+	slog.DebugContext(ctx, "gdrive create", "file", res.Id, "link", res.WebContentLink)
+
+	return driveStoredFile(res), nil
+}
+
+func (s driveStorage) get(ctx context.Context, id string) (*storedFile, error) {
+	service, err := s.service.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := service.Files.
+		Get(id).
+		Fields(DRIVE_FILE_FIELDS).
+		Context(ctx).
+		Do()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, errStoredFileNotFound
+		}
+
+		return nil, err
+	}
+
+	return driveStoredFile(res), nil
+}
+
+func (s driveStorage) open(ctx context.Context, id string) (io.ReadCloser, error) {
+	service, err := s.service.get()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := service.Files.
+		Get(id).
+		Context(ctx).
+		Download()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+func (s driveStorage) remove(ctx context.Context, id string) error {
+	service, err := s.service.get()
+	if err != nil {
+		return err
+	}
+
+	if err := service.Files.
+		Delete(id).
+		Context(ctx).
+		Do(); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return errStoredFileNotFound
+		}
+
+		return err
+	}
+
+	s.invalidateQuota()
+
+	return nil
+}
+
+func (s driveStorage) list(ctx context.Context, fn func(file storedFile) error) error {
+	service, err := s.service.get()
+	if err != nil {
+		return err
+	}
+
+	return service.Files.
+		List().
+		Q("trashed = false").
+		Fields(googleapi.Field(fmt.Sprintf("nextPageToken, files(%s)", DRIVE_FILE_FIELDS))).
+		PageSize(1000).
+		Pages(ctx, func(res *drive.FileList) error {
+			for _, file := range res.Files {
+				if err := fn(*driveStoredFile(file)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+}
+
+func driveStoredFile(file *drive.File) *storedFile {
+	createdAt, _ := time.Parse(time.RFC3339, file.CreatedTime)
+
+	return &storedFile{
+		id:         file.Id,
+		name:       file.Name,
+		mimeType:   file.MimeType,
+		properties: file.Properties,
+		createdAt:  createdAt,
+	}
+}
+
+func driveQueryValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
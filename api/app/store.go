@@ -0,0 +1,264 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errLeadNotFound = errors.New("lead not found")
+
+type leadFilter struct {
+	status string
+	// Leads with all of the tags
+	tags []string
+	form string
+	// Inclusive score range
+	minScore *int
+	maxScore *int
+	// Received from and before until when set
+	from  time.Time
+	until time.Time
+	// Leads merged into another are left out unless set
+	merged bool
+	// Soft deleted leads are left out unless set
+	deleted bool
+}
+
+// Where leads are kept once received, selected by LEAD_STORE
+type leadStore interface {
+	save(ctx context.Context, l *lead) error
+	get(ctx context.Context, id string) (*lead, error)
+	// Newest first
+	list(ctx context.Context, filter leadFilter) ([]*lead, error)
+	// Applies the change to the stored lead and saves it
+	update(ctx context.Context, id string, change func(l *lead) error) (*lead, error)
+	// Only for purging, leads are otherwise soft deleted
+	remove(ctx context.Context, id string) error
+}
+
+var leads leadStore
+
+func createLeadStore(ctx context.Context) leadStore {
+	store := &memoryLeadStore{leads: map[string]*lead{}}
+
+	if LEAD_STORE.Value() == "file" {
+		store.path = LEAD_STORE_FILE.Value()
+		if err := store.load(); err != nil {
+			slog.ErrorContext(ctx, "error", "lead store", err.Error())
+			panic(err)
+		}
+	}
+
+	slog.DebugContext(ctx, "created lead store", "type", LEAD_STORE.Value(), "leads", len(store.leads))
+
+	return store
+}
+
+// Keeps leads in memory, with a path every change is also written to a JSON
+// file that is loaded on startup
+type memoryLeadStore struct {
+	mu    sync.RWMutex
+	path  string
+	leads map[string]*lead
+}
+
+func (s *memoryLeadStore) load() error {
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := []*lead{}
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return err
+	}
+
+	for _, l := range stored {
+		s.leads[l.ID] = l
+	}
+
+	return nil
+}
+
+// Written to a temporary file first so a crash never leaves a partial file
+func (s *memoryLeadStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+
+	stored := make([]*lead, 0, len(s.leads))
+	for _, l := range s.leads {
+		stored = append(stored, l)
+	}
+
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	temporary := s.path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, s.path)
+}
+
+func (s *memoryLeadStore) save(ctx context.Context, l *lead) error {
+	stored, err := copyLead(l)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.leads[l.ID]; ok {
+		stored.CreatedAt = existing.CreatedAt
+	} else if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = now
+	}
+	stored.UpdatedAt = now
+
+	s.leads[l.ID] = stored
+
+	l.CreatedAt = stored.CreatedAt
+	l.UpdatedAt = stored.UpdatedAt
+
+	return s.persist()
+}
+
+func (s *memoryLeadStore) get(ctx context.Context, id string) (*lead, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.leads[id]
+	if !ok {
+		return nil, errLeadNotFound
+	}
+
+	return copyLead(l)
+}
+
+func (s *memoryLeadStore) list(ctx context.Context, filter leadFilter) ([]*lead, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []*lead{}
+	for _, l := range s.leads {
+		if filter.status != "" && l.Status != filter.status {
+			continue
+		}
+		if !l.hasTags(filter.tags) {
+			continue
+		}
+		if filter.form != "" && l.Form != filter.form {
+			continue
+		}
+		if (filter.minScore != nil && l.Score < *filter.minScore) || (filter.maxScore != nil && l.Score > *filter.maxScore) {
+			continue
+		}
+		if (!filter.from.IsZero() && l.CreatedAt.Before(filter.from)) || (!filter.until.IsZero() && !l.CreatedAt.Before(filter.until)) {
+			continue
+		}
+		if l.MergedInto != "" && !filter.merged {
+			continue
+		}
+		if l.DeletedAt != nil && !filter.deleted {
+			continue
+		}
+
+		copied, err := copyLead(l)
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, copied)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	return matched, nil
+}
+
+func (s *memoryLeadStore) update(ctx context.Context, id string, change func(l *lead) error) (*lead, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.leads[id]
+	if !ok {
+		return nil, errLeadNotFound
+	}
+
+	updated, err := copyLead(existing)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := change(updated); err != nil {
+		return nil, err
+	}
+	updated.ID = existing.ID
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = time.Now()
+
+	s.leads[id] = updated
+	if err := s.persist(); err != nil {
+		s.leads[id] = existing
+
+		return nil, err
+	}
+
+	return copyLead(updated)
+}
+
+func (s *memoryLeadStore) remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.leads[id]
+	if !ok {
+		return errLeadNotFound
+	}
+
+	delete(s.leads, id)
+	if err := s.persist(); err != nil {
+		s.leads[id] = existing
+
+		return err
+	}
+
+	return nil
+}
+
+// Leads are copied in and out of the store so callers can't change a stored
+// lead without going through update
+func copyLead(l *lead) (*lead, error) {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := &lead{}
+	if err := json.Unmarshal(content, copied); err != nil {
+		return nil, err
+	}
+
+	return copied, nil
+}
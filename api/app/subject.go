@@ -0,0 +1,169 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Answers data-access requests with a zip of subject.json, holding every
+// lead for the email, and the files stored for it under attachments/, or
+// signed links to them with ?attachments=links
+type subjectExport struct {
+	Email       string              `json:"email"`
+	ExportedAt  time.Time           `json:"exportedAt"`
+	Leads       []*lead             `json:"leads"`
+	Attachments []subjectAttachment `json:"attachments"`
+}
+
+type subjectAttachment struct {
+	ID   string `json:"id"`
+	Lead string `json:"lead"`
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+	Link string `json:"link,omitempty"`
+}
+
+func (h *Handler) adminSubjectExportHandler(w http.ResponseWriter, r *http.Request) {
+	email, err := url.PathUnescape(chi.URLParam(r, "email"))
+	if err != nil || email == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid email")
+
+		return
+	}
+
+	links := r.URL.Query().Get("attachments") == "links"
+	if links && !attachmentLinksEnabled() {
+		writeProblem(w, r, http.StatusConflict, "Attachment links need PUBLIC_URL and ATTACHMENT_LINK_SECRET")
+
+		return
+	}
+
+	export := subjectExport{
+		Email:       email,
+		ExportedAt:  time.Now(),
+		Leads:       []*lead{},
+		Attachments: []subjectAttachment{},
+	}
+
+	all, err := leads.list(r.Context(), leadFilter{merged: true, deleted: true})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+	for _, l := range all {
+		if strings.EqualFold(l.Email, email) {
+			export.Leads = append(export.Leads, l)
+		}
+	}
+
+	// Files are found by the email they were stored with, which includes any
+	// no longer referenced by a lead
+	files := []storedFile{}
+	err = h.storage.list(r.Context(), func(file storedFile) error {
+		if file.properties["lead"] != "" && strings.EqualFold(file.properties["email"], email) {
+			files = append(files, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "subject export", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+
+	for idx, file := range files {
+		attachment := subjectAttachment{ID: file.id, Lead: file.properties["lead"], Name: file.name}
+
+		if links {
+			attachment.Link = publicAttachmentLink(file.id)
+		} else {
+			attachment.Path = path.Join("attachments", fmt.Sprintf("%d-%s", idx+1, path.Base(file.name)))
+			if err := writeSubjectAttachment(r.Context(), h.storage, zw, attachment.Path, file); err != nil {
+				slog.ErrorContext(r.Context(), "error", "subject export", err.Error(), "file", file.id)
+				writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+				return
+			}
+		}
+
+		export.Attachments = append(export.Attachments, attachment)
+	}
+
+	subject, err := zw.Create("subject.json")
+	if err == nil {
+		encoder := json.NewEncoder(subject)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(export)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "subject export", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "subject export", "leads", len(export.Leads), "attachments", len(export.Attachments), "ip", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("subject-%s.zip", export.ExportedAt.UTC().Format("20060102T150405Z")),
+	}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(archive.Bytes())
+}
+
+// Encrypted attachments are exported decrypted
+func writeSubjectAttachment(ctx context.Context, storage attachmentStorage, zw *zip.Writer, name string, file storedFile) error {
+	content, err := storage.open(ctx, file.id)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if file.properties["encrypted"] != "true" {
+		_, err = io.Copy(entry, content)
+
+		return err
+	}
+
+	if !isEncryptionEnabled() {
+		return errors.New("encryption is not configured")
+	}
+
+	plaintext, err := decryptAttachment(ctx, content)
+	if err != nil {
+		return err
+	}
+
+	_, err = entry.Write(plaintext)
+
+	return err
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/go-chi/chi"
+)
+
+// Free-form labels for organising leads, added and removed through the admin
+// API or added by the scoring rules and notification routes a lead matches.
+// Tags are kept lowercase so filtering doesn't depend on how they were typed
+const EVENT_LEAD_TAGS_CHANGED = "lead.tags_changed"
+
+const MAX_TAG_LENGTH = 64
+const MAX_LEAD_TAGS = 32
+
+var errTooManyTags = fmt.Errorf("a lead can have at most %d tags", MAX_LEAD_TAGS)
+
+// Letters, digits, spaces and -_:/. are allowed, spaces are collapsed to one
+func normalizeTag(tag string) (string, error) {
+	tag = strings.Join(strings.Fields(strings.ToLower(tag)), " ")
+	if tag == "" {
+		return "", fmt.Errorf("empty tag")
+	}
+	if len([]rune(tag)) > MAX_TAG_LENGTH {
+		return "", fmt.Errorf("tag '%s...' is longer than %d characters", string([]rune(tag)[:16]), MAX_TAG_LENGTH)
+	}
+
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" -_:/.", r) {
+			return "", fmt.Errorf("tag '%s' has an invalid character %q", tag, r)
+		}
+	}
+
+	return tag, nil
+}
+
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+
+		normalized = append(normalized, tag)
+	}
+
+	return normalized, nil
+}
+
+// Tags are expected to be normalized
+func (l *lead) addTags(tags ...string) {
+	for _, tag := range tags {
+		if !slices.Contains(l.Tags, tag) {
+			l.Tags = append(l.Tags, tag)
+		}
+	}
+}
+
+func (l *lead) removeTags(tags ...string) {
+	l.Tags = slices.DeleteFunc(l.Tags, func(tag string) bool {
+		return slices.Contains(tags, tag)
+	})
+}
+
+func (l *lead) hasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(l.Tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Repeated ?tag= filter to leads with all of them
+func requestTagFilter(r *http.Request) ([]string, error) {
+	return normalizeTags(r.URL.Query()["tag"])
+}
+
+func adminLeadTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	add, err := normalizeTags(req.Add)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+	remove, err := normalizeTags(req.Remove)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	var previous []string
+	l, err := leads.update(r.Context(), chi.URLParam(r, "id"), func(l *lead) error {
+		previous = slices.Clone(l.Tags)
+
+		l.removeTags(remove...)
+		l.addTags(add...)
+
+		if len(l.Tags) > MAX_LEAD_TAGS {
+			return errTooManyTags
+		}
+
+		return nil
+	})
+	if errors.Is(err, errTooManyTags) {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+
+		return
+	}
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	if !slices.Equal(previous, l.Tags) {
+		slog.InfoContext(r.Context(), "tags", "lead", l.ID, "tags", strings.Join(l.Tags, ","))
+
+		events.publish(r.Context(), EVENT_LEAD_TAGS_CHANGED, l.ID, map[string]any{
+			"from": previous,
+			"to":   l.Tags,
+		})
+	}
+
+	writeResponse(w, r, http.StatusOK, l)
+}
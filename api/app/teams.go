@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Posts an Adaptive Card to a Teams incoming webhook or workflow, the webhook
+// decides the channel. Links need PUBLIC_URL set
+type teamsNotifier struct {
+	webhook string
+}
+
+const ADAPTIVE_CARD_CONTENT_TYPE = "application/vnd.microsoft.card.adaptive"
+const ADAPTIVE_CARD_SCHEMA = "http://adaptivecards.io/schemas/adaptive-card.json"
+
+// Teams supports up to 1.5, 1.4 is what the mobile apps render
+const ADAPTIVE_CARD_VERSION = "1.4"
+
+func (teamsNotifier) name() string { return "teams" }
+
+func (n teamsNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	body := []map[string]any{
+		{
+			"type":   "TextBlock",
+			"text":   fmt.Sprintf("New lead from %s", l.name()),
+			"size":   "Large",
+			"weight": "Bolder",
+			"wrap":   true,
+		},
+		{
+			"type":  "FactSet",
+			"facts": teamsFacts(l),
+		},
+	}
+
+	if l.Summary != "" {
+		body = append(body, teamsText("Summary", l.Summary))
+	}
+	body = append(body, teamsText("Enquiry", l.Enquiry))
+	if l.Translation != nil {
+		body = append(body, teamsText(fmt.Sprintf("Translation from %s", l.Language), l.Translation.Enquiry))
+	}
+
+	actions := []map[string]any{}
+	if link := adminLeadLink(l.ID); link != "" {
+		actions = append(actions, map[string]any{"type": "Action.OpenUrl", "title": "Open lead", "url": link})
+	}
+	for _, file := range l.Attachments {
+		if link := publicAttachmentLink(file.ID); link != "" {
+			actions = append(actions, map[string]any{"type": "Action.OpenUrl", "title": file.Name, "url": link})
+		}
+	}
+
+	card := map[string]any{
+		"$schema": ADAPTIVE_CARD_SCHEMA,
+		"type":    "AdaptiveCard",
+		"version": ADAPTIVE_CARD_VERSION,
+		"body":    body,
+		"msteams": map[string]any{"width": "Full"},
+	}
+	if len(actions) > 0 {
+		card["actions"] = actions
+	}
+
+	return postWebhook(ctx, outgoing, n.webhook, map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{"contentType": ADAPTIVE_CARD_CONTENT_TYPE, "content": card},
+		},
+	})
+}
+
+func teamsFacts(l *lead) []map[string]string {
+	facts := []map[string]string{}
+	add := func(title string, value string) {
+		if value != "" {
+			facts = append(facts, map[string]string{"title": title, "value": value})
+		}
+	}
+
+	add("Email", l.Email)
+	add("Mobile", l.Mobile)
+	add("Enquiry type", l.EnquiryType)
+	if l.Form != DEFAULT_FORM {
+		add("Form", l.Form)
+	}
+
+	names := []string{}
+	for name := range l.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(fieldLabel(name), l.CustomFields[name])
+	}
+
+	if l.Geo != nil {
+		add("Location", strings.Join(nonEmpty(l.Geo.City, l.Geo.Country, l.Geo.Timezone), ", "))
+	}
+	add("Score", fmt.Sprint(l.Score))
+	if len(l.Flags) > 0 {
+		add("Flags", strings.Join(l.Flags, ", "))
+	}
+
+	// Attachments are linked from the card's actions when links are enabled
+	if !attachmentLinksEnabled() {
+		files := []string{}
+		for _, file := range l.Attachments {
+			files = append(files, file.Name)
+		}
+		add("Attachments", strings.Join(files, ", "))
+	}
+
+	return facts
+}
+
+func teamsText(heading string, text string) map[string]any {
+	return map[string]any{
+		"type": "Container",
+		"items": []map[string]any{
+			{"type": "TextBlock", "text": heading, "weight": "Bolder", "wrap": true},
+			{"type": "TextBlock", "text": text, "wrap": true},
+		},
+	}
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sends new leads to a Telegram chat through the Bot API. With
+// TELEGRAM_WEBHOOK_SECRET set, and the bot's webhook pointed at
+// /telegram/webhook with the same secret, messages have buttons to mark the
+// lead contacted or spam from the chat
+const TELEGRAM_API = "https://api.telegram.org"
+const TELEGRAM_SECRET_HEADER = "X-Telegram-Bot-Api-Secret-Token"
+
+// Callback data is the status and the lead, Telegram allows 64 bytes
+const TELEGRAM_CALLBACK_SEPARATOR = ":"
+
+// Telegram allows 4096 characters in a message
+const TELEGRAM_MAX_ENQUIRY = 3000
+
+type telegramAction struct {
+	label  string
+	status string
+}
+
+var TELEGRAM_ACTIONS = []telegramAction{
+	{label: "Mark contacted", status: LEAD_STATUS_CONTACTED},
+	{label: "Spam", status: LEAD_STATUS_SPAM},
+}
+
+var telegramClient = tracedClient(10 * time.Second)
+
+type telegramNotifier struct {
+	chat string
+}
+
+type telegramUpdate struct {
+	CallbackQuery *struct {
+		ID   string `json:"id"`
+		Data string `json:"data"`
+		From struct {
+			Username  string `json:"username"`
+			FirstName string `json:"first_name"`
+		} `json:"from"`
+		Message *struct {
+			MessageID int64 `json:"message_id"`
+			Chat      struct {
+				ID int64 `json:"id"`
+			} `json:"chat"`
+		} `json:"message"`
+	} `json:"callback_query"`
+}
+
+func (telegramNotifier) name() string { return "telegram" }
+
+func (n telegramNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	if _, ok := TELEGRAM_BOT_TOKEN.Value(); !ok {
+		return fmt.Errorf("telegram is not configured")
+	}
+
+	message := map[string]any{
+		"chat_id":                  n.chat,
+		"text":                     telegramText(l),
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	}
+
+	buttons := []map[string]string{}
+	if _, ok := TELEGRAM_WEBHOOK_SECRET.Value(); ok {
+		for _, action := range TELEGRAM_ACTIONS {
+			buttons = append(buttons, map[string]string{
+				"text":          action.label,
+				"callback_data": action.status + TELEGRAM_CALLBACK_SEPARATOR + l.ID,
+			})
+		}
+	}
+	if link := adminLeadLink(l.ID); link != "" {
+		buttons = append(buttons, map[string]string{"text": "Open", "url": link})
+	}
+	if len(buttons) > 0 {
+		message["reply_markup"] = map[string]any{"inline_keyboard": [][]map[string]string{buttons}}
+	}
+
+	return telegramCall(ctx, "sendMessage", message)
+}
+
+func telegramText(l *lead) string {
+	var text strings.Builder
+
+	fmt.Fprintf(&text, "<b>New lead from %s</b>\n", html.EscapeString(l.name()))
+	fmt.Fprintf(&text, "Email: %s\n", html.EscapeString(l.Email))
+	fmt.Fprintf(&text, "Mobile: %s\n", html.EscapeString(l.Mobile))
+	fmt.Fprintf(&text, "Enquiry type: %s\n", html.EscapeString(l.EnquiryType))
+	fmt.Fprintf(&text, "Score: %d\n", l.Score)
+	if len(l.Flags) > 0 {
+		fmt.Fprintf(&text, "Flags: %s\n", html.EscapeString(strings.Join(l.Flags, ", ")))
+	}
+
+	if l.Summary != "" {
+		fmt.Fprintf(&text, "\n<i>%s</i>\n", html.EscapeString(l.Summary))
+	}
+	fmt.Fprintf(&text, "\n%s\n", html.EscapeString(truncate(l.Enquiry, TELEGRAM_MAX_ENQUIRY)))
+
+	for _, file := range l.Attachments {
+		if link := publicAttachmentLink(file.ID); link != "" {
+			fmt.Fprintf(&text, "\n<a href=\"%s\">%s</a>", html.EscapeString(link), html.EscapeString(file.Name))
+		} else {
+			fmt.Fprintf(&text, "\n%s", html.EscapeString(file.Name))
+		}
+	}
+
+	return text.String()
+}
+
+func telegramCall(ctx context.Context, method string, payload any) error {
+	token, _ := TELEGRAM_BOT_TOKEN.Value()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/%s", TELEGRAM_API, token, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := telegramClient.Do(req)
+	if err != nil {
+		// The URL holds the token
+		return fmt.Errorf("telegram: %s failed", method)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("telegram: %s: %s: %s", method, res.Status, message)
+	}
+
+	return nil
+}
+
+// Chats leads are sent to, only callbacks from these are acted on
+func telegramChats() []string {
+	chats := []string{}
+	for _, route := range append(slices.Clone(currentConfig().routes), defaultRoute) {
+		if route.Telegram != "" {
+			chats = append(chats, route.Telegram)
+		}
+	}
+
+	return chats
+}
+
+func telegramWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	secret, _ := TELEGRAM_WEBHOOK_SECRET.Value()
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(TELEGRAM_SECRET_HEADER)), []byte(secret)) != 1 {
+		writeProblem(w, r, http.StatusUnauthorized, "Unauthorized")
+
+		return
+	}
+
+	update := telegramUpdate{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	// Telegram retries anything but a success, so updates that aren't ours are
+	// acknowledged and ignored
+	query := update.CallbackQuery
+	if query == nil || query.Message == nil || !slices.Contains(telegramChats(), strconv.FormatInt(query.Message.Chat.ID, 10)) {
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	by := query.From.Username
+	if by == "" {
+		by = query.From.FirstName
+	}
+
+	answer := ""
+	status, id, ok := strings.Cut(query.Data, TELEGRAM_CALLBACK_SEPARATOR)
+	if !ok || !slices.ContainsFunc(TELEGRAM_ACTIONS, func(a telegramAction) bool { return a.status == status }) {
+		answer = "Unknown action"
+	} else if l, previous, err := changeLeadStatus(r.Context(), id, "", status); err != nil {
+		slog.ErrorContext(r.Context(), "error", "telegram", err.Error(), "lead", id)
+		answer = "Couldn't update the lead"
+	} else {
+		slog.InfoContext(r.Context(), "status", "lead", l.ID, "from", previous, "to", l.Status, "by", by, "via", "telegram")
+		answer = fmt.Sprintf("Marked %s", l.Status)
+
+		// The buttons are removed so the lead isn't triaged twice from the chat
+		err := telegramCall(r.Context(), "editMessageReplyMarkup", map[string]any{
+			"chat_id":      query.Message.Chat.ID,
+			"message_id":   query.Message.MessageID,
+			"reply_markup": map[string]any{"inline_keyboard": [][]map[string]string{}},
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error", "telegram", err.Error(), "lead", id)
+		}
+	}
+
+	if err := telegramCall(r.Context(), "answerCallbackQuery", map[string]any{"callback_query_id": query.ID, "text": answer}); err != nil {
+		slog.ErrorContext(r.Context(), "error", "telegram", err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
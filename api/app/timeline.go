@@ -0,0 +1,192 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// Notes are written by the team through the admin API, activity is recorded
+// from the events published for a lead. Both are kept on the lead and merged
+// into one timeline, oldest first
+const TIMELINE_NOTE = "note"
+
+const MAX_NOTE_LENGTH = 10_000
+
+// The oldest activity is dropped past this so busy leads don't grow forever
+const MAX_LEAD_ACTIVITY = 500
+
+// Events recorded on the timeline of their lead, the rest are left out
+var timelineEvents = map[string]bool{
+	EVENT_LEAD_RECEIVED:       true,
+	EVENT_LEAD_IMPORTED:       true,
+	EVENT_LEAD_VERIFIED:       true,
+	EVENT_LEAD_STATUS_CHANGED: true,
+	EVENT_LEAD_TAGS_CHANGED:   true,
+	EVENT_LEAD_MERGED:         true,
+	EVENT_LEAD_DELETED:        true,
+	EVENT_LEAD_RESTORED:       true,
+	EVENT_LEAD_CLAIMED:        true,
+	EVENT_LEAD_UNCLAIMED:      true,
+	EVENT_LEAD_SLA_BREACHED:   true,
+	EVENT_LEAD_CRM_SYNCED:     true,
+	EVENT_LEAD_CRM_FAILED:     true,
+	EVENT_LEAD_NOTIFIED:       true,
+	EVENT_NOTIFICATION_FAILED: true,
+	EVENT_EMAIL_SENT:          true,
+	EVENT_EMAIL_FAILED:        true,
+	EVENT_WHATSAPP_SENT:       true,
+	EVENT_WHATSAPP_FAILED:     true,
+	EVENT_CONSULTATION_BOOKED: true,
+	EVENT_ATTACHMENT_SPOOLED:  true,
+	EVENT_ATTACHMENT_UPLOADED: true,
+	EVENT_OUTBOX_FAILED:       true,
+}
+
+// The data of these would copy the lead into its own timeline
+var timelineEventsWithoutData = map[string]bool{
+	EVENT_LEAD_RECEIVED: true,
+}
+
+type leadNote struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type leadActivity struct {
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	At    time.Time       `json:"at"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type timelineEntry struct {
+	Type   string    `json:"type"`
+	At     time.Time `json:"at"`
+	ID     string    `json:"id"`
+	Text   string    `json:"text,omitempty"`
+	Author string    `json:"author,omitempty"`
+	Data   any       `json:"data,omitempty"`
+}
+
+func recordActivity(ctx context.Context, e event) {
+	if e.Lead == "" || !timelineEvents[e.Name] || isSelfTest(ctx) {
+		return
+	}
+
+	activity := leadActivity{ID: e.ID, Event: e.Name, At: e.At}
+	if e.Data != nil && !timelineEventsWithoutData[e.Name] {
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "activity", err.Error(), "event", e.Name, "lead", e.Lead)
+
+			return
+		}
+
+		activity.Data = data
+	}
+
+	_, err := leads.update(ctx, e.Lead, func(l *lead) error {
+		l.Activity = append(l.Activity, activity)
+		if len(l.Activity) > MAX_LEAD_ACTIVITY {
+			l.Activity = l.Activity[len(l.Activity)-MAX_LEAD_ACTIVITY:]
+		}
+
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "activity", err.Error(), "event", e.Name, "lead", e.Lead)
+	}
+}
+
+func leadTimeline(l *lead) []timelineEntry {
+	timeline := []timelineEntry{}
+	for _, note := range l.Notes {
+		timeline = append(timeline, timelineEntry{
+			Type:   TIMELINE_NOTE,
+			At:     note.CreatedAt,
+			ID:     note.ID,
+			Text:   note.Text,
+			Author: note.Author,
+		})
+	}
+
+	for _, activity := range l.Activity {
+		entry := timelineEntry{Type: activity.Event, At: activity.At, ID: activity.ID}
+		if len(activity.Data) > 0 {
+			entry.Data = activity.Data
+		}
+
+		timeline = append(timeline, entry)
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].At.Before(timeline[j].At)
+	})
+
+	return timeline
+}
+
+func adminAddLeadNoteHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Text   string `json:"text"`
+		Author string `json:"author"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+
+		return
+	}
+
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Missing note text")
+
+		return
+	}
+	if len(req.Text) > MAX_NOTE_LENGTH {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "Note is too long")
+
+		return
+	}
+
+	note := leadNote{
+		ID:        uuid.NewString(),
+		Text:      req.Text,
+		Author:    truncate(strings.TrimSpace(req.Author), 255),
+		CreatedAt: time.Now(),
+	}
+
+	_, err := leads.update(r.Context(), chi.URLParam(r, "id"), func(l *lead) error {
+		l.Notes = append(l.Notes, note)
+
+		return nil
+	})
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusCreated, note)
+}
+
+func adminLeadTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	l, err := leads.get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		leadStoreError(w, r, err)
+
+		return
+	}
+
+	writeResponse(w, r, http.StatusOK, map[string]any{"timeline": leadTimeline(l)})
+}
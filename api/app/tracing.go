@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// Outbound requests get a client span and a W3C traceparent header, so a
+// submission can be followed from the router through every API it calls
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Host
+		}),
+	)
+}
+
+// Clients created once for the services called on every submission, with
+// enough connections kept open that a burst doesn't dial for each request.
+// HTTP/2 is preferred so requests to a host share the connections they have
+func tunedTransport(maxConnsPerHost uint) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = int(maxConnsPerHost)
+	transport.MaxIdleConnsPerHost = int(maxConnsPerHost)
+	transport.MaxConnsPerHost = int(maxConnsPerHost)
+	transport.IdleConnTimeout = HTTP_IDLE_CONN_TIMEOUT.Value()
+	transport.ResponseHeaderTimeout = HTTP_RESPONSE_HEADER_TIMEOUT.Value()
+
+	return transport
+}
+
+func tracedClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: tracedTransport(http.DefaultTransport)}
+}
+
+// Google services only use the options for their own client when given an
+// HTTP client, so the scopes and credentials are set on the transport here
+func googleClientOption(ctx context.Context, scopes []string, options ...option.ClientOption) (option.ClientOption, error) {
+	return googleTransportOption(ctx, http.DefaultTransport, scopes, options...)
+}
+
+func googleTransportOption(ctx context.Context, base http.RoundTripper, scopes []string, options ...option.ClientOption) (option.ClientOption, error) {
+	transport, err := htransport.NewTransport(ctx, tracedTransport(base), append(options, option.WithScopes(scopes...))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return option.WithHTTPClient(&http.Client{Transport: transport}), nil
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/api/option"
+	translate "google.golang.org/api/translate/v2"
+)
+
+// Enquiries not written in TRANSLATION_TARGET get a machine translation so
+// the team can read them
+var translateService *translate.Service
+
+func createTranslateService(ctx context.Context) *translate.Service {
+	if !TRANSLATION.Value() {
+		return nil
+	}
+
+	options := []option.ClientOption{}
+	if key, ok := TRANSLATION_API_KEY.Value(); ok {
+		options = append(options, option.WithAPIKey(key))
+	}
+
+	// Authenticates with client default credentials unless an API key is set
+	client, err := googleClientOption(ctx, []string{translate.CloudTranslationScope}, options...)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "translate service", err.Error())
+		panic(err)
+	}
+
+	service, err := translate.NewService(ctx, client)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "translate service", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "created translate service")
+
+	return service
+}
+
+type leadTranslation struct {
+	Language string `json:"language"`
+	Enquiry  string `json:"enquiry"`
+}
+
+type translateProcessor struct{}
+
+func (translateProcessor) name() string { return "translate" }
+
+func (translateProcessor) stage() processorStage { return PROCESSOR_STAGE_ENRICH }
+
+func (translateProcessor) process(ctx context.Context, l *lead) error {
+	if translateService == nil || strings.TrimSpace(l.Enquiry) == "" {
+		return nil
+	}
+
+	target := TRANSLATION_TARGET.Value()
+
+	detections, err := translateService.Detections.List([]string{l.Enquiry}).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("detect language: %w", err)
+	}
+
+	if len(detections.Detections) == 0 || len(detections.Detections[0]) == 0 {
+		return nil
+	}
+
+	l.Language = detections.Detections[0][0].Language
+	if l.Language == "" || l.Language == "und" || strings.HasPrefix(l.Language, target) {
+		return nil
+	}
+
+	res, err := translateService.Translations.List([]string{l.Enquiry}, target).
+		Source(l.Language).
+		Format("text").
+		Context(ctx).
+		Do()
+	if err != nil {
+		return fmt.Errorf("translate: %w", err)
+	}
+
+	if len(res.Translations) == 0 {
+		return nil
+	}
+
+	l.Translation = &leadTranslation{
+		Language: target,
+		Enquiry:  html.UnescapeString(res.Translations[0].TranslatedText),
+	}
+
+	slog.DebugContext(ctx, "translated", "lead", l.ID, "from", l.Language, "to", target)
+
+	return nil
+}
@@ -0,0 +1,429 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/google/uuid"
+)
+
+// Implements the core tus protocol along with the creation, expiration and
+// termination extensions
+// see: https://tus.io/protocols/resumable-upload
+const TUS_VERSION = "1.0.0"
+const TUS_EXTENSIONS = "creation,expiration,termination"
+
+var errTusUploadNotFound = errors.New("upload not found")
+var errTusUploadIncomplete = errors.New("upload incomplete")
+
+var tusUploads *tusStore
+
+type tusUpload struct {
+	mu       sync.Mutex
+	id       string
+	filename string
+	metadata string
+	length   int64
+	offset   int64
+	expires  time.Time
+}
+
+type tusStore struct {
+	mu      sync.Mutex
+	dir     string
+	expiry  time.Duration
+	uploads map[string]*tusUpload
+}
+
+func createTusStore(ctx context.Context) *tusStore {
+	dir, ok := TUS_DIR.Value()
+	if !ok {
+		dir = filepath.Join(os.TempDir(), "tus")
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		slog.ErrorContext(ctx, "error", "tus store", err.Error())
+		panic(err)
+	}
+
+	store := &tusStore{
+		dir:     dir,
+		expiry:  TUS_UPLOAD_EXPIRY.Value(),
+		uploads: map[string]*tusUpload{},
+	}
+
+	store.sweep(ctx)
+	go store.expire(ctx)
+
+	slog.DebugContext(ctx, "created tus store", "dir", dir)
+
+	return store
+}
+
+func (s *tusStore) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *tusStore) create(filename string, metadata string, length int64) (*tusUpload, error) {
+	upload := &tusUpload{
+		id:       uuid.NewString(),
+		filename: filename,
+		metadata: metadata,
+		length:   length,
+		expires:  time.Now().Add(s.expiry),
+	}
+
+	file, err := os.OpenFile(s.path(upload.id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	s.mu.Lock()
+	s.uploads[upload.id] = upload
+	s.mu.Unlock()
+
+	return upload, nil
+}
+
+func (s *tusStore) get(id string) (*tusUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || time.Now().After(upload.expires) {
+		return nil, errTusUploadNotFound
+	}
+
+	return upload, nil
+}
+
+func (s *tusStore) remove(id string) error {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Returns a completed upload as an attachment for the lead pipeline
+func (s *tusStore) attachment(id string) (attachment, error) {
+	upload, err := s.get(id)
+	if err != nil {
+		return attachment{}, err
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if upload.offset != upload.length {
+		return attachment{}, errTusUploadIncomplete
+	}
+
+	return attachment{
+		filename: upload.filename,
+		size:     upload.length,
+		open: func() (io.ReadCloser, error) {
+			return os.Open(s.path(id))
+		},
+	}, nil
+}
+
+// Uploads are only tracked in memory, so files left in the directory by an
+// earlier run are removed once they are older than an upload could be
+func (s *tusStore) sweep(ctx context.Context) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "tus sweep", err.Error())
+
+		return
+	}
+
+	cutoff := time.Now().Add(-s.expiry)
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		s.mu.Lock()
+		_, tracked := s.uploads[entry.Name()]
+		s.mu.Unlock()
+		if tracked {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(s.path(entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "tus sweep", err.Error(), "upload", entry.Name())
+
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		slog.DebugContext(ctx, "swept", "tus uploads", removed)
+	}
+}
+
+func (s *tusStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired := []string{}
+
+			s.mu.Lock()
+			for id, upload := range s.uploads {
+				if now.After(upload.expires) {
+					expired = append(expired, id)
+				}
+			}
+			s.mu.Unlock()
+
+			for _, id := range expired {
+				if err := s.remove(id); err != nil {
+					slog.ErrorContext(ctx, "error", "tus expire", err.Error(), "upload", id)
+				}
+			}
+
+			if len(expired) > 0 {
+				slog.DebugContext(ctx, "expired", "tus uploads", len(expired))
+			}
+		}
+	}
+}
+
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TUS_VERSION)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != TUS_VERSION {
+			w.Header().Set("Tus-Version", TUS_VERSION)
+			writeProblem(w, r, http.StatusPreconditionFailed, "Unsupported tus version")
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TUS_VERSION)
+	w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(MAX_UPLOAD_SIZE))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeProblem(w, r, http.StatusBadRequest, "Deferred upload length is not supported")
+
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid Upload-Length")
+
+		return
+	}
+
+	if length > MAX_UPLOAD_SIZE {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "Upload too large")
+
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	filename := tusMetadataValue(metadata, "filename")
+	if filename == "" {
+		filename = tusMetadataValue(metadata, "name")
+	}
+	if filename == "" {
+		writeProblem(w, r, http.StatusBadRequest, "Missing filename in Upload-Metadata")
+
+		return
+	}
+
+	if !isAcceptedAttachment(filename) {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "File type is not accepted")
+
+		return
+	}
+
+	upload, err := tusUploads.create(filename, metadata, length)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "tus create", err.Error())
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	slog.DebugContext(r.Context(), "created", "tus upload", upload.id, "filename", filename, "length", length)
+
+	w.Header().Set("Location", path.Join(r.URL.Path, upload.id))
+	w.Header().Set("Upload-Expires", upload.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	upload, err := tusUploads.get(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.Header().Set("Upload-Expires", upload.expires.UTC().Format(http.TimeFormat))
+	if upload.metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "Invalid Content-Type")
+
+		return
+	}
+
+	upload, err := tusUploads.get(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid Upload-Offset")
+
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if offset != upload.offset {
+		writeProblem(w, r, http.StatusConflict, "Upload-Offset does not match")
+
+		return
+	}
+
+	file, err := os.OpenFile(tusUploads.path(upload.id), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "tus patch", err.Error(), "upload", upload.id)
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+	defer file.Close()
+
+	// Keep whatever was received before an interrupted connection so the
+	// client can resume from the new offset
+	written, err := io.Copy(file, http.MaxBytesReader(w, r.Body, upload.length-upload.offset))
+	upload.offset += written
+
+	slog.DebugContext(r.Context(), "patched", "tus upload", upload.id, "offset", upload.offset, "length", upload.length)
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "Upload exceeds Upload-Length")
+
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "error", "tus patch", err.Error(), "upload", upload.id)
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Expires", upload.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := tusUploads.get(id); err != nil {
+		writeProblem(w, r, http.StatusNotFound, err.Error())
+
+		return
+	}
+
+	if err := tusUploads.remove(id); err != nil {
+		slog.ErrorContext(r.Context(), "error", "tus delete", err.Error(), "upload", id)
+		writeProblem(w, r, http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Upload-Metadata is a comma separated list of keys and base64 encoded values
+func tusMetadataValue(metadata string, key string) string {
+	for _, pair := range strings.Split(metadata, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k != key {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return ""
+		}
+
+		return string(value)
+	}
+
+	return ""
+}
+
+// Lead submissions reference completed uploads either by ID or by the
+// Location returned on creation
+func tusUploadID(reference string) string {
+	return path.Base(strings.TrimSpace(reference))
+}
+
+func tusUploadError(reference string, err error) string {
+	return fmt.Sprintf("Upload %s: %s", reference, err.Error())
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const TWILIO_API = "https://api.twilio.com/2010-04-01"
+
+var twilioClient = tracedClient(10 * time.Second)
+
+func twilioConfigured() bool {
+	_, sid := TWILIO_ACCOUNT_SID.Value()
+	_, token := TWILIO_AUTH_TOKEN.Value()
+
+	return sid && token
+}
+
+// Posts a form to a Twilio API with the account credentials, decoding the
+// JSON response into result when it isn't nil
+func twilioPost(ctx context.Context, endpoint string, form url.Values, result any) error {
+	sid, _ := TWILIO_ACCOUNT_SID.Value()
+	token, _ := TWILIO_AUTH_TOKEN.Value()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(sid, token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := twilioClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("twilio: %s: %s", res.Status, body)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+func sendSms(ctx context.Context, to string, body string) error {
+	sid, _ := TWILIO_ACCOUNT_SID.Value()
+	from, _ := TWILIO_FROM.Value()
+
+	form := url.Values{}
+	form.Set("To", strings.TrimSpace(to))
+	form.Set("Body", body)
+	if strings.HasPrefix(from, "MG") {
+		form.Set("MessagingServiceSid", from)
+	} else {
+		form.Set("From", from)
+	}
+
+	return twilioPost(ctx, fmt.Sprintf("%s/Accounts/%s/Messages.json", TWILIO_API, url.PathEscape(sid)), form, nil)
+}
+
+type smsNotifier struct {
+	recipients []string
+	minScore   int
+}
+
+func (smsNotifier) name() string { return "sms" }
+
+func (n smsNotifier) threshold() int { return n.minScore }
+
+func (n smsNotifier) notify(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	if !twilioConfigured() {
+		return fmt.Errorf("twilio is not configured")
+	}
+
+	body := fmt.Sprintf("New lead (score %d) from %s, %s %s", l.Score, l.name(), l.Email, l.Mobile)
+	if l.Summary != "" {
+		body += ": " + l.Summary
+	}
+
+	for _, to := range n.recipients {
+		if err := sendSms(ctx, to, body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Emails to leads carry a signed unsubscribe link, addresses that follow it
+// are suppressed from every later send
+// see: https://www.rfc-editor.org/rfc/rfc8058
+const EVENT_EMAIL_UNSUBSCRIBED = "email.unsubscribed"
+
+var errEmailSuppressed = errors.New("recipient has unsubscribed")
+
+var suppressions *suppressionList
+
+type suppressionList struct {
+	mu        sync.RWMutex
+	path      string
+	addresses map[string]time.Time
+}
+
+func createSuppressionList(ctx context.Context) *suppressionList {
+	list := &suppressionList{addresses: map[string]time.Time{}}
+
+	if path, ok := SUPPRESSION_FILE.Value(); ok {
+		list.path = path
+
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "error", "suppression list", err.Error())
+			panic(err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(content, &list.addresses); err != nil {
+				slog.ErrorContext(ctx, "error", "suppression list", err.Error())
+				panic(err)
+			}
+		}
+	}
+
+	slog.DebugContext(ctx, "created suppression list", "addresses", len(list.addresses))
+
+	return list
+}
+
+func (s *suppressionList) add(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address = strings.ToLower(address)
+	if _, ok := s.addresses[address]; ok {
+		return nil
+	}
+	s.addresses[address] = time.Now()
+
+	if s.path == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(s.addresses)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	temporary := s.path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, s.path)
+}
+
+func (s *suppressionList) contains(address string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.addresses[strings.ToLower(address)]
+
+	return ok
+}
+
+// Drops suppressed addresses from a recipient list, failing when none are
+// left
+func (s *suppressionList) filter(to string) (string, error) {
+	recipients, err := mail.ParseAddressList(to)
+	if err != nil {
+		return "", err
+	}
+
+	kept := []*mail.Address{}
+	for _, recipient := range recipients {
+		if !s.contains(recipient.Address) {
+			kept = append(kept, recipient)
+		}
+	}
+
+	if len(kept) == 0 {
+		return "", errEmailSuppressed
+	}
+	if len(kept) == len(recipients) {
+		return to, nil
+	}
+
+	return strings.Join(addressStrings(kept), ", "), nil
+}
+
+// The address and a signature of it, links never expire
+func unsubscribeToken(address string) string {
+	address = strings.ToLower(address)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(address)) + "." + signUnsubscribe(address)
+}
+
+func signUnsubscribe(address string) string {
+	secret, _ := linkSecret()
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "unsubscribe.%s", address)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseUnsubscribeToken(token string) (string, bool) {
+	if _, ok := linkSecret(); !ok {
+		return "", false
+	}
+
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", false
+	}
+
+	address, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	return string(address), hmac.Equal([]byte(sig), []byte(signUnsubscribe(string(address))))
+}
+
+// Links are only added when PUBLIC_URL and the link secret are set, as emails
+// are mostly sent outside a request
+func unsubscribeUrl(address string) string {
+	base, ok := publicUrl()
+	if !ok {
+		return ""
+	}
+
+	if _, ok := linkSecret(); !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("%s%s/unsubscribe?token=%s", base, API_V1_PREFIX, url.QueryEscape(unsubscribeToken(address)))
+}
+
+func unsubscribeHeaders(address string) map[string]string {
+	link := unsubscribeUrl(address)
+	if link == "" {
+		return nil
+	}
+
+	return map[string]string{
+		"List-Unsubscribe":      fmt.Sprintf("<%s>", link),
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// Browsers follow the link with GET and are asked to confirm, as link
+// scanners fetch every link in an email. Only a POST unsubscribes, either
+// from that page or from a mail client unsubscribing in one click
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	address, ok := parseUnsubscribeToken(token)
+	if !ok {
+		slog.WarnContext(r.Context(), "denied", "unsubscribe", "invalid signature", "ip", r.RemoteAddr)
+		renderResult(w, r, http.StatusForbidden, "Invalid link", "This unsubscribe link is not valid.", false)
+
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		renderUnsubscribeConfirmation(w, r, token)
+
+		return
+	}
+
+	if err := suppressions.add(address); err != nil {
+		slog.ErrorContext(r.Context(), "error", "unsubscribe", err.Error())
+		renderResult(w, r, http.StatusInternalServerError, "Something went wrong", "We could not unsubscribe you, please try again.", false)
+
+		return
+	}
+
+	slog.InfoContext(r.Context(), "unsubscribed", "ip", r.RemoteAddr)
+
+	events.publish(r.Context(), EVENT_EMAIL_UNSUBSCRIBED, "", nil)
+
+	if r.PostFormValue("List-Unsubscribe") == "One-Click" {
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, "Unsubscribed", "You will not receive any more emails from us.", false)
+}
+
+func renderUnsubscribeConfirmation(w http.ResponseWriter, r *http.Request, token string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	if err := templates.ExecuteTemplate(w, "result.html", map[string]any{
+		"Title":   "Unsubscribe",
+		"Message": "Do you want to stop receiving emails from us?",
+		"Confirm": map[string]string{
+			"Action": fmt.Sprintf("%s/unsubscribe?token=%s", API_V1_PREFIX, url.QueryEscape(token)),
+			"Label":  "Unsubscribe",
+		},
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "error", "render result", err.Error())
+	}
+}
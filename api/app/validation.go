@@ -0,0 +1,323 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Fields the lead pipeline depends on, any other configured field is collected
+// into the lead as an extra field
+var CORE_FIELDS = []string{"email", "mobile", "firstName", "lastName", "enquiryType", "enquiry", "consent"}
+
+const DEFAULT_FORM = "default"
+
+var FORM_ID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Types decide the input a field is rendered with, and imply a format when
+// the rule does not give one
+var FIELD_TYPES = []string{"text", "textarea", "email", "tel", "url", "number", "date", "select", "checkbox"}
+
+var FIELD_TYPE_FORMATS = map[string]string{
+	"email":    "email",
+	"tel":      "e164",
+	"url":      "url",
+	"number":   "numeric",
+	"date":     "datetime=2006-01-02",
+	"checkbox": "oneof=on true false",
+}
+
+type fieldRule struct {
+	Required  bool     `json:"required"`
+	Type      string   `json:"type,omitempty"`
+	Format    string   `json:"format,omitempty"`
+	MinLength int      `json:"minLength,omitempty"`
+	MaxLength int      `json:"maxLength,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Options   []string `json:"options,omitempty"`
+	// Only used on mobile, the number has to be confirmed with a code
+	Verify  bool `json:"verify,omitempty"`
+	pattern *regexp.Regexp
+}
+
+type formRules map[string]*fieldRule
+
+func defaultFormRules() formRules {
+	return formRules{
+		"email":       {Required: true, Format: "email"},
+		"mobile":      {Required: true, Format: "e164"},
+		"firstName":   {Required: true},
+		"lastName":    {Required: true},
+		"enquiryType": {},
+		"enquiry":     {Required: true},
+		"consent":     {Type: "checkbox"},
+		"company":     {MaxLength: 200},
+		"budget":      {MaxLength: 100},
+		"timeframe":   {MaxLength: 100},
+	}
+}
+
+// Rules from FORM_RULES are merged over the defaults so a config only needs to
+// describe what it changes, a field set to null is removed
+func loadFormRules(ctx context.Context) formRules {
+	rules := defaultFormRules()
+
+	if file, ok := FORM_RULES.Value(); ok {
+		content, err := file.ReadBytes()
+		if err != nil {
+			slog.ErrorContext(ctx, "error", "form rules", err.Error())
+			panic(err)
+		}
+
+		configured := formRules{}
+		if err := json.Unmarshal(content, &configured); err != nil {
+			slog.ErrorContext(ctx, "error", "form rules", err.Error())
+			panic(err)
+		}
+
+		rules = rules.merge(configured)
+	}
+
+	if err := rules.check(); err != nil {
+		slog.ErrorContext(ctx, "error", "form rules", err.Error())
+		panic(err)
+	}
+
+	slog.DebugContext(ctx, "loaded form rules", "fields", len(rules))
+
+	return rules
+}
+
+// Each form in FORMS is merged over the default form in the same way, so a
+// landing page only describes the fields it adds or changes
+func loadForms(ctx context.Context, defaults formRules) map[string]formRules {
+	loaded := map[string]formRules{DEFAULT_FORM: defaults}
+
+	file, ok := FORMS.Value()
+	if !ok {
+		return loaded
+	}
+
+	content, err := file.ReadBytes()
+	if err != nil {
+		slog.ErrorContext(ctx, "error", "forms", err.Error())
+		panic(err)
+	}
+
+	configured := map[string]formRules{}
+	if err := json.Unmarshal(content, &configured); err != nil {
+		slog.ErrorContext(ctx, "error", "forms", err.Error())
+		panic(err)
+	}
+
+	for id, form := range configured {
+		if !FORM_ID.MatchString(id) {
+			err := fmt.Errorf("invalid form id %s", id)
+			slog.ErrorContext(ctx, "error", "forms", err.Error())
+			panic(err)
+		}
+
+		rules := defaults.merge(form)
+		if err := rules.check(); err != nil {
+			err = fmt.Errorf("form %s: %w", id, err)
+			slog.ErrorContext(ctx, "error", "forms", err.Error())
+			panic(err)
+		}
+
+		loaded[id] = rules
+	}
+
+	slog.DebugContext(ctx, "loaded forms", "forms", len(loaded))
+
+	return loaded
+}
+
+func (rules formRules) merge(configured formRules) formRules {
+	merged := formRules{}
+	for name, rule := range rules {
+		merged[name] = rule
+	}
+
+	for name, rule := range configured {
+		if rule == nil {
+			delete(merged, name)
+
+			continue
+		}
+
+		merged[name] = rule
+	}
+
+	return merged
+}
+
+func (rules formRules) check() error {
+	for _, name := range CORE_FIELDS {
+		if _, ok := rules[name]; !ok {
+			return fmt.Errorf("missing rule for core field %s", name)
+		}
+	}
+
+	for name, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("invalid rule for %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Submissions pick their form with formId, leaving it out uses the default
+func requestForm(r *http.Request) (string, formRules, bool) {
+	id := r.FormValue("formId")
+	if id == "" {
+		id = DEFAULT_FORM
+	}
+
+	rules, ok := currentConfig().forms[id]
+
+	return id, rules, ok
+}
+
+func (rule *fieldRule) compile() (err error) {
+	if rule.Type != "" && !slices.Contains(FIELD_TYPES, rule.Type) {
+		return fmt.Errorf("unknown type %s", rule.Type)
+	}
+	if rule.Type == "select" && len(rule.Options) == 0 {
+		return errors.New("select without options")
+	}
+
+	if rule.Pattern != "" {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return err
+		}
+
+		rule.pattern = pattern
+	}
+
+	// The validator panics on unknown tags, surface that at startup rather
+	// than on the first submission
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	validator.New().Var("", rule.tag())
+
+	return nil
+}
+
+func (rule *fieldRule) tag() string {
+	tags := []string{"omitempty"}
+	if rule.Required {
+		tags = []string{"required"}
+	}
+
+	if rule.Format != "" {
+		tags = append(tags, rule.Format)
+	} else if rule.Type == "checkbox" && rule.Required {
+		// A required checkbox has to be ticked, as in the browser
+		tags = append(tags, "oneof=on true")
+	} else if format, ok := FIELD_TYPE_FORMATS[rule.Type]; ok {
+		tags = append(tags, format)
+	}
+	if rule.MinLength > 0 {
+		tags = append(tags, "min="+strconv.Itoa(rule.MinLength))
+	}
+	if rule.MaxLength > 0 {
+		tags = append(tags, "max="+strconv.Itoa(rule.MaxLength))
+	}
+	if len(rule.Options) > 0 {
+		tags = append(tags, "oneof="+strings.Join(rule.Options, " "))
+	}
+
+	return strings.Join(tags, ",")
+}
+
+func (rules formRules) names() []string {
+	names := []string{}
+	for name := range rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (rules formRules) extraFields() []string {
+	extra := []string{}
+	for _, name := range rules.names() {
+		isCore := false
+		for _, core := range CORE_FIELDS {
+			if name == core {
+				isCore = true
+			}
+		}
+
+		if !isCore {
+			extra = append(extra, name)
+		}
+	}
+
+	return extra
+}
+
+func (rules formRules) validate(validate *validator.Validate, values map[string]string) []string {
+	errs := []string{}
+
+	for _, name := range rules.names() {
+		rule := rules[name]
+		value := values[name]
+
+		err := validate.Var(value, rule.tag())
+		if err != nil {
+			var validationErrs validator.ValidationErrors
+			if !errors.As(err, &validationErrs) {
+				errs = append(errs, fmt.Sprintf("- Field validation for '%s' failed: %s", name, err.Error()))
+
+				continue
+			}
+
+			for _, fieldErr := range validationErrs {
+				errs = append(errs, fmt.Sprintf("- Field validation for '%s' failed on the '%s' tag", name, fieldErr.Tag()))
+			}
+
+			continue
+		}
+
+		if rule.pattern != nil && value != "" && !rule.pattern.MatchString(value) {
+			errs = append(errs, fmt.Sprintf("- Field validation for '%s' failed on the 'pattern' tag", name))
+		}
+	}
+
+	return errs
+}
+
+// Drafts are checked as they are saved, only against the fields sent and
+// without enforcing required fields
+func (rules formRules) validatePartial(validate *validator.Validate, values map[string]string) []string {
+	partial := formRules{}
+	for name := range values {
+		rule, ok := rules[name]
+		if !ok {
+			continue
+		}
+
+		optional := *rule
+		optional.Required = false
+		partial[name] = &optional
+	}
+
+	return partial.validate(validate, values)
+}
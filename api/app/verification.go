@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With EMAIL_VERIFICATION the submitter is sent a signed link and the lead is
+// held as unverified, it is only delivered to the team and CRM once the link
+// is followed
+const EVENT_LEAD_VERIFIED = "lead.verified"
+
+var errVerificationMemoryStore = errors.New("unverified leads are lost on restart with the memory store, EMAIL_VERIFICATION needs LEAD_STORE=file")
+
+// Unverified leads are only kept in the lead store until they are verified,
+// fails at startup rather than losing them on the next restart
+func checkEmailVerification(ctx context.Context) {
+	if !EMAIL_VERIFICATION.Value() {
+		return
+	}
+
+	if LEAD_STORE.Value() != "file" {
+		slog.ErrorContext(ctx, "error", "email verification", errVerificationMemoryStore.Error())
+		panic(errVerificationMemoryStore)
+	}
+
+	_, hasSecret := linkSecret()
+	if _, ok := publicUrl(); !ok || !hasSecret {
+		err := errors.New("EMAIL_VERIFICATION needs PUBLIC_URL and ATTACHMENT_LINK_SECRET to send verification links")
+		slog.ErrorContext(ctx, "error", "email verification", err.Error())
+		panic(err)
+	}
+}
+
+// Runs the deliver stage, or sends the verification email in its place for
+// leads waiting on it
+func deliverLead(ctx context.Context, outgoing *outgoingSpool, l *lead) {
+	if l.Status != LEAD_STATUS_UNVERIFIED {
+		deliverOutbox(ctx, l)
+
+		return
+	}
+
+	if err := sendVerification(ctx, outgoing, l); err != nil {
+		slog.ErrorContext(ctx, "error", "verification email", err.Error(), "lead", l.ID)
+		events.publish(ctx, EVENT_EMAIL_FAILED, l.ID, map[string]any{"error": err.Error()})
+	}
+}
+
+func sendVerification(ctx context.Context, outgoing *outgoingSpool, l *lead) error {
+	expires := time.Now().Add(EMAIL_VERIFICATION_EXPIRY.Value())
+
+	message, err := renderEmail("verification", map[string]interface{}{
+		"firstName": l.FirstName,
+		"link":      verificationLink(l.ID, expires.Unix()),
+		"expires":   expires.In(businessHours.location).Format(CONSULTATION_TIME_FORMAT),
+	})
+	if err != nil {
+		return err
+	}
+
+	message.From = POSTMARK_FROM.Value()
+	message.To = l.Email
+	message.Tag = "verification"
+	message.Metadata = map[string]string{"lead": l.ID}
+	message.Headers = unsubscribeHeaders(l.Email)
+
+	id, err := sendEmail(ctx, outgoing, message)
+	if err != nil {
+		return err
+	}
+
+	slog.DebugContext(ctx, "sent verification", "message id", id, "lead", l.ID)
+
+	events.publish(ctx, EVENT_EMAIL_SENT, l.ID, map[string]any{"message": id, "tag": message.Tag})
+
+	return nil
+}
+
+// Checked at startup to have PUBLIC_URL and the link secret
+func verificationLink(id string, expires int64) string {
+	query := url.Values{}
+	query.Set("lead", id)
+	query.Set("exp", strconv.FormatInt(expires, 10))
+	query.Set("sig", signVerificationLink(id, expires))
+
+	base, _ := publicUrl()
+
+	return fmt.Sprintf("%s%s/lead/verify?%s", base, API_V1_PREFIX, query.Encode())
+}
+
+// Shares the attachment link secret, the prefix keeps one kind of link from
+// being passed off as the other
+func signVerificationLink(id string, expires int64) string {
+	secret, _ := linkSecret()
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "verify.%s.%d", id, expires)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func leadVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("lead")
+
+	_, hasSecret := linkSecret()
+	expires, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if !hasSecret || err != nil || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(signVerificationLink(id, expires))) {
+		slog.WarnContext(r.Context(), "denied", "verification", id, "reason", "invalid signature", "ip", r.RemoteAddr)
+		renderResult(w, r, http.StatusForbidden, "Invalid link", "This confirmation link is not valid.", false)
+
+		return
+	}
+
+	if time.Now().Unix() > expires {
+		renderVerificationExpired(w, r, id)
+
+		return
+	}
+
+	verified := false
+	now := time.Now()
+	l, err := leads.update(r.Context(), id, func(l *lead) error {
+		if l.Status != LEAD_STATUS_UNVERIFIED {
+			return nil
+		}
+
+		l.Status = LEAD_STATUS_NEW
+		l.VerifiedAt = &now
+		queueDelivery(l)
+		verified = true
+
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error", "verify lead", err.Error(), "lead", id)
+		renderResult(w, r, http.StatusNotFound, "Something went wrong", "We could not find your enquiry.", true)
+
+		return
+	}
+
+	if verified {
+		slog.InfoContext(r.Context(), "verified", "lead", id)
+
+		events.publish(r.Context(), EVENT_LEAD_VERIFIED, id, nil)
+		events.publish(r.Context(), EVENT_LEAD_STATUS_CHANGED, id, map[string]any{
+			"from": LEAD_STATUS_UNVERIFIED,
+			"to":   LEAD_STATUS_NEW,
+		})
+
+		deliverOutbox(r.Context(), l)
+	}
+
+	renderResult(w, r, http.StatusOK, "Thank you", "Your enquiry is confirmed, we will be in touch soon.", false)
+}
+
+func renderVerificationExpired(w http.ResponseWriter, r *http.Request, id string) {
+	l, err := leads.get(r.Context(), id)
+	if err != nil || l.Status != LEAD_STATUS_UNVERIFIED {
+		renderResult(w, r, http.StatusGone, "Link expired", "This confirmation link has expired.", true)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+
+	if err := templates.ExecuteTemplate(w, "result.html", map[string]any{
+		"Title":   "Link expired",
+		"Message": "This confirmation link has expired, we can send you a new one.",
+		"Resend": map[string]string{
+			"Action": API_V1_PREFIX + "/lead/verify/resend",
+			"Lead":   l.ID,
+			"Email":  l.Email,
+		},
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "error", "render result", err.Error())
+	}
+}
+
+// Sends a new link for an unverified lead, the email has to match the lead so
+// an ID alone can't be used to send mail
+func (h *Handler) leadVerifyResendHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		leadError(w, r, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	l, err := leads.get(r.Context(), r.PostFormValue("lead"))
+	if err != nil || l.Status != LEAD_STATUS_UNVERIFIED || !strings.EqualFold(l.Email, strings.TrimSpace(r.PostFormValue("email"))) {
+		leadError(w, r, "Lead not found", http.StatusNotFound)
+
+		return
+	}
+
+	if err := sendVerification(r.Context(), h.outgoing, l); err != nil {
+		slog.ErrorContext(r.Context(), "error", "verification email", err.Error(), "lead", l.ID)
+		leadError(w, r, "Failed to send the confirmation email", http.StatusBadGateway)
+
+		return
+	}
+
+	if !isBrowserForm(r) {
+		w.WriteHeader(http.StatusAccepted)
+
+		return
+	}
+
+	renderResult(w, r, http.StatusOK, "Check your email", "We have sent you a new link to confirm your enquiry.", false)
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const API_V1_PREFIX = "/v1"
+
+// Paths served before the API was versioned, deprecated from when v1 was added
+var API_LEGACY_DEPRECATED = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+
+var LEGACY_PATH_PREFIXES = []string{"/lead", "/attachments", "/uploads", ADMIN_PATH_PREFIX}
+
+func v1Router(h *Handler, rateLimiter func(http.Handler) http.Handler, countryRateLimiter func(http.Handler) http.Handler) chi.Router {
+	r := chi.NewRouter()
+
+	// Routes taking submissions, an API key has to be scoped for the route
+	submission := func(scope string) chi.Middlewares {
+		return chi.Chain(uploadBackpressureMiddleware, frontendSignatureMiddleware, botFilterMiddleware, rateLimiter, countryRateLimiter, apiKeyMiddleware(scope), leadFormMiddleware, apiKeyFormMiddleware, csrfMiddleware)
+	}
+
+	r.Get("/lead", formHandler)
+	r.Get("/lead/token", csrfTokenHandler)
+	r.Get("/lead/schema", schemaHandler)
+	r.With(submission(API_KEY_SCOPE_LEADS)...).Post("/lead", h.leadHandler)
+
+	r.Get("/lead/progress/{token}", progressHandler)
+
+	r.Get("/lead/verify", leadVerifyHandler)
+	r.With(submission(API_KEY_SCOPE_MOBILE)...).Post("/lead/verify-mobile", h.verifyMobileHandler)
+	r.With(botFilterMiddleware, rateLimiter, countryRateLimiter).Post("/lead/verify/resend", h.leadVerifyResendHandler)
+
+	r.Route("/lead/draft", func(r chi.Router) {
+		r.With(submission(API_KEY_SCOPE_DRAFTS)...).Post("/", h.leadDraftCreateHandler)
+		r.Get("/{id}", leadDraftGetHandler)
+		r.With(apiKeyMiddleware(API_KEY_SCOPE_DRAFTS), leadFormMiddleware, apiKeyFormMiddleware, csrfMiddleware).Put("/{id}", h.leadDraftUpdateHandler)
+		r.With(submission(API_KEY_SCOPE_DRAFTS)...).Post("/{id}/confirm", h.leadDraftConfirmHandler)
+	})
+
+	r.Get("/attachments/{id}", h.attachmentHandler)
+
+	r.Get("/unsubscribe", unsubscribeHandler)
+	r.Post("/unsubscribe", unsubscribeHandler)
+
+	r.Route("/uploads", func(r chi.Router) {
+		r.Use(tusMiddleware)
+
+		r.Options("/", tusOptionsHandler)
+		r.With(botFilterMiddleware, rateLimiter, countryRateLimiter).Post("/", tusCreateHandler)
+		r.Head("/{id}", tusHeadHandler)
+		r.With(uploadBackpressureMiddleware).Patch("/{id}", tusPatchHandler)
+		r.Delete("/{id}", tusDeleteHandler)
+	})
+
+	if _, ok := TELEGRAM_WEBHOOK_SECRET.Value(); ok {
+		r.Post("/telegram/webhook", telegramWebhookHandler)
+	}
+
+	if _, ok := ADMIN_TOKEN.Value(); ok {
+		r.Mount(ADMIN_PATH_PREFIX, adminRouter(h))
+	}
+
+	return r
+}
+
+// Legacy paths keep working but point clients at the versioned path
+// see: https://www.rfc-editor.org/rfc/rfc9745 and https://www.rfc-editor.org/rfc/rfc8594
+func deprecatedMiddleware(successor string) func(http.Handler) http.Handler {
+	deprecation := fmt.Sprintf("@%d", API_LEGACY_DEPRECATED.Unix())
+
+	sunset := ""
+	if value, ok := API_LEGACY_SUNSET.Value(); ok {
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			panic(fmt.Errorf("invalid API_LEGACY_SUNSET: %w", err))
+		}
+
+		sunset = date.UTC().Format(http.TimeFormat)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", deprecation)
+			if sunset != "" {
+				w.Header().Set("Sunset", sunset)
+			}
+			w.Header().Add("Link", "<"+successor+r.URL.Path+`>; rel="successor-version"`)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Sends the submitter an approved WhatsApp template confirming their enquiry,
+// through Twilio or the Meta Cloud API. Only sent with the whatsapp processor
+// in LEAD_PROCESSORS, to leads with a mobile that gave consent. The template
+// gets the lead's first name as its only variable
+const EVENT_WHATSAPP_SENT = "whatsapp.sent"
+const EVENT_WHATSAPP_FAILED = "whatsapp.failed"
+
+const WHATSAPP_PROVIDER_TWILIO = "twilio"
+const WHATSAPP_PROVIDER_META = "meta"
+
+const META_GRAPH_API = "https://graph.facebook.com/v20.0"
+
+var whatsappClient = tracedClient(10 * time.Second)
+
+type whatsappProcessor struct{}
+
+// The processor is only configured when asked for, so missing settings stop
+// startup rather than failing every lead
+func createWhatsappProcessor(ctx context.Context, h *Handler) processor {
+	if err := checkWhatsapp(); err != nil {
+		slog.ErrorContext(ctx, "error", "whatsapp", err.Error())
+		panic(err)
+	}
+
+	return whatsappProcessor{}
+}
+
+func checkWhatsapp() error {
+	if _, ok := WHATSAPP_TEMPLATE.Value(); !ok {
+		return errors.New("WHATSAPP_TEMPLATE is required by the whatsapp processor")
+	}
+
+	switch WHATSAPP_PROVIDER.Value() {
+	case WHATSAPP_PROVIDER_META:
+		_, id := WHATSAPP_PHONE_NUMBER_ID.Value()
+		_, token := WHATSAPP_ACCESS_TOKEN.Value()
+		if !id || !token {
+			return errors.New("WHATSAPP_PHONE_NUMBER_ID and WHATSAPP_ACCESS_TOKEN are required to send WhatsApp messages with Meta")
+		}
+	default:
+		_, from := WHATSAPP_FROM.Value()
+		if !twilioConfigured() || !from {
+			return errors.New("twilio and WHATSAPP_FROM are required to send WhatsApp messages with Twilio")
+		}
+	}
+
+	return nil
+}
+
+func (whatsappProcessor) name() string { return "whatsapp" }
+
+func (whatsappProcessor) stage() processorStage { return PROCESSOR_STAGE_DELIVER }
+
+func (whatsappProcessor) process(ctx context.Context, l *lead) error {
+	if l.Mobile == "" || l.Consent == nil || !l.Consent.Given || l.Status == LEAD_STATUS_QUARANTINED {
+		return nil
+	}
+
+	var err error
+	switch WHATSAPP_PROVIDER.Value() {
+	case WHATSAPP_PROVIDER_META:
+		err = sendMetaWhatsapp(ctx, l)
+	default:
+		err = sendTwilioWhatsapp(ctx, l)
+	}
+	if err != nil {
+		events.publish(ctx, EVENT_WHATSAPP_FAILED, l.ID, map[string]any{"error": err.Error()})
+
+		return err
+	}
+
+	events.publish(ctx, EVENT_WHATSAPP_SENT, l.ID, map[string]any{"provider": WHATSAPP_PROVIDER.Value()})
+
+	return nil
+}
+
+// The template is a content SID
+func sendTwilioWhatsapp(ctx context.Context, l *lead) error {
+	sid, _ := TWILIO_ACCOUNT_SID.Value()
+	from, _ := WHATSAPP_FROM.Value()
+	template, _ := WHATSAPP_TEMPLATE.Value()
+
+	variables, err := json.Marshal(map[string]string{"1": l.FirstName})
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("To", "whatsapp:"+l.Mobile)
+	form.Set("From", "whatsapp:"+strings.TrimPrefix(from, "whatsapp:"))
+	form.Set("ContentSid", template)
+	form.Set("ContentVariables", string(variables))
+
+	return twilioPost(ctx, fmt.Sprintf("%s/Accounts/%s/Messages.json", TWILIO_API, url.PathEscape(sid)), form, nil)
+}
+
+// The template is the approved template name
+func sendMetaWhatsapp(ctx context.Context, l *lead) error {
+	id, _ := WHATSAPP_PHONE_NUMBER_ID.Value()
+	token, _ := WHATSAPP_ACCESS_TOKEN.Value()
+	template, _ := WHATSAPP_TEMPLATE.Value()
+
+	body, err := json.Marshal(map[string]any{
+		"messaging_product": "whatsapp",
+		// Numbers are sent without the +
+		"to":   strings.TrimPrefix(l.Mobile, "+"),
+		"type": "template",
+		"template": map[string]any{
+			"name":     template,
+			"language": map[string]string{"code": WHATSAPP_TEMPLATE_LANGUAGE.Value()},
+			"components": []map[string]any{
+				{
+					"type":       "body",
+					"parameters": []map[string]string{{"type": "text", "text": l.FirstName}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s/messages", META_GRAPH_API, url.PathEscape(id)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := whatsappClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+
+		return fmt.Errorf("whatsapp: %s: %s", res.Status, message)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/dogmatiq/ferrite"
+
+	"skulpture/landing/app"
+)
+
+var FUNCTIONS_CUSTOMHANDLER_PORT = ferrite.
+	NetworkPort("FUNCTIONS_CUSTOMHANDLER_PORT", "Port the Azure Functions host forwards requests to").
+	Required()
+
+func init() {
+	ferrite.Init()
+}
+
+// Azure Functions custom handler, the host forwards HTTP requests unchanged
+// (see host.json) so the shared router serves every route. Set
+// ATTACHMENT_STORAGE=azure-blob to store attachments in Blob Storage.
+//
+// Build with: GOOS=linux GOARCH=amd64 go build -o azure/handler ./azure
+func main() {
+	ctx := context.Background()
+
+	cleanup := app.InitOtel(ctx)
+	defer cleanup(ctx)
+
+	if err := http.ListenAndServe(":"+FUNCTIONS_CUSTOMHANDLER_PORT.Value(), app.NewRouter(ctx, app.NewHandler(ctx))); err != nil {
+		slog.ErrorContext(ctx, "error", "serve", err.Error())
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+
+	"skulpture/landing/app"
+)
+
+// Serves canned responses for the lead routes, without any of the
+// environment the API needs
+func main() {
+	addr := flag.String("addr", ":8080", "Address to listen on")
+	flag.Parse()
+
+	slog.Info("serving mock api", "addr", *addr)
+
+	if err := http.ListenAndServe(*addr, app.NewMockRouter()); err != nil {
+		slog.Error("error", "serve", err.Error())
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	"skulpture/landing/app"
+)
+
+// Adds fake leads to a file store, point LEAD_STORE_FILE at the same path
+// with LEAD_STORE=file to serve them
+func main() {
+	path := flag.String("file", "leads.json", "Lead store file to add the leads to")
+	count := flag.Int("count", 100, "Number of leads to add")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "Seed for the fake data, the same seed gives the same leads")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	if err := app.SeedLeads(ctx, *path, *count, *seed); err != nil {
+		slog.ErrorContext(ctx, "error", "seed", err.Error())
+		os.Exit(1)
+	}
+
+	slog.InfoContext(ctx, "seeded", "file", *path, "leads", *count, "seed", *seed)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/awslabs/aws-lambda-go-api-proxy/httpadapter"
+	"github.com/dogmatiq/ferrite"
+
+	"skulpture/landing/app"
+)
+
+func init() {
+	ferrite.Init()
+}
+
+// Serves the same router from AWS Lambda behind an API Gateway HTTP API or a
+// Function URL, both of which use the version 2.0 payload format
+//
+// Build with: GOOS=linux GOARCH=arm64 go build -tags lambda.norpc -o bootstrap ./lambda
+func main() {
+	ctx := context.Background()
+
+	cleanup := app.InitOtel(ctx)
+	defer cleanup(ctx)
+
+	router := app.NewRouter(ctx, app.NewHandler(ctx))
+
+	// The execution environment is frozen once the response is returned
+	adapter := httpadapter.NewV2(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r)
+		app.WaitForEvents()
+	}))
+
+	lambda.StartWithOptions(adapter.ProxyWithContext, lambda.WithEnableSIGTERM(func() {
+		cleanup(ctx)
+	}))
+}